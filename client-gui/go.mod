@@ -3,11 +3,17 @@ module gui-client
 go 1.25.0
 
 require (
+	HEMSAEUCC-core v0.0.0
 	github.com/jchv/go-webview2 v0.0.0-20250406165304-0bcfea011047
-	golang.org/x/crypto v0.42.0
 )
 
 require (
+	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/jchv/go-winloader v0.0.0-20250406163304-c1995be93bd1 // indirect
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
 	golang.org/x/sys v0.36.0 // indirect
 )
+
+replace HEMSAEUCC-core => ../core
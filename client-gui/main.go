@@ -3,49 +3,49 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"maps"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/jchv/go-webview2"
-	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/curve25519"
-)
 
-// EncryptedMessage represents the data structure for an encrypted message packet.
-type EncryptedMessage struct {
-	FromID      string `json:"from_id"`
-	ToID        string `json:"to_id"`
-	EphemeralPK string `json:"ephemeral_pk"`
-	Nonce       string `json:"nonce"`
-	Ciphertext  string `json:"ciphertext"`
-}
+	"HEMSAEUCC-core"
+)
 
 // ClientState holds the state of the chat client, including keys, contacts, and message history.
 type ClientState struct {
 	myID            string
-	privKey         []byte
-	pubKey          []byte
 	activeContactID string
-	contacts        []string
-	messageHistory  map[string][]string
-	mu              sync.Mutex
-	w               webview2.WebView
+	contacts        *core.ContactStore
+	// changed holds the conversations that changed since the UI last
+	// fetched, and typing when each contact's typing indicator ends.
+	changed  map[string]bool
+	typing   map[string]time.Time
+	sessions *core.Store
+	// relayURL is the relay the identity uses, from --relay, the
+	// environment or config.
+	relayURL string
+	config   *core.Config
+	mu       sync.Mutex
+	w        webview2.WebView
+	// ctx is cancelled when the window closes, ending relay requests
+	// still in flight.
+	ctx  context.Context
+	stop context.CancelFunc
 }
 
-const (
-	keysDir  = "keys"
-	privPath = "keys/x25519_secret.bin"
-	pubPath  = "keys/x25519_public.bin"
-)
+// keysDir holds the identity of the profile picked by --profile.
+var keysDir string
 
 // The HTML for the chat client's user interface.
 const html = `<!DOCTYPE html>
@@ -145,6 +145,72 @@ const html = `<!DOCTYPE html>
 			margin-right: auto;
 			max-width: 70%;
 		}
+		.message-status {
+			display: block;
+			font-size: 11px;
+			color: #777;
+		}
+		.message-status.failed {
+			color: #c00;
+		}
+		.message-quote {
+			display: block;
+			padding-left: 6px;
+			border-left: 3px solid #999;
+			color: #555;
+			font-size: 12px;
+			margin-bottom: 4px;
+		}
+		.message-actions {
+			display: none;
+			font-size: 11px;
+		}
+		.message:hover .message-actions {
+			display: block;
+		}
+		.message-actions a, .compose-bar a {
+			margin-left: 8px;
+			color: #007bff;
+			cursor: pointer;
+		}
+		.typing-indicator {
+			padding: 0 15px;
+			min-height: 16px;
+			font-size: 12px;
+			color: #777;
+		}
+		.compose-bar {
+			display: none;
+			padding: 6px 15px;
+			background-color: #ffffff;
+			border-top: 1px solid #e0e0e0;
+			font-size: 13px;
+			white-space: nowrap;
+			overflow: hidden;
+			text-overflow: ellipsis;
+		}
+		.search-form {
+			display: flex;
+			flex-direction: column;
+			gap: 5px;
+			margin-bottom: 10px;
+			font-size: 13px;
+		}
+		.search-form input[type=text] {
+			padding: 8px;
+			border: 1px solid #ccc;
+			border-radius: 5px;
+		}
+		.search-result {
+			cursor: pointer;
+		}
+		.search-result .message-status {
+			margin-bottom: 4px;
+		}
+		.receipt-setting {
+			margin-bottom: 10px;
+			font-size: 13px;
+		}
 		.your-id-label {
 			padding: 10px;
 			text-align: center;
@@ -164,7 +230,89 @@ const html = `<!DOCTYPE html>
 			border: 1px solid #ccc;
 			border-radius: 5px;
 		}
-		.contact-form button {
+		.contact-item .badge {
+			float: right;
+			font-size: 12px;
+		}
+		.contact-item.key-changed {
+			color: #c0392b;
+		}
+		.warning-banner {
+			display: none;
+			padding: 10px 15px;
+			background-color: #c0392b;
+			color: white;
+			font-weight: bold;
+		}
+		.header button {
+			background-color: white;
+			color: #007bff;
+			border: none;
+			padding: 6px 12px;
+			border-radius: 5px;
+			cursor: pointer;
+		}
+		.modal {
+			display: none;
+			position: fixed;
+			inset: 0;
+			background-color: rgba(0, 0, 0, 0.5);
+			align-items: center;
+			justify-content: center;
+		}
+		.modal-content {
+			background-color: white;
+			padding: 20px;
+			border-radius: 8px;
+			text-align: center;
+			max-width: 400px;
+		}
+		.safety-number {
+			font-family: monospace;
+			font-size: 18px;
+			white-space: pre;
+			margin: 10px 0;
+		}
+		.modal-content button {
+			margin: 5px;
+			padding: 8px 15px;
+			border: none;
+			border-radius: 5px;
+			cursor: pointer;
+		}
+		.section-title {
+			margin: 10px 0 0;
+			font-size: 13px;
+			color: #777;
+			text-transform: uppercase;
+		}
+		.group-form {
+			display: flex;
+			flex-direction: column;
+			gap: 5px;
+			margin-top: 10px;
+		}
+		.group-form input {
+			padding: 8px;
+			border: 1px solid #ccc;
+			border-radius: 5px;
+		}
+		.contact-item.left {
+			color: #999;
+		}
+		.group-members {
+			display: none;
+			padding: 8px 15px;
+			background-color: #ffffff;
+			border-bottom: 1px solid #e0e0e0;
+			font-size: 13px;
+		}
+		.group-members input {
+			padding: 4px;
+			border: 1px solid #ccc;
+			border-radius: 5px;
+		}
+		.contact-form button, .group-form button, .group-members button {
 			background-color: #28a745;
 			color: white;
 			border: none;
@@ -177,38 +325,146 @@ const html = `<!DOCTYPE html>
 <body>
 	<div class="sidebar">
 		<div class="your-id-label" id="my-id-label">Your ID: Not Set</div>
+		<label class="receipt-setting">
+			<input type="checkbox" id="read-receipts" onchange="setReadReceipts()"> Send read receipts
+		</label>
+		<div class="search-form">
+			<input type="text" id="search-entry" placeholder="Search messages" onkeydown="if (event.key === 'Enter') search()">
+			<label><input type="checkbox" id="search-this-chat"> In this chat only</label>
+			<label>From <input type="date" id="search-since"> to <input type="date" id="search-until"></label>
+		</div>
 		<div class="contact-form">
 			<input type="text" id="contact-entry" placeholder="Enter contact ID">
 			<button onclick="addContact()">Add</button>
 		</div>
 		<ul id="contact-list" class="contact-list"></ul>
+		<h4 class="section-title">Groups</h4>
+		<ul id="group-list" class="contact-list"></ul>
+		<div class="group-form">
+			<input type="text" id="group-name" placeholder="Group name">
+			<input type="text" id="group-members" placeholder="Contacts, separated by commas">
+			<button onclick="createGroup()">Create group</button>
+		</div>
 	</div>
 	<div class="main-content">
 		<div class="header">
 			<h3 id="chat-title">Select a chat to begin</h3>
+			<span>
+				<select id="timer-select" style="display: none" onchange="setTimer()" title="Disappearing messages">
+					<option value="0">Messages stay</option>
+					<option value="30">Disappear after 30 seconds</option>
+					<option value="300">Disappear after 5 minutes</option>
+					<option value="3600">Disappear after 1 hour</option>
+					<option value="86400">Disappear after 1 day</option>
+					<option value="604800">Disappear after 1 week</option>
+				</select>
+				<button id="verify-button" style="display: none" onclick="showSafetyNumber()">Verify</button>
+				<button id="relay-button" style="display: none" onclick="setContactRelay()">Relay</button>
+			</span>
+		</div>
+		<div class="warning-banner" id="key-warning">
+			The key of this verified contact has changed. Anyone could be behind the new key. Verify the safety number again before sending anything sensitive.
+		</div>
+		<div class="group-members" id="group-members-bar">
+			<span id="group-member-list"></span>
+			<span id="group-admin-controls">
+				<input type="text" id="group-member-entry" placeholder="Contact">
+				<button onclick="changeGroupMember(true)">Add</button>
+				<button onclick="changeGroupMember(false)">Remove</button>
+			</span>
 		</div>
 		<div class="chat-area" id="chat-area"></div>
+		<div class="typing-indicator" id="typing-indicator"></div>
+		<div class="compose-bar" id="compose-bar">
+			<span id="compose-text"></span>
+			<a onclick="cancelCompose()">Cancel</a>
+		</div>
 		<div class="message-input">
-			<input type="text" id="message-input" placeholder="Type your message here...">
+			<input type="text" id="message-input" placeholder="Type your message here..." oninput="typing()">
 			<button onclick="sendMessage()">Send</button>
 		</div>
 	</div>
 
+	<div class="modal" id="passphrase-modal">
+		<div class="modal-content">
+			<h3 id="passphrase-title">Unlock your identity</h3>
+			<p id="passphrase-help"></p>
+			<input type="password" id="passphrase-entry" onkeydown="if (event.key === 'Enter') submitPassphrase()">
+			<p id="passphrase-error" style="color: #c0392b"></p>
+			<button style="background-color: #007bff; color: white" onclick="submitPassphrase()">OK</button>
+		</div>
+	</div>
+
+	<div class="modal" id="verify-modal">
+		<div class="modal-content">
+			<h3 id="verify-title">Safety number</h3>
+			<p>Compare these numbers with the ones shown on your contact's device, or scan their code.</p>
+			<div class="safety-number" id="safety-number"></div>
+			<img id="safety-qr" width="200" height="200">
+			<div>
+				<button style="background-color: #28a745; color: white" onclick="markVerified()">They match</button>
+				<button onclick="closeSafetyNumber()">Cancel</button>
+			</div>
+		</div>
+	</div>
+
 	<script>
 		let myId = "";
+		let contactsById = {};
 		let activeContactId = "";
 		let contactNames = {};
+		let groupsById = {};
+
+		window.onfocus = markRead;
 
 		window.onload = async function() {
 			const idExists = await window.go_is_id_existing();
 			if (!idExists) {
-				const myId = await window.go_init_identity();
-				// Changed from alert() to a UI update for better user experience
-				document.getElementById('my-id-label').textContent = "Your ID: " + myId;
+				showPassphrase(true);
+			} else if (await window.go_is_locked()) {
+				showPassphrase(false);
 			} else {
-				myId = await window.go_get_my_id();
-				document.getElementById('my-id-label').textContent = "Your ID: " + myId.substring(0, 8);
+				start();
+			}
+		};
+
+		let creatingIdentity = false;
+
+		function showPassphrase(create) {
+			creatingIdentity = create;
+			document.getElementById('passphrase-title').textContent = create ? "Create your identity" : "Unlock your identity";
+			document.getElementById('passphrase-help').textContent = create
+				? "Choose a passphrase to protect your identity key on this computer, or leave it empty."
+				: "Enter the passphrase protecting your identity key.";
+			document.getElementById('passphrase-error').textContent = "";
+			document.getElementById('passphrase-modal').style.display = 'flex';
+			document.getElementById('passphrase-entry').focus();
+		}
+
+		async function submitPassphrase() {
+			const entry = document.getElementById('passphrase-entry');
+			try {
+				if (creatingIdentity) {
+					await window.go_init_identity(entry.value);
+				} else {
+					await window.go_unlock(entry.value);
+				}
+			} catch (err) {
+				document.getElementById('passphrase-error').textContent = err;
+				entry.value = "";
+				return;
 			}
+			entry.value = "";
+			document.getElementById('passphrase-modal').style.display = 'none';
+			start();
+		}
+
+		async function start() {
+			myId = await window.go_get_my_id();
+			document.getElementById('my-id-label').textContent = "Your ID: " + myId.substring(0, 8);
+			document.getElementById('read-receipts').checked = await window.go_get_read_receipts();
+			updateContactList();
+			updateGroupList();
 			fetchMessages();
 			// Polling interval changed from 5000ms to 2000ms (2 seconds)
 			setInterval(fetchMessages, 2000);
@@ -228,343 +484,1457 @@ const html = `<!DOCTYPE html>
 			const list = document.getElementById('contact-list');
 			list.innerHTML = '';
 			contactNames = {};
-			contacts.forEach((contactId, index) => {
+			contactsById = {};
+			contacts.forEach(contact => {
+				const li = document.createElement('li');
+				li.className = 'contact-item';
+				li.textContent = contact.label;
+				if (contact.id === activeContactId) {
+					li.classList.add('active');
+				}
+				const badge = document.createElement('span');
+				badge.className = 'badge';
+				if (contact.key_changed) {
+					li.classList.add('key-changed');
+					badge.textContent = '\u26a0';
+				} else if (contact.verified) {
+					badge.textContent = '\u2713';
+				}
+				li.appendChild(badge);
+				contactNames[contact.id.substring(0, 8)] = contact.id;
+				contactsById[contact.id] = contact;
+				li.onclick = () => {
+					selectChat(contact.id);
+					document.querySelectorAll('.contact-item').forEach(item => item.classList.remove('active'));
+					li.classList.add('active');
+				};
+				list.appendChild(li);
+			});
+			updateChatHeader();
+		}
+
+		async function updateGroupList() {
+			const groups = await window.go_get_groups();
+			const list = document.getElementById('group-list');
+			list.innerHTML = '';
+			groupsById = {};
+			(groups || []).forEach(group => {
+				const key = 'group:' + group.id;
 				const li = document.createElement('li');
 				li.className = 'contact-item';
-				li.textContent = contactId.substring(0, 8);
-				contactNames[contactId.substring(0, 8)] = contactId;
+				li.textContent = '# ' + group.label;
+				if (key === activeContactId) {
+					li.classList.add('active');
+				}
+				if (group.left) {
+					li.classList.add('left');
+				}
+				groupsById[key] = group;
 				li.onclick = () => {
-					selectChat(contactId);
+					selectChat(key);
 					document.querySelectorAll('.contact-item').forEach(item => item.classList.remove('active'));
 					li.classList.add('active');
 				};
 				list.appendChild(li);
 			});
+			updateChatHeader();
+		}
+
+		async function createGroup() {
+			const name = document.getElementById('group-name').value;
+			const members = document.getElementById('group-members').value.split(',').map(s => s.trim()).filter(s => s);
+			if (!name || members.length === 0) {
+				return;
+			}
+			try {
+				const id = await window.go_create_group(name, members);
+				document.getElementById('group-name').value = "";
+				document.getElementById('group-members').value = "";
+				await updateGroupList();
+				selectChat('group:' + id);
+			} catch (err) {
+				alert(err);
+			}
+		}
+
+		async function changeGroupMember(add) {
+			const entry = document.getElementById('group-member-entry');
+			const group = groupsById[activeContactId];
+			if (!group || !entry.value) {
+				return;
+			}
+			try {
+				if (add) {
+					await window.go_add_group_member(group.id, entry.value);
+				} else {
+					await window.go_remove_group_member(group.id, entry.value);
+				}
+				entry.value = "";
+				updateGroupList();
+			} catch (err) {
+				alert(err);
+			}
+		}
+
+		function updateChatHeader() {
+			const group = groupsById[activeContactId];
+			document.getElementById('group-members-bar').style.display = group ? 'block' : 'none';
+			if (group) {
+				document.getElementById('chat-title').textContent = "Group " + group.label;
+				document.getElementById('group-member-list').textContent = group.left
+					? "You are no longer a member. "
+					: "Members: " + group.members.join(', ') + " ";
+				document.getElementById('group-admin-controls').style.display = group.admin && !group.left ? 'inline' : 'none';
+			}
+			const contact = contactsById[activeContactId];
+			document.getElementById('verify-button').style.display = contact ? 'inline-block' : 'none';
+			document.getElementById('relay-button').style.display = contact ? 'inline-block' : 'none';
+			document.getElementById('key-warning').style.display = contact && contact.key_changed ? 'block' : 'none';
+			if (contact) {
+				document.getElementById('chat-title').textContent = "Chat with " + contact.label + (contact.verified ? " \u2713" : "");
+			}
+		}
+
+		async function showSafetyNumber() {
+			const contact = contactsById[activeContactId];
+			if (!contact) {
+				return;
+			}
+			const view = await window.go_get_safety_number(contact.id);
+			document.getElementById('verify-title').textContent = "Safety number with " + contact.label;
+			document.getElementById('safety-number').textContent = view.number;
+			document.getElementById('safety-qr').src = view.qr;
+			document.getElementById('verify-modal').style.display = 'flex';
+		}
+
+		function closeSafetyNumber() {
+			document.getElementById('verify-modal').style.display = 'none';
+		}
+
+		// setContactRelay asks which relay the active contact uses: a relay
+		// profile or URL, or nothing for ours.
+		async function setContactRelay() {
+			const contact = contactsById[activeContactId];
+			if (!contact) {
+				return;
+			}
+			const relay = prompt("Relay " + contact.label + " uses (profile or URL, empty for ours):", contact.relay || "");
+			if (relay === null) {
+				return;
+			}
+			try {
+				await window.go_set_contact_relay(contact.id, relay.trim());
+				updateContactList();
+			} catch (err) {
+				alert(err);
+			}
+		}
+
+		async function markVerified() {
+			await window.go_mark_verified(activeContactId);
+			closeSafetyNumber();
+			updateContactList();
+		}
+
+		async function updateTimer() {
+			const select = document.getElementById('timer-select');
+			select.style.display = activeContactId ? 'inline-block' : 'none';
+			if (!activeContactId) {
+				return;
+			}
+			const seconds = String(await window.go_get_timer(activeContactId));
+			if (![...select.options].some(o => o.value === seconds)) {
+				const option = document.createElement('option');
+				option.value = seconds;
+				option.textContent = "Disappear after " + seconds + " seconds";
+				select.appendChild(option);
+			}
+			select.value = seconds;
+		}
+
+		async function setTimer() {
+			const select = document.getElementById('timer-select');
+			try {
+				await window.go_set_timer(activeContactId, parseInt(select.value, 10));
+			} catch (err) {
+				alert(err);
+			}
+			selectChat(activeContactId);
 		}
 
 		async function selectChat(contactId) {
+			if (contactId !== activeContactId) {
+				cancelCompose();
+			}
 			activeContactId = contactId;
+			searching = false;
+			updateTimer();
 			document.getElementById('chat-title').textContent = "Chat with " + contactId.substring(0, 8);
+			updateChatHeader();
 			const chatArea = document.getElementById('chat-area');
 			chatArea.innerHTML = '';
 			const messages = await window.go_get_history(contactId);
-			messages.forEach(msg => {
+			(messages || []).forEach(msg => {
 				const p = document.createElement('p');
-				p.className = 'message ' + (msg.startsWith('[You]') ? 'sent' : 'received');
-				p.textContent = msg;
+				p.className = 'message ' + (msg.sent ? 'sent' : 'received');
+				if (msg.quote) {
+					const quote = document.createElement('span');
+					quote.className = 'message-quote';
+					quote.textContent = msg.quote;
+					p.appendChild(quote);
+				}
+				p.appendChild(document.createTextNode(msg.text));
+				const details = [];
+				if (msg.reactions) {
+					details.push(msg.reactions.join(' '));
+				}
+				if (msg.edited) {
+					details.push('edited');
+				}
+				if (msg.status) {
+					details.push(msg.status);
+				}
+				if (details.length > 0) {
+					const status = document.createElement('span');
+					status.className = 'message-status' + (msg.status === 'failed' ? ' failed' : '');
+					status.textContent = details.join(' \u00b7 ');
+					p.appendChild(status);
+				}
+				if (msg.id) {
+					p.appendChild(messageActions(msg));
+				}
 				chatArea.appendChild(p);
 			});
 			chatArea.scrollTop = chatArea.scrollHeight;
+			markRead();
+		}
+
+		// messageActions returns the links to reply or react to msg, and to
+		// edit or delete it if it is ours.
+		function messageActions(msg) {
+			const actions = document.createElement('span');
+			actions.className = 'message-actions';
+			const add = (label, onclick) => {
+				const a = document.createElement('a');
+				a.textContent = label;
+				a.onclick = onclick;
+				actions.appendChild(a);
+			};
+			if (msg.status === 'failed') {
+				add('Retry', () => retryMessage(msg));
+			}
+			add('Reply', () => startCompose('reply', msg));
+			add('React', () => react(msg));
+			if (msg.sent) {
+				add('Edit', () => startCompose('edit', msg));
+				add('Delete', () => deleteMessage(msg));
+			}
+			return actions;
+		}
+
+		// retryMessage sends a message the relay refused again.
+		async function retryMessage(msg) {
+			try {
+				await window.go_retry_message(msg.id);
+			} catch (err) {
+				alert(err);
+			}
+			selectChat(activeContactId);
+		}
+
+		// compose is the message being replied to or edited, if any.
+		let compose = null;
+
+		function startCompose(mode, msg) {
+			compose = {mode: mode, id: msg.id};
+			const input = document.getElementById('message-input');
+			if (mode === 'edit') {
+				input.value = msg.text.replace(/^\[You\]: /, '');
+			}
+			document.getElementById('compose-text').textContent = (mode === 'edit' ? 'Editing: ' : 'Replying to: ') + msg.text;
+			document.getElementById('compose-bar').style.display = 'block';
+			input.focus();
+		}
+
+		function cancelCompose() {
+			if (compose && compose.mode === 'edit') {
+				document.getElementById('message-input').value = "";
+			}
+			compose = null;
+			document.getElementById('compose-bar').style.display = 'none';
+		}
+
+		async function react(msg) {
+			const emoji = prompt('React with an emoji, or leave empty to take your reaction back:', '\u{1F44D}');
+			if (emoji === null) {
+				return;
+			}
+			try {
+				await window.go_react(activeContactId, msg.id, emoji.trim());
+			} catch (err) {
+				alert(err);
+				return;
+			}
+			selectChat(activeContactId);
+		}
+
+		async function deleteMessage(msg) {
+			if (!confirm('Delete this message for everyone?')) {
+				return;
+			}
+			try {
+				await window.go_delete_message(activeContactId, msg.id);
+			} catch (err) {
+				alert(err);
+				return;
+			}
+			selectChat(activeContactId);
+		}
+
+		// typingSent is when we last told the open conversation we were
+		// typing.
+		let typingSent = 0;
+
+		function typing() {
+			if (activeContactId && !activeContactId.startsWith('group:') && Date.now() - typingSent > 5000) {
+				typingSent = Date.now();
+				window.go_send_typing(activeContactId);
+			}
+		}
+
+		async function updateTyping() {
+			const isTyping = activeContactId && await window.go_is_typing(activeContactId);
+			document.getElementById('typing-indicator').textContent = isTyping ? activeContactId.substring(0, 8) + ' is typing...' : '';
+		}
+
+		// markRead sends read receipts for the open conversation while the
+		// window has focus.
+		function markRead() {
+			if (activeContactId && !activeContactId.startsWith('group:') && document.hasFocus()) {
+				window.go_mark_read(activeContactId);
+			}
+		}
+
+		async function setReadReceipts() {
+			const box = document.getElementById('read-receipts');
+			try {
+				await window.go_set_read_receipts(box.checked);
+			} catch (err) {
+				alert(err);
+				box.checked = !box.checked;
+				return;
+			}
+			markRead();
 		}
 
 		async function sendMessage() {
 			const input = document.getElementById('message-input');
 			const message = input.value;
 			if (message && activeContactId) {
-				await window.go_send_message(activeContactId, message);
-				const chatArea = document.getElementById('chat-area');
-				const p = document.createElement('p');
-				p.className = 'message sent';
-				p.textContent = "[You]: " + message;
-				chatArea.appendChild(p);
-				chatArea.scrollTop = chatArea.scrollHeight;
+				try {
+					if (compose && compose.mode === 'edit') {
+						await window.go_edit_message(activeContactId, compose.id, message);
+					} else if (compose) {
+						await window.go_reply(activeContactId, compose.id, message);
+					} else if (activeContactId.startsWith('group:')) {
+						await window.go_send_group_message(activeContactId.substring(6), message);
+					} else {
+						await window.go_send_message(activeContactId, message);
+					}
+				} catch (err) {
+					alert(err);
+					return;
+				}
 				input.value = "";
+				typingSent = 0;
+				cancelCompose();
+				selectChat(activeContactId);
+			}
+		}
+
+		// searching is set while the chat area shows search results.
+		let searching = false;
+
+		async function search() {
+			const query = document.getElementById('search-entry').value.trim();
+			if (!query) {
+				return;
+			}
+			const conv = document.getElementById('search-this-chat').checked ? activeContactId : "";
+			let results;
+			try {
+				results = await window.go_search(query, conv,
+					document.getElementById('search-since').value,
+					document.getElementById('search-until').value);
+			} catch (err) {
+				alert(err);
+				return;
 			}
+			searching = true;
+			cancelCompose();
+			document.getElementById('chat-title').textContent = "Messages matching \u201c" + query + "\u201d";
+			const chatArea = document.getElementById('chat-area');
+			chatArea.innerHTML = '';
+			if (!results || results.length === 0) {
+				chatArea.textContent = "No messages found.";
+				return;
+			}
+			results.forEach(result => {
+				const p = document.createElement('p');
+				p.className = 'message received search-result';
+				const where = document.createElement('span');
+				where.className = 'message-status';
+				where.textContent = result.title + ' \u00b7 ' + result.time;
+				p.appendChild(where);
+				p.appendChild(document.createTextNode(result.text));
+				p.onclick = () => selectChat(result.conv);
+				chatArea.appendChild(p);
+			});
+			chatArea.scrollTop = 0;
 		}
 
 		async function fetchMessages() {
-			const newMessages = await window.go_fetch_messages();
-			if (newMessages) {
-				newMessages.forEach(msg => {
-					if (!contactNames[msg.FromID.substring(0, 8)]) {
-						window.go_add_contact(msg.FromID);
-						updateContactList();
-					}
-					if (msg.FromID === activeContactId) {
-						const chatArea = document.getElementById('chat-area');
-						const p = document.createElement('p');
-						p.className = 'message received';
-						p.textContent = '[' + msg.FromID.substring(0, 8) + ']: ' + msg.Ciphertext;
-						chatArea.appendChild(p);
-						chatArea.scrollTop = chatArea.scrollHeight;
-					}
-				});
+			if (await window.go_purge_history() && activeContactId && !searching) {
+				selectChat(activeContactId);
 			}
+			const changed = await window.go_fetch_messages();
+			if (changed && changed.length > 0) {
+				updateContactList();
+				updateGroupList();
+				updateTimer();
+				if (activeContactId && !searching && changed.includes(activeContactId)) {
+					selectChat(activeContactId);
+				}
+			}
+			updateTyping();
 		}
 	</script>
 </body>
 </html>`
 
-// initIdentity generates a new key pair and saves it to a file.
-func (cs *ClientState) initIdentity() (string, error) {
+// initIdentity generates a new key pair and saves it to a keystore
+// protected by passphrase, which may be empty.
+func (cs *ClientState) initIdentity(passphrase string) (string, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
 	// Check if identity already exists.
-	if _, err := os.Stat(privPath); err == nil {
-		return "", fmt.Errorf("identity already exists. Delete the 'keys' folder to reset.")
-	}
-
-	// Generate a new private key.
-	priv := make([]byte, 32)
-	if _, err := rand.Read(priv); err != nil {
-		return "", fmt.Errorf("failed to generate random private key: %w", err)
+	if core.IdentityExists(keysDir) {
+		return "", fmt.Errorf("identity already exists. Delete the %q folder to reset.", keysDir)
 	}
 
-	// Derive the public key from the private key.
-	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	me, err := core.NewIdentity()
 	if err != nil {
-		return "", fmt.Errorf("failed to derive public key: %w", err)
+		return "", err
 	}
-
-	// Create a directory for the keys and save them.
-	if err := os.MkdirAll(keysDir, 0700); err != nil {
-		return "", fmt.Errorf("failed to create keys directory: %w", err)
+	if err := me.Save(keysDir, []byte(passphrase)); err != nil {
+		return "", err
 	}
-	if err := os.WriteFile(privPath, priv, 0600); err != nil {
-		return "", fmt.Errorf("failed to save private key: %w", err)
-	}
-	if err := os.WriteFile(pubPath, pub, 0600); err != nil {
-		return "", fmt.Errorf("failed to save public key: %w", err)
+	sessions, err := me.OpenStore(keysDir)
+	if err != nil {
+		return "", err
 	}
+	sessions.SetContext(cs.ctx)
+	sessions.Relay = core.NewRelay(cs.relayURL)
+	sessions.KnownRelays = cs.config.RelayURLs()
 
-	cs.privKey = priv
-	cs.pubKey = pub
-	cs.myID = hex.EncodeToString(pub)
-	cs.contacts = []string{}
-	cs.messageHistory = make(map[string][]string)
+	cs.myID = me.ID()
+	cs.sessions = sessions
+	cs.contacts = sessions.Contacts()
 
 	return cs.myID, nil
 }
 
-// loadIdentity loads an existing key pair from a file.
-func (cs *ClientState) loadIdentity() error {
+// LoadIdentity unlocks the existing key pair with passphrase.
+func (cs *ClientState) loadIdentity(passphrase string) error {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
-	priv, err := os.ReadFile(privPath)
+	me, migrated, err := core.LoadIdentity(keysDir, func() ([]byte, error) {
+		return []byte(passphrase), nil
+	})
 	if err != nil {
 		return err
 	}
-	pub, err := os.ReadFile(pubPath)
+	if migrated {
+		log.Println("Identity key moved into an encrypted keystore.")
+	}
+	sessions, err := me.OpenStore(keysDir)
 	if err != nil {
 		return err
 	}
+	sessions.SetContext(cs.ctx)
+	sessions.Relay = core.NewRelay(cs.relayURL)
+	sessions.KnownRelays = cs.config.RelayURLs()
 
-	cs.privKey = priv
-	cs.pubKey = pub
-	cs.myID = hex.EncodeToString(pub)
-	cs.contacts = []string{}
-	cs.messageHistory = make(map[string][]string)
+	cs.myID = me.ID()
+	cs.sessions = sessions
+	cs.contacts = sessions.Contacts()
 	return nil
 }
 
 // sendMessage encrypts a message and sends it to the server.
 func (cs *ClientState) sendMessage(toID, msg string) error {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-
-	// Generate an ephemeral key pair for forward secrecy.
-	ephPriv := make([]byte, 32)
-	rand.Read(ephPriv)
-	ephPub, err := curve25519.X25519(ephPriv, curve25519.Basepoint)
+	m, err := core.NewMessage([]byte(msg))
 	if err != nil {
-		return fmt.Errorf("failed to generate ephemeral key: %w", err)
+		return err
 	}
+	return cs.send(toID, m)
+}
 
-	toPub, err := hex.DecodeString(toID)
+// sendContent sends a message of kind acting on the message ref of the
+// conversation conv: a reply, an edit, a deletion or a reaction.
+func (cs *ClientState) sendContent(conv string, kind uint64, ref, body string) error {
+	m, err := core.NewContent(kind, ref, []byte(body))
 	if err != nil {
-		return fmt.Errorf("invalid recipient ID format: %w", err)
+		return err
 	}
-
-	// Derive the shared secret.
-	shared, err := curve25519.X25519(ephPriv, toPub)
-	if err != nil {
-		return fmt.Errorf("failed to derive shared secret: %w", err)
+	if kind == core.KindReaction && len(m.Body) > core.MaxReactionSize {
+		return fmt.Errorf("a reaction is a single emoji")
 	}
+	return cs.send(conv, m)
+}
 
-	// Create a ChaCha20-Poly1305 AEAD cipher.
-	aead, err := chacha20poly1305.NewX(shared)
+// sendTyping tells a contact that we are typing.
+func (cs *ClientState) sendTyping(contactID string) error {
+	if strings.HasPrefix(contactID, "group:") {
+		return nil
+	}
+	m, err := core.NewContent(core.KindTyping, "", nil)
 	if err != nil {
-		return fmt.Errorf("failed to create AEAD: %w", err)
+		return err
 	}
+	return cs.send(contactID, m)
+}
 
-	// Generate a random nonce and seal the message.
-	nonce := make([]byte, chacha20poly1305.NonceSizeX)
-	rand.Read(nonce)
-	ct := aead.Seal(nil, nonce, []byte(msg), nil)
+// send seals m for the conversation conv, shows it there and posts it. A
+// contact who has rotated their key is moved to the new one first.
+func (cs *ClientState) send(conv string, m *core.Message) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
 
-	// Build the encrypted message packet.
-	packet := EncryptedMessage{
-		FromID:      cs.myID,
-		ToID:        toID,
-		EphemeralPK: base64.StdEncoding.EncodeToString(ephPub),
-		Nonce:       base64.StdEncoding.EncodeToString(nonce),
-		Ciphertext:  base64.StdEncoding.EncodeToString(ct),
-	}
-	pjson, err := json.Marshal(packet)
-	if err != nil {
-		return fmt.Errorf("failed to marshal packet: %w", err)
+	var packets []core.EncryptedMessage
+	groupID, isGroup := strings.CutPrefix(conv, "group:")
+	if isGroup {
+		g, err := cs.sessions.LoadGroup(groupID)
+		if err != nil {
+			return err
+		}
+		if packets, err = cs.sessions.SealGroupMessage(g, m); err != nil {
+			return err
+		}
+	} else {
+		newID, _, err := core.FollowRotation(cs.sessions, cs.contacts, conv)
+		if err != nil {
+			return err
+		}
+		if newID != conv {
+			log.Printf("%s moved to a new key, %s, signed by their old one.\n", core.ShortID(conv), core.ShortID(newID))
+			conv = newID
+		}
+		if packets, err = cs.sessions.SealMessage(conv, m); err != nil {
+			return err
+		}
 	}
+	cs.show(conv, cs.sessions.AccountID(), m)
 
-	body, err := json.Marshal(map[string]any{
-		"to_id":   toID,
-		"from_id": cs.myID,
-		"packet":  base64.StdEncoding.EncodeToString(pjson),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal request body: %w", err)
+	// Only messages of their own to a contact get receipts.
+	tracked := !isGroup && m.IsText()
+	if tracked {
+		if err := cs.sessions.TrackSent(conv, m); err != nil {
+			return err
+		}
 	}
-
-	// Send the encrypted message to the server.
-	_, err = http.Post(fmt.Sprintf("%s/send", "http://localhost:8080"), "application/json", bytes.NewReader(body))
-	if err != nil {
-		return fmt.Errorf("failed to send message to server: %w", err)
+	if m.Kind == core.KindTyping {
+		// Typing is only worth telling now, so it never waits in the
+		// outbox.
+		for _, p := range packets {
+			if err := cs.sessions.Relay.PostPacket(cs.sessions.Context(), p); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-
-	return nil
+	return cs.postPackets(conv, m, packets)
 }
 
-// fetchMessages retrieves and decrypts messages from the server.
-func (cs *ClientState) fetchMessages() ([]EncryptedMessage, error) {
+// fetchMessages retrieves and decrypts messages from the server, and
+// returns the conversations that changed.
+func (cs *ClientState) fetchMessages() ([]string, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
-	url := fmt.Sprintf("%s/fetch?id=%s", "http://localhost:8080", cs.myID)
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch messages: %w", err)
+	if cs.sessions == nil {
+		return nil, fmt.Errorf("identity is locked")
 	}
-	defer resp.Body.Close()
-
-	data, err := io.ReadAll(resp.Body)
+	msgs, header, err := cs.sessions.Relay.FetchPackets(cs.sessions.Context(), cs.myID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, err
 	}
-
-	var raw []struct {
-		Packet string `json:"packet"`
-		FromID string `json:"from_id"`
-	}
-	if err := json.Unmarshal(data, &raw); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	if status, ok := core.PreKeyStatusFromHeader(header); ok && status.Low {
+		go cs.publishPreKeys()
 	}
+	// The relay is reachable again: send what is waiting for it.
+	cs.flushOutbox()
 
-	var decryptedMessages []EncryptedMessage
-	for _, r := range raw {
-		b, err := base64.StdEncoding.DecodeString(r.Packet)
-		if err != nil {
+	// Delivery receipts are sent once, for everything fetched.
+	acks := make(map[string][]string)
+	for _, m := range msgs {
+		if m.Version == core.GroupVersion {
+			g, sender, msg, err := cs.sessions.OpenGroup(m)
+			if err != nil {
+				log.Printf("Failed to decrypt group message from %s: %v\n", core.ShortID(m.FromID), err)
+				continue
+			}
+			conv := "group:" + g.ID
+			cs.applyTimer(conv, cs.memberLabel(sender), msg)
+			cs.show(conv, sender, msg)
 			continue
 		}
-		var m EncryptedMessage
-		if err := json.Unmarshal(b, &m); err != nil {
+		msg, err := cs.sessions.Open(m)
+		if errors.Is(err, core.ErrReplay) {
+			log.Printf("Dropped message from %s: %v\n", core.ShortID(m.FromID), err)
 			continue
 		}
-
-		ephPub, err := base64.StdEncoding.DecodeString(m.EphemeralPK)
-		if err != nil {
+		if errors.Is(err, core.ErrSenderUnverified) {
+			log.Printf("Rejected message claiming to be from %s: %v\n", core.ShortID(m.FromID), err)
 			continue
 		}
-
-		// Derive the shared secret using our private key and the sender's ephemeral public key.
-		shared, err := curve25519.X25519(cs.privKey, ephPub)
 		if err != nil {
+			log.Printf("Failed to decrypt message from %s: %v\n", core.ShortID(m.FromID), err)
 			continue
 		}
-
-		aead, err := chacha20poly1305.NewX(shared)
-		if err != nil {
+		if msg.Provision != nil {
 			continue
 		}
-
-		nonce, err := base64.StdEncoding.DecodeString(m.Nonce)
+		sender, err := cs.sessions.SenderOf(m, msg)
 		if err != nil {
+			log.Printf("Rejected message from device %s: %v\n", core.ShortID(m.FromID), err)
 			continue
 		}
-
-		ct, err := base64.StdEncoding.DecodeString(m.Ciphertext)
-		if err != nil {
+		if msg.Group != nil {
+			g, packets, err := cs.sessions.HandleGroupControl(sender, m.FromID, msg)
+			if err != nil {
+				log.Printf("Ignored group update from %s: %v\n", core.ShortID(sender), err)
+				continue
+			}
+			if err := cs.postPackets("group:"+g.ID, nil, packets); err != nil {
+				log.Println("Error sending group keys:", err)
+			}
+			// Membership changes are shown in the group's conversation.
+			conv := "group:" + g.ID
+			switch {
+			case g.Left:
+				cs.appendHistory(conv, "You are no longer a member of this group.")
+			case packets != nil:
+				cs.appendHistory(conv, fmt.Sprintf("The group now has %d members.", len(g.Members)))
+			}
 			continue
 		}
-
-		// Open the sealed message.
-		plain, err := aead.Open(nil, nonce, ct, nil)
-		if err != nil {
-			log.Printf("Failed to decrypt message from %s: %v\n", m.FromID[:8], err)
+		if msg.Receipt != nil {
+			changed, err := cs.sessions.HandleReceipt(sender, msg)
+			if err != nil {
+				log.Printf("Ignored receipt from %s: %v\n", core.ShortID(sender), err)
+			} else if changed != nil {
+				cs.changed[sender] = true
+			}
+			continue
+		}
+		if msg.SyncTo != nil {
+			// Sent from another of our devices.
+			to := hex.EncodeToString(msg.SyncTo)
+			cs.applyTimer(to, "You", msg)
+			cs.show(to, cs.sessions.AccountID(), msg)
 			continue
 		}
-		m.Ciphertext = string(plain)
-		decryptedMessages = append(decryptedMessages, m)
+		if c, _ := cs.contacts.Lookup(sender); c == nil {
+			c, err := core.FollowRotationTo(cs.sessions, cs.contacts, sender)
+			if err != nil {
+				log.Println("Error checking key rotation:", err)
+			} else if c != nil {
+				log.Printf("%s moved to a new key, %s, signed by their old one.\n", c.Label(), core.ShortID(c.ID))
+			} else if _, err := cs.contacts.Add("", sender); err != nil {
+				log.Println("Error adding contact:", err)
+			}
+		}
+		cs.applyTimer(sender, core.ShortID(sender), msg)
+		if cs.show(sender, sender, msg) && core.WantsReceipt(msg) {
+			acks[sender] = append(acks[sender], msg.IDString())
+		}
 	}
 
-	return decryptedMessages, nil
+	for id, ids := range acks {
+		if err := cs.sendReceipt(id, core.ReceiptDelivered, ids); err != nil {
+			log.Printf("No delivery receipt sent to %s: %v\n", core.ShortID(id), err)
+		}
+	}
+	convs := make([]string, 0, len(cs.changed))
+	for conv := range cs.changed {
+		convs = append(convs, conv)
+	}
+	clear(cs.changed)
+	return convs, nil
 }
 
-// isIDExisting checks if the client has an existing identity.
-func (cs *ClientState) isIDExisting() bool {
-	return cs.myID != ""
+// sendReceipt acknowledges the messages ids received from the identity
+// toID. The caller holds cs.mu.
+func (cs *ClientState) sendReceipt(toID string, typ byte, ids []string) error {
+	packets, err := cs.sessions.ReceiptPackets(toID, typ, ids)
+	if err != nil {
+		return err
+	}
+	return cs.postPackets(toID, nil, packets)
+}
+
+// show applies msg, sent by from in conv, to the history, and reports
+// whether it was a message of its own. Typing indicators are only kept in
+// memory. The caller holds cs.mu.
+func (cs *ClientState) show(conv, from string, msg *core.Message) bool {
+	if msg.Expired(time.Now()) {
+		return false
+	}
+	self := from == cs.sessions.AccountID()
+	if msg.Kind == core.KindTyping {
+		if !self {
+			cs.typing[conv] = msg.Deadline()
+		}
+		return false
+	}
+	if !self {
+		delete(cs.typing, conv)
+	}
+	h, err := cs.sessions.History()
+	if err != nil {
+		log.Println("Error opening the history:", err)
+		return false
+	}
+	text := string(msg.Body)
+	if msg.IsText() && !msg.Empty() {
+		text = cs.messageText(msg)
+	}
+	_, changed, err := h.ApplyContent(conv, from, text, msg)
+	if err != nil {
+		log.Printf("Ignored a message from %s: %v\n", core.ShortID(from), err)
+		return false
+	}
+	if changed {
+		cs.changed[conv] = true
+	}
+	return changed && msg.IsText()
+}
+
+// isTyping reports whether the contact of a conversation is typing.
+func (cs *ClientState) isTyping(conv string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return time.Now().Before(cs.typing[conv])
+}
+
+// messageText returns the text shown for msg. Attachments are downloaded
+// into the downloads folder in the background, unless they are on a relay
+// the user does not know.
+func (cs *ClientState) messageText(msg *core.Message) string {
+	if msg.Attachment == nil {
+		return string(msg.Body)
+	}
+	text := string(msg.Body)
+	if text != "" {
+		text += " "
+	}
+	a, err := core.ParseAttachment(msg.Attachment)
+	if err != nil {
+		return text + "[" + err.Error() + "]"
+	}
+	if d := core.PacketExpiry(msg); d != 0 {
+		a.Expires = min(a.Expires, d)
+	}
+	if err := cs.sessions.SaveAttachment(a); err != nil {
+		return text + "[attachment lost: " + err.Error() + "]"
+	}
+	if !cs.sessions.KnownRelay(a.Relay) {
+		return fmt.Sprintf("%s[file %s, %s, not downloaded: it is on %s, which is not your relay, a contact's or a relay profile]", text, a.Name, core.FormatSize(a.Size), a.Relay)
+	}
+	go func(sessions *core.Store) {
+		path, err := sessions.DownloadAttachment(a, core.DownloadsDir, nil)
+		if err != nil {
+			log.Printf("Error downloading %s: %v\n", a.Name, err)
+			return
+		}
+		log.Println("Saved", path)
+	}(cs.sessions)
+	return fmt.Sprintf("%s[file %s, %s, saved to %s]", text, a.Name, core.FormatSize(a.Size), core.DownloadsDir)
+}
+
+// appendHistory adds a notice to the conversation conv. The caller holds
+// cs.mu.
+func (cs *ClientState) appendHistory(conv, text string) {
+	h, err := cs.sessions.History()
+	if err == nil {
+		err = h.Add(conv, &core.HistoryMessage{Text: text, Sent: time.Now().UnixMilli()})
+	}
+	if err != nil {
+		log.Println("Error saving to the history:", err)
+		return
+	}
+	cs.changed[conv] = true
+}
+
+// ApplyTimer takes the disappearing message timer carried by msg for conv.
+// If who changed it, the change is noted in the conversation. The caller
+// holds cs.mu.
+func (cs *ClientState) applyTimer(conv, who string, msg *core.Message) {
+	changed, err := cs.sessions.ApplyTimer(conv, msg)
+	if err != nil {
+		log.Println("Error saving timer:", err)
+	}
+	if changed {
+		cs.appendHistory(conv, fmt.Sprintf("%s set disappearing messages to %s.", who, core.FormatTimer(msg.Timer)))
+	}
+}
+
+// purgeHistory drops disappeared messages from the history and reports
+// whether there were any.
+func (cs *ClientState) purgeHistory() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.sessions == nil {
+		return false
+	}
+	h, err := cs.sessions.History()
+	if err != nil {
+		log.Println("Error opening the history:", err)
+		return false
+	}
+	now := time.Now()
+	purged, err := h.Purge(now)
+	if err != nil {
+		log.Println("Error purging the history:", err)
+	}
+	if purged == nil {
+		return false
+	}
+	if err := cs.sessions.PurgeExpired(now); err != nil {
+		log.Println("Error purging attachments:", err)
+	}
+	return true
+}
+
+// getTimer returns the disappearing message timer of a conversation in
+// seconds.
+func (cs *ClientState) getTimer(conv string) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	d, err := cs.sessions.Timer(conv)
+	return int(d / time.Second), err
+}
+
+// SetTimer changes the disappearing message timer of a conversation and
+// sends an empty message to tell the other side.
+func (cs *ClientState) setTimer(conv string, seconds int) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	d := time.Duration(seconds) * time.Second
+	if d < 0 || d > core.MaxTimer {
+		return fmt.Errorf("the longest timer is %s", core.FormatTimer(core.MaxTimer))
+	}
+	if err := cs.sessions.SetTimer(conv, d); err != nil {
+		return err
+	}
+	var packets []core.EncryptedMessage
+	var err error
+	if groupID, ok := strings.CutPrefix(conv, "group:"); ok {
+		g, err := cs.sessions.LoadGroup(groupID)
+		if err != nil {
+			return err
+		}
+		if packets, err = cs.sessions.SealGroup(g, nil); err != nil {
+			return err
+		}
+	} else if packets, err = cs.sessions.SealAll(conv, nil); err != nil {
+		return err
+	}
+	cs.appendHistory(conv, "You set disappearing messages to "+core.FormatTimer(d)+".")
+	return cs.postPackets(conv, nil, packets)
 }
 
-// getMyID returns the client's public ID.
+// PublishPreKeys tops up our prekeys on the relay in the background.
+func (cs *ClientState) publishPreKeys() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.sessions == nil {
+		return
+	}
+	if _, err := cs.sessions.PublishPreKeys(); err != nil {
+		log.Println("Error publishing prekeys:", err)
+	}
+}
+
+// isIDExisting checks if the client has an existing identity.
+func (cs *ClientState) isIDExisting() bool {
+	return core.IdentityExists(keysDir)
+}
+
+// isLocked reports whether the identity is still waiting for its
+// passphrase.
+func (cs *ClientState) isLocked() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.sessions == nil && core.IdentityExists(keysDir)
+}
+
+// unlock loads the identity with passphrase.
+func (cs *ClientState) unlock(passphrase string) error {
+	if err := cs.loadIdentity(passphrase); err != nil {
+		return err
+	}
+	go cs.publishPreKeys()
+	return nil
+}
+
+// getMyID returns the client's public ID, which on a linked device is
+// that of the identity it belongs to.
 func (cs *ClientState) getMyID() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.sessions != nil {
+		return cs.sessions.AccountID()
+	}
 	return cs.myID
 }
 
+// contactView is a contact as shown in the contact list.
+type contactView struct {
+	ID         string `json:"id"`
+	Label      string `json:"label"`
+	Verified   bool   `json:"verified"`
+	KeyChanged bool   `json:"key_changed"`
+	Relay      string `json:"relay,omitempty"`
+}
+
 // getContacts returns the list of contacts.
-func (cs *ClientState) getContacts() []string {
+func (cs *ClientState) getContacts() ([]contactView, error) {
+	list, err := cs.contacts.List()
+	if err != nil {
+		return nil, err
+	}
+	views := make([]contactView, 0, len(list))
+	for _, c := range list {
+		views = append(views, contactView{ID: c.ID, Label: c.Label(), Verified: c.Verified, KeyChanged: c.KeyChanged, Relay: c.Relay})
+	}
+	return views, nil
+}
+
+// historyView is a line of a conversation as shown in the chat area.
+// Status is set for the messages we sent in a one-to-one conversation. ID
+// is set for messages that can be replied or reacted to.
+type historyView struct {
+	Text      string   `json:"text"`
+	Sent      bool     `json:"sent"`
+	Status    string   `json:"status,omitempty"`
+	ID        string   `json:"id,omitempty"`
+	Quote     string   `json:"quote,omitempty"`
+	Edited    bool     `json:"edited,omitempty"`
+	Reactions []string `json:"reactions,omitempty"`
+}
+
+// historyLimit is how many of the last messages of a conversation are
+// shown.
+const historyLimit = 500
+
+// getHistory returns the message history for a specific contact.
+func (cs *ClientState) getHistory(contactID string) ([]historyView, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	return cs.contacts
+	if cs.sessions == nil {
+		return nil, nil
+	}
+	statuses := make(map[string]string)
+	if !strings.HasPrefix(contactID, "group:") {
+		sent, err := cs.sessions.SentTo(contactID)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sent {
+			statuses[s.ID] = s.Status.String()
+		}
+	}
+	// Messages still in the outbox are queued, or failed if the relay
+	// refused them.
+	out, err := cs.sessions.Outbox()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range out {
+		if e.Conv == contactID {
+			statuses[e.ID] = e.Status()
+		}
+	}
+	h, err := cs.sessions.History()
+	if err != nil {
+		return nil, err
+	}
+	list, err := h.Messages(contactID, historyLimit)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*core.HistoryMessage)
+	for _, m := range list {
+		byID[m.ID] = m
+	}
+	self := cs.sessions.AccountID()
+	lines := make([]historyView, 0, len(list))
+	for _, m := range list {
+		if m.ID == "" {
+			lines = append(lines, historyView{Text: m.Text})
+			continue
+		}
+		prefix := "[You]: "
+		if m.From != self {
+			prefix = "[" + cs.memberLabel(m.From) + "]: "
+		}
+		if m.Deleted {
+			lines = append(lines, historyView{Text: prefix + "This message was deleted.", Sent: m.From == self})
+			continue
+		}
+		v := historyView{Text: prefix + m.Text, Sent: m.From == self, ID: m.ID, Edited: m.Edited}
+		if v.Sent {
+			v.Status = statuses[m.ID]
+		}
+		if m.ReplyTo != "" {
+			v.Quote = "a message that is no longer here"
+			if r := byID[m.ReplyTo]; r != nil && !r.Deleted {
+				v.Quote = core.Truncate(r.Text, core.SentPreviewSize)
+			}
+		}
+		v.Reactions = slices.Sorted(maps.Values(m.Reactions))
+		lines = append(lines, v)
+	}
+	return lines, nil
 }
 
-// getHistory returns the message history for a specific contact.
-func (cs *ClientState) getHistory(contactID string) []string {
+// markRead sends read receipts for the messages of a conversation that
+// were not shown yet, if the user allows them.
+func (cs *ClientState) markRead(contactID string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.sessions == nil {
+		return nil
+	}
+	settings, err := cs.sessions.LoadReceiptSettings()
+	if err != nil || !settings.ReadReceipts {
+		return err
+	}
+	h, err := cs.sessions.History()
+	if err != nil {
+		return err
+	}
+	list, err := h.Messages(contactID, historyLimit)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, m := range list {
+		if m.From == contactID && m.ID != "" && !m.Read {
+			m.Read = true
+			if err := h.Update(contactID, m); err != nil {
+				return err
+			}
+			ids = append(ids, m.ID)
+		}
+	}
+	if ids == nil {
+		return nil
+	}
+	return cs.sendReceipt(contactID, core.ReceiptRead, ids)
+}
+
+// getReadReceipts reports whether read receipts are sent.
+func (cs *ClientState) getReadReceipts() (bool, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	return cs.messageHistory[contactID]
+	if cs.sessions == nil {
+		return false, fmt.Errorf("identity is locked")
+	}
+	settings, err := cs.sessions.LoadReceiptSettings()
+	return settings.ReadReceipts, err
+}
+
+// setReadReceipts turns read receipts on or off.
+func (cs *ClientState) setReadReceipts(on bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.sessions == nil {
+		return fmt.Errorf("identity is locked")
+	}
+	settings, err := cs.sessions.LoadReceiptSettings()
+	if err != nil {
+		return err
+	}
+	settings.ReadReceipts = on
+	return cs.sessions.SaveReceiptSettings(settings)
 }
 
 // addContact adds a new contact to the client's contact list.
-func (cs *ClientState) addContact(contactID string) {
+func (cs *ClientState) addContact(contactID string) error {
+	_, err := cs.contacts.Add("", contactID)
+	return err
+}
+
+// safetyNumberView is the safety number of a conversation as shown in the
+// verification dialog.
+type safetyNumberView struct {
+	Number string `json:"number"`
+	QR     string `json:"qr"`
+}
+
+// getSafetyNumber returns the safety number shared with a contact, with
+// its QR code as a PNG data URL.
+func (cs *ClientState) getSafetyNumber(contactID string) (safetyNumberView, error) {
+	theirPub, err := core.DecodeID(contactID)
+	if err != nil {
+		return safetyNumberView{}, err
+	}
+	number := cs.sessions.SafetyNumberWith(theirPub)
+	qr, err := core.SafetyQR(number)
+	if err != nil {
+		return safetyNumberView{}, fmt.Errorf("failed to create QR code: %w", err)
+	}
+	png, err := qr.PNG(256)
+	if err != nil {
+		return safetyNumberView{}, fmt.Errorf("failed to render QR code: %w", err)
+	}
+	return safetyNumberView{
+		Number: core.FormatSafetyNumber(number),
+		QR:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+// markVerified records that the safety number with a contact was compared.
+func (cs *ClientState) markVerified(contactID string) error {
+	return cs.contacts.SetVerified(contactID, true)
+}
+
+// setContactRelay records the relay a contact uses, a profile name or a
+// URL. An empty relay means they use ours.
+func (cs *ClientState) setContactRelay(contactID, relay string) error {
+	if relay != "" {
+		var err error
+		if relay, err = cs.config.ResolveRelay(relay); err != nil {
+			return err
+		}
+	}
+	return cs.contacts.SetRelay(contactID, relay)
+}
+
+// memberLabel names a group member: "You", a contact's label or a short
+// ID. The caller holds cs.mu.
+func (cs *ClientState) memberLabel(id string) string {
+	if id == cs.sessions.AccountID() {
+		return "You"
+	}
+	if c, _ := cs.contacts.Lookup(id); c != nil {
+		return c.Label()
+	}
+	return core.ShortID(id)
+}
+
+// searchView is a message found by a search.
+type searchView struct {
+	Conv  string `json:"conv"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	Time  string `json:"time"`
+}
+
+// search looks for the messages containing every word of query, in the
+// conversation conv if set, and between the days since and until, given
+// as YYYY-MM-DD, if set.
+func (cs *ClientState) search(query, conv, since, until string) ([]searchView, error) {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	cs.contacts = append(cs.contacts, contactID)
-	cs.messageHistory[contactID] = []string{}
+	if cs.sessions == nil {
+		return nil, fmt.Errorf("identity is locked")
+	}
+	q := core.SearchQuery{Text: query, Conv: conv}
+	var err error
+	if since != "" {
+		if q.Since, err = core.ParseSearchDate(since, false); err != nil {
+			return nil, err
+		}
+	}
+	if until != "" {
+		if q.Until, err = core.ParseSearchDate(until, true); err != nil {
+			return nil, err
+		}
+	}
+	h, err := cs.sessions.History()
+	if err != nil {
+		return nil, err
+	}
+	results, err := h.Search(q)
+	if err != nil {
+		return nil, err
+	}
+	views := make([]searchView, 0, len(results))
+	for _, r := range results {
+		title := cs.memberLabel(r.Conv)
+		if groupID, ok := strings.CutPrefix(r.Conv, "group:"); ok {
+			title = "# " + core.ShortID(groupID)
+			if g, err := cs.sessions.LoadGroup(groupID); err == nil {
+				title = "# " + g.Label()
+			}
+		}
+		views = append(views, searchView{
+			Conv:  r.Conv,
+			Title: title,
+			Text:  "[" + cs.memberLabel(r.Message.From) + "]: " + r.Message.Text,
+			Time:  time.UnixMilli(r.Message.Sent).Format("Jan _2 2006 15:04"),
+		})
+	}
+	return views, nil
+}
+
+// groupView is a group as shown in the group list.
+type groupView struct {
+	ID      string   `json:"id"`
+	Label   string   `json:"label"`
+	Members []string `json:"members"`
+	Admin   bool     `json:"admin"`
+	Left    bool     `json:"left"`
+}
+
+// getGroups returns the groups we belong to or have left.
+func (cs *ClientState) getGroups() ([]groupView, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.sessions == nil {
+		return nil, fmt.Errorf("identity is locked")
+	}
+	groups, err := cs.sessions.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	views := make([]groupView, 0, len(groups))
+	for _, g := range groups {
+		v := groupView{ID: g.ID, Label: g.Label(), Admin: g.Admin == cs.sessions.AccountID(), Left: g.Left}
+		for _, id := range g.Members {
+			v.Members = append(v.Members, cs.memberLabel(id))
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// postPackets sends packets carrying msg, if any, to the conversation conv
+// through the outbox. Packets the relay cannot take yet stay queued and
+// are sent after a later fetch. The caller holds cs.mu.
+func (cs *ClientState) postPackets(conv string, msg *core.Message, packets []core.EncryptedMessage) error {
+	err := cs.sessions.Send(conv, msg, packets)
+	if errors.Is(err, core.ErrQueued) {
+		log.Println(err)
+		return nil
+	}
+	return err
+}
+
+// flushOutbox sends what is queued in the outbox and marks the
+// conversations concerned as changed. The caller holds cs.mu.
+func (cs *ClientState) flushOutbox() {
+	out, err := cs.sessions.Outbox()
+	if err != nil || len(out) == 0 {
+		return
+	}
+	if _, err := cs.sessions.Flush(); err != nil {
+		log.Println("Error sending the outbox:", err)
+	}
+	for _, e := range out {
+		if e.Conv != "" {
+			cs.changed[e.Conv] = true
+		}
+	}
+}
+
+// retryMessage sends a message the relay refused again.
+func (cs *ClientState) retryMessage(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if err := cs.sessions.Retry(id); err != nil {
+		return err
+	}
+	cs.flushOutbox()
+	out, err := cs.sessions.Outbox()
+	if err != nil {
+		return err
+	}
+	for _, e := range out {
+		if e.ID == id && e.Failed {
+			return errors.New(e.Error)
+		}
+	}
+	return nil
+}
+
+// CreateGroup starts a group with the given contacts and returns its ID.
+func (cs *ClientState) createGroup(name string, members []string) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	var ids []string
+	for _, s := range members {
+		id, _, err := cs.contacts.Resolve(s)
+		if err != nil {
+			return "", err
+		}
+		ids = append(ids, id)
+	}
+	g, packets, err := cs.sessions.CreateGroup(name, ids)
+	if err != nil {
+		return "", err
+	}
+	return g.ID, cs.postPackets("group:"+g.ID, nil, packets)
+}
+
+// setGroupMembers adds or removes a contact from a group we administer.
+// Every change gives the group new keys.
+func (cs *ClientState) setGroupMembers(groupID, contact string, add bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	id, _, err := cs.contacts.Resolve(contact)
+	if err != nil {
+		return err
+	}
+	g, err := cs.sessions.LoadGroup(groupID)
+	if err != nil {
+		return err
+	}
+	members := slices.DeleteFunc(slices.Clone(g.Members), func(m string) bool { return m == id })
+	if add {
+		members = append(members, id)
+	}
+	packets, err := cs.sessions.SetMembers(g, members)
+	if err != nil {
+		return err
+	}
+	return cs.postPackets("group:"+g.ID, nil, packets)
+}
+
+// sendGroupMessage encrypts a message once for the group and sends it to
+// every member's devices.
+func (cs *ClientState) sendGroupMessage(groupID, msg string) error {
+	m, err := core.NewMessage([]byte(msg))
+	if err != nil {
+		return err
+	}
+	return cs.send("group:"+groupID, m)
 }
 
 func main() {
-	cs := &ClientState{}
+	cs := &ClientState{changed: make(map[string]bool), typing: make(map[string]time.Time)}
+	cs.ctx, cs.stop = context.WithCancel(context.Background())
 
-	// Attempt to load an existing identity.
-	if err := cs.loadIdentity(); err != nil {
+	profile := flag.String("profile", "", "identity profile, overriding $"+core.ProfileEnvVar)
+	relay := flag.String("relay", "", "relay profile or URL, overriding $"+core.RelayEnvVar+" and the config")
+	flag.Parse()
+	var err error
+	var name string
+	if name, keysDir, err = core.SelectProfile(*profile); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		log.Fatal(err)
+	}
+	if cs.config, err = core.LoadConfig(keysDir); err != nil {
+		log.Fatal(err)
+	}
+	if cs.relayURL, err = cs.config.RelayURL(*relay); err != nil {
+		log.Fatal(err)
+	}
+
+	// Attempt to load an existing identity. One protected by a passphrase
+	// waits for the UI to unlock it.
+	if locked, err := core.KeystoreLocked(keysDir); errors.Is(err, core.ErrNoIdentity) {
 		log.Println("No existing identity found. A new one will be generated on UI.")
+	} else if err != nil {
+		log.Println("Error reading identity:", err)
+	} else if !locked {
+		if err := cs.unlock(""); err != nil {
+			log.Println("Error loading identity:", err)
+		}
 	}
 
 	w := webview2.New(true)
 	defer w.Destroy()
 
-	w.SetTitle("HEMSAEUCC - Humanized Encrypted Messaging System Against Europian Union Chat Control")
+	title := "HEMSAEUCC - Humanized Encrypted Messaging System Against Europian Union Chat Control"
+	if name != "" && name != core.DefaultProfile {
+		title = "HEMSAEUCC (" + name + ") - Humanized Encrypted Messaging System Against Europian Union Chat Control"
+	}
+	w.SetTitle(title)
 	w.SetSize(800, 600, webview2.HintNone)
 
 	// Bind Go functions to JavaScript.
 	w.Bind("go_is_id_existing", cs.isIDExisting)
-	w.Bind("go_init_identity", cs.initIdentity)
+	w.Bind("go_is_locked", cs.isLocked)
+	w.Bind("go_unlock", cs.unlock)
+	w.Bind("go_init_identity", func(passphrase string) (string, error) {
+		id, err := cs.initIdentity(passphrase)
+		if err == nil {
+			go cs.publishPreKeys()
+		}
+		return id, err
+	})
 	w.Bind("go_get_my_id", cs.getMyID)
 	w.Bind("go_add_contact", cs.addContact)
 	w.Bind("go_get_contacts", cs.getContacts)
+	w.Bind("go_get_safety_number", cs.getSafetyNumber)
+	w.Bind("go_mark_verified", cs.markVerified)
+	w.Bind("go_set_contact_relay", cs.setContactRelay)
 	w.Bind("go_send_message", func(contactID, msg string) {
 		err := cs.sendMessage(contactID, msg)
 		if err != nil {
 			log.Println("Error sending message:", err)
 		}
-		cs.mu.Lock()
-		// Append the sent message to our local history.
-		cs.messageHistory[contactID] = append(cs.messageHistory[contactID], "[You]: "+msg)
-		cs.mu.Unlock()
 	})
 	w.Bind("go_fetch_messages", cs.fetchMessages)
 	w.Bind("go_get_history", cs.getHistory)
+	w.Bind("go_get_groups", cs.getGroups)
+	w.Bind("go_create_group", cs.createGroup)
+	w.Bind("go_add_group_member", func(groupID, contact string) error {
+		return cs.setGroupMembers(groupID, contact, true)
+	})
+	w.Bind("go_remove_group_member", func(groupID, contact string) error {
+		return cs.setGroupMembers(groupID, contact, false)
+	})
+	w.Bind("go_send_group_message", cs.sendGroupMessage)
+	w.Bind("go_purge_history", cs.purgeHistory)
+	w.Bind("go_get_timer", cs.getTimer)
+	w.Bind("go_set_timer", cs.setTimer)
+	w.Bind("go_reply", func(conv, ref, text string) error {
+		return cs.sendContent(conv, core.KindText, ref, text)
+	})
+	w.Bind("go_edit_message", func(conv, ref, text string) error {
+		return cs.sendContent(conv, core.KindEdit, ref, text)
+	})
+	w.Bind("go_delete_message", func(conv, ref string) error {
+		return cs.sendContent(conv, core.KindDelete, ref, "")
+	})
+	w.Bind("go_react", func(conv, ref, emoji string) error {
+		return cs.sendContent(conv, core.KindReaction, ref, emoji)
+	})
+	w.Bind("go_send_typing", cs.sendTyping)
+	w.Bind("go_is_typing", cs.isTyping)
+	w.Bind("go_mark_read", cs.markRead)
+	w.Bind("go_retry_message", cs.retryMessage)
+	w.Bind("go_get_read_receipts", cs.getReadReceipts)
+	w.Bind("go_set_read_receipts", cs.setReadReceipts)
+	w.Bind("go_search", cs.search)
 
 	w.SetHtml(html)
 	w.Run()
+
+	cs.stop()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.sessions != nil {
+		cs.sessions.Close()
+	}
 }
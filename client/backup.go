@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tyler-smith/go-bip39"
+
+	"HEMSAEUCC-core"
+)
+
+// backupPassphraseEnvVar supplies the passphrase of backup files to
+// non-interactive clients.
+const backupPassphraseEnvVar = "HEMSAEUCC_BACKUP_PASSPHRASE"
+
+// identityMnemonic returns the 24-word BIP39 mnemonic of an identity
+// secret. The last word carries an 8-bit checksum.
+func identityMnemonic(priv []byte) (string, error) {
+	return bip39.NewMnemonic(priv)
+}
+
+// identityFromMnemonic recovers the identity secret from its mnemonic.
+func identityFromMnemonic(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) != 24 {
+		return nil, fmt.Errorf("a recovery phrase has 24 words, got %d", len(words))
+	}
+	for _, w := range words {
+		if _, ok := bip39.GetWordIndex(w); !ok {
+			return nil, fmt.Errorf("%q is not a recovery phrase word", w)
+		}
+	}
+	priv, err := bip39.EntropyFromMnemonic(strings.Join(words, " "))
+	if err != nil {
+		return nil, fmt.Errorf("recovery phrase is mistyped: %w", err)
+	}
+	return priv, nil
+}
+
+// writeBackupFile saves priv to path as a keystore under a passphrase of
+// its own.
+func writeBackupFile(path string, priv []byte) error {
+	passphrase, err := newBackupPassphrase()
+	if err != nil {
+		return err
+	}
+	data, err := core.SealKeystore(priv, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt backup: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// readBackupFile decrypts a backup file written by writeBackupFile.
+func readBackupFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup: %w", err)
+	}
+	passphrase, err := readPassphrase("Backup passphrase: ", backupPassphraseEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := core.OpenKeystore(data, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+	if len(priv) != 32 {
+		return nil, fmt.Errorf("backup is corrupt")
+	}
+	return priv, nil
+}
+
+func newBackupPassphrase() ([]byte, error) {
+	p, err := readPassphrase("Backup passphrase: ", backupPassphraseEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return nil, fmt.Errorf("a backup file needs a passphrase")
+	}
+	if _, ok := os.LookupEnv(backupPassphraseEnvVar); ok {
+		return p, nil
+	}
+	again, err := readPassphrase("Repeat backup passphrase: ", backupPassphraseEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p, again) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return p, nil
+}
+
+// restoreIdentity installs priv as the identity in keysDir. If a different
+// identity is there, force must be set; its keys directory is then moved
+// aside rather than deleted, since its state cannot be read with the
+// restored key.
+func restoreIdentity(keysDir string, priv []byte, force bool) (*core.Identity, error) {
+	me, err := core.IdentityFromKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if core.IdentityExists(keysDir) {
+		old, _ := core.ReadPublicKey(keysDir)
+		if !bytes.Equal(old, me.Pub) {
+			if !force {
+				return nil, errIdentityExists
+			}
+			aside := fmt.Sprintf("%s.replaced-%d", keysDir, time.Now().Unix())
+			if err := os.Rename(keysDir, aside); err != nil {
+				return nil, fmt.Errorf("failed to move old identity aside: %w", err)
+			}
+			fmt.Println("The previous identity was moved to", aside)
+		}
+	}
+
+	passphrase, err := newPassphrase(core.PassphraseEnvVar)
+	if err != nil {
+		return nil, err
+	}
+	if err := me.Save(keysDir, passphrase); err != nil {
+		return nil, err
+	}
+	return me, nil
+}
+
+// errIdentityExists is returned when a restore would replace a different
+// identity without confirmation.
+var errIdentityExists = errors.New("a different identity already exists")
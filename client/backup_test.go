@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"HEMSAEUCC-core"
+)
+
+func TestIdentityMnemonic(t *testing.T) {
+	priv := bytes.Repeat([]byte{0xa5}, 32)
+	mnemonic, err := identityMnemonic(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := strings.Fields(mnemonic)
+	if len(words) != 24 {
+		t.Fatalf("mnemonic has %d words, want 24", len(words))
+	}
+	for _, phrase := range []string{mnemonic, strings.ToUpper(mnemonic), "  " + strings.Join(words, "\n ") + " "} {
+		got, err := identityFromMnemonic(phrase)
+		if err != nil || !bytes.Equal(got, priv) {
+			t.Errorf("identityFromMnemonic(%q) = %x, %v, want %x", phrase, got, err, priv)
+		}
+	}
+
+	swapped := append([]string{}, words...)
+	swapped[0], swapped[1] = swapped[1], swapped[0]
+	if swapped[0] == swapped[1] {
+		t.Fatal("test mnemonic starts with a repeated word")
+	}
+	tests := []struct {
+		name   string
+		phrase string
+	}{
+		{"empty", ""},
+		{"too short", strings.Join(words[:23], " ")},
+		{"too long", mnemonic + " " + words[0]},
+		{"not a word", strings.Join(append([]string{"hemsaeucc"}, words[1:]...), " ")},
+		{"bad checksum", strings.Join(swapped, " ")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if priv, err := identityFromMnemonic(tt.phrase); err == nil {
+				t.Errorf("identityFromMnemonic accepted %q as %x", tt.phrase, priv)
+			}
+		})
+	}
+}
+
+func TestBackupFile(t *testing.T) {
+	priv := bytes.Repeat([]byte{7}, 32)
+	path := filepath.Join(t.TempDir(), "backup.bin")
+	t.Setenv(backupPassphraseEnvVar, "backup passphrase")
+	if err := writeBackupFile(path, priv); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readBackupFile(path)
+	if err != nil || !bytes.Equal(got, priv) {
+		t.Errorf("readBackupFile = %x, %v, want %x", got, err, priv)
+	}
+
+	t.Setenv(backupPassphraseEnvVar, "wrong passphrase")
+	if _, err := readBackupFile(path); err == nil {
+		t.Error("readBackupFile accepted the wrong passphrase")
+	}
+	t.Setenv(backupPassphraseEnvVar, "")
+	if err := writeBackupFile(path, priv); err == nil {
+		t.Error("writeBackupFile accepted an empty passphrase")
+	}
+}
+
+func TestRestoreIdentity(t *testing.T) {
+	t.Setenv(core.PassphraseEnvVar, "")
+	newID := func() *core.Identity {
+		id, err := core.NewIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	saved := newID()
+	restored := newID()
+	tests := []struct {
+		name      string
+		existing  *core.Identity
+		restore   *core.Identity
+		force     bool
+		wantErr   error
+		wantAside bool
+	}{
+		{"empty", nil, restored, false, nil, false},
+		{"same identity", restored, restored, false, nil, false},
+		{"different identity", saved, restored, false, errIdentityExists, false},
+		{"different identity forced", saved, restored, true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keysDir := filepath.Join(dir, "keys")
+			if tt.existing != nil {
+				if err := tt.existing.Save(keysDir, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			me, err := restoreIdentity(keysDir, tt.restore.Priv, tt.force)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("restoreIdentity = %v, want %v", err, tt.wantErr)
+			}
+			pub, readErr := core.ReadPublicKey(keysDir)
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if err != nil {
+				if !bytes.Equal(pub, tt.existing.Pub) {
+					t.Error("refused restore replaced the existing identity")
+				}
+				return
+			}
+			if me.ID() != tt.restore.ID() || !bytes.Equal(pub, tt.restore.Pub) {
+				t.Errorf("restored %s, keystore holds %x, want %s", me.ID(), pub, tt.restore.ID())
+			}
+
+			aside, err := filepath.Glob(keysDir + ".replaced-*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(aside) == 1; got != tt.wantAside {
+				t.Fatalf("moved aside: %v, want %v", aside, tt.wantAside)
+			}
+			if tt.wantAside {
+				if old, err := core.ReadPublicKey(aside[0]); err != nil || !bytes.Equal(old, tt.existing.Pub) {
+					t.Errorf("moved-aside keystore holds %x, %v, want %x", old, err, tt.existing.Pub)
+				}
+			}
+		})
+	}
+}
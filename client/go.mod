@@ -2,6 +2,18 @@ module HEMSAEUCC-client
 
 go 1.25.0
 
-require golang.org/x/crypto v0.42.0
+require (
+	HEMSAEUCC-core v0.0.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/tyler-smith/go-bip39 v1.1.0
+	golang.org/x/term v0.35.0
+)
 
-require golang.org/x/sys v0.36.0 // indirect
+require (
+	filippo.io/edwards25519 v1.1.0 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+)
+
+replace HEMSAEUCC-core => ../core
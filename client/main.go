@@ -1,142 +1,1779 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/rand"
-	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"log"
+	"maps"
 	"os"
-	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/curve25519"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/term"
+
+	"HEMSAEUCC-core"
 )
 
-type EncryptedMessage struct {
-	FromID      string `json:"from_id"`
-	ToID        string `json:"to_id"`
-	EphemeralPK string `json:"ephemeral_pk"`
-	Nonce       string `json:"nonce"`
-	Ciphertext  string `json:"ciphertext"`
+// linkTimeout is how long `client link` waits for the primary device.
+const linkTimeout = 10 * time.Minute
+
+// options are given before the command.
+type options struct {
+	// profile is the identity profile to use.
+	profile string
+	// relay overrides the relay of the config, by relay profile name or
+	// URL.
+	relay string
+}
+
+// parseOptions takes the options from the front of os.Args.
+func parseOptions() (options, error) {
+	var opts options
+	for len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "--") {
+		name, value, ok := strings.Cut(os.Args[1], "=")
+		n := 1
+		if !ok {
+			if len(os.Args) < 3 {
+				return opts, fmt.Errorf("%s needs a value", name)
+			}
+			value, n = os.Args[2], 2
+		}
+		switch name {
+		case "--profile":
+			opts.profile = value
+		case "--relay":
+			opts.relay = value
+		default:
+			return opts, fmt.Errorf("unknown option %s", name)
+		}
+		os.Args = append(os.Args[:1], os.Args[1+n:]...)
+	}
+	return opts, nil
+}
+
+// openStore opens the session store of me, talking to the relay at
+// relayURL.
+func openStore(me *core.Identity, keysDir, relayURL string) (*core.Store, error) {
+	sessions, err := me.OpenStore(keysDir)
+	if err != nil {
+		return nil, err
+	}
+	sessions.Relay = core.NewRelay(relayURL)
+	return sessions, nil
+}
+
+// relays runs `client relays`, which lists and edits the relay profiles of
+// the config.
+func relays(config *core.Config, opts options) {
+	usage := "client relays [add <name> <url> | remove <name> | default <profile|url>]"
+	if len(os.Args) > 2 {
+		switch sub := os.Args[2]; {
+		case sub == "add" && len(os.Args) == 5:
+			url, err := core.ParseRelayURL(os.Args[4])
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			if config.Relays == nil {
+				config.Relays = make(map[string]string)
+			}
+			config.Relays[os.Args[3]] = url
+		case sub == "remove" && len(os.Args) == 4:
+			if _, ok := config.Relays[os.Args[3]]; !ok {
+				fmt.Println("ERROR: no relay profile", strconv.Quote(os.Args[3]))
+				return
+			}
+			delete(config.Relays, os.Args[3])
+			if config.Relay == os.Args[3] {
+				config.Relay = ""
+			}
+		case sub == "default" && len(os.Args) == 4:
+			if _, err := config.ResolveRelay(os.Args[3]); err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			config.Relay = os.Args[3]
+		default:
+			fmt.Println(usage)
+			return
+		}
+		if err := config.Save(); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println("Saved", config.Path())
+	}
+
+	for _, name := range config.Profiles() {
+		mark := " "
+		if name == config.Relay {
+			mark = "*"
+		}
+		fmt.Printf("%s %-16s %s\n", mark, name, config.Relays[name])
+	}
+	url, err := config.RelayURL(opts.relay)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	fmt.Println("Using", url)
+}
+
+// profiles runs `client profile`, which lists, creates and deletes the
+// identity profiles.
+func profiles(opts options) {
+	usage := "client profile [list | create <name> | delete <name>]"
+	sub := "list"
+	if len(os.Args) > 2 {
+		sub = os.Args[2]
+	}
+	switch {
+	case sub == "list" && len(os.Args) <= 3:
+		names, err := core.Profiles()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		current, keysDir, _ := core.SelectProfile(opts.profile)
+		if current == "" {
+			fmt.Println("Using", keysDir, "in the working directory, not a profile.")
+		}
+		if len(names) == 0 {
+			fmt.Println("No profiles yet. Create one with `client profile create <name>`.")
+			return
+		}
+		for _, name := range names {
+			mark := " "
+			if name == current {
+				mark = "*"
+			}
+			id := "no identity"
+			if dir, err := core.ProfileKeysDir(name); err == nil {
+				if pub, err := core.ReadPublicKey(dir); err == nil {
+					id = core.ShortID(hex.EncodeToString(pub))
+				}
+			}
+			fmt.Printf("%s %-16s %s\n", mark, name, id)
+		}
+
+	case sub == "create" && len(os.Args) == 4:
+		name := os.Args[3]
+		if _, err := core.CreateProfile(name); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Printf("Created profile %s. Run `client --profile %s init` to give it an identity.\n", name, name)
+
+	case sub == "delete" && len(os.Args) == 4:
+		name := os.Args[3]
+		names, err := core.Profiles()
+		if err == nil && !slices.Contains(names, name) {
+			err = fmt.Errorf("%w: %s", core.ErrNoProfile, name)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println("WARNING: this deletes the identity, contacts, message history and config of", name+".")
+		fmt.Println("Without a backup, the identity cannot be recovered.")
+		if !confirm("Delete profile " + name + "?") {
+			fmt.Println("Profile kept.")
+			return
+		}
+		if err := core.DeleteProfile(name); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println("Deleted profile", name+".")
+
+	default:
+		fmt.Println(usage)
+	}
 }
 
 func main() {
+	opts, err := parseOptions()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
 	if len(os.Args) < 2 {
-		fmt.Println("Usage:")
+		fmt.Println("Usage: client [--profile <name>] [--relay <profile|url>] <command>")
 		fmt.Println("  client init")
-		fmt.Println("  client send <to_id> <message>")
+		fmt.Println("  client send <contact|id> <message>")
+		fmt.Println("  client send-file <contact|id> <file> [caption]")
+		fmt.Println("  client reply <message> <text>")
+		fmt.Println("  client edit <message> <text>")
+		fmt.Println("  client delete <message>")
+		fmt.Println("  client react <message> <emoji|off>")
+		fmt.Println("  client download [<attachment> [dir]]")
+		fmt.Println("  client timer <contact|group> [duration|off]")
+		fmt.Println("  client history [<contact|group> [count]]")
+		fmt.Println("  client search [--in <contact|group>] [--since <date>] [--until <date>] <words>")
+		fmt.Println("  client status [contact]")
+		fmt.Println("  client outbox [retry|drop <message>]")
 		fmt.Println("  client fetch")
 		fmt.Println("  client id")
+		fmt.Println("  client add <name> <id>")
+		fmt.Println("  client relay <contact> [<profile|url>|off]")
+		fmt.Println("  client relays [add <name> <url> | remove <name> | default <profile|url>]")
+		fmt.Println("  client profile [list | create <name> | delete <name>]")
+		fmt.Println("  client contacts")
+		fmt.Println("  client verify <contact|id> [safety number]")
+		fmt.Println("  client reset <id>")
+		fmt.Println("  client prekeys")
+		fmt.Println("  client passwd")
+		fmt.Println("  client backup [file]")
+		fmt.Println("  client restore [file] [--force]")
+		fmt.Println("  client rotate")
+		fmt.Println("  client link")
+		fmt.Println("  client devices [add <link code> [name] | remove <name|id>]")
+		fmt.Println("  client groups")
+		fmt.Println("  client group create|add|remove|send|info ...")
 		return
 	}
 
 	cmd := os.Args[1]
-	keysDir := "keys"
+	log.SetFlags(0)
+	if cmd == "profile" {
+		profiles(opts)
+		return
+	}
+	_, keysDir, err := core.SelectProfile(opts.profile)
+	if errors.Is(err, core.ErrNoProfile) {
+		fmt.Printf("ERROR: %v. Create it with `client profile create <name>`.\n", err)
+		return
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
 	os.MkdirAll(keysDir, 0700)
-	privPath := filepath.Join(keysDir, "x25519_secret.bin")
-	pubPath := filepath.Join(keysDir, "x25519_public.bin")
-
-if cmd == "init" {
-    if _, err := os.Stat(privPath); err == nil {
-        fmt.Println("ERROR: Identity already exists. Delete the 'keys' folder to reset.")
-        return
-    }
-    priv := make([]byte, 32)
-    rand.Read(priv)
-    pub, _ := curve25519.X25519(priv, curve25519.Basepoint)
-    os.WriteFile(privPath, priv, 0600)
-    os.WriteFile(pubPath, pub, 0600)
-    fmt.Println("Your HEMSAEUCC ID:", hex.EncodeToString(pub))
-    return
-}
-
-	priv, _ := os.ReadFile(privPath)
-	pub, _ := os.ReadFile(pubPath)
-	myID := hex.EncodeToString(pub)
+
+	config, err := core.LoadConfig(keysDir)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	if cmd == "relays" {
+		relays(config, opts)
+		return
+	}
+	relayURL, err := config.RelayURL(opts.relay)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+
+	if cmd == "init" {
+		if core.IdentityExists(keysDir) {
+			fmt.Println("ERROR: Identity already exists. Run `client rotate` to replace its key.")
+			return
+		}
+		passphrase, err := newPassphrase(core.PassphraseEnvVar)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		me, err := core.NewIdentity()
+		if err == nil {
+			err = me.Save(keysDir, passphrase)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println("Your HEMSAEUCC ID:", me.ID())
+
+		sessions, err := openStore(me, keysDir, relayURL)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if _, err := sessions.PublishPreKeys(); err != nil {
+			fmt.Println("WARNING: prekeys not published, run `client prekeys` later:", err)
+		}
+		return
+	}
+
+	if cmd == "link" && !core.IdentityExists(keysDir) {
+		// A device being linked gets a key of its own, protected like an
+		// identity key.
+		passphrase, err := newPassphrase(core.PassphraseEnvVar)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		me, err := core.NewIdentity()
+		if err == nil {
+			err = me.Save(keysDir, passphrase)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		sessions, err := openStore(me, keysDir, relayURL)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if _, err := sessions.StartLink(); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if _, err := sessions.PublishPreKeys(); err != nil {
+			fmt.Println("ERROR: prekeys not published:", err)
+			return
+		}
+		link(sessions, sessions.Contacts())
+		return
+	}
+
+	if cmd == "restore" {
+		force := len(os.Args) > 2 && os.Args[len(os.Args)-1] == "--force"
+		args := os.Args[2:]
+		if force {
+			args = args[:len(args)-1]
+		}
+		var priv []byte
+		var err error
+		if len(args) > 0 {
+			priv, err = readBackupFile(args[0])
+		} else {
+			fmt.Println("Enter your 24-word recovery phrase:")
+			line, _ := stdin.ReadString('\n')
+			priv, err = identityFromMnemonic(line)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		me, err := restoreIdentity(keysDir, priv, force)
+		if errors.Is(err, errIdentityExists) {
+			fmt.Println("WARNING: this replaces the identity in", keysDir, "with a different one.")
+			if !confirm("Replace it?") {
+				fmt.Println("Restore cancelled.")
+				return
+			}
+			me, err = restoreIdentity(keysDir, priv, true)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println("Restored HEMSAEUCC ID:", me.ID())
+
+		sessions, err := openStore(me, keysDir, relayURL)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if _, err := sessions.PublishPreKeys(); err != nil {
+			fmt.Println("WARNING: prekeys not published, run `client prekeys` later:", err)
+		}
+		return
+	}
+
+	if cmd == "id" {
+		pub, err := core.ReadPublicKey(keysDir)
+		if errors.Is(err, core.ErrNoIdentity) {
+			fmt.Println("No identity found. Run `client init` first.")
+			return
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if account := core.LinkedIdentity(keysDir, pub); !bytes.Equal(account, pub) {
+			fmt.Println("Your HEMSAEUCC ID:", hex.EncodeToString(account))
+			fmt.Println("This device:", hex.EncodeToString(pub))
+			return
+		}
+		fmt.Println("Your HEMSAEUCC ID:", hex.EncodeToString(pub))
+		return
+	}
+
+	// The passphrase is kept for `client rotate`, which protects the new
+	// key with it.
+	var passphrase []byte
+	me, migrated, err := core.LoadIdentity(keysDir, func() (p []byte, err error) {
+		passphrase, err = readPassphrase("Passphrase: ", core.PassphraseEnvVar)
+		return passphrase, err
+	})
+	if errors.Is(err, core.ErrNoIdentity) {
+		fmt.Println("No identity found. Run `client init` first.")
+		return
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	if migrated {
+		fmt.Println("Your identity key was moved into an encrypted keystore. Run `client passwd` to protect it with a passphrase.")
+	}
+	priv, pub, myID := me.Priv, me.Pub, me.ID()
+	sessions, err := openStore(me, keysDir, relayURL)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	defer sessions.Close()
+	contacts := sessions.Contacts()
+	if err := sessions.PurgeExpired(time.Now()); err != nil {
+		fmt.Println("WARNING:", err)
+	}
+	if cmd != "outbox" {
+		flushOutbox(sessions)
+	}
 
 	switch cmd {
-		
-case "id":
-    if _, err := os.Stat(pubPath); err != nil {
-        fmt.Println("No identity found. Run `client init` first.")
-        return
-    }
-    pub, _ := os.ReadFile(pubPath)
-    fmt.Println("Your HEMSAEUCC ID:", hex.EncodeToString(pub))
-    return
 
 	case "send":
 		if len(os.Args) < 4 {
 			fmt.Println("client send <to_id> <msg>")
 			return
 		}
-		toID := os.Args[2]
-		msg := []byte(os.Args[3])
+		toID, err := recipient(sessions, contacts, os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		msg, err := core.NewMessage([]byte(os.Args[3]))
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		err = deliver(sessions, toID, msg)
+		if !reportSend(err, fmt.Sprintf("Message %s sent.", core.ShortID(msg.IDString()))) {
+			return
+		}
+		record(sessions, toID, msg)
 
-		ephPriv := make([]byte, 32)
-		rand.Read(ephPriv)
-		ephPub, _ := curve25519.X25519(ephPriv, curve25519.Basepoint)
+	case "send-file":
+		if len(os.Args) < 4 {
+			fmt.Println("client send-file <contact|id> <file> [caption]")
+			return
+		}
+		toID, err := recipient(sessions, contacts, os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		a, err := sessions.UploadAttachment(os.Args[3], func(done, total int64) {
+			fmt.Printf("\rUploading... %s of %s", core.FormatSize(done), core.FormatSize(total))
+		})
+		fmt.Println()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		msg, err := core.NewMessage(nil)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(os.Args) > 4 {
+			msg.Body = []byte(os.Args[4])
+		}
+		if msg.Attachment, err = json.Marshal(a); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		err = deliver(sessions, toID, msg)
+		if !reportSend(err, fmt.Sprintf("Sent %s (%s) as message %s, %s.", a.Name, core.FormatSize(a.Size), core.ShortID(msg.IDString()), core.ExpiresIn(a.Expires))) {
+			return
+		}
+		record(sessions, toID, msg)
 
-		toPub, _ := hex.DecodeString(toID)
-		shared, _ := curve25519.X25519(ephPriv, toPub)
+	case "reply", "edit", "delete", "react":
+		usage := map[string]string{
+			"reply":  "client reply <message> <text>",
+			"edit":   "client edit <message> <text>",
+			"delete": "client delete <message>",
+			"react":  "client react <message> <emoji|off>",
+		}[cmd]
+		if len(os.Args) < 3 || (cmd != "delete" && len(os.Args) < 4) {
+			fmt.Println(usage)
+			return
+		}
+		h, err := sessions.History()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		conv, r, err := h.FindPrefix(os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if (cmd == "edit" || cmd == "delete") && r.From != sessions.AccountID() {
+			fmt.Println("ERROR: you can only", cmd, "your own messages")
+			return
+		}
+		var kind uint64
+		var body []byte
+		switch cmd {
+		case "reply":
+			kind, body = core.KindText, []byte(os.Args[3])
+		case "edit":
+			kind, body = core.KindEdit, []byte(os.Args[3])
+		case "delete":
+			kind = core.KindDelete
+		case "react":
+			kind = core.KindReaction
+			if os.Args[3] != "off" {
+				body = []byte(os.Args[3])
+			}
+			if len(body) > core.MaxReactionSize {
+				fmt.Println("ERROR: a reaction is a single emoji")
+				return
+			}
+		}
+		msg, err := core.NewContent(kind, r.ID, body)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		done := map[string]string{
+			"reply":  fmt.Sprintf("Message %s sent.", core.ShortID(msg.IDString())),
+			"edit":   "Message edited.",
+			"delete": "Message deleted for everyone.",
+			"react":  "Reaction sent.",
+		}[cmd]
+		if !reportSend(sendContent(sessions, conv, msg), done) {
+			return
+		}
+		record(sessions, conv, msg)
 
-		aead, _ := chacha20poly1305.NewX(shared)
-		nonce := make([]byte, chacha20poly1305.NonceSizeX)
-		rand.Read(nonce)
-		ct := aead.Seal(nil, nonce, msg, nil)
+	case "download":
+		if len(os.Args) < 3 {
+			list, err := sessions.ListAttachments()
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			if len(list) == 0 {
+				fmt.Println("No attachments waiting.")
+				return
+			}
+			for _, a := range list {
+				fmt.Printf("%s  %-24s %10s  %s\n", core.ShortID(a.Blob), a.Name, core.FormatSize(a.Size), core.ExpiresIn(a.Expires))
+			}
+			return
+		}
+		a, err := sessions.FindAttachment(os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		dir := core.DownloadsDir
+		if len(os.Args) > 3 {
+			dir = os.Args[3]
+		}
+		sessions.KnownRelays = config.RelayURLs()
+		if !sessions.KnownRelay(a.Relay) {
+			fmt.Println("WARNING:", a.Name, "is on", a.Relay+", which is not your relay, a contact's or a relay profile.")
+			fmt.Println("The sender picked it, and downloading tells it your address.")
+			if !confirm("Download it anyway?") {
+				fmt.Println("Download cancelled.")
+				return
+			}
+			sessions.KnownRelays = append(sessions.KnownRelays, a.Relay)
+		}
+		path, err := sessions.DownloadAttachment(a, dir, func(done, total int64) {
+			fmt.Printf("\rDecrypting... %s of %s", core.FormatSize(done), core.FormatSize(total))
+		})
+		fmt.Println()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println("Saved", path)
 
-		packet := EncryptedMessage{
-			FromID:      myID,
-			ToID:        toID,
-			EphemeralPK: base64.StdEncoding.EncodeToString(ephPub),
-			Nonce:       base64.StdEncoding.EncodeToString(nonce),
-			Ciphertext:  base64.StdEncoding.EncodeToString(ct),
+	case "status":
+		id := ""
+		if len(os.Args) > 2 {
+			if id, _, err = contacts.Resolve(os.Args[2]); err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+		}
+		sent, err := sessions.SentTo(id)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(sent) == 0 {
+			fmt.Println("No sent messages.")
+			return
+		}
+		for _, s := range sent {
+			fmt.Printf("%s  %s  %-16s %-9s  %s\n", core.ShortID(s.ID), time.UnixMilli(s.Sent).Format("Jan _2 15:04"), memberLabel(sessions, contacts, s.To), s.Status, s.Preview)
 		}
-		pjson, _ := json.Marshal(packet)
 
-		body, _ := json.Marshal(map[string]any{
-			"to_id":   toID,
-			"from_id": myID,
-			"packet":  base64.StdEncoding.EncodeToString(pjson),
-		})
-		http.Post("http://localhost:8080/send", "application/json", bytes.NewReader(body))
-		fmt.Println("Message sent.")
+	case "outbox":
+		if len(os.Args) > 2 {
+			if len(os.Args) < 4 || (os.Args[2] != "retry" && os.Args[2] != "drop") {
+				fmt.Println("client outbox [retry|drop <message>]")
+				return
+			}
+			if os.Args[2] == "drop" {
+				e, err := sessions.Drop(os.Args[3])
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					return
+				}
+				fmt.Printf("Message %s dropped from the outbox.\n", core.ShortID(e.ID))
+				return
+			}
+			if err := sessions.Retry(os.Args[3]); err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+		}
+		sent, err := sessions.Flush()
+		if err != nil && !errors.Is(err, core.ErrRelayUnavailable) {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		reportFlushed(sent)
+		out, err := sessions.Outbox()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(out) == 0 {
+			fmt.Println("The outbox is empty.")
+			return
+		}
+		for _, e := range out {
+			to := "-"
+			if e.Conv != "" {
+				to = conversationLabel(sessions, contacts, e.Conv)
+			}
+			fmt.Printf("%s  %s  %-16s %-6s  %d attempts  %s\n", core.ShortID(e.ID), time.Unix(e.Queued, 0).Format("Jan _2 15:04"), to, e.Status(), e.Attempts, e.Preview)
+			if e.Error != "" {
+				fmt.Println("    " + e.Error)
+			}
+		}
 
 	case "fetch":
-		url := fmt.Sprintf("http://localhost:8080/fetch?id=%s", myID)
-		resp, _ := http.Get(url)
-		defer resp.Body.Close()
-		data, _ := io.ReadAll(resp.Body)
-
-		var raw []struct {
-			Packet string `json:"packet"`
-			FromID string `json:"from_id"`
-		}
-		json.Unmarshal(data, &raw)
-
-		for _, r := range raw {
-			b, _ := base64.StdEncoding.DecodeString(r.Packet)
-			var m EncryptedMessage
-			json.Unmarshal(b, &m)
-
-			ephPub, _ := base64.StdEncoding.DecodeString(m.EphemeralPK)
-			shared, _ := curve25519.X25519(priv, ephPub)
-			aead, _ := chacha20poly1305.NewX(shared)
-			nonce, _ := base64.StdEncoding.DecodeString(m.Nonce)
-			ct, _ := base64.StdEncoding.DecodeString(m.Ciphertext)
-			plain, err := aead.Open(nil, nonce, ct, nil)
-			if err != nil {
-				fmt.Println("Failed to decrypt from", m.FromID[:8])
-				continue
+		if err := showMessages(myID, sessions, contacts); err != nil {
+			fmt.Println("ERROR:", err)
+		}
+
+	case "relay":
+		if len(os.Args) < 3 {
+			fmt.Println("client relay <contact> [<profile|url>|off]")
+			return
+		}
+		c, err := contacts.Lookup(os.Args[2])
+		if err == nil && c == nil {
+			err = fmt.Errorf("no contact %q", os.Args[2])
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(os.Args) < 4 {
+			if c.Relay == "" {
+				fmt.Printf("%s uses your relay, %s.\n", c.Label(), relayURL)
+			} else {
+				fmt.Printf("%s uses %s.\n", c.Label(), c.Relay)
+			}
+			return
+		}
+		url := ""
+		if os.Args[3] != "off" {
+			if url, err = config.ResolveRelay(os.Args[3]); err != nil {
+				fmt.Println("ERROR:", err)
+				return
 			}
-			fmt.Printf("[%s]: %s\n", m.FromID[:8], plain)
+		}
+		if err := contacts.SetRelay(c.ID, url); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if url == "" {
+			fmt.Printf("Messages to %s now go through your relay.\n", c.Label())
+		} else {
+			fmt.Printf("Messages to %s now go through %s.\n", c.Label(), url)
 		}
 
-	default:
-		fmt.Println("Unknown command")
-	}
+	case "add":
+		if len(os.Args) < 4 {
+			fmt.Println("client add <name> <id>")
+			return
+		}
+		name, id := os.Args[2], os.Args[3]
+		old, err := contacts.Add(name, id)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if old != nil {
+			warnKeyChanged(name, old.ID, id)
+			return
+		}
+		fmt.Printf("Added %s. Compare safety numbers with `client verify %s`.\n", name, name)
+
+	case "contacts":
+		list, err := contacts.List()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(list) == 0 {
+			fmt.Println("No contacts yet. Add one with `client add <name> <id>`.")
+			return
+		}
+		for _, c := range list {
+			status := "unverified"
+			switch {
+			case c.KeyChanged:
+				status = "KEY CHANGED"
+			case c.Verified:
+				status = "verified"
+			}
+			if c.Relay != "" {
+				status += "  via " + c.Relay
+			}
+			fmt.Printf("%-16s %s  %s\n", c.Label(), c.ID, status)
+		}
+
+	case "verify":
+		if len(os.Args) < 3 {
+			fmt.Println("client verify <contact|id> [safety number]")
+			return
+		}
+		id, c, err := contacts.Resolve(os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		label := core.ShortID(id)
+		if c != nil {
+			label = c.Label()
+		}
+		theirPub, _ := core.DecodeID(id)
+		number := sessions.SafetyNumberWith(theirPub)
+
+		if len(os.Args) > 3 {
+			// Compare against a number read out or scanned from their device.
+			if core.NormalizeSafetyNumber(strings.Join(os.Args[3:], "")) != number {
+				fmt.Println("ERROR: Safety numbers do NOT match. Do not trust", label+"'s key.")
+				return
+			}
+		} else {
+			fmt.Printf("Safety number with %s:\n\n%s\n\n", label, core.FormatSafetyNumber(number))
+			if qr, err := core.SafetyQR(number); err == nil {
+				fmt.Println(qr.ToSmallString(false))
+			}
+			if !confirm("Compare it with the number on their device. Do they match?") {
+				fmt.Println(label, "was not marked as verified.")
+				return
+			}
+		}
+		if err := contacts.SetVerified(id, true); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println(label, "is now verified.")
+
+	case "backup":
+		if len(os.Args) > 2 {
+			if err := writeBackupFile(os.Args[2], priv); err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			fmt.Println("Encrypted backup written to", os.Args[2]+". Restore it with `client restore", os.Args[2]+"`.")
+			return
+		}
+		mnemonic, err := identityMnemonic(priv)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Println("Your recovery phrase. Anyone who sees it can read your messages and")
+		fmt.Println("pose as you; write it down and keep it offline.")
+		fmt.Println()
+		for i, w := range strings.Fields(mnemonic) {
+			fmt.Printf("%2d. %-10s", i+1, w)
+			if i%4 == 3 {
+				fmt.Println()
+			}
+		}
+		fmt.Println()
+		fmt.Println("Restore it with `client restore`.")
+
+	case "passwd":
+		passphrase, err := newPassphrase(core.NewPassphraseEnvVar)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if err := core.SaveIdentityKey(keysDir, priv, passphrase); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(passphrase) == 0 {
+			fmt.Println("Passphrase removed. Your identity key is no longer protected.")
+			return
+		}
+		fmt.Println("Passphrase changed.")
+
+	case "rotate":
+		if !sessions.IsPrimary() {
+			fmt.Println("ERROR:", core.ErrNotPrimary)
+			return
+		}
+		if l, err := sessions.LoadDeviceList(); err == nil && len(l.Devices) > 0 {
+			fmt.Println("Your linked devices will have to be linked again after rotating.")
+		}
+		if out, err := sessions.Outbox(); err == nil && len(out) > 0 {
+			fmt.Println("WARNING: messages in the outbox have not reached the relay yet; they are lost if you rotate now.")
+		}
+		fmt.Println("This replaces your identity key with a new one. Your contacts move to")
+		fmt.Println("it automatically and stay verified; sessions start over.")
+		if !confirm("Rotate your identity key?") {
+			fmt.Println("Rotation cancelled.")
+			return
+		}
+		next, err := core.NewIdentity()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		statement, err := core.NewRotationStatement(priv, pub, next.Priv, next.Pub)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if err := core.StageIdentity(keysDir, next, passphrase); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if err := sessions.Relay.PublishRotation(sessions.Context(), statement); err != nil {
+			os.RemoveAll(core.RotationDir(keysDir))
+			fmt.Println("ERROR:", err)
+			return
+		}
+		// Contacts stop writing to the old ID once the statement is out;
+		// read what they sent before, while the old key can still do it.
+		if err := showMessages(myID, sessions, contacts); err != nil {
+			fmt.Println("WARNING: messages to your old ID were not fetched:", err)
+		}
+		sessions.Close()
+		if err := core.RotateKeysDir(keysDir, priv, next.Priv); err != nil {
+			fmt.Println("ERROR:", err)
+			fmt.Println("The rotation was published but not completed. Your new key is in")
+			fmt.Println(core.RotationDir(keysDir)+"; put that folder in place of", keysDir, "to use it.")
+			return
+		}
+		fmt.Println("Your new HEMSAEUCC ID:", next.ID())
+		fmt.Println("Back up the new key with `client backup`; backups of the old one are now useless.")
+
+		sessions, err := openStore(next, keysDir, relayURL)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if _, err := sessions.PublishPreKeys(); err != nil {
+			fmt.Println("WARNING: prekeys not published, run `client prekeys` later:", err)
+		}
+
+	case "link":
+		link(sessions, contacts)
+
+	case "devices":
+		if len(os.Args) < 3 {
+			listDevices(sessions)
+			return
+		}
+		switch os.Args[2] {
+		case "add":
+			if len(os.Args) < 4 {
+				fmt.Println("client devices add <link code> [name]")
+				return
+			}
+			name := ""
+			if len(os.Args) > 4 {
+				name = os.Args[4]
+			}
+			pub, _, err := core.ParseLinkCode(os.Args[3])
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			fmt.Println("The new device will read all messages sent to you from now on.")
+			if !confirm("Link device " + core.ShortID(hex.EncodeToString(pub)) + "?") {
+				fmt.Println("Device not linked.")
+				return
+			}
+			list, err := contacts.List()
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			packet, err := sessions.LinkDevice(os.Args[3], name, list)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			reportSend(sessions.Send("", nil, []core.EncryptedMessage{packet}), "Device linked.")
+		case "remove":
+			if len(os.Args) < 4 {
+				fmt.Println("client devices remove <name|id>")
+				return
+			}
+			l, err := sessions.LoadDeviceList()
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			i := l.Find(os.Args[3])
+			if i < 0 {
+				fmt.Println("ERROR: no linked device", os.Args[3])
+				return
+			}
+			removed := l.Devices[i]
+			l.Devices = append(l.Devices[:i], l.Devices[i+1:]...)
+			if err := sessions.PublishDeviceList(l); err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			sessions.Session(removed.ID()).Reset()
+			fmt.Println("Device", core.ShortID(removed.ID()), "removed. It no longer receives your messages.")
+		default:
+			fmt.Println("client devices [add <link code> [name] | remove <name|id>]")
+		}
+
+	case "groups":
+		groups, err := sessions.ListGroups()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(groups) == 0 {
+			fmt.Println("No groups yet. Create one with `client group create <name> <contact>...`.")
+			return
+		}
+		for _, g := range groups {
+			status := fmt.Sprintf("%d members", len(g.Members))
+			switch {
+			case g.Left:
+				status = "left"
+			case g.Admin == sessions.AccountID():
+				status += ", admin"
+			}
+			fmt.Printf("%-16s %s  %s\n", g.Label(), g.ID, status)
+		}
+
+	case "group":
+		if len(os.Args) < 4 {
+			fmt.Println("client group create <name> <contact>...")
+			fmt.Println("client group add|remove <group> <contact>...")
+			fmt.Println("client group send <group> <message>")
+			fmt.Println("client group info <group>")
+			return
+		}
+		sub, arg := os.Args[2], os.Args[3]
+		var members []string
+		if sub != "send" {
+			for _, s := range os.Args[4:] {
+				id, _, err := contacts.Resolve(s)
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					return
+				}
+				members = append(members, id)
+			}
+		}
+
+		var g *core.GroupState
+		var packets []core.EncryptedMessage
+		var msg *core.Message
+		if sub == "create" {
+			g, packets, err = sessions.CreateGroup(arg, members)
+		} else if g, err = sessions.FindGroup(arg); err == nil {
+			switch sub {
+			case "add":
+				packets, err = sessions.SetMembers(g, append(slices.Clone(g.Members), members...))
+			case "remove":
+				packets, err = sessions.SetMembers(g, slices.DeleteFunc(slices.Clone(g.Members), func(id string) bool {
+					return slices.Contains(members, id)
+				}))
+			case "send":
+				if len(os.Args) < 5 {
+					fmt.Println("client group send <group> <message>")
+					return
+				}
+				if msg, err = core.NewMessage([]byte(os.Args[4])); err == nil {
+					packets, err = sessions.SealGroupMessage(g, msg)
+				}
+			case "info":
+				fmt.Printf("Group %s (%s), epoch %d\n", g.Label(), g.ID, g.Epoch)
+				for _, id := range g.Members {
+					role := ""
+					if id == g.Admin {
+						role = "  admin"
+					}
+					fmt.Printf("  %-16s %s%s\n", memberLabel(sessions, contacts, id), id, role)
+				}
+				return
+			default:
+				fmt.Println("Unknown group command")
+				return
+			}
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		done := fmt.Sprintf("Group %s now has %d members. Everyone's keys have been replaced.", g.Label(), len(g.Members))
+		switch sub {
+		case "create":
+			done = fmt.Sprintf("Group %s created with %d members.", g.Label(), len(g.Members))
+		case "send":
+			done = fmt.Sprintf("Message %s sent.", core.ShortID(msg.IDString()))
+		}
+		if !reportSend(sessions.Send("group:"+g.ID, msg, packets), done) {
+			return
+		}
+		if sub == "send" {
+			record(sessions, "group:"+g.ID, msg)
+		}
+
+	case "timer":
+		if len(os.Args) < 3 {
+			fmt.Println("client timer <contact|group> [duration|off]")
+			return
+		}
+		conv, label, g, err := conversationOf(sessions, contacts, os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(os.Args) < 4 {
+			d, err := sessions.Timer(conv)
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			fmt.Printf("Disappearing messages for %s: %s\n", label, core.FormatTimer(d))
+			return
+		}
+		d, err := core.ParseTimer(os.Args[3])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if g == nil {
+			if conv, err = recipient(sessions, contacts, conv); err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+		}
+		if err := sessions.SetTimer(conv, d); err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		// An empty message tells the other side.
+		var packets []core.EncryptedMessage
+		if g != nil {
+			packets, err = sessions.SealGroup(g, nil)
+		} else {
+			packets, err = sessions.SealAll(conv, nil)
+		}
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		done := fmt.Sprintf("Disappearing messages for %s set to %s.", label, core.FormatTimer(d))
+		if d == 0 {
+			done = fmt.Sprintf("Disappearing messages for %s turned off.", label)
+		}
+		reportSend(sessions.Send(conv, nil, packets), done)
+
+	case "history":
+		h, err := sessions.History()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(os.Args) < 3 {
+			convs, err := h.Conversations()
+			if err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+			if len(convs) == 0 {
+				fmt.Println("No conversations.")
+				return
+			}
+			for _, c := range convs {
+				fmt.Printf("%s  %s\n", time.UnixMilli(c.Updated).Format("Jan _2 15:04"), conversationLabel(sessions, contacts, c.ID))
+			}
+			return
+		}
+		conv, _, _, err := conversationOf(sessions, contacts, os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		limit := 20
+		if len(os.Args) > 3 {
+			if limit, err = strconv.Atoi(os.Args[3]); err != nil || limit < 1 {
+				fmt.Println("ERROR: invalid number of messages", os.Args[3])
+				return
+			}
+		}
+		list, err := h.Messages(conv, limit)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		byID := make(map[string]*core.HistoryMessage)
+		for _, m := range list {
+			byID[m.ID] = m
+		}
+		for _, m := range list {
+			fmt.Println(time.UnixMilli(m.Sent).Format("Jan _2 15:04"), historyLine(sessions, contacts, m, byID))
+		}
+
+	case "search":
+		if len(os.Args) < 3 {
+			fmt.Println("client search [--in <contact|group>] [--since <date>] [--until <date>] <words>")
+			return
+		}
+		q, err := parseSearchArgs(sessions, contacts, os.Args[2:])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		h, err := sessions.History()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		results, err := h.Search(q)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		if len(results) == 0 {
+			fmt.Println("No messages found.")
+			return
+		}
+		for _, r := range results {
+			fmt.Printf("%s  %s  %s\n", time.UnixMilli(r.Message.Sent).Format("Jan _2 2006 15:04"),
+				conversationLabel(sessions, contacts, r.Conv), historyLine(sessions, contacts, r.Message, nil))
+		}
+
+	case "prekeys":
+		status, err := sessions.PublishPreKeys()
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		fmt.Printf("%d one-time prekeys published on the relay.\n", status.Remaining)
+
+	case "reset":
+		if len(os.Args) < 3 {
+			fmt.Println("client reset <id>")
+			return
+		}
+		id, _, err := contacts.Resolve(os.Args[2])
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		devices, err := sessions.DevicesOf(id)
+		if err != nil {
+			devices = []string{id}
+		}
+		for _, dev := range devices {
+			if err := sessions.Session(dev).Reset(); err != nil {
+				fmt.Println("ERROR:", err)
+				return
+			}
+		}
+		fmt.Println("Session reset. The next message will start a new one.")
+
+	default:
+		fmt.Println("Unknown command")
+	}
+}
+
+// showMessages fetches the packets waiting for myID and prints them.
+func showMessages(myID string, sessions *core.Store, contacts *core.ContactStore) error {
+	msgs, header, err := sessions.Relay.FetchPackets(sessions.Context(), myID)
+	if err != nil {
+		return err
+	}
+	if status, ok := core.PreKeyStatusFromHeader(header); ok && status.Low {
+		fmt.Printf("WARNING: only %d one-time prekeys left on the relay. Run `client prekeys` to replenish them.\n", status.Remaining)
+	}
+
+	// Delivery receipts are sent once, for everything fetched.
+	acks := make(map[string][]string)
+	for _, m := range msgs {
+		if m.Version == core.GroupVersion {
+			g, sender, msg, err := sessions.OpenGroup(m)
+			if err != nil {
+				fmt.Println("Failed to decrypt group message from", core.ShortID(m.FromID)+":", err)
+				continue
+			}
+			from := memberLabel(sessions, contacts, sender)
+			if showTimer(sessions, "group:"+g.ID, from, "in "+g.Label(), msg) {
+				showContent(sessions, "group:"+g.ID, sender, g.Label()+"/"+from, msg)
+			}
+			continue
+		}
+		msg, err := sessions.Open(m)
+		if errors.Is(err, core.ErrReplay) {
+			fmt.Println("Dropped message from", core.ShortID(m.FromID)+":", err)
+			continue
+		}
+		if errors.Is(err, core.ErrSenderUnverified) {
+			fmt.Println("Rejected message claiming to be from", core.ShortID(m.FromID)+": sender verification failed")
+			continue
+		}
+		if errors.Is(err, core.ErrNoSession) {
+			fmt.Println("Failed to decrypt from", core.ShortID(m.FromID)+": no session, ask them to run `client reset` for you")
+			continue
+		}
+		if err != nil {
+			fmt.Println("Failed to decrypt from", core.ShortID(m.FromID))
+			continue
+		}
+		if msg.Provision != nil {
+			fmt.Println("Ignored a device link from", core.ShortID(m.FromID)+"; run `client link` on a new device to accept one.")
+			continue
+		}
+		sender, err := sessions.SenderOf(m, msg)
+		if err != nil {
+			fmt.Println("Rejected message from device", core.ShortID(m.FromID)+":", err)
+			continue
+		}
+		if msg.Group != nil {
+			g, packets, err := sessions.HandleGroupControl(sender, m.FromID, msg)
+			if err != nil {
+				fmt.Println("Ignored group update from", core.ShortID(sender)+":", err)
+				continue
+			}
+			if err := sessions.Send("group:"+g.ID, nil, packets); err != nil && !errors.Is(err, core.ErrQueued) {
+				fmt.Println("ERROR:", err)
+			}
+			if g.Left {
+				fmt.Printf("You are no longer a member of group %s.\n", g.Label())
+			} else if packets != nil {
+				fmt.Printf("Group %s now has %d members.\n", g.Label(), len(g.Members))
+			}
+			continue
+		}
+		if msg.Receipt != nil {
+			changed, err := sessions.HandleReceipt(sender, msg)
+			if err != nil {
+				fmt.Println("Ignored receipt from", core.ShortID(sender)+":", err)
+				continue
+			}
+			for _, s := range changed {
+				verb := "Delivered to"
+				if s.Status == core.StatusRead {
+					verb = "Read by"
+				}
+				fmt.Printf("%s %s: %s\n", verb, memberLabel(sessions, contacts, sender), s.Preview)
+			}
+			continue
+		}
+		if msg.SyncTo != nil {
+			to := core.ShortID(hex.EncodeToString(msg.SyncTo))
+			if c, _ := contacts.Lookup(hex.EncodeToString(msg.SyncTo)); c != nil {
+				to = c.Label()
+			}
+			if showTimer(sessions, hex.EncodeToString(msg.SyncTo), "You", "with "+to, msg) {
+				showContent(sessions, hex.EncodeToString(msg.SyncTo), sessions.AccountID(), "You -> "+to, msg)
+			}
+			continue
+		}
+		from := core.ShortID(sender)
+		c, _ := contacts.Lookup(sender)
+		if c == nil {
+			if c, err = core.FollowRotationTo(sessions, contacts, sender); err != nil {
+				fmt.Println("WARNING:", err)
+			} else if c != nil {
+				fmt.Printf("%s moved to a new key, %s, signed by their old one.\n", c.Label(), core.ShortID(c.ID))
+			}
+		}
+		if c != nil {
+			from = c.Label()
+			if c.KeyChanged {
+				from += " (KEY CHANGED)"
+			}
+		}
+		if showTimer(sessions, sender, from, "", msg) && showContent(sessions, sender, sender, from, msg) && core.WantsReceipt(msg) {
+			acks[sender] = append(acks[sender], msg.IDString())
+		}
+	}
+
+	for id, ids := range acks {
+		packets, err := sessions.ReceiptPackets(id, core.ReceiptDelivered, ids)
+		if err != nil {
+			fmt.Println("WARNING: no delivery receipt sent to", core.ShortID(id)+":", err)
+			continue
+		}
+		if err := sessions.Send(id, nil, packets); err != nil && !errors.Is(err, core.ErrQueued) {
+			fmt.Println("WARNING: no delivery receipt sent to", core.ShortID(id)+":", err)
+		}
+	}
+	return nil
+}
+
+// showContent prints msg, sent by from in conv, on a line starting with
+// who, and adds it to the history. Replies, edits and reactions are shown
+// against the message they refer to. It reports whether msg was a message
+// of its own.
+func showContent(sessions *core.Store, conv, from, who string, msg *core.Message) bool {
+	if msg.Kind == core.KindTyping {
+		return false
+	}
+	h, err := sessions.History()
+	var target *core.HistoryMessage
+	if err == nil {
+		target, _, err = h.ApplyContent(conv, from, core.MessageSummary(msg), msg)
+	}
+	what := "a message"
+	if target != nil {
+		what = strconv.Quote(core.Truncate(target.Text, core.SentPreviewSize))
+	}
+	if msg.IsText() {
+		if err != nil {
+			fmt.Println("WARNING: not saved to the history:", err)
+		}
+		text := messageText(sessions, msg)
+		if msg.Ref != nil {
+			text = "(reply to " + what + ") " + text
+		}
+		fmt.Printf("[%s %s]: %s\n", who, core.ShortID(msg.IDString()), text)
+		return true
+	}
+	if err != nil {
+		fmt.Printf("Ignored a change from %s: %v\n", who, err)
+		return false
+	}
+	switch msg.Kind {
+	case core.KindEdit:
+		fmt.Printf("[%s] edited %s: %s\n", who, what, msg.Body)
+	case core.KindDelete:
+		fmt.Printf("[%s] deleted %s.\n", who, what)
+	case core.KindReaction:
+		if len(msg.Body) == 0 {
+			fmt.Printf("[%s] took back their reaction to %s.\n", who, what)
+		} else {
+			fmt.Printf("[%s] reacted %s to %s.\n", who, msg.Body, what)
+		}
+	}
+	return false
+}
+
+// record adds msg, which we sent to conv, to the history.
+func record(sessions *core.Store, conv string, msg *core.Message) {
+	h, err := sessions.History()
+	if err == nil {
+		_, _, err = h.ApplyContent(conv, sessions.AccountID(), core.MessageSummary(msg), msg)
+	}
+	if err != nil {
+		fmt.Println("WARNING: not saved to the history:", err)
+	}
+}
+
+// historyLine returns the line shown for m by `client history`. byID
+// holds the messages shown with it, for quotes.
+func historyLine(sessions *core.Store, contacts *core.ContactStore, m *core.HistoryMessage, byID map[string]*core.HistoryMessage) string {
+	if m.ID == "" {
+		return m.Text
+	}
+	line := "[" + memberLabel(sessions, contacts, m.From) + " " + core.ShortID(m.ID) + "]: "
+	if m.Deleted {
+		return line + "This message was deleted."
+	}
+	if m.ReplyTo != "" {
+		what := "a message"
+		if r := byID[m.ReplyTo]; r != nil && !r.Deleted {
+			what = strconv.Quote(core.Truncate(r.Text, core.SentPreviewSize))
+		}
+		line += "(reply to " + what + ") "
+	}
+	line += m.Text
+	if m.Edited {
+		line += " (edited)"
+	}
+	if len(m.Reactions) > 0 {
+		reactions := slices.Sorted(maps.Values(m.Reactions))
+		line += "  " + strings.Join(reactions, " ")
+	}
+	return line
+}
+
+// parseSearchArgs reads the arguments of `client search`.
+func parseSearchArgs(sessions *core.Store, contacts *core.ContactStore, args []string) (core.SearchQuery, error) {
+	var q core.SearchQuery
+	var words []string
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if !strings.HasPrefix(flag, "--") {
+			words = append(words, flag)
+			continue
+		}
+		if i+1 == len(args) {
+			return q, fmt.Errorf("%s needs a value", flag)
+		}
+		i++
+		var err error
+		switch flag {
+		case "--in":
+			q.Conv, _, _, err = conversationOf(sessions, contacts, args[i])
+		case "--since":
+			q.Since, err = core.ParseSearchDate(args[i], false)
+		case "--until":
+			q.Until, err = core.ParseSearchDate(args[i], true)
+		default:
+			err = fmt.Errorf("unknown option %s", flag)
+		}
+		if err != nil {
+			return q, err
+		}
+	}
+	if len(words) == 0 {
+		return q, errors.New("nothing to search for")
+	}
+	q.Text = strings.Join(words, " ")
+	return q, nil
+}
+
+// conversationOf resolves a contact or group to its conversation, with a
+// label for it. g is set for groups.
+func conversationOf(sessions *core.Store, contacts *core.ContactStore, s string) (conv, label string, g *core.GroupState, err error) {
+	conv, c, err := contacts.Resolve(s)
+	if err == nil {
+		label = core.ShortID(conv)
+		if c != nil {
+			label = c.Label()
+		}
+		return conv, label, nil, nil
+	}
+	if g, err = sessions.FindGroup(s); err != nil {
+		return "", "", nil, fmt.Errorf("no contact or group %s", s)
+	}
+	return "group:" + g.ID, g.Label(), g, nil
+}
+
+// conversationLabel names the conversation conv.
+func conversationLabel(sessions *core.Store, contacts *core.ContactStore, conv string) string {
+	if id, ok := strings.CutPrefix(conv, "group:"); ok {
+		if g, err := sessions.LoadGroup(id); err == nil {
+			return "group " + g.Label()
+		}
+		return "group " + core.ShortID(id)
+	}
+	return memberLabel(sessions, contacts, conv)
+}
+
+// sendContent sends msg to conv: a contact's identity, or "group:" and a
+// group ID.
+func sendContent(sessions *core.Store, conv string, msg *core.Message) error {
+	var packets []core.EncryptedMessage
+	if id, ok := strings.CutPrefix(conv, "group:"); ok {
+		g, err := sessions.LoadGroup(id)
+		if err != nil {
+			return err
+		}
+		if packets, err = sessions.SealGroupMessage(g, msg); err != nil {
+			return err
+		}
+	} else if msg.IsText() {
+		return deliver(sessions, conv, msg)
+	} else {
+		var err error
+		if packets, err = sessions.SealMessage(conv, msg); err != nil {
+			return err
+		}
+	}
+	return sessions.Send(conv, msg, packets)
+}
+
+// deliver seals msg for the identity toID and sends it through the
+// outbox, tracking its status from queued to relayed.
+func deliver(sessions *core.Store, toID string, msg *core.Message) error {
+	packets, err := sessions.SealMessage(toID, msg)
+	if err != nil {
+		return err
+	}
+	if err := sessions.TrackSent(toID, msg); err != nil {
+		return err
+	}
+	return sessions.Send(toID, msg, packets)
+}
+
+// reportSend tells the user what became of packets handed to the outbox:
+// done if the relay took them, or that they wait in the outbox if it could
+// not be reached. It prints any other error and returns false.
+func reportSend(err error, done string) bool {
+	switch {
+	case err == nil:
+		fmt.Println(done)
+	case errors.Is(err, core.ErrQueued):
+		fmt.Println("WARNING:", err)
+		fmt.Println("It is sent with your next command; `client outbox` shows what is waiting.")
+	default:
+		fmt.Println("ERROR:", err)
+		return false
+	}
+	return true
+}
+
+// flushOutbox sends what earlier commands left in the outbox, trying the
+// relay only once so that commands that do not need it are not held up.
+func flushOutbox(sessions *core.Store) {
+	attempts := sessions.Relay.Attempts
+	sessions.Relay.Attempts = 1
+	sent, err := sessions.Flush()
+	sessions.Relay.Attempts = attempts
+	if err != nil && !errors.Is(err, core.ErrRelayUnavailable) {
+		fmt.Println("WARNING:", err)
+	}
+	reportFlushed(sent)
+}
+
+// reportFlushed tells how many queued entries the outbox just sent.
+func reportFlushed(sent []*core.OutboxEntry) {
+	if n := len(sent); n == 1 {
+		fmt.Println("Sent 1 queued message from the outbox.")
+	} else if n > 1 {
+		fmt.Printf("Sent %d queued messages from the outbox.\n", n)
+	}
+}
+
+// showTimer takes the disappearing message timer carried by msg for the
+// conversation conv and tells when who changed it. It reports whether msg
+// has anything left to show: a message that has already disappeared, or
+// only carried the timer, has not.
+func showTimer(sessions *core.Store, conv, who, where string, msg *core.Message) bool {
+	if changed, err := sessions.ApplyTimer(conv, msg); err != nil {
+		fmt.Println("WARNING:", err)
+	} else if changed {
+		fmt.Println(strings.TrimSpace(fmt.Sprintf("%s set disappearing messages %s", who, where)), "to", core.FormatTimer(msg.Timer)+".")
+	}
+	if msg.Expired(time.Now()) {
+		return false
+	}
+	return len(msg.Body) > 0 || msg.Attachment != nil || !msg.IsText()
+}
+
+// messageText returns the text shown for msg. An attachment is kept for
+// `client download` and described after the body.
+func messageText(sessions *core.Store, msg *core.Message) string {
+	if msg.Attachment == nil {
+		return string(msg.Body)
+	}
+	text := string(msg.Body)
+	if text != "" {
+		text += " "
+	}
+	a, err := core.ParseAttachment(msg.Attachment)
+	if err != nil {
+		return text + "[" + err.Error() + "]"
+	}
+	if d := core.PacketExpiry(msg); d != 0 {
+		a.Expires = min(a.Expires, d)
+	}
+	if err := sessions.SaveAttachment(a); err != nil {
+		return text + "[attachment lost: " + err.Error() + "]"
+	}
+	return fmt.Sprintf("%s[file %s, %s, %s: client download %s]", text, a.Name, core.FormatSize(a.Size), core.ExpiresIn(a.Expires), core.ShortID(a.Blob))
+}
+
+// recipient resolves a contact name or ID to send to, following a key
+// rotation and warning about unknown contacts and changed keys.
+func recipient(sessions *core.Store, contacts *core.ContactStore, s string) (string, error) {
+	toID, c, err := contacts.Resolve(s)
+	if err != nil {
+		return "", err
+	}
+	newID, moved, err := core.FollowRotation(sessions, contacts, toID)
+	if err != nil {
+		return "", err
+	}
+	if newID != toID {
+		if moved != nil {
+			c = moved
+			fmt.Printf("%s moved to a new key, %s, signed by their old one.\n", c.Label(), core.ShortID(newID))
+		} else {
+			fmt.Println(core.ShortID(toID), "moved to a new key,", core.ShortID(newID)+", signed by their old one.")
+		}
+		toID = newID
+	}
+	if c == nil {
+		fmt.Println("Note:", core.ShortID(toID), "is not in your contacts. Add it with `client add <name> <id>`.")
+	} else if c.KeyChanged {
+		warnKeyChanged(c.Label(), c.PreviousID, c.ID)
+	}
+	return toID, nil
+}
+
+// link shows this device's link code and waits for the primary device to
+// answer it.
+func link(sessions *core.Store, contacts *core.ContactStore) {
+	if !sessions.IsPrimary() {
+		fmt.Println("This device is already linked to", sessions.AccountID())
+		return
+	}
+	if !sessions.LinkPending() {
+		fmt.Println("ERROR: this folder already holds an identity. Link a new device from an empty folder.")
+		return
+	}
+	code, err := sessions.StartLink()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	fmt.Println("On your primary device, run:")
+	fmt.Println()
+	fmt.Println("  client devices add", code)
+	fmt.Println()
+	if qr, err := qrcode.New(code, qrcode.Medium); err == nil {
+		fmt.Println(qr.ToSmallString(false))
+	}
+	fmt.Println("Waiting for the link...")
+
+	myID := sessions.DeviceID()
+	for deadline := time.Now().Add(linkTimeout); time.Now().Before(deadline); time.Sleep(2 * time.Second) {
+		msgs, _, err := sessions.Relay.FetchPackets(sessions.Context(), myID)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		for _, m := range msgs {
+			msg, err := sessions.Open(m)
+			if err != nil || msg.Provision == nil {
+				continue
+			}
+			identity, err := sessions.CompleteLink(m, msg, contacts)
+			if err != nil {
+				fmt.Println("Ignored a device link:", err)
+				continue
+			}
+			fmt.Println("Linked. Your HEMSAEUCC ID:", identity)
+			return
+		}
+	}
+	fmt.Println("Not linked yet. Run `client link` again to keep waiting.")
+}
+
+// listDevices prints the devices of our identity.
+func listDevices(sessions *core.Store) {
+	l, err := sessions.Relay.FetchDeviceList(sessions.Context(), sessions.AccountID())
+	if err == nil && l != nil {
+		err = l.Verify(sessions.AccountID())
+	}
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	this := sessions.DeviceID()
+	mark := func(id string) string {
+		if id == this {
+			return "  (this device)"
+		}
+		return ""
+	}
+	fmt.Printf("%-16s %s%s\n", "primary", sessions.AccountID(), mark(sessions.AccountID()))
+	if l == nil {
+		return
+	}
+	for _, d := range l.Devices {
+		name := d.Name
+		if name == "" {
+			name = "linked"
+		}
+		fmt.Printf("%-16s %s%s\n", name, d.ID(), mark(d.ID()))
+	}
+}
+
+// memberLabel names the identity id for display.
+func memberLabel(sessions *core.Store, contacts *core.ContactStore, id string) string {
+	if id == sessions.AccountID() {
+		return "You"
+	}
+	if c, _ := contacts.Lookup(id); c != nil {
+		return c.Label()
+	}
+	return core.ShortID(id)
+}
+
+// warnKeyChanged prints the warning shown whenever a verified contact's
+// key has changed.
+func warnKeyChanged(name, oldID, newID string) {
+	fmt.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+	fmt.Printf("WARNING: the key of verified contact %s has changed!\n", name)
+	fmt.Println("  old:", oldID)
+	fmt.Println("  new:", newID)
+	fmt.Println("Someone else may be using their name. Compare safety numbers with")
+	fmt.Printf("`client verify %s` before sending anything sensitive.\n", name)
+	fmt.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+}
+
+// readPassphrase returns the passphrase from the environment variable
+// envVar, or asks for it on the terminal.
+func readPassphrase(prompt, envVar string) ([]byte, error) {
+	if p, ok := os.LookupEnv(envVar); ok {
+		return []byte(p), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("a passphrase is needed; set %s when not running in a terminal", envVar)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	p, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return p, err
+}
+
+// newPassphrase asks for a new passphrase twice, unless envVar supplies
+// it. An empty passphrase leaves the identity key unprotected.
+func newPassphrase(envVar string) ([]byte, error) {
+	if p, ok := os.LookupEnv(envVar); ok {
+		return []byte(p), nil
+	}
+	p, err := readPassphrase("New passphrase (empty for none): ", envVar)
+	if err != nil {
+		return nil, err
+	}
+	again, err := readPassphrase("Repeat passphrase: ", envVar)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p, again) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return p, nil
+}
+
+// stdin reads answers typed on standard input.
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirm asks a yes/no question on standard input.
+func confirm(question string) bool {
+	fmt.Print(question, " [y/N] ")
+	answer, _ := stdin.ReadString('\n')
+	a := strings.ToLower(strings.TrimSpace(answer))
+	return a == "y" || a == "yes"
 }
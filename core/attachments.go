@@ -0,0 +1,455 @@
+package core
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Attachments are encrypted with the STREAM construction: the file is cut
+// into chunks of attachmentChunkSize, and chunk i is sealed with a fresh
+// random key and the nonce
+//
+//	uint64be(i) || 0x000000 || last
+//
+// where last is 1 for the final chunk only, so chunks cannot be reordered,
+// dropped or the stream cut short without detection. The ciphertext is
+// uploaded to the relay's blob store, and the message carries the blob ID,
+// the key and a digest of the ciphertext.
+const (
+	attachmentChunkSize = 64 << 10
+	// maxAttachmentSize caps the size of a file sent as an attachment.
+	maxAttachmentSize = 64 << 20
+
+	blobIDSize = 16
+
+	blobUploadLabel = "HEMSAEUCC blob upload"
+
+	DownloadsDir = "downloads"
+)
+
+var errAttachmentCorrupt = errors.New("attachment does not match its digest")
+
+// ErrUnknownRelay is returned for an attachment on a relay that is neither
+// ours, a contact's, nor one of the KnownRelays of the Store. The sender
+// picks that URL, and downloading from it tells its owner our address.
+var ErrUnknownRelay = errors.New("attachment is on a relay you do not use")
+
+// Attachment is carried in the attachment field of a payload.
+type Attachment struct {
+	Blob string `json:"blob"`
+	Key  []byte `json:"key"`
+	Name string `json:"name"`
+	// Size is that of the file; Digest is the SHA-256 of the uploaded
+	// ciphertext.
+	Size    int64  `json:"size"`
+	Digest  []byte `json:"digest"`
+	Expires int64  `json:"expires"`
+	// Relay is the URL of the relay the blob was uploaded to.
+	Relay string `json:"relay,omitempty"`
+}
+
+// blobRequest asks the relay to start the upload of a blob of Size bytes,
+// counted against the quota of Owner, who signs it.
+type blobRequest struct {
+	Owner string `json:"owner"`
+	Size  int64  `json:"size"`
+	TS    int64  `json:"ts"`
+	Sig   []byte `json:"sig"`
+}
+
+// signedMessage returns the bytes covered by the request signature.
+func (r *blobRequest) signedMessage() []byte {
+	owner, _ := hex.DecodeString(r.Owner)
+	b := append([]byte(blobUploadLabel), 0)
+	b = append(b, owner...)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.TS))
+	return binary.BigEndian.AppendUint64(b, uint64(r.Size))
+}
+
+// blobInfo is the relay's description of a blob.
+type blobInfo struct {
+	ID      string `json:"id"`
+	Size    int64  `json:"size"`
+	Chunks  uint32 `json:"chunks"`
+	Stored  int64  `json:"stored"`
+	Expires int64  `json:"expires"`
+}
+
+// pendingUpload is kept in keys/uploads while a file is being uploaded, so
+// an interrupted upload resumes with the same key and blob.
+type pendingUpload struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+	Blob    string `json:"blob"`
+	Key     []byte `json:"key"`
+}
+
+// streamChunks returns the number of chunks of a file of size bytes. An
+// empty file still has its final chunk.
+func streamChunks(size int64) uint32 {
+	return uint32(max(1, (size+attachmentChunkSize-1)/attachmentChunkSize))
+}
+
+// streamNonce returns the nonce of chunk i.
+func streamNonce(i uint32, last bool) []byte {
+	nonce := binary.BigEndian.AppendUint64(make([]byte, 0, chacha20poly1305.NonceSize), uint64(i))
+	nonce = append(nonce, 0, 0, 0)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (st *Store) uploadPath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(filepath.Dir(st.dir), "uploads", hex.EncodeToString(sum[:16])+".bin")
+}
+
+// UploadAttachment encrypts the file at path and uploads it to the relay.
+// An upload of the same, unchanged file that was interrupted is resumed.
+// progress, if not nil, is called after every chunk.
+func (st *Store) UploadAttachment(path string, progress func(done, total int64)) (*Attachment, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a file", filepath.Base(path))
+	}
+	if fi.Size() > maxAttachmentSize {
+		return nil, fmt.Errorf("%s is larger than %s", filepath.Base(path), FormatSize(maxAttachmentSize))
+	}
+	chunks := streamChunks(fi.Size())
+	ctSize := fi.Size() + int64(chunks)*chacha20poly1305.Overhead
+
+	statePath := st.uploadPath(path)
+	var up pendingUpload
+	var info *blobInfo
+	err = readSealedFile(statePath, st.key, "upload", &up)
+	if err == nil && up.Path == path && up.Size == fi.Size() && up.ModTime == fi.ModTime().UnixNano() {
+		info, err = st.Relay.fetchBlobInfo(st.ctx, up.Blob)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if info == nil {
+		key := make([]byte, chacha20poly1305.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		req := &blobRequest{Owner: hex.EncodeToString(st.pub), Size: ctSize, TS: time.Now().UnixNano()}
+		if req.Sig, err = xeddsaSign(st.priv, req.signedMessage()); err != nil {
+			return nil, fmt.Errorf("failed to sign upload: %w", err)
+		}
+		if info, err = st.Relay.createBlob(st.ctx, req); err != nil {
+			return nil, err
+		}
+		up = pendingUpload{Path: path, Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Blob: info.ID, Key: key}
+		if err := writeSealedFile(statePath, st.key, "upload", &up); err != nil {
+			return nil, fmt.Errorf("failed to save upload: %w", err)
+		}
+	}
+
+	aead, err := chacha20poly1305.New(up.Key)
+	if err != nil {
+		return nil, err
+	}
+	// Chunks already on the relay are encrypted again, which gives the
+	// same bytes, to compute the digest.
+	digest := sha256.New()
+	buf := make([]byte, attachmentChunkSize)
+	var done int64
+	for i := range chunks {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		ct := aead.Seal(nil, streamNonce(i, i == chunks-1), buf[:n], nil)
+		digest.Write(ct)
+		if i >= info.Chunks {
+			if err := st.Relay.uploadChunk(st.ctx, info.ID, i, ct); err != nil {
+				return nil, fmt.Errorf("%w (%d of %d chunks stored, send again to resume)", err, i, chunks)
+			}
+		}
+		done += int64(n)
+		if progress != nil {
+			progress(done, fi.Size())
+		}
+	}
+	os.Remove(statePath)
+
+	return &Attachment{
+		Blob:    info.ID,
+		Key:     up.Key,
+		Name:    filepath.Base(path),
+		Size:    fi.Size(),
+		Digest:  digest.Sum(nil),
+		Expires: info.Expires,
+		Relay:   st.Relay.url,
+	}, nil
+}
+
+// ParseAttachment decodes and checks the attachment field of a payload.
+func ParseAttachment(b []byte) (*Attachment, error) {
+	var a Attachment
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("malformed attachment")
+	}
+	blob, err := hex.DecodeString(a.Blob)
+	if err != nil || len(blob) != blobIDSize || hex.EncodeToString(blob) != a.Blob {
+		return nil, fmt.Errorf("malformed attachment")
+	}
+	name := filepath.Base(a.Name)
+	if len(a.Key) != chacha20poly1305.KeySize || len(a.Digest) != sha256.Size || a.Size < 0 || a.Size > maxAttachmentSize ||
+		name != a.Name || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return nil, fmt.Errorf("malformed attachment")
+	}
+	if a.Relay != "" {
+		if a.Relay, err = ParseRelayURL(a.Relay); err != nil {
+			return nil, fmt.Errorf("malformed attachment")
+		}
+	}
+	return &a, nil
+}
+
+func (st *Store) attachmentPath(blob string) string {
+	return filepath.Join(filepath.Dir(st.dir), "attachments", blob+".bin")
+}
+
+// SaveAttachment keeps a received attachment until it is downloaded.
+func (st *Store) SaveAttachment(a *Attachment) error {
+	if err := writeSealedFile(st.attachmentPath(a.Blob), st.key, "attachment:"+a.Blob, a); err != nil {
+		return fmt.Errorf("failed to save attachment: %w", err)
+	}
+	return nil
+}
+
+// ListAttachments returns the received attachments not yet downloaded.
+func (st *Store) ListAttachments() ([]*Attachment, error) {
+	entries, err := os.ReadDir(filepath.Dir(st.attachmentPath("")))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var list []*Attachment
+	for _, e := range entries {
+		blob, ok := strings.CutSuffix(e.Name(), ".bin")
+		if !ok {
+			continue
+		}
+		var a Attachment
+		if err := readSealedFile(st.attachmentPath(blob), st.key, "attachment:"+blob, &a); err != nil {
+			return nil, err
+		}
+		list = append(list, &a)
+	}
+	return list, nil
+}
+
+// FindAttachment returns the received attachment whose blob ID starts
+// with prefix.
+func (st *Store) FindAttachment(prefix string) (*Attachment, error) {
+	list, err := st.ListAttachments()
+	if err != nil {
+		return nil, err
+	}
+	var found *Attachment
+	for _, a := range list {
+		if !strings.HasPrefix(a.Blob, prefix) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%q matches more than one attachment", prefix)
+		}
+		found = a
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no attachment %q", prefix)
+	}
+	return found, nil
+}
+
+// KnownRelay reports whether attachments are downloaded from the relay at
+// url without asking: it is ours, a contact's or one of KnownRelays.
+func (st *Store) KnownRelay(url string) bool {
+	if url == "" || url == st.Relay.url || slices.Contains(st.KnownRelays, url) {
+		return true
+	}
+	list, err := st.Contacts().List()
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(list, func(c Contact) bool { return c.Relay == url })
+}
+
+// DownloadAttachment downloads a from the relay it was uploaded to,
+// verifies and decrypts it into dir, under its name or a numbered variant
+// of it if that is taken, and returns the path written. It fails with
+// ErrUnknownRelay unless KnownRelay accepts that relay; a client that asks
+// the user first adds it to KnownRelays and tries again.
+func (st *Store) DownloadAttachment(a *Attachment, dir string, progress func(done, total int64)) (string, error) {
+	if !st.KnownRelay(a.Relay) {
+		return "", fmt.Errorf("%w: %s", ErrUnknownRelay, a.Relay)
+	}
+	relay := st.relayAt(a.Relay)
+	info, err := relay.fetchBlobInfo(st.ctx, a.Blob)
+	if err != nil {
+		return "", err
+	}
+	if info == nil || info.Stored != info.Size {
+		return "", fmt.Errorf("%s is no longer on the relay", a.Name)
+	}
+	chunks := streamChunks(a.Size)
+	if info.Size != a.Size+int64(chunks)*chacha20poly1305.Overhead {
+		return "", errAttachmentCorrupt
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// The whole ciphertext is checked against the digest before any of
+	// it is decrypted.
+	digest := sha256.New()
+	for n := range info.Chunks {
+		ct, err := relay.fetchChunk(st.ctx, a.Blob, n)
+		if err != nil {
+			return "", err
+		}
+		digest.Write(ct)
+		if _, err := tmp.Write(ct); err != nil {
+			return "", err
+		}
+	}
+	if !bytes.Equal(digest.Sum(nil), a.Digest) {
+		return "", errAttachmentCorrupt
+	}
+
+	out, path, err := createUnique(dir, a.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := decryptStream(a, tmp, out, chunks, progress); err != nil {
+		out.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	os.Remove(st.attachmentPath(a.Blob))
+	return path, nil
+}
+
+// decryptStream decrypts the chunks of a from the start of r into w.
+func decryptStream(a *Attachment, r io.ReadSeeker, w io.Writer, chunks uint32, progress func(done, total int64)) error {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.New(a.Key)
+	if err != nil {
+		return err
+	}
+	var done int64
+	buf := make([]byte, attachmentChunkSize+aead.Overhead())
+	for i := range chunks {
+		size := min(a.Size-int64(i)*attachmentChunkSize, attachmentChunkSize)
+		ct := buf[:size+int64(aead.Overhead())]
+		if _, err := io.ReadFull(r, ct); err != nil {
+			return err
+		}
+		plain, err := openChunk(aead, i, i == chunks-1, ct)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		done += int64(len(plain))
+		if progress != nil {
+			progress(done, a.Size)
+		}
+	}
+	return nil
+}
+
+func openChunk(aead cipher.AEAD, i uint32, last bool, ct []byte) ([]byte, error) {
+	plain, err := aead.Open(ct[:0], streamNonce(i, last), ct, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt chunk %d", i)
+	}
+	return plain, nil
+}
+
+// createUnique creates name in dir, or "name (2)" and so on if it exists.
+func createUnique(dir, name string) (*os.File, string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		path := filepath.Join(dir, name)
+		if i > 1 {
+			path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		return f, path, err
+	}
+}
+
+// FormatSize returns n bytes in a human readable form.
+func FormatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// ExpiresIn describes how long until the Unix time t.
+func ExpiresIn(t int64) string {
+	d := time.Until(time.Unix(t, 0))
+	if d <= 0 {
+		return "expired"
+	}
+	if d >= 48*time.Hour {
+		return fmt.Sprintf("expires in %d days", int((d+12*time.Hour)/(24*time.Hour)))
+	}
+	if d < 2*time.Hour {
+		return "expires within 2 hours"
+	}
+	return fmt.Sprintf("expires in %d hours", int(d.Hours()))
+}
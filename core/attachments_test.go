@@ -0,0 +1,56 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestDownloadUnknownRelay checks that attachments are only downloaded
+// from relays the user knows, not from any the sender names.
+func TestDownloadUnknownRelay(t *testing.T) {
+	relay := newFakeRelay(t)
+	st := newTestStore(t, relay.URL)
+	contact := newTestStore(t, relay.URL)
+	if _, err := st.Contacts().Add("carol", contact.DeviceID()); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Contacts().SetRelay(contact.DeviceID(), "https://carol.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	st.KnownRelays = []string{"https://work.example.com"}
+
+	tests := []struct {
+		name  string
+		relay string
+		known bool
+	}{
+		{"unnamed", "", true},
+		{"ours", relay.URL, true},
+		{"contact's", "https://carol.example.org", true},
+		{"profile", "https://work.example.com", true},
+		{"profile with trailing slash", "https://work.example.com/", true},
+		{"unknown https", "https://attacker.example.net", false},
+		{"unknown http", "http://169.254.169.254", false},
+		{"internal host", "http://localhost:6379", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := `{"blob":"` + strings.Repeat("ab", blobIDSize) + `","key":"` + strings.Repeat("A", 43) + `=","name":"f.txt","size":1,` +
+				`"digest":"` + strings.Repeat("A", 43) + `=","relay":"` + tt.relay + `"}`
+			a, err := ParseAttachment([]byte(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := st.KnownRelay(a.Relay); got != tt.known {
+				t.Errorf("KnownRelay(%q) = %v, want %v", a.Relay, got, tt.known)
+			}
+			if tt.known {
+				return
+			}
+			if _, err := st.DownloadAttachment(a, t.TempDir(), nil); !errors.Is(err, ErrUnknownRelay) {
+				t.Errorf("DownloadAttachment = %v, want ErrUnknownRelay", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// configFile is looked for next to the keys directory, then as
+	// hemsaeucc/config.json in the user's config directory, which is
+	// $XDG_CONFIG_HOME or ~/.config on Linux. The latter is shared by the
+	// profiles that have no config of their own.
+	configFile = "hemsaeucc.json"
+
+	// RelayEnvVar picks the relay, by profile name or URL, over the
+	// config file.
+	RelayEnvVar = "HEMSAEUCC_RELAY"
+)
+
+// Config is the client configuration, a JSON file the user may edit:
+//
+//	{
+//		"relay": "work",
+//		"relays": {
+//			"work": "https://relay.example.com",
+//			"local": "http://localhost:8080"
+//		}
+//	}
+type Config struct {
+	// Relay is the relay used by default, a profile name or a URL.
+	Relay string `json:"relay,omitempty"`
+	// Relays maps profile names to relay URLs.
+	Relays map[string]string `json:"relays,omitempty"`
+
+	path string
+}
+
+// ConfigPaths returns where the config of the keys in keysDir is looked
+// for, in order.
+func ConfigPaths(keysDir string) []string {
+	paths := []string{filepath.Join(filepath.Dir(filepath.Clean(keysDir)), configFile)}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "hemsaeucc", "config.json"))
+	}
+	return paths
+}
+
+// LoadConfig reads the first config file of ConfigPaths that exists, or
+// returns an empty config if there is none. Save always writes the first,
+// so a change made for one profile does not reach the others.
+func LoadConfig(keysDir string) (*Config, error) {
+	paths := ConfigPaths(keysDir)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		c := &Config{path: paths[0]}
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", path, err)
+		}
+		return c, nil
+	}
+	return &Config{path: paths[0]}, nil
+}
+
+// Path returns the file the config is saved to.
+func (c *Config) Path() string {
+	return c.path
+}
+
+// Save writes the config back to its file.
+func (c *Config) Save() error {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	if err := os.WriteFile(c.path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+// Profiles returns the names of the relay profiles, sorted.
+func (c *Config) Profiles() []string {
+	return slices.Sorted(maps.Keys(c.Relays))
+}
+
+// RelayURLs returns the URLs of the relay profiles that are valid.
+func (c *Config) RelayURLs() []string {
+	var urls []string
+	for _, name := range c.Profiles() {
+		if u, err := ParseRelayURL(c.Relays[name]); err == nil {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// ResolveRelay returns the URL of the relay s names: a profile, or a URL
+// of its own.
+func (c *Config) ResolveRelay(s string) (string, error) {
+	if u, ok := c.Relays[s]; ok {
+		return ParseRelayURL(u)
+	}
+	if !strings.Contains(s, "://") {
+		return "", fmt.Errorf("no relay profile %q", s)
+	}
+	return ParseRelayURL(s)
+}
+
+// RelayURL returns the URL of the relay to use: flag if it is set, else
+// the one named by $HEMSAEUCC_RELAY, the config, or DefaultRelayURL.
+func (c *Config) RelayURL(flag string) (string, error) {
+	for _, s := range []string{flag, os.Getenv(RelayEnvVar), c.Relay} {
+		if s != "" {
+			return c.ResolveRelay(s)
+		}
+	}
+	return DefaultRelayURL, nil
+}
+
+// ParseRelayURL checks that s is the http or https URL of a relay, and
+// returns it without a trailing slash.
+func ParseRelayURL(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid relay URL %q", s)
+	}
+	return strings.TrimRight(s, "/"), nil
+}
@@ -0,0 +1,281 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errUnknownContact is returned when a name matches no contact and is not
+// an ID either.
+var errUnknownContact = errors.New("unknown contact")
+
+// Contact is an entry in the address book.
+type Contact struct {
+	Name string `json:"name,omitempty"`
+	ID   string `json:"id"`
+	// Verified is set once the safety number has been compared out of
+	// band.
+	Verified bool `json:"verified,omitempty"`
+	// KeyChanged is set when the ID of a verified contact changes, and
+	// stays set until they are verified again.
+	KeyChanged bool   `json:"key_changed,omitempty"`
+	PreviousID string `json:"previous_id,omitempty"`
+	Added      int64  `json:"added"`
+	// Relay is the URL of the relay the contact uses, if not ours.
+	Relay string `json:"relay,omitempty"`
+}
+
+// Label returns the name of c, or its short ID if it has none.
+func (c *Contact) Label() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return ShortID(c.ID)
+}
+
+// ContactStore keeps the address book in keys/contacts.bin.
+type ContactStore struct {
+	path string
+	key  []byte
+	mu   sync.Mutex
+}
+
+func openContactStore(keysDir string, key []byte) *ContactStore {
+	return &ContactStore{path: filepath.Join(keysDir, "contacts.bin"), key: key}
+}
+
+// Contacts returns the contact list kept with st.
+func (st *Store) Contacts() *ContactStore {
+	return openContactStore(filepath.Dir(st.dir), st.key)
+}
+
+func (cs *ContactStore) load() ([]Contact, error) {
+	var list []Contact
+	err := readSealedFile(cs.path, cs.key, "contacts", &list)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load contacts: %w", err)
+	}
+	return list, nil
+}
+
+func (cs *ContactStore) save(list []Contact) error {
+	if err := writeSealedFile(cs.path, cs.key, "contacts", list); err != nil {
+		return fmt.Errorf("failed to save contacts: %w", err)
+	}
+	return nil
+}
+
+// List returns all contacts in the order they were added.
+func (cs *ContactStore) List() ([]Contact, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.load()
+}
+
+// Lookup returns the contact named or identified by s, or nil if there is
+// none.
+func (cs *ContactStore) Lookup(s string) (*Contact, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list, err := cs.load()
+	if err != nil {
+		return nil, err
+	}
+	if i := findContact(list, s); i >= 0 {
+		return &list[i], nil
+	}
+	return nil, nil
+}
+
+// findContact returns the index of the contact named or identified by s.
+func findContact(list []Contact, s string) int {
+	for i, c := range list {
+		if c.Name != "" && c.Name == s {
+			return i
+		}
+	}
+	s = strings.ToLower(s)
+	for i, c := range list {
+		if c.ID == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// Resolve returns the ID of the contact named s, or s itself if it is a
+// valid ID.
+func (cs *ContactStore) Resolve(s string) (string, *Contact, error) {
+	c, err := cs.Lookup(s)
+	if err != nil {
+		return "", nil, err
+	}
+	if c != nil {
+		return c.ID, c, nil
+	}
+	pub, err := DecodeID(s)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w %q", errUnknownContact, s)
+	}
+	return hex.EncodeToString(pub), nil, nil
+}
+
+// Add stores a contact under name, which may be empty. If a contact with
+// that name or ID exists it is updated; if this changes the ID of a
+// verified contact the previous entry is returned so that the caller can
+// warn about it.
+func (cs *ContactStore) Add(name, id string) (changed *Contact, err error) {
+	pub, err := DecodeID(id)
+	if err != nil {
+		return nil, err
+	}
+	id = hex.EncodeToString(pub)
+	if name != "" {
+		if _, err := hex.DecodeString(name); err == nil && len(name) == len(id) {
+			return nil, fmt.Errorf("a contact name cannot be an ID")
+		}
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list, err := cs.load()
+	if err != nil {
+		return nil, err
+	}
+	i := -1
+	if name != "" {
+		i = findContact(list, name)
+	}
+	if i < 0 {
+		i = findContact(list, id)
+	}
+	if i < 0 {
+		list = append(list, Contact{Name: name, ID: id, Added: time.Now().Unix()})
+		return nil, cs.save(list)
+	}
+
+	c := &list[i]
+	if name != "" {
+		c.Name = name
+	}
+	if c.ID != id {
+		old := *c
+		c.PreviousID, c.ID = c.ID, id
+		if c.Verified || c.KeyChanged {
+			c.Verified, c.KeyChanged = false, true
+			changed = &old
+		}
+	}
+	return changed, cs.save(list)
+}
+
+// SetVerified marks the contact with id as verified, or not. Verifying a
+// contact clears a key change warning.
+func (cs *ContactStore) SetVerified(id string, verified bool) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list, err := cs.load()
+	if err != nil {
+		return err
+	}
+	i := findContact(list, id)
+	if i < 0 {
+		list = append(list, Contact{ID: id, Added: time.Now().Unix()})
+		i = len(list) - 1
+	}
+	list[i].Verified = verified
+	if verified {
+		list[i].KeyChanged = false
+		list[i].PreviousID = ""
+	}
+	return cs.save(list)
+}
+
+// SetRelay sets the URL of the relay the contact with id is reached on,
+// or clears it if url is empty.
+func (cs *ContactStore) SetRelay(id, url string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list, err := cs.load()
+	if err != nil {
+		return err
+	}
+	i := findContact(list, id)
+	if i < 0 {
+		list = append(list, Contact{ID: id, Added: time.Now().Unix()})
+		i = len(list) - 1
+	}
+	list[i].Relay = url
+	return cs.save(list)
+}
+
+// migrate moves the contact with oldID to newID after a verified rotation
+// statement, keeping its name and verification. An entry already made for
+// newID is merged into it. It returns the moved contact, or nil if oldID
+// is not a contact.
+func (cs *ContactStore) migrate(oldID, newID string) (*Contact, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list, err := cs.load()
+	if err != nil {
+		return nil, err
+	}
+	i := findContact(list, oldID)
+	if i < 0 {
+		return nil, nil
+	}
+	c := list[i]
+	c.ID, c.PreviousID = newID, oldID
+	if j := findContact(list, newID); j >= 0 {
+		if c.Name == "" {
+			c.Name = list[j].Name
+		}
+		list = append(list[:j], list[j+1:]...)
+		if j < i {
+			i--
+		}
+	}
+	list[i] = c
+	return &c, cs.save(list)
+}
+
+// merge adds the contacts of another device of ours. Entries we already
+// have keep their name, and become verified if the other device verified
+// them.
+func (cs *ContactStore) merge(other []Contact) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	list, err := cs.load()
+	if err != nil {
+		return err
+	}
+	for _, c := range other {
+		if _, err := DecodeID(c.ID); err != nil {
+			continue
+		}
+		i := findContact(list, c.ID)
+		if i < 0 {
+			list = append(list, c)
+			continue
+		}
+		if list[i].Name == "" {
+			list[i].Name = c.Name
+		}
+		if list[i].Relay == "" {
+			list[i].Relay = c.Relay
+		}
+		if c.Verified && list[i].ID == c.ID {
+			list[i].Verified, list[i].KeyChanged = true, false
+		}
+	}
+	return cs.save(list)
+}
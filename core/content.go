@@ -0,0 +1,195 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Message kinds, carried in the kind field of a payload. A payload without
+// one is a text message, or a reply to the message in ref. The other kinds
+// act on the earlier message ref of the same conversation. A client that
+// does not know a kind shows its body, if any, as text, so new kinds should
+// carry a readable fallback there.
+const (
+	KindText = iota
+	// KindEdit replaces the text of ref, one of the sender's messages,
+	// with the body.
+	KindEdit
+	// KindDelete deletes ref, one of the sender's messages, for everyone.
+	KindDelete
+	// KindReaction puts the emoji in the body on ref, replacing the
+	// sender's earlier reaction; an empty body takes it back.
+	KindReaction
+	// KindTyping tells that the sender is typing. It has no body, and
+	// lasts typingTimeout unless renewed, or until their next message.
+	KindTyping
+
+	// maxKind is the last kind this client understands.
+	maxKind = KindTyping
+)
+
+const (
+	// typingTimeout is how long a typing indicator lasts unless it is
+	// renewed. The relay drops typing packets older than that.
+	typingTimeout = 10 * time.Second
+	// MaxReactionSize bounds the emoji of a reaction.
+	MaxReactionSize = 32
+)
+
+// NewContent returns a message of kind acting on the message ref.
+func NewContent(kind uint64, ref string, body []byte) (*Message, error) {
+	msg, err := NewMessage(body)
+	if err != nil {
+		return nil, err
+	}
+	msg.Kind = kind
+	if ref != "" {
+		if msg.Ref, err = hex.DecodeString(ref); err != nil || len(msg.Ref) != messageIDSize {
+			return nil, fmt.Errorf("invalid message ID %q", ref)
+		}
+	}
+	return msg, nil
+}
+
+// RefString returns the ID of the message msg refers to in hex, or "".
+func (m *Message) RefString() string {
+	if m.Ref == nil {
+		return ""
+	}
+	return hex.EncodeToString(m.Ref)
+}
+
+// known reports whether this client understands the kind of msg. Others
+// are shown as text messages.
+func (m *Message) known() bool {
+	return m.Kind <= maxKind
+}
+
+// IsText reports whether msg is shown as a message of its own rather than
+// acting on another one.
+func (m *Message) IsText() bool {
+	return m.Kind == KindText || !m.known()
+}
+
+// Empty reports whether msg is a message of its own with nothing to show,
+// as those only changing the timer are.
+func (m *Message) Empty() bool {
+	return m.IsText() && len(m.Body) == 0 && m.Attachment == nil
+}
+
+// ephemeral reports whether msg only matters right now: it carries no
+// timer and is not copied to our other devices.
+func (m *Message) ephemeral() bool {
+	return m.Receipt != nil || m.Kind == KindTyping
+}
+
+// checkContent validates the kind and ref of a parsed payload.
+func checkContent(m *Message) error {
+	if m.Ref != nil && len(m.Ref) != messageIDSize {
+		return errMalformedPayload
+	}
+	switch m.Kind {
+	case KindEdit, KindDelete, KindReaction:
+		if m.Ref == nil {
+			return errMalformedPayload
+		}
+	}
+	if m.Kind == KindReaction && (len(m.Body) > MaxReactionSize || !utf8.Valid(m.Body)) {
+		return errMalformedPayload
+	}
+	return nil
+}
+
+// MessageSummary returns the text of msg, with the name of its
+// attachment, if any, in front.
+func MessageSummary(msg *Message) string {
+	text := string(msg.Body)
+	if msg.Attachment != nil {
+		if a, err := ParseAttachment(msg.Attachment); err == nil {
+			text = strings.TrimSpace("[file " + a.Name + "] " + text)
+		}
+	}
+	return text
+}
+
+// messagePreview returns the start of what msg shows, to name it next to
+// a status.
+func messagePreview(msg *Message) string {
+	return Truncate(MessageSummary(msg), SentPreviewSize)
+}
+
+// Truncate shortens s to at most n bytes, on a rune boundary, marking the
+// cut.
+func Truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	s = s[:n]
+	for !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s + "..."
+}
+
+// ApplyContent applies msg, sent by from in conv, to the history. A
+// message of its own is added with text. The other kinds change the
+// message they refer to, which for edits and deletions must be one of the
+// sender's. It returns the message referred to as it was before, or nil
+// if it is not in the history, and whether the history changed.
+func (h *HistoryStore) ApplyContent(conv, from, text string, msg *Message) (*HistoryMessage, bool, error) {
+	var target *HistoryMessage
+	if msg.Ref != nil {
+		t, err := h.find(conv, msg.RefString())
+		if err != nil {
+			return nil, false, err
+		}
+		if t != nil && !t.Deleted {
+			before := *t
+			target = &before
+		}
+	}
+	if msg.Kind == KindTyping || msg.Empty() {
+		return target, false, nil
+	}
+	if msg.IsText() {
+		return target, true, h.Add(conv, &HistoryMessage{
+			ID:      msg.IDString(),
+			From:    from,
+			Text:    text,
+			Sent:    msg.Sent.UnixMilli(),
+			Expires: PacketExpiry(msg),
+			ReplyTo: msg.RefString(),
+		})
+	}
+	if target == nil {
+		return nil, false, nil
+	}
+	t := *target
+	switch msg.Kind {
+	case KindEdit, KindDelete:
+		if t.From != from {
+			return nil, false, errors.New("only the sender of a message can change it")
+		}
+		if msg.Kind == KindEdit {
+			t.Text, t.Edited = text, true
+		} else {
+			t.Text, t.Deleted, t.ReplyTo, t.Reactions = "", true, "", nil
+		}
+	case KindReaction:
+		t.Reactions = maps.Clone(t.Reactions)
+		if t.Reactions == nil {
+			t.Reactions = make(map[string]string)
+		}
+		if len(msg.Body) == 0 {
+			delete(t.Reactions, from)
+		} else {
+			t.Reactions[from] = string(msg.Body)
+		}
+	}
+	return target, true, h.Update(conv, &t)
+}
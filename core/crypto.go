@@ -0,0 +1,184 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// EncryptedMessage represents the data structure for an encrypted message packet.
+type EncryptedMessage struct {
+	Version     int    `json:"v"`
+	FromID      string `json:"from_id"`
+	ToID        string `json:"to_id"`
+	EphemeralPK string `json:"ephemeral_pk,omitempty"`
+	Nonce       string `json:"nonce,omitempty"`
+	Ciphertext  string `json:"ciphertext"`
+
+	// Double Ratchet header, for version 3 packets.
+	RatchetPK string `json:"ratchet_pk,omitempty"`
+	PN        uint32 `json:"pn,omitempty"`
+	N         uint32 `json:"n,omitempty"`
+
+	// Prekeys used by the X3DH initiator, for version 3 prekey messages.
+	SignedPreKeyID  uint32 `json:"spk_id,omitempty"`
+	OneTimePreKeyID uint32 `json:"opk_id,omitempty"`
+	// ML-KEM-768 ciphertext, for version 4 prekey messages.
+	KEMCiphertext string `json:"kem_ct,omitempty"`
+
+	// Group, sender key epoch and signature, for version 5 group messages,
+	// whose chain position is in N.
+	GroupID   string `json:"group_id,omitempty"`
+	Epoch     uint32 `json:"epoch,omitempty"`
+	Signature string `json:"sig,omitempty"`
+
+	// Expires is the Unix time after which the relay drops the packet, for
+	// disappearing messages.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// sealedVersion is the version of packets sealed to the recipient's identity
+// key with the v2 key schedule. They are still accepted on receipt.
+const sealedVersion = 2
+
+// Labels separating the keys derived by the v2 key schedule.
+const (
+	protocolLabel   = "HEMSAEUCC"
+	messageKeyLabel = "HEMSAEUCC v2 message key"
+	senderKeyLabel  = "HEMSAEUCC v2 sender auth key"
+	senderAuthLabel = "HEMSAEUCC v2 sender auth"
+)
+
+// errUnsupportedVersion is returned for packets sealed with a key schedule
+// this client does not implement.
+var errUnsupportedVersion = errors.New("unsupported packet version")
+
+// ErrSenderUnverified is returned by openMessage when a packet decrypts but
+// was not written by the holder of the key named in its FromID.
+var ErrSenderUnverified = errors.New("sender verification failed")
+
+// deriveKey expands an X25519 shared secret into a 32-byte key with
+// HKDF-SHA256. The info string binds the label, the packet version and the
+// three public keys involved, so a key is never reused across roles, packets
+// or protocol versions.
+func deriveKey(shared []byte, label string, fromPub, toPub, ephPub []byte) ([]byte, error) {
+	info := make([]byte, 0, len(label)+1+3*curve25519.PointSize)
+	info = append(info, label...)
+	info = append(info, sealedVersion)
+	info = append(info, fromPub...)
+	info = append(info, toPub...)
+	info = append(info, ephPub...)
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// headerAD returns the associated data binding the packet header, so that a
+// packet cannot be re-addressed or have its ephemeral key swapped without
+// failing authentication.
+func headerAD(version int, fromPub, toPub, ephPub []byte) []byte {
+	ad := make([]byte, 0, len(protocolLabel)+1+3*curve25519.PointSize)
+	ad = append(ad, protocolLabel...)
+	ad = append(ad, byte(version))
+	ad = append(ad, fromPub...)
+	ad = append(ad, toPub...)
+	ad = append(ad, ephPub...)
+	return ad
+}
+
+// senderTag authenticates the sender of a packet. It is keyed from the
+// static-static X25519 secret, which only the sender and the recipient can
+// compute, and covers both identities, the ephemeral key and the message.
+func senderTag(senderKey, fromPub, toPub, ephPub, msg []byte) []byte {
+	mac := hmac.New(sha256.New, senderKey)
+	mac.Write([]byte(senderAuthLabel))
+	mac.Write(fromPub)
+	mac.Write(toPub)
+	mac.Write(ephPub)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// openMessage decrypts a version 2 packet m with the identity (priv, pub)
+// and checks that it was written by the holder of m.FromID. If the packet
+// decrypts but the sender tag does not match, the plaintext is returned
+// together with ErrSenderUnverified so that callers can flag or drop it.
+func openMessage(priv, pub []byte, m EncryptedMessage) ([]byte, error) {
+	if m.Version != sealedVersion {
+		return nil, fmt.Errorf("%w %d", errUnsupportedVersion, m.Version)
+	}
+	fromPub, err := hex.DecodeString(m.FromID)
+	if err != nil || len(fromPub) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid sender ID format")
+	}
+	toPub, err := hex.DecodeString(m.ToID)
+	if err != nil || len(toPub) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid recipient ID format")
+	}
+	ephPub, err := base64.StdEncoding.DecodeString(m.EphemeralPK)
+	if err != nil || len(ephPub) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid ephemeral key")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(m.Nonce)
+	if err != nil || len(nonce) != chacha20poly1305.NonceSizeX {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	ct, err := base64.StdEncoding.DecodeString(m.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+
+	// Derive the shared secret using our private key and the sender's ephemeral public key.
+	shared, err := curve25519.X25519(priv, ephPub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive shared secret: %w", err)
+	}
+	key, err := deriveKey(shared, messageKeyLabel, fromPub, toPub, ephPub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive message key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AEAD: %w", err)
+	}
+	inner, err := aead.Open(nil, nonce, ct, headerAD(m.Version, fromPub, toPub, ephPub))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	if len(inner) < sha256.Size {
+		return nil, ErrSenderUnverified
+	}
+	tag, msg := inner[:sha256.Size], inner[sha256.Size:]
+
+	staticShared, err := curve25519.X25519(priv, fromPub)
+	if err != nil {
+		return msg, ErrSenderUnverified
+	}
+	senderKey, err := deriveKey(staticShared, senderKeyLabel, fromPub, toPub, ephPub)
+	if err != nil {
+		return msg, ErrSenderUnverified
+	}
+	if !hmac.Equal(tag, senderTag(senderKey, fromPub, toPub, ephPub, msg)) {
+		return msg, ErrSenderUnverified
+	}
+	return msg, nil
+}
+
+// ShortID returns the abbreviated form of an ID used in listings.
+func ShortID(id string) string {
+	if len(id) < 8 {
+		return id
+	}
+	return id[:8]
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// protocolDoc is the specification holding the test vectors.
+const protocolDoc = "../docs/protocol.md"
+
+// docVectors reads the "### Vector N" blocks of the protocol document, each
+// a map from field name to its value. Hex values are decoded; plaintext is
+// a quoted string.
+func docVectors(t *testing.T) map[string]map[string][]byte {
+	t.Helper()
+	f, err := os.Open(protocolDoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	vectors := make(map[string]map[string][]byte)
+	var name string
+	var inBlock bool
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "### Vector "):
+			name = strings.TrimPrefix(line, "### ")
+			vectors[name] = make(map[string][]byte)
+		case name != "" && line == "```":
+			if inBlock {
+				name = ""
+			}
+			inBlock = !inBlock
+		case name != "" && inBlock:
+			key, value, ok := strings.Cut(line, " ")
+			if !ok {
+				t.Fatalf("%s: malformed line %q", name, line)
+			}
+			value = strings.TrimSpace(value)
+			var b []byte
+			if key == "plaintext" {
+				s, err := strconv.Unquote(value)
+				if err != nil {
+					t.Fatalf("%s: plaintext: %v", name, err)
+				}
+				b = []byte(s)
+			} else if b, err = hex.DecodeString(value); err != nil {
+				t.Fatalf("%s: %s: %v", name, key, err)
+			}
+			vectors[name][key] = b
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
+
+// TestProtocolVectors recomputes the v2 key schedule test vectors of the
+// protocol document from their inputs.
+func TestProtocolVectors(t *testing.T) {
+	vectors := docVectors(t)
+	if len(vectors) != 2 {
+		t.Fatalf("found %d test vectors in %s, want 2", len(vectors), protocolDoc)
+	}
+	for name, v := range vectors {
+		t.Run(name, func(t *testing.T) {
+			x25519 := func(scalar, point []byte) []byte {
+				out, err := curve25519.X25519(scalar, point)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return out
+			}
+			S := x25519(v["sender_secret"], curve25519.Basepoint)
+			R := x25519(v["recipient_secret"], curve25519.Basepoint)
+			E := x25519(v["ephemeral_secret"], curve25519.Basepoint)
+			dhES := x25519(v["ephemeral_secret"], R)
+			dhSS := x25519(v["sender_secret"], R)
+			messageKey, err := deriveKey(dhES, messageKeyLabel, S, R, E)
+			if err != nil {
+				t.Fatal(err)
+			}
+			authKey, err := deriveKey(dhSS, senderKeyLabel, S, R, E)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ad := headerAD(sealedVersion, S, R, E)
+			tag := senderTag(authKey, S, R, E, v["plaintext"])
+			aead, err := chacha20poly1305.NewX(messageKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ct := aead.Seal(nil, v["nonce"], append(append([]byte{}, tag...), v["plaintext"]...), ad)
+
+			for _, c := range []struct {
+				field string
+				got   []byte
+			}{
+				{"sender_public", S},
+				{"recipient_public", R},
+				{"ephemeral_public", E},
+				{"dh_es", dhES},
+				{"dh_ss", dhSS},
+				{"message_key", messageKey},
+				{"sender_auth_key", authKey},
+				{"associated_data", ad},
+				{"sender_tag", tag},
+				{"ciphertext", ct},
+			} {
+				if want := v[c.field]; hex.EncodeToString(c.got) != hex.EncodeToString(want) {
+					t.Errorf("%s = %x, document has %x", c.field, c.got, want)
+				}
+			}
+
+			m := EncryptedMessage{
+				Version:     sealedVersion,
+				FromID:      hex.EncodeToString(S),
+				ToID:        hex.EncodeToString(R),
+				EphemeralPK: base64.StdEncoding.EncodeToString(E),
+				Nonce:       base64.StdEncoding.EncodeToString(v["nonce"]),
+				Ciphertext:  base64.StdEncoding.EncodeToString(v["ciphertext"]),
+			}
+			got, err := openMessage(v["recipient_secret"], R, m)
+			if err != nil {
+				t.Fatalf("openMessage: %v", err)
+			}
+			if string(got) != string(v["plaintext"]) {
+				t.Errorf("openMessage = %q, want %q", got, v["plaintext"])
+			}
+		})
+	}
+}
@@ -0,0 +1,440 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An identity may be used from several devices. The primary device holds
+// the identity key, which doubles as its device key. Every other device has
+// a key of its own, listed in a device list signed by the identity key and
+// published on the relay. Sessions and mailboxes are per device: a message
+// is encrypted once for each device of the recipient, and a copy goes to
+// the sender's other devices.
+const (
+	deviceListLabel = "HEMSAEUCC device list"
+
+	// linkedIdentityFile holds, on a linked device, the public key of the
+	// identity it belongs to.
+	linkedIdentityFile = "identity_public.bin"
+
+	// maxDevices caps the number of linked devices per identity.
+	maxDevices = 16
+	// deviceListTTL is how long a fetched device list is trusted before it
+	// is fetched again.
+	deviceListTTL = 5 * time.Minute
+
+	// linkCodePrefix starts the code a new device shows for linking.
+	linkCodePrefix = "HEMSAEUCC-LINK:"
+	linkNonceSize  = 8
+)
+
+var (
+	ErrNotPrimary     = errors.New("only the primary device can do this")
+	errUnlinkedDevice = errors.New("sending device is not linked to the identity it claims")
+	errNoPendingLink  = errors.New("no link in progress")
+)
+
+// Device is an entry in a device list.
+type Device struct {
+	Pub   []byte `json:"pub"`
+	Name  string `json:"name,omitempty"`
+	Added int64  `json:"added"`
+}
+
+// ID returns the hex ID of the device, which is also its mailbox.
+func (d Device) ID() string {
+	return hex.EncodeToString(d.Pub)
+}
+
+// DeviceList names the linked devices of an identity, signed by it.
+type DeviceList struct {
+	ID      string   `json:"id"`
+	Devices []Device `json:"devices"`
+	TS      int64    `json:"ts"`
+	Sig     []byte   `json:"sig"`
+}
+
+// signedMessage returns the bytes covered by the list signature.
+func (l *DeviceList) signedMessage() []byte {
+	id, _ := hex.DecodeString(l.ID)
+	b := append([]byte(deviceListLabel), 0)
+	b = append(b, id...)
+	b = binary.BigEndian.AppendUint64(b, uint64(l.TS))
+	for _, d := range l.Devices {
+		b = append(b, d.Pub...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(d.Name)))
+		b = append(b, d.Name...)
+		b = binary.BigEndian.AppendUint64(b, uint64(d.Added))
+	}
+	return b
+}
+
+// sign stamps l with the current time and signs it with the identity key.
+func (l *DeviceList) sign(priv []byte) error {
+	l.TS = max(time.Now().UnixMilli(), l.TS+1)
+	sig, err := xeddsaSign(priv, l.signedMessage())
+	if err != nil {
+		return err
+	}
+	l.Sig = sig
+	return nil
+}
+
+// Verify checks that l is a well-formed list signed by the identity id.
+func (l *DeviceList) Verify(id string) error {
+	pub, err := DecodeID(id)
+	if err != nil {
+		return err
+	}
+	if l.ID != id || len(l.Devices) > maxDevices {
+		return fmt.Errorf("device list for %s is malformed", ShortID(id))
+	}
+	for _, d := range l.Devices {
+		if len(d.Pub) != 32 || len(d.Name) > 64 {
+			return fmt.Errorf("device list for %s is malformed", ShortID(id))
+		}
+	}
+	if !xeddsaVerify(pub, l.signedMessage(), l.Sig) {
+		return fmt.Errorf("device list for %s has a bad signature", ShortID(id))
+	}
+	return nil
+}
+
+// Find returns the index of the device named or identified by s.
+func (l *DeviceList) Find(s string) int {
+	for i, d := range l.Devices {
+		if (d.Name != "" && d.Name == s) || d.ID() == strings.ToLower(s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// cachedDevices is a device list fetched from the relay.
+type cachedDevices struct {
+	ids     []string
+	fetched time.Time
+}
+
+// LinkedIdentity returns the identity the device pub in keysDir belongs to.
+func LinkedIdentity(keysDir string, pub []byte) []byte {
+	id, err := os.ReadFile(filepath.Join(keysDir, linkedIdentityFile))
+	if err != nil || len(id) != 32 {
+		return pub
+	}
+	return id
+}
+
+// IsPrimary reports whether this device holds the identity key.
+func (st *Store) IsPrimary() bool {
+	return bytes.Equal(st.account, st.pub)
+}
+
+// DeviceID returns the hex ID of this device.
+func (st *Store) DeviceID() string {
+	return hex.EncodeToString(st.pub)
+}
+
+// AccountID returns the hex ID of the identity this device belongs to.
+func (st *Store) AccountID() string {
+	return hex.EncodeToString(st.account)
+}
+
+// DevicesOf returns the device IDs of the identity id: the identity key
+// itself, then the devices on its verified list. While the relay cannot be
+// reached, it returns the identity key alone, so that a message can still
+// be sealed and queued.
+func (st *Store) DevicesOf(id string) ([]string, error) {
+	if c, ok := st.devices[id]; ok && time.Since(c.fetched) < deviceListTTL {
+		return c.ids, nil
+	}
+	l, err := st.relayFor(id).FetchDeviceList(st.ctx, id)
+	if errors.Is(err, ErrRelayUnavailable) {
+		return []string{id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{id}
+	if l != nil {
+		if err := l.Verify(id); err != nil {
+			return nil, err
+		}
+		for _, d := range l.Devices {
+			ids = append(ids, d.ID())
+		}
+	}
+	st.devices[id] = cachedDevices{ids: ids, fetched: time.Now()}
+	return ids, nil
+}
+
+// SealAll encrypts body for every device of the identity toID, and a copy
+// for each of our own other devices. It fails only if no device of the
+// recipient could be reached.
+func (st *Store) SealAll(toID string, body []byte) ([]EncryptedMessage, error) {
+	msg, err := NewMessage(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message: %w", err)
+	}
+	return st.SealMessage(toID, msg)
+}
+
+// SealMessage is SealAll for a message that carries more than a body.
+func (st *Store) SealMessage(toID string, msg *Message) ([]EncryptedMessage, error) {
+	toPub, err := DecodeID(toID)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsPrimary() {
+		msg.Identity = st.account
+	}
+	if !msg.TimerSet && !msg.ephemeral() {
+		if err := st.stampTimer(hex.EncodeToString(toPub), msg); err != nil {
+			return nil, err
+		}
+	}
+	targets, err := st.DevicesOf(hex.EncodeToString(toPub))
+	if err != nil {
+		return nil, err
+	}
+
+	var packets []EncryptedMessage
+	for i, dev := range targets {
+		p, err := st.seal(dev, msg)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			log.Printf("Not sent to device %s: %v\n", ShortID(dev), err)
+			continue
+		}
+		p.Expires = PacketExpiry(msg)
+		packets = append(packets, p)
+	}
+
+	if msg.ephemeral() {
+		// Our other devices have no use for our receipts or typing.
+		return packets, nil
+	}
+	own, err := st.DevicesOf(st.AccountID())
+	if err != nil {
+		log.Println("Not copied to your other devices:", err)
+		return packets, nil
+	}
+	sync := *msg
+	sync.SyncTo = toPub
+	for _, dev := range own {
+		if dev == hex.EncodeToString(st.pub) {
+			continue
+		}
+		p, err := st.seal(dev, &sync)
+		if err != nil {
+			log.Printf("Not copied to your device %s: %v\n", ShortID(dev), err)
+			continue
+		}
+		p.Expires = PacketExpiry(msg)
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// SenderOf returns the identity that sent msg from the device m.FromID. A
+// device claiming an identity must be on its device list; copies of our
+// own sent messages must come from our own identity.
+func (st *Store) SenderOf(m EncryptedMessage, msg *Message) (string, error) {
+	from := m.FromID
+	if msg.Identity != nil {
+		from = hex.EncodeToString(msg.Identity)
+		devices, err := st.DevicesOf(from)
+		if err != nil {
+			return "", err
+		}
+		if !slices.Contains(devices, m.FromID) {
+			return "", errUnlinkedDevice
+		}
+	}
+	if msg.SyncTo != nil && from != st.AccountID() {
+		return "", errUnlinkedDevice
+	}
+	return from, nil
+}
+
+// LoadDeviceList returns our signed device list, kept in keys/devices.bin
+// on the primary device.
+func (st *Store) LoadDeviceList() (*DeviceList, error) {
+	l := &DeviceList{ID: st.AccountID()}
+	err := readSealedFile(filepath.Join(filepath.Dir(st.dir), "devices.bin"), st.key, "devices", l)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load devices: %w", err)
+	}
+	return l, nil
+}
+
+// PublishDeviceList signs l, publishes it and saves it.
+func (st *Store) PublishDeviceList(l *DeviceList) error {
+	if !st.IsPrimary() {
+		return ErrNotPrimary
+	}
+	if err := l.sign(st.priv); err != nil {
+		return err
+	}
+	if err := st.Relay.uploadDeviceList(st.ctx, l); err != nil {
+		return err
+	}
+	delete(st.devices, l.ID)
+	if err := writeSealedFile(filepath.Join(filepath.Dir(st.dir), "devices.bin"), st.key, "devices", l); err != nil {
+		return fmt.Errorf("failed to save devices: %w", err)
+	}
+	return nil
+}
+
+// linkCode returns the code a new device shows for linking: its device
+// key and a nonce the provisioning message must echo.
+func linkCode(pub, nonce []byte) string {
+	return linkCodePrefix + hex.EncodeToString(pub) + ":" + hex.EncodeToString(nonce)
+}
+
+// ParseLinkCode reads a code made by linkCode.
+func ParseLinkCode(s string) (pub, nonce []byte, err error) {
+	key, n, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(s), linkCodePrefix), ":")
+	if !ok {
+		return nil, nil, fmt.Errorf("not a link code")
+	}
+	if pub, err = DecodeID(key); err != nil {
+		return nil, nil, fmt.Errorf("not a link code")
+	}
+	if nonce, err = hex.DecodeString(n); err != nil || len(nonce) != linkNonceSize {
+		return nil, nil, fmt.Errorf("not a link code")
+	}
+	return pub, nonce, nil
+}
+
+// provision is what the primary device sends a device it links: proof
+// that it is on the identity's device list, and the address book.
+type provision struct {
+	Identity string      `json:"identity"`
+	Nonce    []byte      `json:"nonce"`
+	Devices  *DeviceList `json:"devices"`
+	Contacts []Contact   `json:"contacts"`
+}
+
+// pendingLink is kept by a new device while it waits to be linked.
+type pendingLink struct {
+	Nonce []byte `json:"nonce"`
+}
+
+func (st *Store) pendingLinkPath() string {
+	return filepath.Join(filepath.Dir(st.dir), "link.bin")
+}
+
+// LinkPending reports whether this device is waiting to be linked.
+func (st *Store) LinkPending() bool {
+	_, err := os.Stat(st.pendingLinkPath())
+	return err == nil
+}
+
+// StartLink returns the link code of this device, creating the pending
+// link if there is none.
+func (st *Store) StartLink() (string, error) {
+	var p pendingLink
+	err := readSealedFile(st.pendingLinkPath(), st.key, "link", &p)
+	if errors.Is(err, os.ErrNotExist) {
+		p.Nonce = make([]byte, linkNonceSize)
+		if _, err := rand.Read(p.Nonce); err != nil {
+			return "", err
+		}
+		err = writeSealedFile(st.pendingLinkPath(), st.key, "link", &p)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to start link: %w", err)
+	}
+	return linkCode(st.pub, p.Nonce), nil
+}
+
+// LinkDevice adds the device that showed code to our device list as name,
+// and returns the provisioning packet to send it.
+func (st *Store) LinkDevice(code, name string, contacts []Contact) (EncryptedMessage, error) {
+	if !st.IsPrimary() {
+		return EncryptedMessage{}, ErrNotPrimary
+	}
+	pub, nonce, err := ParseLinkCode(code)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	if bytes.Equal(pub, st.pub) {
+		return EncryptedMessage{}, fmt.Errorf("this is the code of this device")
+	}
+	l, err := st.LoadDeviceList()
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	if i := l.Find(hex.EncodeToString(pub)); i < 0 {
+		if len(l.Devices) >= maxDevices {
+			return EncryptedMessage{}, fmt.Errorf("at most %d devices can be linked", maxDevices)
+		}
+		l.Devices = append(l.Devices, Device{Pub: pub, Name: name, Added: time.Now().Unix()})
+		if err := st.PublishDeviceList(l); err != nil {
+			return EncryptedMessage{}, err
+		}
+	}
+
+	data, err := json.Marshal(provision{Identity: st.AccountID(), Nonce: nonce, Devices: l, Contacts: contacts})
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	msg, err := NewMessage(nil)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+	msg.Provision = data
+	return st.seal(hex.EncodeToString(pub), msg)
+}
+
+// CompleteLink accepts a provisioning message received from m.FromID: if
+// it answers our pending link, this device joins the identity and its
+// address book is filled from the primary's. It returns the identity.
+func (st *Store) CompleteLink(m EncryptedMessage, msg *Message, contacts *ContactStore) (string, error) {
+	var pending pendingLink
+	if err := readSealedFile(st.pendingLinkPath(), st.key, "link", &pending); err != nil {
+		return "", errNoPendingLink
+	}
+	var p provision
+	if err := json.Unmarshal(msg.Provision, &p); err != nil || p.Devices == nil {
+		return "", fmt.Errorf("malformed device link")
+	}
+	if p.Identity != m.FromID || !bytes.Equal(p.Nonce, pending.Nonce) {
+		return "", fmt.Errorf("device link does not answer our link code")
+	}
+	if err := p.Devices.Verify(p.Identity); err != nil {
+		return "", err
+	}
+	if p.Devices.Find(hex.EncodeToString(st.pub)) < 0 {
+		return "", fmt.Errorf("device link does not list this device")
+	}
+
+	identity, _ := DecodeID(p.Identity)
+	if err := contacts.merge(p.Contacts); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(st.dir), linkedIdentityFile), identity, 0600); err != nil {
+		return "", fmt.Errorf("failed to save identity: %w", err)
+	}
+	os.Remove(st.pendingLinkPath())
+	st.account = identity
+	return p.Identity, nil
+}
@@ -0,0 +1,11 @@
+// Package core is the client side of HEMSAEUCC shared by the CLI and the
+// GUI: the keys of a device, the relay protocol and the end-to-end
+// encryption on top of it, and the encrypted state kept next to the keys.
+//
+// An Identity is the key pair of a device. Loading or creating one and
+// calling OpenStore gives the Store of that device, which reaches the
+// relay through its Relay. Store.Session returns the Session with one
+// device of a peer, which seals and opens their messages; SealAll seals a
+// message to every device of a contact. The contacts, groups, devices and
+// message history of the device hang off the Store too.
+package core
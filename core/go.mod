@@ -0,0 +1,12 @@
+module HEMSAEUCC-core
+
+go 1.25.0
+
+require (
+	filippo.io/edwards25519 v1.1.0
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.42.0
+)
+
+require golang.org/x/sys v0.36.0 // indirect
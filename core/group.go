@@ -0,0 +1,548 @@
+package core
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Groups use sender keys. Every device of every member keeps a hash chain
+// per group and epoch, and hands its chain key and a signing key to all
+// other member devices over the pairwise sessions. A group message is
+// encrypted once with the next key of the sender's chain, signed, and the
+// same packet is posted to every member device. Changing the membership
+// starts a new epoch, in which every member makes a fresh chain and shares
+// it only with the new membership, so removed members cannot read on.
+const (
+	// GroupVersion is the packet version of group messages.
+	GroupVersion = 5
+
+	groupIDSize = 16
+
+	groupMessageLabel = "HEMSAEUCC v5 group message keys"
+	groupADLabel      = "HEMSAEUCC v5 group"
+
+	// maxGroupMembers caps the membership of a group.
+	maxGroupMembers = 100
+)
+
+var (
+	errNoGroup        = errors.New("unknown group")
+	errNotGroupAdmin  = errors.New("only the group admin can change its members")
+	errNoSenderKey    = errors.New("no sender key for this member yet")
+	errNotGroupMember = errors.New("sender is not a member of the group")
+)
+
+// senderChain is the sender key of one device in one epoch of a group.
+type senderChain struct {
+	// Identity owns the device the chain belongs to.
+	Identity   string            `json:"identity"`
+	Epoch      uint32            `json:"epoch"`
+	ChainKey   []byte            `json:"chain_key"`
+	N          uint32            `json:"n"`
+	SigningPub []byte            `json:"signing_pub"`
+	Signing    []byte            `json:"signing,omitempty"`
+	Skipped    map[uint32][]byte `json:"skipped,omitempty"`
+}
+
+// newSenderChain creates a chain for our device in epoch.
+func newSenderChain(identity string, epoch uint32) (*senderChain, error) {
+	ck := make([]byte, 32)
+	if _, err := rand.Read(ck); err != nil {
+		return nil, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &senderChain{Identity: identity, Epoch: epoch, ChainKey: ck, SigningPub: pub, Signing: priv}, nil
+}
+
+// share returns the part of our chain other members receive.
+func (c *senderChain) share() *senderChain {
+	return &senderChain{Identity: c.Identity, Epoch: c.Epoch, ChainKey: c.ChainKey, N: c.N, SigningPub: c.SigningPub}
+}
+
+// next returns the message key at the head of the chain and advances it.
+func (c *senderChain) next() (n uint32, mk []byte) {
+	n = c.N
+	c.ChainKey, mk = kdfChain(c.ChainKey)
+	c.N++
+	return n, mk
+}
+
+// keyAt returns the message key for iteration n, storing the keys it skips
+// over, and forgets it so that it cannot be used twice.
+func (c *senderChain) keyAt(n uint32) ([]byte, error) {
+	if n < c.N {
+		mk, ok := c.Skipped[n]
+		if !ok {
+			return nil, fmt.Errorf("message key already used")
+		}
+		delete(c.Skipped, n)
+		return mk, nil
+	}
+	if n-c.N > maxSkip {
+		return nil, errTooManySkipped
+	}
+	if c.Skipped == nil {
+		c.Skipped = make(map[uint32][]byte)
+	}
+	for c.N < n {
+		i, mk := c.next()
+		c.Skipped[i] = mk
+	}
+	for len(c.Skipped) > maxSkippedKeys {
+		delete(c.Skipped, slices.Min(slices.Collect(maps.Keys(c.Skipped))))
+	}
+	_, mk := c.next()
+	return mk, nil
+}
+
+func (c *senderChain) clone() *senderChain {
+	d := *c
+	d.Skipped = maps.Clone(c.Skipped)
+	return &d
+}
+
+// GroupState is what we know of a group, kept in keys/groups/<id>.bin.
+type GroupState struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Admin   string   `json:"admin"`
+	Epoch   uint32   `json:"epoch"`
+	Members []string `json:"members"`
+	// Left is set once we are no longer a member.
+	Left bool `json:"left,omitempty"`
+	// Mine is our chain in the current epoch.
+	Mine *senderChain `json:"mine,omitempty"`
+	// Chains holds the chains of other devices, keyed by chainKey.
+	Chains map[string]*senderChain `json:"chains,omitempty"`
+}
+
+// Label returns the name of g, or its short ID if it has none.
+func (g *GroupState) Label() string {
+	if g.Name != "" {
+		return g.Name
+	}
+	return ShortID(g.ID)
+}
+
+func chainKey(deviceID string, epoch uint32) string {
+	return fmt.Sprintf("%s/%d", deviceID, epoch)
+}
+
+// groupControl is carried in the group field of pairwise payloads. It
+// always describes the group as the sender knows it; only the admin's
+// description is taken as a membership change. SenderKey shares the
+// sender's chain for Epoch.
+type groupControl struct {
+	Group     string       `json:"group"`
+	Name      string       `json:"name"`
+	Admin     string       `json:"admin"`
+	Epoch     uint32       `json:"epoch"`
+	Members   []string     `json:"members"`
+	SenderKey *senderChain `json:"sender_key,omitempty"`
+}
+
+func (st *Store) groupPath(id string) string {
+	return filepath.Join(filepath.Dir(st.dir), "groups", id+".bin")
+}
+
+// LoadGroup returns the group id, or errNoGroup.
+func (st *Store) LoadGroup(id string) (*GroupState, error) {
+	var g GroupState
+	err := readSealedFile(st.groupPath(id), st.key, "group:"+id, &g)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errNoGroup
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load group: %w", err)
+	}
+	if g.Chains == nil {
+		g.Chains = make(map[string]*senderChain)
+	}
+	return &g, nil
+}
+
+func (st *Store) saveGroup(g *GroupState) error {
+	if err := writeSealedFile(st.groupPath(g.ID), st.key, "group:"+g.ID, g); err != nil {
+		return fmt.Errorf("failed to save group: %w", err)
+	}
+	return nil
+}
+
+// ListGroups returns the groups we know of.
+func (st *Store) ListGroups() ([]*GroupState, error) {
+	entries, err := os.ReadDir(filepath.Join(filepath.Dir(st.dir), "groups"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var groups []*GroupState
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".bin")
+		if !ok {
+			continue
+		}
+		g, err := st.LoadGroup(id)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+// FindGroup returns the group named or identified by s.
+func (st *Store) FindGroup(s string) (*GroupState, error) {
+	groups, err := st.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	var found *GroupState
+	for _, g := range groups {
+		if g.ID == strings.ToLower(s) {
+			return g, nil
+		}
+		if g.Name == s {
+			if found != nil {
+				return nil, fmt.Errorf("several groups are named %q; use the group ID", s)
+			}
+			found = g
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w %q", errNoGroup, s)
+	}
+	return found, nil
+}
+
+// CreateGroup starts a group with members, which must not include us, and
+// returns the packets announcing it.
+func (st *Store) CreateGroup(name string, members []string) (*GroupState, []EncryptedMessage, error) {
+	id := make([]byte, groupIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, nil, err
+	}
+	g := &GroupState{
+		ID:     hex.EncodeToString(id),
+		Name:   name,
+		Admin:  st.AccountID(),
+		Chains: make(map[string]*senderChain),
+	}
+	packets, err := st.SetMembers(g, append([]string{st.AccountID()}, members...))
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, packets, nil
+}
+
+// SetMembers changes the membership of a group we administer, starting a
+// new epoch, and returns the packets telling old and new members.
+func (st *Store) SetMembers(g *GroupState, members []string) ([]EncryptedMessage, error) {
+	if g.Admin != st.AccountID() {
+		return nil, errNotGroupAdmin
+	}
+	members = compactIDs(members)
+	if !slices.Contains(members, g.Admin) {
+		return nil, fmt.Errorf("the admin cannot leave the group")
+	}
+	if len(members) > maxGroupMembers {
+		return nil, fmt.Errorf("a group has at most %d members", maxGroupMembers)
+	}
+	removed := slices.DeleteFunc(slices.Clone(g.Members), func(id string) bool {
+		return slices.Contains(members, id)
+	})
+	g.Members = members
+	packets, err := st.newEpoch(g, g.Epoch+1)
+	if err != nil {
+		return nil, err
+	}
+	// Removed members only learn they are out; they get no key.
+	notice, err := st.groupPackets(g, removed, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(packets, notice...), nil
+}
+
+// newEpoch moves g to epoch with a fresh chain of ours, saves it and
+// returns the packets sharing the chain with the members.
+func (st *Store) newEpoch(g *GroupState, epoch uint32) ([]EncryptedMessage, error) {
+	mine, err := newSenderChain(st.AccountID(), epoch)
+	if err != nil {
+		return nil, err
+	}
+	g.Epoch, g.Mine = epoch, mine
+	// Keep the chains of the previous epoch for messages still in flight.
+	for k, c := range g.Chains {
+		if c.Epoch+1 < epoch {
+			delete(g.Chains, k)
+		}
+	}
+	if err := st.saveGroup(g); err != nil {
+		return nil, err
+	}
+	return st.groupPackets(g, g.Members, mine.share())
+}
+
+// groupPackets seals a control message describing g, with key if it is
+// not nil, to every device of the identities in to except this one.
+func (st *Store) groupPackets(g *GroupState, to []string, key *senderChain) ([]EncryptedMessage, error) {
+	data, err := json.Marshal(groupControl{
+		Group: g.ID, Name: g.Name, Admin: g.Admin, Epoch: g.Epoch, Members: g.Members, SenderKey: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg, err := NewMessage(nil)
+	if err != nil {
+		return nil, err
+	}
+	msg.Group = data
+	if !st.IsPrimary() {
+		msg.Identity = st.account
+	}
+	self := hex.EncodeToString(st.pub)
+
+	var packets []EncryptedMessage
+	for _, id := range to {
+		devices, err := st.DevicesOf(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, dev := range devices {
+			if dev == self {
+				continue
+			}
+			p, err := st.seal(dev, msg)
+			if err != nil {
+				return nil, fmt.Errorf("failed to reach %s: %w", ShortID(dev), err)
+			}
+			packets = append(packets, p)
+		}
+	}
+	return packets, nil
+}
+
+// HandleGroupControl applies a control message sent by the identity from
+// from its device fromDevice. It returns the group and any packets to post
+// in reply, which share our chain when a new epoch begins.
+func (st *Store) HandleGroupControl(from, fromDevice string, msg *Message) (*GroupState, []EncryptedMessage, error) {
+	var gc groupControl
+	if err := json.Unmarshal(msg.Group, &gc); err != nil {
+		return nil, nil, fmt.Errorf("malformed group message")
+	}
+	if _, err := hex.DecodeString(gc.Group); err != nil || len(gc.Group) != 2*groupIDSize {
+		return nil, nil, fmt.Errorf("malformed group message")
+	}
+	g, err := st.LoadGroup(gc.Group)
+	if errors.Is(err, errNoGroup) {
+		// Until the admin's announcement arrives the group has no members.
+		g = &GroupState{ID: gc.Group, Admin: gc.Admin, Chains: make(map[string]*senderChain)}
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var packets []EncryptedMessage
+	if from == g.Admin && gc.Admin == g.Admin && gc.Epoch > g.Epoch {
+		g.Name = gc.Name
+		g.Members = compactIDs(gc.Members)
+		if !slices.Contains(g.Members, st.AccountID()) {
+			g.Left, g.Mine, g.Chains = true, nil, nil
+			g.Epoch = gc.Epoch
+			return g, nil, st.saveGroup(g)
+		}
+		g.Left = false
+		if packets, err = st.newEpoch(g, gc.Epoch); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if k := gc.SenderKey; k != nil && !g.Left {
+		if len(k.ChainKey) != 32 || len(k.SigningPub) != ed25519.PublicKeySize || k.Epoch != gc.Epoch {
+			return nil, nil, fmt.Errorf("malformed sender key")
+		}
+		// Keys for an epoch we have not reached yet are kept until the
+		// admin's announcement arrives; membership is checked on use.
+		if k.Epoch+1 >= g.Epoch {
+			k.Identity, k.Signing, k.Skipped = from, nil, nil
+			g.Chains[chainKey(fromDevice, k.Epoch)] = k
+		}
+	}
+	if err := st.saveGroup(g); err != nil {
+		return nil, nil, err
+	}
+	return g, packets, nil
+}
+
+// groupAEAD expands a group message key into an XChaCha20-Poly1305 key and
+// nonce.
+func groupAEAD(mk []byte) (cipher.AEAD, []byte, error) {
+	out := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSizeX)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, mk, nil, []byte(groupMessageLabel)), out); err != nil {
+		return nil, nil, err
+	}
+	aead, err := chacha20poly1305.NewX(out[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, out[chacha20poly1305.KeySize:], nil
+}
+
+// groupAD binds a group message to its group, epoch, position and sending
+// device.
+func groupAD(groupID []byte, epoch, n uint32, from []byte) []byte {
+	b := append([]byte(groupADLabel), 0)
+	b = append(b, groupID...)
+	b = binary.BigEndian.AppendUint32(b, epoch)
+	b = binary.BigEndian.AppendUint32(b, n)
+	return append(b, from...)
+}
+
+// SealGroup encrypts body once for g and returns a copy of the packet for
+// every member device.
+func (st *Store) SealGroup(g *GroupState, body []byte) ([]EncryptedMessage, error) {
+	msg, err := NewMessage(body)
+	if err != nil {
+		return nil, err
+	}
+	return st.SealGroupMessage(g, msg)
+}
+
+// SealGroupMessage is SealGroup for a message that carries more than a
+// body.
+func (st *Store) SealGroupMessage(g *GroupState, msg *Message) ([]EncryptedMessage, error) {
+	if g.Left || g.Mine == nil {
+		return nil, fmt.Errorf("you are not a member of %s", g.Label())
+	}
+	if err := st.stampTimer("group:"+g.ID, msg); err != nil {
+		return nil, err
+	}
+	gid, _ := hex.DecodeString(g.ID)
+	n, mk := g.Mine.next()
+	ad := groupAD(gid, g.Epoch, n, st.pub)
+	aead, nonce, err := groupAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	ct := aead.Seal(nil, nonce, encodePayload(msg), ad)
+	sig := ed25519.Sign(g.Mine.Signing, append(ad, ct...))
+	// The chain has moved on; save it before anything is sent.
+	if err := st.saveGroup(g); err != nil {
+		return nil, err
+	}
+
+	self := hex.EncodeToString(st.pub)
+	var packets []EncryptedMessage
+	for _, id := range g.Members {
+		devices, err := st.DevicesOf(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, dev := range devices {
+			if dev == self {
+				continue
+			}
+			packets = append(packets, EncryptedMessage{
+				Version:    GroupVersion,
+				FromID:     self,
+				ToID:       dev,
+				GroupID:    g.ID,
+				Epoch:      g.Epoch,
+				N:          n,
+				Ciphertext: base64.StdEncoding.EncodeToString(ct),
+				Signature:  base64.StdEncoding.EncodeToString(sig),
+				Expires:    PacketExpiry(msg),
+			})
+		}
+	}
+	return packets, nil
+}
+
+// OpenGroup decrypts a group message. It returns the group and the
+// identity of the member who sent it.
+func (st *Store) OpenGroup(m EncryptedMessage) (*GroupState, string, *Message, error) {
+	gid, err := hex.DecodeString(m.GroupID)
+	if err != nil || len(gid) != groupIDSize {
+		return nil, "", nil, fmt.Errorf("invalid group ID")
+	}
+	g, err := st.LoadGroup(m.GroupID)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	chain, ok := g.Chains[chainKey(m.FromID, m.Epoch)]
+	if !ok {
+		return g, "", nil, errNoSenderKey
+	}
+	if !slices.Contains(g.Members, chain.Identity) {
+		return g, chain.Identity, nil, errNotGroupMember
+	}
+	from, err := DecodeID(m.FromID)
+	if err != nil {
+		return g, "", nil, err
+	}
+	ct, err := base64.StdEncoding.DecodeString(m.Ciphertext)
+	if err != nil {
+		return g, "", nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return g, "", nil, fmt.Errorf("invalid signature: %w", err)
+	}
+	ad := groupAD(gid, m.Epoch, m.N, from)
+	if !ed25519.Verify(chain.SigningPub, append(bytes.Clone(ad), ct...), sig) {
+		return g, "", nil, ErrSenderUnverified
+	}
+
+	trial := chain.clone()
+	mk, err := trial.keyAt(m.N)
+	if err != nil {
+		return g, "", nil, err
+	}
+	aead, nonce, err := groupAEAD(mk)
+	if err != nil {
+		return g, "", nil, err
+	}
+	plain, err := aead.Open(nil, nonce, ct, ad)
+	if err != nil {
+		return g, "", nil, fmt.Errorf("failed to decrypt")
+	}
+	msg, err := st.accept(m.GroupID+"-"+m.FromID, plain, ct, func() error {
+		g.Chains[chainKey(m.FromID, m.Epoch)] = trial
+		return st.saveGroup(g)
+	})
+	return g, chain.Identity, msg, err
+}
+
+// compactIDs sorts ids and drops duplicates and invalid IDs.
+func compactIDs(ids []string) []string {
+	var out []string
+	for _, id := range ids {
+		if pub, err := DecodeID(id); err == nil {
+			out = append(out, hex.EncodeToString(pub))
+		}
+	}
+	slices.Sort(out)
+	return slices.Compact(out)
+}
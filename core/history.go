@@ -0,0 +1,589 @@
+package core
+
+import (
+	"cmp"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The message history is a bbolt database, keys/history.db. Every value
+// in it is sealed with XChaCha20-Poly1305 under the history key, with the
+// bucket and the record key as associated data, and record keys never
+// hold a conversation or message ID in the clear:
+//
+//	meta           "key"                  the history key, sealed under the storage key
+//	conversations  tag(conv)              conversation
+//	messages       tag(conv) / seq        HistoryMessage, in a bucket per conversation
+//	message_ids    tag(conv "/" id)       seq of the message id in conv
+//	search         see search.go
+//
+// where tag is a truncated HMAC-SHA256 under the history key. The history
+// key is random, so a key rotation only has to seal it again.
+const (
+	bucketHistoryMeta   = "meta"
+	bucketConversations = "conversations"
+	bucketMessages      = "messages"
+	bucketMessageIDs    = "message_ids"
+
+	historyKeyLabel = "history key"
+	historyTagSize  = 16
+	// historyLockTimeout is how long to wait for another client using
+	// the same history.
+	historyLockTimeout = 2 * time.Second
+)
+
+var errHistoryInUse = errors.New("the message history is in use by another client")
+
+// HistoryMessage is a line of a conversation: a message, or a notice about
+// the conversation if ID is empty.
+type HistoryMessage struct {
+	ID string `json:"id,omitempty"`
+	// From is the identity that sent the message.
+	From string `json:"from,omitempty"`
+	Text string `json:"text"`
+	// Sent is when the message was sent, or the notice made, in Unix
+	// milliseconds. Expires, in Unix seconds, is set for disappearing
+	// messages.
+	Sent    int64  `json:"sent"`
+	Expires int64  `json:"expires,omitempty"`
+	ReplyTo string `json:"reply_to,omitempty"`
+	Edited  bool   `json:"edited,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// Reactions maps the identities who reacted to their emoji.
+	Reactions map[string]string `json:"reactions,omitempty"`
+	// Read is set on received messages once they were shown.
+	Read bool `json:"read,omitempty"`
+
+	seq uint64
+}
+
+// expired reports whether m is a disappearing message whose time is up.
+func (m *HistoryMessage) expired(now time.Time) bool {
+	return m.Expires != 0 && now.Unix() >= m.Expires
+}
+
+// Conversation is the summary of a conversation in the history.
+type Conversation struct {
+	ID string `json:"id"`
+	// Updated is when the last message was added, in Unix milliseconds.
+	Updated int64 `json:"updated"`
+}
+
+// HistoryStore is the open message history.
+type HistoryStore struct {
+	db   *bolt.DB
+	aead cipher.AEAD
+	key  []byte
+}
+
+// openHistory opens the history in keysDir, creating it if needed, with
+// its key sealed under storageKey.
+func openHistory(keysDir string, storageKey []byte) (*HistoryStore, error) {
+	db, err := bolt.Open(filepath.Join(keysDir, "history.db"), 0600, &bolt.Options{Timeout: historyLockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, errHistoryInUse
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message history: %w", err)
+	}
+	var key []byte
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{bucketHistoryMeta, bucketConversations, bucketMessages, bucketMessageIDs, bucketSearch} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		key, err = historyKey(tx, storageKey)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open message history: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	h := &HistoryStore{db: db, aead: aead, key: key}
+	if err := h.reindex(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to index message history: %w", err)
+	}
+	return h, nil
+}
+
+// historyKey returns the history key, generating it in a new history.
+func historyKey(tx *bolt.Tx, storageKey []byte) ([]byte, error) {
+	meta := tx.Bucket([]byte(bucketHistoryMeta))
+	aead, err := chacha20poly1305.NewX(storageKey)
+	if err != nil {
+		return nil, err
+	}
+	if sealed := meta.Get([]byte("key")); sealed != nil {
+		if len(sealed) < aead.NonceSize() {
+			return nil, errCorrupt
+		}
+		key, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(historyKeyLabel))
+		if err != nil {
+			return nil, errCorrupt
+		}
+		return key, nil
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return key, meta.Put([]byte("key"), aead.Seal(nonce, nonce, key, []byte(historyKeyLabel)))
+}
+
+// rewrapHistory copies the history at src to dst with its key sealed
+// under newKey instead of oldKey. The history must not be open.
+func rewrapHistory(src, dst string, oldKey, newKey []byte) error {
+	in, err := os.Open(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(dst, 0600, &bolt.Options{Timeout: historyLockTimeout})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		key, err := historyKey(tx, oldKey)
+		if err != nil {
+			return err
+		}
+		aead, err := chacha20poly1305.NewX(newKey)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(bucketHistoryMeta)).Put([]byte("key"), aead.Seal(nonce, nonce, key, []byte(historyKeyLabel)))
+	})
+}
+
+// History returns the message history kept with st, opening it and
+// dropping what has disappeared since on first use.
+func (st *Store) History() (*HistoryStore, error) {
+	if st.hist == nil || st.hist.db == nil {
+		h, err := openHistory(filepath.Dir(st.dir), st.key)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := h.Purge(time.Now()); err != nil {
+			h.close()
+			return nil, err
+		}
+		st.hist = h
+	}
+	return st.hist, nil
+}
+
+// Close closes the message history of st, if it was opened.
+func (st *Store) Close() error {
+	return st.hist.close()
+}
+
+// close closes the history. It can be called more than once.
+func (h *HistoryStore) close() error {
+	if h == nil || h.db == nil {
+		return nil
+	}
+	err := h.db.Close()
+	h.db = nil
+	return err
+}
+
+func (h *HistoryStore) tag(s string) []byte {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)[:historyTagSize]
+}
+
+func historyAD(bucket string, key []byte) []byte {
+	return append(append([]byte(bucket), 0), key...)
+}
+
+func (h *HistoryStore) seal(bucket string, key []byte, v any) ([]byte, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, h.aead.NonceSize(), h.aead.NonceSize()+len(plain)+h.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return h.aead.Seal(nonce, nonce, plain, historyAD(bucket, key)), nil
+}
+
+func (h *HistoryStore) open(bucket string, key, sealed []byte, v any) error {
+	if len(sealed) < h.aead.NonceSize() {
+		return errCorrupt
+	}
+	plain, err := h.aead.Open(nil, sealed[:h.aead.NonceSize()], sealed[h.aead.NonceSize():], historyAD(bucket, key))
+	if err != nil {
+		return errCorrupt
+	}
+	if err := json.Unmarshal(plain, v); err != nil {
+		return errCorrupt
+	}
+	return nil
+}
+
+func seqKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
+
+// messageAD is the bucket name bound to the messages of a conversation.
+func messageAD(convTag []byte) string {
+	return bucketMessages + "/" + string(convTag)
+}
+
+// Add appends m to the conversation conv.
+func (h *HistoryStore) Add(conv string, m *HistoryMessage) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		ct := h.tag(conv)
+		b, err := tx.Bucket([]byte(bucketMessages)).CreateBucketIfNotExists(ct)
+		if err != nil {
+			return err
+		}
+		if m.seq, err = b.NextSequence(); err != nil {
+			return err
+		}
+		if err := h.put(b, messageAD(ct), seqKey(m.seq), m); err != nil {
+			return err
+		}
+		if err := h.indexMessage(tx, ct, m.seq, m, true); err != nil {
+			return err
+		}
+		if m.ID != "" {
+			idKey := h.tag(conv + "/" + m.ID)
+			if err := h.put(tx.Bucket([]byte(bucketMessageIDs)), bucketMessageIDs, idKey, m.seq); err != nil {
+				return err
+			}
+		}
+		return h.put(tx.Bucket([]byte(bucketConversations)), bucketConversations, ct, Conversation{ID: conv, Updated: time.Now().UnixMilli()})
+	})
+}
+
+func (h *HistoryStore) put(b *bolt.Bucket, bucket string, key []byte, v any) error {
+	sealed, err := h.seal(bucket, key, v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, sealed)
+}
+
+// Update stores m, previously read from the conversation conv, again.
+func (h *HistoryStore) Update(conv string, m *HistoryMessage) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		ct := h.tag(conv)
+		b := tx.Bucket([]byte(bucketMessages)).Bucket(ct)
+		var sealed []byte
+		if b != nil {
+			sealed = b.Get(seqKey(m.seq))
+		}
+		if sealed == nil {
+			return fmt.Errorf("message %s is no longer in the history", ShortID(m.ID))
+		}
+		var old HistoryMessage
+		if err := h.open(messageAD(ct), seqKey(m.seq), sealed, &old); err != nil {
+			return err
+		}
+		if err := h.indexMessage(tx, ct, m.seq, &old, false); err != nil {
+			return err
+		}
+		if err := h.indexMessage(tx, ct, m.seq, m, true); err != nil {
+			return err
+		}
+		return h.put(b, messageAD(ct), seqKey(m.seq), m)
+	})
+}
+
+// Messages returns the last limit lines of the conversation conv, or all
+// of them if limit is 0, oldest first and without those that have
+// disappeared.
+func (h *HistoryStore) Messages(conv string, limit int) ([]*HistoryMessage, error) {
+	var list []*HistoryMessage
+	now := time.Now()
+	err := h.db.View(func(tx *bolt.Tx) error {
+		ct := h.tag(conv)
+		b := tx.Bucket([]byte(bucketMessages)).Bucket(ct)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && (limit == 0 || len(list) < limit); k, v = c.Prev() {
+			var m HistoryMessage
+			if err := h.open(messageAD(ct), k, v, &m); err != nil {
+				return err
+			}
+			m.seq = binary.BigEndian.Uint64(k)
+			if !m.expired(now) {
+				list = append(list, &m)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message history: %w", err)
+	}
+	slices.Reverse(list)
+	return list, nil
+}
+
+// find returns the message id of the conversation conv, or nil if it is
+// not in the history.
+func (h *HistoryStore) find(conv, id string) (*HistoryMessage, error) {
+	var found *HistoryMessage
+	err := h.db.View(func(tx *bolt.Tx) error {
+		idKey := h.tag(conv + "/" + id)
+		sealed := tx.Bucket([]byte(bucketMessageIDs)).Get(idKey)
+		if sealed == nil {
+			return nil
+		}
+		var seq uint64
+		if err := h.open(bucketMessageIDs, idKey, sealed, &seq); err != nil {
+			return err
+		}
+		ct := h.tag(conv)
+		b := tx.Bucket([]byte(bucketMessages)).Bucket(ct)
+		if b == nil {
+			return nil
+		}
+		v := b.Get(seqKey(seq))
+		if v == nil {
+			return nil
+		}
+		var m HistoryMessage
+		if err := h.open(messageAD(ct), seqKey(seq), v, &m); err != nil {
+			return err
+		}
+		m.seq = seq
+		if !m.expired(time.Now()) {
+			found = &m
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message history: %w", err)
+	}
+	return found, nil
+}
+
+// Conversations returns the conversations in the history, most recently
+// updated first.
+func (h *HistoryStore) Conversations() ([]*Conversation, error) {
+	var list []*Conversation
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketConversations)).ForEach(func(k, v []byte) error {
+			var c Conversation
+			if err := h.open(bucketConversations, k, v, &c); err != nil {
+				return err
+			}
+			list = append(list, &c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message history: %w", err)
+	}
+	slices.SortFunc(list, func(a, b *Conversation) int {
+		return cmp.Compare(b.Updated, a.Updated)
+	})
+	return list, nil
+}
+
+// FindPrefix returns the message whose ID starts with prefix, and its
+// conversation.
+func (h *HistoryStore) FindPrefix(prefix string) (string, *HistoryMessage, error) {
+	convs, err := h.Conversations()
+	if err != nil {
+		return "", nil, err
+	}
+	var conv string
+	var found *HistoryMessage
+	for _, c := range convs {
+		list, err := h.Messages(c.ID, 0)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, m := range list {
+			if m.ID == "" || m.Deleted || !strings.HasPrefix(m.ID, prefix) {
+				continue
+			}
+			if found != nil {
+				return "", nil, fmt.Errorf("%q matches more than one message", prefix)
+			}
+			conv, found = c.ID, m
+		}
+	}
+	if found == nil {
+		return "", nil, fmt.Errorf("no message %q", prefix)
+	}
+	return conv, found, nil
+}
+
+// Purge deletes the messages that have disappeared by now and returns the
+// conversations they were in.
+func (h *HistoryStore) Purge(now time.Time) ([]string, error) {
+	convs, err := h.Conversations()
+	if err != nil {
+		return nil, err
+	}
+	var purged []string
+	err = h.db.Update(func(tx *bolt.Tx) error {
+		for _, c := range convs {
+			ct := h.tag(c.ID)
+			b := tx.Bucket([]byte(bucketMessages)).Bucket(ct)
+			if b == nil {
+				continue
+			}
+			var expired []*HistoryMessage
+			err := b.ForEach(func(k, v []byte) error {
+				var m HistoryMessage
+				if err := h.open(messageAD(ct), k, v, &m); err != nil {
+					return err
+				}
+				if m.expired(now) {
+					m.seq = binary.BigEndian.Uint64(k)
+					expired = append(expired, &m)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, m := range expired {
+				if err := h.remove(tx, c.ID, m); err != nil {
+					return err
+				}
+			}
+			if expired != nil {
+				purged = append(purged, c.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to purge message history: %w", err)
+	}
+	return purged, nil
+}
+
+func (h *HistoryStore) remove(tx *bolt.Tx, conv string, m *HistoryMessage) error {
+	if err := h.indexMessage(tx, h.tag(conv), m.seq, m, false); err != nil {
+		return err
+	}
+	if m.ID != "" {
+		if err := tx.Bucket([]byte(bucketMessageIDs)).Delete(h.tag(conv + "/" + m.ID)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket([]byte(bucketMessages)).Bucket(h.tag(conv)).Delete(seqKey(m.seq))
+}
+
+// renameSender marks the messages sent or reacted to by oldID as by newID,
+// after our own key rotation.
+func (h *HistoryStore) renameSender(oldID, newID string) error {
+	convs, err := h.Conversations()
+	if err != nil {
+		return err
+	}
+	for _, c := range convs {
+		list, err := h.Messages(c.ID, 0)
+		if err != nil {
+			return err
+		}
+		for _, m := range list {
+			r, reacted := m.Reactions[oldID]
+			if m.From != oldID && !reacted {
+				continue
+			}
+			if m.From == oldID {
+				m.From = newID
+			}
+			if reacted {
+				delete(m.Reactions, oldID)
+				m.Reactions[newID] = r
+			}
+			if err := h.Update(c.ID, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// move files the conversation with oldID under newID after a key
+// rotation, after whatever newID already has, and its messages from
+// oldID as from newID.
+func (h *HistoryStore) move(oldID, newID string) error {
+	list, err := h.Messages(oldID, 0)
+	if err != nil || list == nil {
+		return err
+	}
+	for _, m := range list {
+		if m.From == oldID {
+			m.From = newID
+		}
+		if r, ok := m.Reactions[oldID]; ok {
+			delete(m.Reactions, oldID)
+			m.Reactions[newID] = r
+		}
+		if err := h.Add(newID, m); err != nil {
+			return err
+		}
+	}
+	return h.db.Update(func(tx *bolt.Tx) error {
+		for _, m := range list {
+			if err := h.remove(tx, oldID, m); err != nil {
+				return err
+			}
+		}
+		ct := h.tag(oldID)
+		if err := tx.Bucket([]byte(bucketMessages)).DeleteBucket(ct); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		return tx.Bucket([]byte(bucketConversations)).Delete(ct)
+	})
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// publicKeyFile holds the public key of the device next to its keystore,
+// so its ID can be shown without the passphrase.
+const publicKeyFile = "x25519_public.bin"
+
+// Identity is the X25519 key pair of this device. On the primary device it
+// is the identity key itself.
+type Identity struct {
+	Priv []byte
+	Pub  []byte
+}
+
+// NewIdentity generates a key pair.
+func NewIdentity() (*Identity, error) {
+	priv := make([]byte, 32)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
+	}
+	return IdentityFromKey(priv)
+}
+
+// IdentityFromKey returns the key pair of the secret priv.
+func IdentityFromKey(priv []byte) (*Identity, error) {
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity secret: %w", err)
+	}
+	return &Identity{Priv: priv, Pub: pub}, nil
+}
+
+// LoadIdentity unlocks the key pair in keysDir; see loadIdentityKey.
+func LoadIdentity(keysDir string, passphrase func() ([]byte, error)) (id *Identity, migrated bool, err error) {
+	priv, migrated, err := loadIdentityKey(keysDir, passphrase)
+	if err != nil {
+		return nil, false, err
+	}
+	id, err = IdentityFromKey(priv)
+	return id, migrated, err
+}
+
+// Save writes the key pair to keysDir, the secret protected by passphrase.
+func (id *Identity) Save(keysDir string, passphrase []byte) error {
+	if err := SaveIdentityKey(keysDir, id.Priv, passphrase); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(keysDir, publicKeyFile), id.Pub, 0600); err != nil {
+		return fmt.Errorf("failed to save public key: %w", err)
+	}
+	return nil
+}
+
+// ID returns the public key in hex, the ID of this device.
+func (id *Identity) ID() string {
+	return hex.EncodeToString(id.Pub)
+}
+
+// OpenStore returns the session store of the device in keysDir.
+func (id *Identity) OpenStore(keysDir string) (*Store, error) {
+	return openSessionStore(keysDir, id.Priv, id.Pub)
+}
+
+// ReadPublicKey returns the public key saved in keysDir.
+func ReadPublicKey(keysDir string) ([]byte, error) {
+	pub, err := os.ReadFile(filepath.Join(keysDir, publicKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoIdentity
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(pub) != 32 {
+		return nil, fmt.Errorf("%s is corrupt", publicKeyFile)
+	}
+	return pub, nil
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// passphraseFn returns a passphrase callback for LoadIdentity that records
+// whether it was asked.
+func passphraseFn(pass []byte, asked *bool) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		*asked = true
+		return pass, nil
+	}
+}
+
+func TestIdentitySaveLoad(t *testing.T) {
+	tests := []struct {
+		name       string
+		saved      []byte
+		given      []byte
+		wantLocked bool
+		wantErr    error
+	}{
+		{"no passphrase", nil, nil, false, nil},
+		{"passphrase", []byte("correct horse"), []byte("correct horse"), true, nil},
+		{"wrong passphrase", []byte("correct horse"), []byte("battery staple"), true, errWrongPassphrase},
+		{"missing passphrase", []byte("correct horse"), nil, true, errWrongPassphrase},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keysDir := filepath.Join(t.TempDir(), "keys")
+			id, err := NewIdentity()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := id.Save(keysDir, tt.saved); err != nil {
+				t.Fatal(err)
+			}
+			if !IdentityExists(keysDir) {
+				t.Fatal("saved identity does not exist")
+			}
+			locked, err := KeystoreLocked(keysDir)
+			if err != nil || locked != tt.wantLocked {
+				t.Fatalf("KeystoreLocked = %v, %v, want %v", locked, err, tt.wantLocked)
+			}
+			pub, err := ReadPublicKey(keysDir)
+			if err != nil || !bytes.Equal(pub, id.Pub) {
+				t.Fatalf("ReadPublicKey = %x, %v, want %x", pub, err, id.Pub)
+			}
+
+			var asked bool
+			got, migrated, err := LoadIdentity(keysDir, passphraseFn(tt.given, &asked))
+			if asked != tt.wantLocked {
+				t.Errorf("asked for passphrase = %v, want %v", asked, tt.wantLocked)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("LoadIdentity = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if migrated {
+				t.Error("keystore reported as migrated")
+			}
+			if got.ID() != id.ID() || !bytes.Equal(got.Priv, id.Priv) {
+				t.Errorf("loaded identity %s, saved %s", got.ID(), id.ID())
+			}
+		})
+	}
+}
+
+func TestLoadIdentityErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, keysDir string)
+	}{
+		{"empty directory", func(t *testing.T, keysDir string) {}},
+		{"truncated keystore", func(t *testing.T, keysDir string) {
+			writeTestFile(t, filepath.Join(keysDir, keystoreFile), []byte(keystoreMagic))
+		}},
+		{"not a keystore", func(t *testing.T, keysDir string) {
+			writeTestFile(t, filepath.Join(keysDir, keystoreFile), make([]byte, keystoreHeaderSize+48))
+		}},
+		{"corrupt legacy secret", func(t *testing.T, keysDir string) {
+			writeTestFile(t, filepath.Join(keysDir, legacySecretFile), make([]byte, 31))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keysDir := t.TempDir()
+			tt.setup(t, keysDir)
+			var asked bool
+			if _, _, err := LoadIdentity(keysDir, passphraseFn(nil, &asked)); err == nil {
+				t.Fatal("LoadIdentity succeeded")
+			}
+			if asked {
+				t.Error("asked for the passphrase of a keystore that cannot be opened")
+			}
+		})
+	}
+	if _, _, err := LoadIdentity(t.TempDir(), nil); !errors.Is(err, ErrNoIdentity) {
+		t.Errorf("LoadIdentity on an empty directory = %v, want ErrNoIdentity", err)
+	}
+}
+
+// TestLoadIdentityMigrates checks that a plaintext secret left by an older
+// client is moved into a keystore and keeps its ID.
+func TestLoadIdentityMigrates(t *testing.T) {
+	keysDir := t.TempDir()
+	id, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(keysDir, legacySecretFile), id.Priv)
+
+	got, migrated, err := LoadIdentity(keysDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated || got.ID() != id.ID() {
+		t.Errorf("LoadIdentity = %s, migrated %v, want %s, migrated", got.ID(), migrated, id.ID())
+	}
+	if _, err := os.Stat(filepath.Join(keysDir, legacySecretFile)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("plaintext secret left behind: %v", err)
+	}
+	if _, migrated, err := LoadIdentity(keysDir, nil); err != nil || migrated {
+		t.Errorf("second LoadIdentity = migrated %v, %v", migrated, err)
+	}
+}
+
+func TestIdentityFromKey(t *testing.T) {
+	id, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := IdentityFromKey(id.Priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID() != id.ID() {
+		t.Errorf("IdentityFromKey gave %s, want %s", again.ID(), id.ID())
+	}
+	if _, err := DecodeID(id.ID()); err != nil {
+		t.Errorf("ID %s does not decode: %v", id.ID(), err)
+	}
+	if _, err := IdentityFromKey(make([]byte, 31)); err == nil {
+		t.Error("IdentityFromKey accepted a short secret")
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+)
+
+// hybridVersion is the packet version of sessions set up with the hybrid
+// X25519 + ML-KEM-768 handshake.
+const hybridVersion = 4
+
+const (
+	kemPreKeyLabel    = "HEMSAEUCC ML-KEM-768 signed prekey"
+	hybridX3DHLabel   = "HEMSAEUCC v4 hybrid X3DH"
+	classicOnlyEnvVar = "HEMSAEUCC_CLASSIC"
+)
+
+// kemPreKey is the ML-KEM-768 encapsulation key an identity publishes next
+// to its X25519 signed prekey, signed by the identity key. It is generated
+// and rotated with the signed prekey, whose ID it shares, and owes nothing
+// to the identity key: recovering that key from the public one does not
+// open hybrid sessions.
+type kemPreKey struct {
+	ID  uint32 `json:"id"`
+	Pub []byte `json:"pub"`
+	Sig []byte `json:"sig"`
+}
+
+// signedMessage returns the bytes covered by the KEM prekey signature.
+func (k kemPreKey) signedMessage() []byte {
+	b := append([]byte(kemPreKeyLabel), 0)
+	b = binary.BigEndian.AppendUint32(b, k.ID)
+	return append(b, k.Pub...)
+}
+
+// newKEMSeed returns a random seed for an ML-KEM-768 key.
+func newKEMSeed() ([]byte, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// hybridEnabled reports whether new sessions should use the hybrid
+// handshake when the contact supports it. Setting HEMSAEUCC_CLASSIC=1
+// forces classic X3DH, e.g. to test interoperability.
+func hybridEnabled() bool {
+	return os.Getenv(classicOnlyEnvVar) == ""
+}
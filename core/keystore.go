@@ -0,0 +1,210 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// The identity secret is kept in a keystore file:
+//
+//	"HMKS" | version | flags | time | memory (KiB) | threads | salt (16) | nonce (24) | ciphertext
+//
+// The ciphertext is the secret sealed with XChaCha20-Poly1305 under a key
+// derived from the passphrase with Argon2id, with everything before it as
+// associated data.
+const (
+	keystoreMagic   = "HMKS"
+	keystoreVersion = 1
+	keystoreFile    = "identity.keystore"
+	// legacySecretFile held the identity secret in the clear.
+	legacySecretFile = "x25519_secret.bin"
+
+	// keystoreHasPassphrase is set in the flags of keystores whose
+	// passphrase is not empty, so that clients know to ask for one.
+	keystoreHasPassphrase = 1
+
+	argonTime    = 3
+	argonMemory  = 64 * 1024
+	argonThreads = 4
+	argonSaltLen = 16
+
+	keystoreHeaderSize = len(keystoreMagic) + 2 + 4 + 4 + 1 + argonSaltLen + chacha20poly1305.NonceSizeX
+
+	// PassphraseEnvVar supplies the passphrase to non-interactive clients,
+	// and NewPassphraseEnvVar the new one to `client passwd`.
+	PassphraseEnvVar    = "HEMSAEUCC_PASSPHRASE"
+	NewPassphraseEnvVar = "HEMSAEUCC_NEW_PASSPHRASE"
+)
+
+var (
+	errWrongPassphrase = errors.New("wrong passphrase")
+	ErrNoIdentity      = errors.New("no identity found")
+)
+
+// keystorePath returns the path of the keystore in keysDir.
+func keystorePath(keysDir string) string {
+	return filepath.Join(keysDir, keystoreFile)
+}
+
+// IdentityExists reports whether keysDir holds an identity secret in
+// either format.
+func IdentityExists(keysDir string) bool {
+	for _, name := range []string{keystoreFile, legacySecretFile} {
+		if _, err := os.Stat(filepath.Join(keysDir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// KeystoreLocked reports whether unlocking the identity in keysDir needs a
+// passphrase.
+func KeystoreLocked(keysDir string) (bool, error) {
+	data, err := os.ReadFile(keystorePath(keysDir))
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(filepath.Join(keysDir, legacySecretFile)); err == nil {
+			return false, nil
+		}
+		return false, ErrNoIdentity
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(data) < keystoreHeaderSize || string(data[:len(keystoreMagic)]) != keystoreMagic {
+		return false, fmt.Errorf("%s is not a keystore", keystoreFile)
+	}
+	return data[5]&keystoreHasPassphrase != 0, nil
+}
+
+// SealKeystore encrypts priv under passphrase.
+func SealKeystore(priv, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, argonSaltLen)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var flags byte
+	if len(passphrase) > 0 {
+		flags |= keystoreHasPassphrase
+	}
+
+	header := append([]byte(keystoreMagic), keystoreVersion, flags)
+	header = binary.BigEndian.AppendUint32(header, argonTime)
+	header = binary.BigEndian.AppendUint32(header, argonMemory)
+	header = append(header, argonThreads)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, argonTime, argonMemory, argonThreads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(header, nonce, priv, header), nil
+}
+
+// OpenKeystore decrypts a keystore with passphrase.
+func OpenKeystore(data, passphrase []byte) ([]byte, error) {
+	if len(data) < keystoreHeaderSize || string(data[:len(keystoreMagic)]) != keystoreMagic {
+		return nil, fmt.Errorf("not a keystore")
+	}
+	if data[4] != keystoreVersion {
+		return nil, fmt.Errorf("unsupported keystore version %d", data[4])
+	}
+	header := data[:keystoreHeaderSize]
+	passes := binary.BigEndian.Uint32(header[6:10])
+	memory := binary.BigEndian.Uint32(header[10:14])
+	threads := header[14]
+	salt := header[15 : 15+argonSaltLen]
+	nonce := header[15+argonSaltLen:]
+	if passes == 0 || passes > 64 || memory > 4*1024*1024 || threads == 0 {
+		return nil, fmt.Errorf("keystore has unreasonable KDF parameters")
+	}
+
+	aead, err := chacha20poly1305.NewX(argon2.IDKey(passphrase, salt, passes, memory, threads, chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	priv, err := aead.Open(nil, nonce, data[keystoreHeaderSize:], header)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return priv, nil
+}
+
+// SaveIdentityKey writes priv to the keystore in keysDir, protected by
+// passphrase, and removes any plaintext copy.
+func SaveIdentityKey(keysDir string, priv, passphrase []byte) error {
+	data, err := SealKeystore(priv, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt identity key: %w", err)
+	}
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		return err
+	}
+	path := keystorePath(keysDir)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to save identity key: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to save identity key: %w", err)
+	}
+	if err := os.Remove(filepath.Join(keysDir, legacySecretFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove plaintext identity key: %w", err)
+	}
+	return nil
+}
+
+// loadIdentityKey returns the identity secret in keysDir. passphrase is
+// only called if the keystore has one. A plaintext secret left by an older
+// client is moved into a keystore without a passphrase; migrated reports
+// whether that happened.
+func loadIdentityKey(keysDir string, passphrase func() ([]byte, error)) (priv []byte, migrated bool, err error) {
+	data, err := os.ReadFile(keystorePath(keysDir))
+	if errors.Is(err, os.ErrNotExist) {
+		priv, err := os.ReadFile(filepath.Join(keysDir, legacySecretFile))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, false, ErrNoIdentity
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if len(priv) != 32 {
+			return nil, false, fmt.Errorf("%s is corrupt", legacySecretFile)
+		}
+		if err := SaveIdentityKey(keysDir, priv, nil); err != nil {
+			return nil, false, err
+		}
+		return priv, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var pass []byte
+	if locked, err := KeystoreLocked(keysDir); err != nil {
+		return nil, false, err
+	} else if locked {
+		if pass, err = passphrase(); err != nil {
+			return nil, false, err
+		}
+	}
+	priv, err = OpenKeystore(data, pass)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(priv) != 32 || bytes.Equal(priv, make([]byte, 32)) {
+		return nil, false, fmt.Errorf("%s is corrupt", keystoreFile)
+	}
+	return priv, false, nil
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OutboxEntry is a message, or other packets, sealed but not yet accepted
+// by the relay. Packets are sealed once, so a retry sends the same
+// ciphertext and the relay drops any copy it already holds.
+type OutboxEntry struct {
+	// ID is the ID of the message carried, or a random one.
+	ID string `json:"id"`
+	// Conv is the conversation the message was sent to, if any.
+	Conv    string `json:"conv,omitempty"`
+	Preview string `json:"preview,omitempty"`
+	Queued  int64  `json:"queued"`
+	Expires int64  `json:"expires,omitempty"`
+	// Packets are those not yet accepted, in the order they are sent.
+	Packets  []OutboxPacket `json:"packets"`
+	Attempts int            `json:"attempts"`
+	// Error is why the last attempt failed.
+	Error string `json:"error,omitempty"`
+	// Failed is set once the relay refuses a packet. A failed entry is
+	// only sent again by Retry.
+	Failed bool `json:"failed,omitempty"`
+}
+
+// OutboxPacket is a queued packet and the relay it goes to.
+type OutboxPacket struct {
+	Packet EncryptedMessage `json:"packet"`
+	// Relay is the URL of the recipient's relay, if not ours.
+	Relay string `json:"relay,omitempty"`
+}
+
+// Status describes how far e has got, as "queued" or "failed".
+func (e *OutboxEntry) Status() string {
+	if e.Failed {
+		return "failed"
+	}
+	return StatusQueued.String()
+}
+
+func (st *Store) outboxPath() string {
+	return filepath.Join(filepath.Dir(st.dir), "outbox.bin")
+}
+
+// loadOutbox returns the queued entries, oldest first, without those that
+// have disappeared.
+func (st *Store) loadOutbox() ([]*OutboxEntry, error) {
+	var out []*OutboxEntry
+	err := readSealedFile(st.outboxPath(), st.key, "outbox", &out)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load outbox: %w", err)
+	}
+	now := time.Now().Unix()
+	return slices.DeleteFunc(out, func(e *OutboxEntry) bool {
+		return e.Expires != 0 && now >= e.Expires
+	}), nil
+}
+
+func (st *Store) saveOutbox(out []*OutboxEntry) error {
+	if len(out) == 0 {
+		if err := os.Remove(st.outboxPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to save outbox: %w", err)
+		}
+		return nil
+	}
+	if err := writeSealedFile(st.outboxPath(), st.key, "outbox", out); err != nil {
+		return fmt.Errorf("failed to save outbox: %w", err)
+	}
+	return nil
+}
+
+// Outbox returns the entries waiting for the relay, oldest first.
+func (st *Store) Outbox() ([]*OutboxEntry, error) {
+	return st.loadOutbox()
+}
+
+// Queue adds packets carrying msg to the conversation conv to the outbox,
+// each for the relay of its recipient. msg is nil for packets that carry
+// no message to show, such as a timer change or a group update.
+func (st *Store) Queue(conv string, msg *Message, packets []EncryptedMessage) (*OutboxEntry, error) {
+	out, err := st.loadOutbox()
+	if err != nil {
+		return nil, err
+	}
+	e := &OutboxEntry{Conv: conv, Queued: time.Now().Unix()}
+	for _, p := range packets {
+		q := OutboxPacket{Packet: p}
+		if r := st.relayFor(p.ToID); r != st.Relay {
+			q.Relay = r.url
+		}
+		e.Packets = append(e.Packets, q)
+	}
+	if msg != nil {
+		e.ID, e.Preview, e.Expires = msg.IDString(), messagePreview(msg), PacketExpiry(msg)
+	} else {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		e.ID = hex.EncodeToString(id)
+	}
+	if err := st.saveOutbox(append(out, e)); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ErrQueued is returned by Send when the relay could not be reached and
+// the packets wait in the outbox for the next Flush.
+var ErrQueued = errors.New("queued in the outbox")
+
+// Send queues packets like Queue and flushes the outbox. It returns an
+// error if the relay did not accept them all: one matching ErrQueued if
+// they are left for the next Flush, ErrRelayRejected if the relay refused
+// them.
+func (st *Store) Send(conv string, msg *Message, packets []EncryptedMessage) error {
+	e, err := st.Queue(conv, msg, packets)
+	if err != nil {
+		return err
+	}
+	_, flushErr := st.Flush()
+	if flushErr != nil && !errors.Is(flushErr, ErrRelayUnavailable) {
+		return flushErr
+	}
+	out, err := st.loadOutbox()
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(out, func(q *OutboxEntry) bool { return q.ID == e.ID })
+	switch {
+	case i < 0:
+		return nil
+	case out[i].Failed:
+		return fmt.Errorf("%w: %s", ErrRelayRejected, out[i].Error)
+	case flushErr != nil:
+		return fmt.Errorf("%w, %w", ErrQueued, flushErr)
+	}
+	return ErrQueued
+}
+
+// Flush hands the queued packets to the relay, oldest first, and returns
+// the entries it accepted in full. Messages among them move to
+// StatusRelayed. An entry the relay refuses is marked failed and skipped;
+// once the relay cannot be reached, the rest wait for the next Flush.
+func (st *Store) Flush() ([]*OutboxEntry, error) {
+	out, err := st.loadOutbox()
+	if err != nil || len(out) == 0 {
+		return nil, err
+	}
+	var sent []*OutboxEntry
+	var stopped error
+	for _, e := range out {
+		if e.Failed {
+			continue
+		}
+		for len(e.Packets) > 0 {
+			err := st.relayAt(e.Packets[0].Relay).PostPacket(st.ctx, e.Packets[0].Packet)
+			if err != nil {
+				e.Attempts++
+				e.Error = err.Error()
+				if errors.Is(err, ErrRelayUnavailable) || st.ctx.Err() != nil {
+					stopped = err
+				} else {
+					e.Failed = true
+				}
+				break
+			}
+			e.Packets = e.Packets[1:]
+		}
+		if len(e.Packets) == 0 {
+			sent = append(sent, e)
+		}
+		if stopped != nil {
+			break
+		}
+	}
+	out = slices.DeleteFunc(out, func(e *OutboxEntry) bool { return len(e.Packets) == 0 })
+	if err := st.saveOutbox(out); err != nil {
+		return sent, err
+	}
+	var ids []string
+	for _, e := range sent {
+		ids = append(ids, e.ID)
+	}
+	if ids != nil {
+		if _, err := st.SetStatus("", ids, StatusRelayed); err != nil {
+			return sent, err
+		}
+	}
+	return sent, stopped
+}
+
+// findOutbox returns the index of the entry whose ID starts with prefix.
+func findOutbox(out []*OutboxEntry, prefix string) (int, error) {
+	found := -1
+	for i, e := range out {
+		if prefix != "" && strings.HasPrefix(e.ID, prefix) {
+			if found >= 0 {
+				return -1, fmt.Errorf("%q matches more than one queued message", prefix)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return -1, fmt.Errorf("no queued message %q", prefix)
+	}
+	return found, nil
+}
+
+// Retry clears the failure of the entry whose ID starts with prefix, so
+// that the next Flush sends it again.
+func (st *Store) Retry(prefix string) error {
+	out, err := st.loadOutbox()
+	if err != nil {
+		return err
+	}
+	i, err := findOutbox(out, prefix)
+	if err != nil {
+		return err
+	}
+	out[i].Failed = false
+	return st.saveOutbox(out)
+}
+
+// Drop removes the entry whose ID starts with prefix from the outbox
+// without sending the rest of it, and returns it.
+func (st *Store) Drop(prefix string) (*OutboxEntry, error) {
+	out, err := st.loadOutbox()
+	if err != nil {
+		return nil, err
+	}
+	i, err := findOutbox(out, prefix)
+	if err != nil {
+		return nil, err
+	}
+	e := out[i]
+	return e, st.saveOutbox(slices.Delete(out, i, i+1))
+}
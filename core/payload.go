@@ -0,0 +1,192 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Everything encrypted in a packet is a payload:
+//
+//	payload version | field*
+//
+// using the field encoding of the wire envelope. Packets from clients that
+// predate payloads carry the bare message text.
+const payloadVersion = 1
+
+// messageIDSize is the size of the random ID given to every message.
+const messageIDSize = 16
+
+// Payload field tags.
+const (
+	tagMessageID = 1
+	tagSentAt    = 2
+	tagBody      = 3
+	tagIdentity  = 4
+	tagSyncTo    = 5
+	tagProvision = 6
+	tagGroup     = 7
+	tagAttach    = 8
+	tagTimer     = 9
+	tagReceipt   = 10
+	tagKind      = 11
+	tagRef       = 12
+)
+
+var errMalformedPayload = errors.New("malformed payload")
+
+// Message is the decrypted content of a packet.
+type Message struct {
+	ID   []byte
+	Sent time.Time
+	Body []byte
+	// Identity is the account of the sending device, when the device key
+	// is not the identity key itself.
+	Identity []byte
+	// SyncTo is set on copies of a sent message for the sender's other
+	// devices, and names the identity it was sent to.
+	SyncTo []byte
+	// Provision carries the linking of a new device, see devices.go.
+	Provision []byte
+	// Group carries a group control message, see group.go.
+	Group []byte
+	// Attachment carries a file reference, see attachments.go.
+	Attachment []byte
+	// Timer is the sender's disappearing message timer for the
+	// conversation, zero when off. TimerSet is false for messages from
+	// clients that predate timers.
+	Timer    time.Duration
+	TimerSet bool
+	// Receipt acknowledges messages, see receipts.go.
+	Receipt []byte
+	// Kind says what the message does, and Ref names the message it
+	// acts on, see content.go.
+	Kind uint64
+	Ref  []byte
+}
+
+// IDString returns the message ID in hex.
+func (m *Message) IDString() string {
+	return hex.EncodeToString(m.ID)
+}
+
+// NewMessage returns a message with body, a fresh ID and the current time.
+func NewMessage(body []byte) (*Message, error) {
+	id := make([]byte, messageIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return &Message{ID: id, Sent: time.Now(), Body: body}, nil
+}
+
+// encodePayload returns the plaintext carrying m.
+func encodePayload(m *Message) []byte {
+	b := []byte{payloadVersion}
+	b = appendField(b, tagMessageID, m.ID)
+	b = appendField(b, tagSentAt, binary.AppendUvarint(nil, uint64(m.Sent.UnixMilli())))
+	b = appendField(b, tagBody, m.Body)
+	if m.Identity != nil {
+		b = appendField(b, tagIdentity, m.Identity)
+	}
+	if m.SyncTo != nil {
+		b = appendField(b, tagSyncTo, m.SyncTo)
+	}
+	if m.Provision != nil {
+		b = appendField(b, tagProvision, m.Provision)
+	}
+	if m.Group != nil {
+		b = appendField(b, tagGroup, m.Group)
+	}
+	if m.Attachment != nil {
+		b = appendField(b, tagAttach, m.Attachment)
+	}
+	if m.Receipt != nil {
+		b = appendField(b, tagReceipt, m.Receipt)
+	}
+	if m.TimerSet {
+		b = appendField(b, tagTimer, binary.AppendUvarint(nil, uint64(m.Timer/time.Second)))
+	}
+	if m.Kind != KindText {
+		b = appendField(b, tagKind, binary.AppendUvarint(nil, m.Kind))
+	}
+	if m.Ref != nil {
+		b = appendField(b, tagRef, m.Ref)
+	}
+	return b
+}
+
+// decodePayload parses a decrypted plaintext. Plaintexts that do not start
+// with the payload version are from older clients and are taken as the
+// message text, with a hash of ct standing in for the ID and no send time.
+// A plaintext that starts with it but does not parse is rejected.
+func decodePayload(plain, ct []byte) (*Message, error) {
+	if len(plain) == 0 || plain[0] != payloadVersion {
+		sum := sha256.Sum256(ct)
+		return &Message{ID: sum[:messageIDSize], Body: plain}, nil
+	}
+	return parsePayload(plain)
+}
+
+func parsePayload(b []byte) (*Message, error) {
+	if len(b) == 0 || b[0] != payloadVersion {
+		return nil, errMalformedPayload
+	}
+	m := new(Message)
+	fields, err := parseFields(b[1:])
+	if err != nil {
+		return nil, errMalformedPayload
+	}
+	for _, f := range fields {
+		switch f.tag {
+		case tagMessageID:
+			m.ID = f.val
+		case tagSentAt:
+			ms, n := binary.Uvarint(f.val)
+			if n != len(f.val) || ms > 1<<62 {
+				return nil, errMalformedPayload
+			}
+			m.Sent = time.UnixMilli(int64(ms))
+		case tagBody:
+			m.Body = f.val
+		case tagIdentity:
+			m.Identity = f.val
+		case tagSyncTo:
+			m.SyncTo = f.val
+		case tagProvision:
+			m.Provision = f.val
+		case tagGroup:
+			m.Group = f.val
+		case tagAttach:
+			m.Attachment = f.val
+		case tagReceipt:
+			m.Receipt = f.val
+		case tagTimer:
+			secs, n := binary.Uvarint(f.val)
+			if n != len(f.val) || secs > uint64(MaxTimer/time.Second) {
+				return nil, errMalformedPayload
+			}
+			m.Timer, m.TimerSet = time.Duration(secs)*time.Second, true
+		case tagKind:
+			kind, n := binary.Uvarint(f.val)
+			if n != len(f.val) {
+				return nil, errMalformedPayload
+			}
+			m.Kind = kind
+		case tagRef:
+			m.Ref = f.val
+		}
+	}
+	if len(m.ID) != messageIDSize || m.Sent.IsZero() {
+		return nil, errMalformedPayload
+	}
+	if (m.Identity != nil && len(m.Identity) != 32) || (m.SyncTo != nil && len(m.SyncTo) != 32) {
+		return nil, errMalformedPayload
+	}
+	if err := checkContent(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
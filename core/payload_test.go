@@ -0,0 +1,51 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDecodePayload(t *testing.T) {
+	m, err := NewMessage([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := encodePayload(m)
+	ct := []byte("ciphertext")
+
+	got, err := decodePayload(valid, ct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.ID, m.ID) || !bytes.Equal(got.Body, m.Body) || got.Sent.UnixMilli() != m.Sent.UnixMilli() {
+		t.Errorf("decoded %+v, encoded %+v", got, m)
+	}
+
+	for _, legacy := range [][]byte{[]byte("hello"), {}} {
+		got, err := decodePayload(legacy, ct)
+		if err != nil {
+			t.Fatalf("legacy text %q: %v", legacy, err)
+		}
+		if !bytes.Equal(got.Body, legacy) || len(got.ID) != messageIDSize || !got.Sent.IsZero() {
+			t.Errorf("legacy text %q decoded as %+v", legacy, got)
+		}
+	}
+
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"version only", []byte{payloadVersion}},
+		{"truncated", valid[:len(valid)-1]},
+		{"no message ID", appendField([]byte{payloadVersion}, tagBody, []byte("hello"))},
+		{"short identity", appendField(bytes.Clone(valid), tagIdentity, make([]byte, 31))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodePayload(tt.b, ct); !errors.Is(err, errMalformedPayload) {
+				t.Errorf("decodePayload = %v, want errMalformedPayload", err)
+			}
+		})
+	}
+}
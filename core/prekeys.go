@@ -0,0 +1,340 @@
+package core
+
+import (
+	"crypto/mlkem"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// preKeyPoolSize is how many one-time prekeys we try to keep on the relay.
+	preKeyPoolSize = 100
+	// signedPreKeyMaxAge is how long a signed prekey is used before it is
+	// rotated on the next replenish.
+	signedPreKeyMaxAge = 7 * 24 * time.Hour
+	// oneTimePreKeyMaxAge is how long the secret of an uploaded one-time
+	// prekey is kept waiting for a session that uses it.
+	oneTimePreKeyMaxAge = 90 * 24 * time.Hour
+	// keptSignedPreKeys is how many signed prekeys are kept so that sessions
+	// started just before a rotation can still be accepted.
+	keptSignedPreKeys = 2
+)
+
+const (
+	signedPreKeyLabel  = "HEMSAEUCC signed prekey"
+	preKeyUploadLabel  = "HEMSAEUCC prekey upload"
+	preKeyReplaceLabel = "HEMSAEUCC prekey replace"
+)
+
+// errPreKeyUsed is returned for a prekey message naming a one-time prekey we
+// no longer have.
+var errPreKeyUsed = errors.New("one-time prekey already used")
+
+// signedPreKey is a medium-term prekey signed by the identity key.
+type signedPreKey struct {
+	ID  uint32 `json:"id"`
+	Pub []byte `json:"pub"`
+	Sig []byte `json:"sig"`
+}
+
+// signedMessage returns the bytes covered by the prekey signature.
+func (k signedPreKey) signedMessage() []byte {
+	b := append([]byte(signedPreKeyLabel), 0)
+	b = binary.BigEndian.AppendUint32(b, k.ID)
+	return append(b, k.Pub...)
+}
+
+// oneTimePreKey is a prekey handed out to a single session initiator.
+type oneTimePreKey struct {
+	ID  uint32 `json:"id"`
+	Pub []byte `json:"pub"`
+}
+
+// preKeyBundle is what the relay returns for a contact: their signed prekey
+// and, while the pool lasts, one one-time prekey.
+type preKeyBundle struct {
+	ID            string         `json:"id"`
+	SignedPreKey  signedPreKey   `json:"signed_prekey"`
+	OneTimePreKey *oneTimePreKey `json:"one_time_prekey,omitempty"`
+	KEMPreKey     *kemPreKey     `json:"kem_prekey,omitempty"`
+}
+
+// verify checks the signed prekey against the identity the bundle was
+// requested for.
+func (b *preKeyBundle) verify(id string) error {
+	pub, err := DecodeID(id)
+	if err != nil {
+		return err
+	}
+	if b.ID != id || !xeddsaVerify(pub, b.SignedPreKey.signedMessage(), b.SignedPreKey.Sig) {
+		return fmt.Errorf("prekey bundle for %s has a bad signature", ShortID(id))
+	}
+	if k := b.KEMPreKey; k != nil && (k.ID != b.SignedPreKey.ID || !xeddsaVerify(pub, k.signedMessage(), k.Sig)) {
+		return fmt.Errorf("prekey bundle for %s has a bad ML-KEM signature", ShortID(id))
+	}
+	return nil
+}
+
+// preKeyUpload is the body of a prekey upload. Sig covers every other field,
+// so the relay only accepts uploads made by the owner of ID. Clients that
+// only speak classic X3DH leave KEMPreKey out. Replace makes the relay drop
+// the one-time prekeys it holds for ID instead of adding to them.
+type preKeyUpload struct {
+	ID             string          `json:"id"`
+	SignedPreKey   signedPreKey    `json:"signed_prekey"`
+	OneTimePreKeys []oneTimePreKey `json:"one_time_prekeys"`
+	KEMPreKey      *kemPreKey      `json:"kem_prekey,omitempty"`
+	Replace        bool            `json:"replace,omitempty"`
+	TS             int64           `json:"ts"`
+	Sig            []byte          `json:"sig"`
+}
+
+// signedMessage returns the bytes covered by the upload signature. An
+// upload that replaces the pool is signed under a label of its own.
+func (u *preKeyUpload) signedMessage() []byte {
+	label := preKeyUploadLabel
+	if u.Replace {
+		label = preKeyReplaceLabel
+	}
+	b := append([]byte(label), 0)
+	b = append(b, u.ID...)
+	b = binary.BigEndian.AppendUint64(b, uint64(u.TS))
+	b = append(b, u.SignedPreKey.signedMessage()...)
+	b = append(b, u.SignedPreKey.Sig...)
+	for _, k := range u.OneTimePreKeys {
+		b = binary.BigEndian.AppendUint32(b, k.ID)
+		b = append(b, k.Pub...)
+	}
+	if u.KEMPreKey != nil {
+		b = append(b, u.KEMPreKey.signedMessage()...)
+		b = append(b, u.KEMPreKey.Sig...)
+	}
+	return b
+}
+
+// PreKeyStatus is the relay's count of our remaining one-time prekeys.
+type PreKeyStatus struct {
+	Remaining int  `json:"remaining"`
+	Low       bool `json:"low"`
+}
+
+// localPreKey is a prekey together with its secret.
+type localPreKey struct {
+	ID   uint32 `json:"id"`
+	Priv []byte `json:"priv"`
+	Pub  []byte `json:"pub"`
+	Sig  []byte `json:"sig,omitempty"`
+	// KEMSeed is the seed of the ML-KEM-768 key of a signed prekey.
+	KEMSeed []byte `json:"kem_seed,omitempty"`
+	Created int64  `json:"created"`
+}
+
+// preKeyState is the persisted set of our prekey secrets.
+type preKeyState struct {
+	NextID         uint32        `json:"next_id"`
+	SignedPreKeys  []localPreKey `json:"signed_prekeys"`
+	OneTimePreKeys []localPreKey `json:"one_time_prekeys"`
+}
+
+// preKeyStore keeps our prekey secrets in keys/prekeys.bin.
+type preKeyStore struct {
+	path string
+	key  []byte
+	priv []byte
+	pub  []byte
+}
+
+func newPreKeyStore(keysDir string, key, priv, pub []byte) *preKeyStore {
+	return &preKeyStore{
+		path: filepath.Join(keysDir, "prekeys.bin"),
+		key:  key,
+		priv: priv,
+		pub:  pub,
+	}
+}
+
+func (ps *preKeyStore) load() (*preKeyState, error) {
+	var state preKeyState
+	err := readSealedFile(ps.path, ps.key, "prekeys", &state)
+	if errors.Is(err, os.ErrNotExist) {
+		return &preKeyState{NextID: 1}, nil
+	}
+	if errors.Is(err, errCorrupt) {
+		log.Println("Prekey store is corrupt and has been reset. Run `client prekeys` to publish new ones.")
+		return &preKeyState{NextID: 1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (ps *preKeyStore) save(state *preKeyState) error {
+	if err := writeSealedFile(ps.path, ps.key, "prekeys", state); err != nil {
+		return fmt.Errorf("failed to save prekeys: %w", err)
+	}
+	return nil
+}
+
+// signedPreKey returns the key pair of the signed prekey id. ID 0 is the
+// identity key, used by contacts that found no published bundle.
+func (ps *preKeyStore) signedPreKey(id uint32) (priv, pub []byte, err error) {
+	if id == 0 {
+		return ps.priv, ps.pub, nil
+	}
+	state, err := ps.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, k := range state.SignedPreKeys {
+		if k.ID == id {
+			return k.Priv, k.Pub, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("unknown signed prekey %d", id)
+}
+
+// kemPreKey returns the ML-KEM-768 key published with the signed prekey id.
+func (ps *preKeyStore) kemPreKey(id uint32) (*mlkem.DecapsulationKey768, error) {
+	state, err := ps.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range state.SignedPreKeys {
+		if k.ID == id && k.KEMSeed != nil {
+			return mlkem.NewDecapsulationKey768(k.KEMSeed)
+		}
+	}
+	return nil, fmt.Errorf("no ML-KEM key for signed prekey %d", id)
+}
+
+// oneTimePreKey returns the secret of the one-time prekey id.
+func (ps *preKeyStore) oneTimePreKey(id uint32) ([]byte, error) {
+	state, err := ps.load()
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range state.OneTimePreKeys {
+		if k.ID == id {
+			return k.Priv, nil
+		}
+	}
+	return nil, errPreKeyUsed
+}
+
+// consume deletes the one-time prekey id once a session has used it.
+func (ps *preKeyStore) consume(id uint32) error {
+	state, err := ps.load()
+	if err != nil {
+		return err
+	}
+	keys := state.OneTimePreKeys[:0]
+	for _, k := range state.OneTimePreKeys {
+		if k.ID != id {
+			keys = append(keys, k)
+		}
+	}
+	state.OneTimePreKeys = keys
+	return ps.save(state)
+}
+
+// replenish prepares a signed upload that tops the relay's pool of one-time
+// prekeys back up to preKeyPoolSize, given that remaining are left, and
+// rotates the signed prekey, and the ML-KEM key with it, if it is due or
+// has no ML-KEM key. If replace is set, or we hold no prekeys at all, as
+// after a restore or once a corrupt store was reset, the upload instead
+// replaces the relay's pool with a full one: the secrets of the keys it
+// holds are gone. The new secrets are saved before the upload is returned.
+func (ps *preKeyStore) replenish(remaining int, replace bool) (*preKeyUpload, error) {
+	state, err := ps.load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if len(state.SignedPreKeys) == 0 {
+		replace = true
+	}
+	if replace {
+		remaining = 0
+	}
+
+	if len(state.SignedPreKeys) == 0 || now.Sub(time.Unix(state.SignedPreKeys[0].Created, 0)) > signedPreKeyMaxAge || state.SignedPreKeys[0].KEMSeed == nil {
+		k, err := ps.generate(state, now)
+		if err != nil {
+			return nil, err
+		}
+		if k.KEMSeed, err = newKEMSeed(); err != nil {
+			return nil, fmt.Errorf("failed to generate ML-KEM key: %w", err)
+		}
+		spk := signedPreKey{ID: k.ID, Pub: k.Pub}
+		if k.Sig, err = xeddsaSign(ps.priv, spk.signedMessage()); err != nil {
+			return nil, fmt.Errorf("failed to sign prekey: %w", err)
+		}
+		state.SignedPreKeys = append([]localPreKey{k}, state.SignedPreKeys...)
+		if len(state.SignedPreKeys) > keptSignedPreKeys {
+			state.SignedPreKeys = state.SignedPreKeys[:keptSignedPreKeys]
+		}
+	}
+
+	kept := state.OneTimePreKeys[:0]
+	for _, k := range state.OneTimePreKeys {
+		if now.Sub(time.Unix(k.Created, 0)) < oneTimePreKeyMaxAge {
+			kept = append(kept, k)
+		}
+	}
+	state.OneTimePreKeys = kept
+
+	current := state.SignedPreKeys[0]
+	u := &preKeyUpload{
+		ID:           hex.EncodeToString(ps.pub),
+		SignedPreKey: signedPreKey{ID: current.ID, Pub: current.Pub, Sig: current.Sig},
+		Replace:      replace,
+		TS:           now.UnixNano(),
+	}
+	for i := remaining; i < preKeyPoolSize; i++ {
+		k, err := ps.generate(state, now)
+		if err != nil {
+			return nil, err
+		}
+		state.OneTimePreKeys = append(state.OneTimePreKeys, k)
+		u.OneTimePreKeys = append(u.OneTimePreKeys, oneTimePreKey{ID: k.ID, Pub: k.Pub})
+	}
+	if hybridEnabled() {
+		kem, err := mlkem.NewDecapsulationKey768(current.KEMSeed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate ML-KEM key: %w", err)
+		}
+		u.KEMPreKey = &kemPreKey{ID: current.ID, Pub: kem.EncapsulationKey().Bytes()}
+		if u.KEMPreKey.Sig, err = xeddsaSign(ps.priv, u.KEMPreKey.signedMessage()); err != nil {
+			return nil, fmt.Errorf("failed to sign ML-KEM key: %w", err)
+		}
+	}
+	if u.Sig, err = xeddsaSign(ps.priv, u.signedMessage()); err != nil {
+		return nil, fmt.Errorf("failed to sign upload: %w", err)
+	}
+	if err := ps.save(state); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// generate creates a new prekey with the next free ID.
+func (ps *preKeyStore) generate(state *preKeyState, now time.Time) (localPreKey, error) {
+	priv, pub, err := newKeyPair()
+	if err != nil {
+		return localPreKey{}, fmt.Errorf("failed to generate prekey: %w", err)
+	}
+	if state.NextID == 0 {
+		// Never hand out 0, which stands for the identity key.
+		state.NextID = 1
+	}
+	k := localPreKey{ID: state.NextID, Priv: priv, Pub: pub, Created: now.Unix()}
+	state.NextID++
+	return k, nil
+}
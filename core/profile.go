@@ -0,0 +1,164 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+)
+
+const (
+	// LegacyKeysDir is where the identity was kept before profiles, relative
+	// to the working directory. It is still used when it exists and no
+	// profile is named.
+	LegacyKeysDir = "keys"
+
+	// DefaultProfile is the profile used when none is named.
+	DefaultProfile = "default"
+
+	// ProfileEnvVar names the profile to use when --profile is not given.
+	ProfileEnvVar = "HEMSAEUCC_PROFILE"
+
+	// maxProfileName bounds the length of a profile name.
+	maxProfileName = 64
+)
+
+// ErrNoProfile is returned for a profile that has not been created.
+var ErrNoProfile = errors.New("no such profile")
+
+// DataDir returns the directory the profiles are kept in: hemsaeucc under
+// $XDG_DATA_HOME, or ~/.local/share, or %LocalAppData% on Windows.
+func DataDir() (string, error) {
+	if dir := os.Getenv("XDG_DATA_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "hemsaeucc"), nil
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("LocalAppData"); dir != "" {
+			return filepath.Join(dir, "hemsaeucc"), nil
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find data directory: %w", err)
+	}
+	return filepath.Join(home, ".local", "share", "hemsaeucc"), nil
+}
+
+// checkProfileName rejects names that are not safe as a directory name.
+func checkProfileName(name string) error {
+	if name == "" || len(name) > maxProfileName || name[0] == '.' {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid profile name %q: use letters, digits, '-', '_' and '.'", name)
+		}
+	}
+	return nil
+}
+
+// profileDir returns the directory of the profile name.
+func profileDir(name string) (string, error) {
+	if err := checkProfileName(name); err != nil {
+		return "", err
+	}
+	dir, err := DataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "profiles", name), nil
+}
+
+// ProfileKeysDir returns the keys directory of the profile name. Its
+// contacts, history and config are kept there too, or next to it.
+func ProfileKeysDir(name string) (string, error) {
+	dir, err := profileDir(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "keys"), nil
+}
+
+// Profiles returns the names of the profiles created, sorted.
+func Profiles() ([]string, error) {
+	dir, err := DataDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "profiles"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list profiles: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && checkProfileName(e.Name()) == nil {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// CreateProfile makes the empty profile name and returns its keys
+// directory.
+func CreateProfile(name string) (string, error) {
+	dir, err := profileDir(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return "", fmt.Errorf("profile %q already exists", name)
+	}
+	keysDir := filepath.Join(dir, "keys")
+	if err := os.MkdirAll(keysDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create profile: %w", err)
+	}
+	return keysDir, nil
+}
+
+// DeleteProfile deletes the profile name: its identity, contacts, history
+// and config.
+func DeleteProfile(name string) error {
+	dir, err := profileDir(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrNoProfile, name)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to delete profile: %w", err)
+	}
+	return nil
+}
+
+// SelectProfile returns the profile to use and its keys directory. name
+// is the profile asked for; if it is empty, the one named by
+// $HEMSAEUCC_PROFILE is used, else LegacyKeysDir if it exists, with no
+// profile name, else DefaultProfile. Any profile but the default must
+// have been created with CreateProfile; the default one's keys directory
+// may not exist yet.
+func SelectProfile(name string) (profile, keysDir string, err error) {
+	if name == "" {
+		name = os.Getenv(ProfileEnvVar)
+	}
+	if name == "" {
+		if info, err := os.Stat(LegacyKeysDir); err == nil && info.IsDir() {
+			return "", LegacyKeysDir, nil
+		}
+		name = DefaultProfile
+	}
+	keysDir, err = ProfileKeysDir(name)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := os.Stat(filepath.Dir(keysDir)); errors.Is(err, os.ErrNotExist) && name != DefaultProfile {
+		return name, "", fmt.Errorf("%w: %s", ErrNoProfile, name)
+	}
+	return name, keysDir, nil
+}
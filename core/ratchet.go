@@ -0,0 +1,292 @@
+package core
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Limits on message keys kept for out-of-order delivery. maxSkip bounds how
+// far ahead of the current chain position a single message may be, and
+// maxSkippedKeys bounds how many unused keys a session stores in total.
+const (
+	maxSkip        = 1000
+	maxSkippedKeys = 2000
+)
+
+const (
+	rootKDFLabel    = "HEMSAEUCC v3 ratchet"
+	messageKDFLabel = "HEMSAEUCC v3 message keys"
+)
+
+var errTooManySkipped = errors.New("too many skipped messages")
+
+// skippedKey is a message key stored for a message that has not arrived yet.
+type skippedKey struct {
+	DH  []byte `json:"dh"`
+	N   uint32 `json:"n"`
+	Key []byte `json:"key"`
+}
+
+// ratchetState is one Double Ratchet session with a contact, as described in
+// the Signal Double Ratchet specification.
+type ratchetState struct {
+	RootKey   []byte       `json:"root_key"`
+	SendPriv  []byte       `json:"send_priv"`
+	SendPub   []byte       `json:"send_pub"`
+	RecvPub   []byte       `json:"recv_pub,omitempty"`
+	SendChain []byte       `json:"send_chain,omitempty"`
+	RecvChain []byte       `json:"recv_chain,omitempty"`
+	Ns        uint32       `json:"ns"`
+	Nr        uint32       `json:"nr"`
+	PN        uint32       `json:"pn"`
+	Skipped   []skippedKey `json:"skipped,omitempty"`
+
+	// Version is the packet version of the session: sessionVersion for
+	// classic X3DH, hybridVersion for the hybrid handshake. Sessions saved
+	// before hybrid support have no version and are classic.
+	Version int `json:"version,omitempty"`
+
+	// PendingEK is the initiator's X3DH ephemeral key. It is attached to
+	// every outgoing message until the first reply arrives, so the contact
+	// can set up the session from whichever message reaches them first.
+	PendingEK  []byte `json:"pending_ek,omitempty"`
+	PendingSPK uint32 `json:"pending_spk,omitempty"`
+	PendingOPK uint32 `json:"pending_opk,omitempty"`
+	// PendingKEMCT is the ML-KEM ciphertext of a hybrid handshake, sent
+	// alongside PendingEK.
+	PendingKEMCT []byte `json:"pending_kem_ct,omitempty"`
+}
+
+// ratchetHeader is the cleartext header of a ratchet message.
+type ratchetHeader struct {
+	DH []byte
+	PN uint32
+	N  uint32
+}
+
+// encode returns the header bytes covered by the AEAD.
+func (h ratchetHeader) encode() []byte {
+	b := make([]byte, 0, len(h.DH)+8)
+	b = append(b, h.DH...)
+	b = binary.BigEndian.AppendUint32(b, h.PN)
+	b = binary.BigEndian.AppendUint32(b, h.N)
+	return b
+}
+
+// newKeyPair generates an X25519 key pair.
+func newKeyPair() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// kdfRoot advances the root key with a new DH output and returns the new
+// root key and chain key.
+func kdfRoot(rootKey, dhOut []byte) (newRoot, chainKey []byte, err error) {
+	out := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dhOut, rootKey, []byte(rootKDFLabel)), out); err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// kdfChain advances a chain key and returns the next chain key and the
+// message key for the current position.
+func kdfChain(chainKey []byte) (next, messageKey []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey = mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	next = mac.Sum(nil)
+	return next, messageKey
+}
+
+// messageAEAD expands a message key into an XChaCha20-Poly1305 key and nonce.
+// Every message key is used exactly once, so the nonce can be derived.
+func messageAEAD(messageKey []byte) (cipher.AEAD, []byte, error) {
+	out := make([]byte, chacha20poly1305.KeySize+chacha20poly1305.NonceSizeX)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, messageKey, nil, []byte(messageKDFLabel)), out); err != nil {
+		return nil, nil, err
+	}
+	aead, err := chacha20poly1305.NewX(out[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, out[chacha20poly1305.KeySize:], nil
+}
+
+// newInitiatorRatchet starts a session as the party that ran X3DH, sending
+// to the contact's signed prekey remotePub.
+func newInitiatorRatchet(sharedKey, remotePub []byte) (*ratchetState, error) {
+	priv, pub, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	dh, err := curve25519.X25519(priv, remotePub)
+	if err != nil {
+		return nil, err
+	}
+	root, chain, err := kdfRoot(sharedKey, dh)
+	if err != nil {
+		return nil, err
+	}
+	return &ratchetState{
+		RootKey:   root,
+		SendPriv:  priv,
+		SendPub:   pub,
+		RecvPub:   remotePub,
+		SendChain: chain,
+	}, nil
+}
+
+// newResponderRatchet starts a session as the party whose signed prekey
+// (priv, pub) was used by the initiator.
+func newResponderRatchet(sharedKey, priv, pub []byte) *ratchetState {
+	return &ratchetState{
+		RootKey:  sharedKey,
+		SendPriv: priv,
+		SendPub:  pub,
+	}
+}
+
+// encrypt seals plaintext under the next sending message key. ad is the
+// packet header, to which the ratchet header is appended.
+func (s *ratchetState) encrypt(plaintext, ad []byte) (ratchetHeader, []byte, error) {
+	if s.SendChain == nil {
+		return ratchetHeader{}, nil, errors.New("session cannot send yet")
+	}
+	next, mk := kdfChain(s.SendChain)
+	h := ratchetHeader{DH: s.SendPub, PN: s.PN, N: s.Ns}
+	aead, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return ratchetHeader{}, nil, err
+	}
+	s.SendChain = next
+	s.Ns++
+	return h, aead.Seal(nil, nonce, plaintext, appendHeader(ad, h)), nil
+}
+
+// decrypt opens a ratchet message. It modifies s even on failure, so callers
+// should decrypt with a clone and keep it only if decryption succeeds.
+func (s *ratchetState) decrypt(h ratchetHeader, ciphertext, ad []byte) ([]byte, error) {
+	ad = appendHeader(ad, h)
+
+	for i, sk := range s.Skipped {
+		if sk.N == h.N && bytes.Equal(sk.DH, h.DH) {
+			s.Skipped = append(s.Skipped[:i], s.Skipped[i+1:]...)
+			return openWithMessageKey(sk.Key, ciphertext, ad)
+		}
+	}
+
+	if !bytes.Equal(h.DH, s.RecvPub) {
+		if err := s.skipUntil(h.PN); err != nil {
+			return nil, err
+		}
+		if err := s.dhRatchet(h.DH); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skipUntil(h.N); err != nil {
+		return nil, err
+	}
+	next, mk := kdfChain(s.RecvChain)
+	s.RecvChain = next
+	s.Nr++
+	return openWithMessageKey(mk, ciphertext, ad)
+}
+
+// appendHeader returns a copy of ad followed by the encoded header.
+func appendHeader(ad []byte, h ratchetHeader) []byte {
+	return append(append([]byte(nil), ad...), h.encode()...)
+}
+
+func openWithMessageKey(mk, ciphertext, ad []byte) ([]byte, error) {
+	aead, nonce, err := messageAEAD(mk)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// skipUntil stores the message keys of the receiving chain up to message n.
+func (s *ratchetState) skipUntil(n uint32) error {
+	if s.RecvChain == nil {
+		return nil
+	}
+	if n > s.Nr+maxSkip {
+		return errTooManySkipped
+	}
+	for s.Nr < n {
+		next, mk := kdfChain(s.RecvChain)
+		s.Skipped = append(s.Skipped, skippedKey{DH: s.RecvPub, N: s.Nr, Key: mk})
+		s.RecvChain = next
+		s.Nr++
+	}
+	if over := len(s.Skipped) - maxSkippedKeys; over > 0 {
+		s.Skipped = s.Skipped[over:]
+	}
+	return nil
+}
+
+// dhRatchet performs a DH ratchet step on receipt of a new ratchet key.
+func (s *ratchetState) dhRatchet(remotePub []byte) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+	s.RecvPub = remotePub
+
+	dh, err := curve25519.X25519(s.SendPriv, remotePub)
+	if err != nil {
+		return err
+	}
+	if s.RootKey, s.RecvChain, err = kdfRoot(s.RootKey, dh); err != nil {
+		return err
+	}
+
+	if s.SendPriv, s.SendPub, err = newKeyPair(); err != nil {
+		return err
+	}
+	if dh, err = curve25519.X25519(s.SendPriv, remotePub); err != nil {
+		return err
+	}
+	s.RootKey, s.SendChain, err = kdfRoot(s.RootKey, dh)
+	return err
+}
+
+// version returns the packet version of messages on this session.
+func (s *ratchetState) version() int {
+	if s.Version == 0 {
+		return sessionVersion
+	}
+	return s.Version
+}
+
+// clone returns a deep copy of s.
+func (s *ratchetState) clone() *ratchetState {
+	c := *s
+	c.Skipped = append([]skippedKey(nil), s.Skipped...)
+	return &c
+}
+
+// String keeps key material out of accidental log output.
+func (s *ratchetState) String() string {
+	return fmt.Sprintf("ratchet(ns=%d nr=%d pn=%d skipped=%d)", s.Ns, s.Nr, s.PN, len(s.Skipped))
+}
@@ -0,0 +1,262 @@
+package core
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Receipts are payloads whose receipt field is
+//
+//	type | message ID*
+//
+// acknowledging messages from the identity they are sent to. Delivery
+// receipts are sent once a message has been decrypted, read receipts when
+// it is shown, if the user allows them.
+const (
+	ReceiptDelivered = 1
+	ReceiptRead      = 2
+
+	// maxReceiptIDs bounds the messages acknowledged by one receipt.
+	maxReceiptIDs = 256
+	// maxTrackedSent bounds how many sent messages keep a status.
+	maxTrackedSent = 500
+	// SentPreviewSize is how much of a sent message is kept to show next
+	// to its status.
+	SentPreviewSize = 40
+)
+
+// DeliveryStatus is how far a sent message has got. It only moves
+// forward.
+type DeliveryStatus int
+
+const (
+	// StatusQueued is a message not yet accepted by the relay.
+	StatusQueued DeliveryStatus = iota
+	// StatusRelayed is a message the relay holds for the recipient.
+	StatusRelayed
+	// StatusDelivered is a message one of the recipient's devices has
+	// decrypted.
+	StatusDelivered
+	// StatusRead is a message the recipient has seen.
+	StatusRead
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case StatusRelayed:
+		return "relayed"
+	case StatusDelivered:
+		return "delivered"
+	case StatusRead:
+		return "read"
+	}
+	return "queued"
+}
+
+// receipt is a decoded receipt field.
+type receipt struct {
+	Type byte
+	IDs  []string
+}
+
+func encodeReceipt(typ byte, ids []string) []byte {
+	b := []byte{typ}
+	for _, id := range ids {
+		raw, _ := hex.DecodeString(id)
+		b = append(b, raw...)
+	}
+	return b
+}
+
+func parseReceipt(b []byte) (*receipt, error) {
+	if len(b) < 1+messageIDSize || (len(b)-1)%messageIDSize != 0 || len(b)-1 > maxReceiptIDs*messageIDSize {
+		return nil, errMalformedPayload
+	}
+	if b[0] != ReceiptDelivered && b[0] != ReceiptRead {
+		return nil, errMalformedPayload
+	}
+	r := &receipt{Type: b[0]}
+	for rest := b[1:]; len(rest) > 0; rest = rest[messageIDSize:] {
+		r.IDs = append(r.IDs, hex.EncodeToString(rest[:messageIDSize]))
+	}
+	return r, nil
+}
+
+// WantsReceipt reports whether msg, received from another identity, should
+// be acknowledged: it is a message of its own with something to show, not
+// a receipt, an edit or a reaction.
+func WantsReceipt(msg *Message) bool {
+	return msg.Receipt == nil && msg.SyncTo == nil && msg.IsText() && (len(msg.Body) > 0 || msg.Attachment != nil)
+}
+
+// ReceiptPackets returns the packets acknowledging ids from the identity
+// toID.
+func (st *Store) ReceiptPackets(toID string, typ byte, ids []string) ([]EncryptedMessage, error) {
+	var packets []EncryptedMessage
+	for chunk := range slices.Chunk(ids, maxReceiptIDs) {
+		msg, err := NewMessage(nil)
+		if err != nil {
+			return nil, err
+		}
+		msg.Receipt = encodeReceipt(typ, chunk)
+		p, err := st.SealMessage(toID, msg)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+	}
+	return packets, nil
+}
+
+// SentMessage is the status of a message we sent.
+type SentMessage struct {
+	ID      string         `json:"id"`
+	To      string         `json:"to"`
+	Preview string         `json:"preview"`
+	Sent    int64          `json:"sent"`
+	Expires int64          `json:"expires,omitempty"`
+	Status  DeliveryStatus `json:"status"`
+}
+
+func (st *Store) sentPath() string {
+	return filepath.Join(filepath.Dir(st.dir), "sent.bin")
+}
+
+// loadSent returns the tracked sent messages, oldest first, without those
+// that have disappeared.
+func (st *Store) loadSent() ([]*SentMessage, error) {
+	var sent []*SentMessage
+	err := readSealedFile(st.sentPath(), st.key, "sent", &sent)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load sent messages: %w", err)
+	}
+	now := time.Now().Unix()
+	return slices.DeleteFunc(sent, func(s *SentMessage) bool {
+		return s.Expires != 0 && now >= s.Expires
+	}), nil
+}
+
+func (st *Store) saveSent(sent []*SentMessage) error {
+	if len(sent) > maxTrackedSent {
+		sent = sent[len(sent)-maxTrackedSent:]
+	}
+	if err := writeSealedFile(st.sentPath(), st.key, "sent", sent); err != nil {
+		return fmt.Errorf("failed to save sent messages: %w", err)
+	}
+	return nil
+}
+
+// TrackSent starts tracking msg, about to be sent to the identity toID, as
+// queued.
+func (st *Store) TrackSent(toID string, msg *Message) error {
+	sent, err := st.loadSent()
+	if err != nil {
+		return err
+	}
+	sent = append(sent, &SentMessage{
+		ID:      msg.IDString(),
+		To:      toID,
+		Preview: messagePreview(msg),
+		Sent:    msg.Sent.UnixMilli(),
+		Expires: PacketExpiry(msg),
+	})
+	return st.saveSent(sent)
+}
+
+// SetStatus moves the messages ids sent to the identity from forward to
+// status, and returns those that changed. Receipts can only acknowledge
+// messages sent to their sender; from is empty for our own updates.
+func (st *Store) SetStatus(from string, ids []string, status DeliveryStatus) ([]*SentMessage, error) {
+	sent, err := st.loadSent()
+	if err != nil {
+		return nil, err
+	}
+	var changed []*SentMessage
+	for _, s := range sent {
+		if !slices.Contains(ids, s.ID) || (from != "" && s.To != from) || s.Status >= status {
+			continue
+		}
+		s.Status = status
+		changed = append(changed, s)
+	}
+	if changed == nil {
+		return nil, nil
+	}
+	return changed, st.saveSent(sent)
+}
+
+// HandleReceipt applies a receipt from the identity from.
+func (st *Store) HandleReceipt(from string, msg *Message) ([]*SentMessage, error) {
+	r, err := parseReceipt(msg.Receipt)
+	if err != nil {
+		return nil, err
+	}
+	status := StatusDelivered
+	if r.Type == ReceiptRead {
+		status = StatusRead
+	}
+	return st.SetStatus(from, r.IDs, status)
+}
+
+// SentTo returns the tracked messages sent to the identity id, oldest
+// first.
+func (st *Store) SentTo(id string) ([]*SentMessage, error) {
+	sent, err := st.loadSent()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(sent, func(s *SentMessage) bool {
+		return id != "" && s.To != id
+	}), nil
+}
+
+// moveSent files the messages sent to oldID under newID after a rotation.
+func (st *Store) moveSent(oldID, newID string) error {
+	sent, err := st.loadSent()
+	if err != nil {
+		return err
+	}
+	moved := false
+	for _, s := range sent {
+		if s.To == oldID {
+			s.To, moved = newID, true
+		}
+	}
+	if !moved {
+		return nil
+	}
+	return st.saveSent(sent)
+}
+
+// ReceiptSettings are the receipt preferences of the identity.
+type ReceiptSettings struct {
+	// ReadReceipts lets contacts know when their messages were shown.
+	ReadReceipts bool `json:"read_receipts"`
+}
+
+func (st *Store) receiptSettingsPath() string {
+	return filepath.Join(filepath.Dir(st.dir), "receipts.bin")
+}
+
+// LoadReceiptSettings returns the receipt preferences. Read receipts are
+// off until the user turns them on.
+func (st *Store) LoadReceiptSettings() (ReceiptSettings, error) {
+	var s ReceiptSettings
+	err := readSealedFile(st.receiptSettingsPath(), st.key, "receipts", &s)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return s, fmt.Errorf("failed to load receipt settings: %w", err)
+	}
+	return s, nil
+}
+
+func (st *Store) SaveReceiptSettings(s ReceiptSettings) error {
+	if err := writeSealedFile(st.receiptSettingsPath(), st.key, "receipts", s); err != nil {
+		return fmt.Errorf("failed to save receipt settings: %w", err)
+	}
+	return nil
+}
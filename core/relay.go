@@ -0,0 +1,493 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// DefaultRelayURL is the relay used for messages and prekeys.
+const DefaultRelayURL = "http://localhost:8080"
+
+// Defaults of a new Relay.
+const (
+	defaultRelayTimeout    = 30 * time.Second
+	defaultRelayAttempts   = 4
+	defaultRelayMinBackoff = 500 * time.Millisecond
+	defaultRelayMaxBackoff = 10 * time.Second
+
+	// maxRelayMessage bounds the reason read from an error response.
+	maxRelayMessage = 512
+)
+
+// Relay is a client of the relay at url. A request that cannot reach the
+// relay, or that the relay fails with a server error, is tried again after
+// an exponential backoff with jitter, unless the relay consumes what it
+// returns. Its fields may be changed before the first request.
+type Relay struct {
+	url string
+	// Timeout bounds each attempt at a request, reading the response
+	// included. Zero means no limit.
+	Timeout time.Duration
+	// Attempts is how many times a request is tried in all.
+	Attempts int
+	// MinBackoff is the longest wait before the first retry. It doubles
+	// for every retry after that, up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Transport makes the requests, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+}
+
+// NewRelay returns a client of the relay at url with the default timeout
+// and retries.
+func NewRelay(url string) *Relay {
+	return &Relay{
+		url:        strings.TrimRight(url, "/"),
+		Timeout:    defaultRelayTimeout,
+		Attempts:   defaultRelayAttempts,
+		MinBackoff: defaultRelayMinBackoff,
+		MaxBackoff: defaultRelayMaxBackoff,
+	}
+}
+
+// URL returns the address of the relay.
+func (r *Relay) URL() string {
+	return r.url
+}
+
+// Errors a RelayError matches, by the status the relay answered with.
+var (
+	// ErrRelayUnavailable is a relay that could not be reached or failed
+	// the request, even after retries. Trying later may succeed.
+	ErrRelayUnavailable = errors.New("relay unavailable")
+	// ErrRelayNotFound is a request for something the relay does not hold.
+	ErrRelayNotFound = errors.New("not found on relay")
+	// ErrRelayRejected is a request the relay refused as malformed,
+	// unauthorized or too large. Sending it again will not help.
+	ErrRelayRejected = errors.New("rejected by relay")
+	// ErrRelayConflict is an upload that conflicts with what the relay
+	// already holds, such as a stale prekey upload.
+	ErrRelayConflict = errors.New("conflicts with relay state")
+	// ErrIdentityRotated is an upload for an identity that has rotated to
+	// a new key.
+	ErrIdentityRotated = errors.New("identity has rotated")
+)
+
+// RelayError is a request that failed at the relay or on the way to it.
+type RelayError struct {
+	// Op describes the request, as in "failed to <Op>".
+	Op string
+	// Status is the HTTP status of the response, 0 if none arrived.
+	Status int
+	// Message is the reason the relay gave, if any.
+	Message string
+	// Err is why no response arrived.
+	Err error
+}
+
+func (e *RelayError) Error() string {
+	switch {
+	case e.Status == 0:
+		return fmt.Sprintf("failed to %s: %v", e.Op, e.Err)
+	case e.Message != "":
+		return fmt.Sprintf("failed to %s: %d %s: %s", e.Op, e.Status, http.StatusText(e.Status), e.Message)
+	default:
+		return fmt.Sprintf("failed to %s: relay returned %d %s", e.Op, e.Status, http.StatusText(e.Status))
+	}
+}
+
+// Unwrap returns the Err* error of the status, and Err.
+func (e *RelayError) Unwrap() []error {
+	var kind error
+	switch {
+	case e.Status == 0 || e.Status == http.StatusTooManyRequests || e.Status >= 500:
+		kind = ErrRelayUnavailable
+	case e.Status == http.StatusNotFound:
+		kind = ErrRelayNotFound
+	case e.Status == http.StatusConflict:
+		kind = ErrRelayConflict
+	case e.Status == http.StatusGone:
+		kind = ErrIdentityRotated
+	default:
+		kind = ErrRelayRejected
+	}
+	if e.Err == nil {
+		return []error{kind}
+	}
+	return []error{kind, e.Err}
+}
+
+// retryable reports whether a request that got status may succeed if it
+// is sent again.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// do sends a request to path on the relay and returns the response once
+// the relay accepts it with 200 OK, retrying as described on Relay. op
+// names the request in errors. The caller closes the response body.
+func (r *Relay) do(ctx context.Context, op, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	return r.send(ctx, max(r.Attempts, 1), op, method, path, header, body)
+}
+
+// doOnce is do for a request the relay answers by deleting what it
+// returns, such as the mailbox or a one-time prekey. It is not retried:
+// if the response was lost, a retry would not get back what it held.
+func (r *Relay) doOnce(ctx context.Context, op, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	return r.send(ctx, 1, op, method, path, header, body)
+}
+
+// send makes up to attempts tries at a request for do.
+func (r *Relay) send(ctx context.Context, attempts int, op, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	client := &http.Client{Transport: r.Transport, Timeout: r.Timeout}
+	var err error
+	for attempt := range attempts {
+		if attempt > 0 {
+			t := time.NewTimer(r.backoff(attempt - 1))
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return nil, fmt.Errorf("failed to %s: %w", op, context.Cause(ctx))
+			case <-t.C:
+			}
+		}
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, method, r.url+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to %s: %w", op, err)
+		}
+		maps.Copy(req.Header, header)
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, fmt.Errorf("failed to %s: %w", op, context.Cause(ctx))
+		}
+		if err != nil {
+			err = &RelayError{Op: op, Err: err}
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxRelayMessage))
+		resp.Body.Close()
+		err = &RelayError{Op: op, Status: resp.StatusCode, Message: string(bytes.TrimSpace(msg))}
+		if !retryable(resp.StatusCode) {
+			break
+		}
+	}
+	return nil, err
+}
+
+// backoff returns the wait before retry n, counting from 0: a random
+// duration between half and all of MinBackoff << n, capped at MaxBackoff.
+func (r *Relay) backoff(n int) time.Duration {
+	d := r.MaxBackoff
+	if n < 32 && r.MinBackoff > 0 && r.MinBackoff<<n < d {
+		d = r.MinBackoff << n
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// get fetches the JSON document at path into v. found is false if the
+// relay holds none.
+func (r *Relay) get(ctx context.Context, op, path string, v any) (found bool, err error) {
+	resp, err := r.do(ctx, op, http.MethodGet, path, nil, nil)
+	return decodeFound(op, resp, err, v)
+}
+
+// decodeFound decodes the JSON response of a get into v. found is false
+// if the relay answered 404.
+func decodeFound(op string, resp *http.Response, err error, v any) (bool, error) {
+	if errors.Is(err, ErrRelayNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("failed to %s: %w", op, err)
+	}
+	return true, nil
+}
+
+// post uploads v as JSON to path and decodes the response into result
+// unless it is nil.
+func (r *Relay) post(ctx context.Context, op, path string, v, result any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(ctx, op, http.MethodPost, path, http.Header{"Content-Type": {"application/json"}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to %s: %w", op, err)
+	}
+	return nil
+}
+
+// errNoBundle is returned when a contact has not published prekeys.
+var errNoBundle = errors.New("contact has not published prekeys")
+
+// PostPacket hands a packet to the relay for delivery. The relay drops
+// a packet it already holds, so a retry does not deliver it twice.
+func (r *Relay) PostPacket(ctx context.Context, m EncryptedMessage) error {
+	body, err := encodeEnvelope(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode packet: %w", err)
+	}
+	resp, err := r.do(ctx, "send message to server", http.MethodPost, "/send", http.Header{"Content-Type": {wireContentType}}, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// FetchPackets collects the packets waiting for id on the relay, which
+// deletes them as it answers, so the request is not retried. Packets that
+// cannot be decoded are logged and skipped. The response header is
+// returned for the prekey pool status.
+func (r *Relay) FetchPackets(ctx context.Context, id string) ([]EncryptedMessage, http.Header, error) {
+	resp, err := r.doOnce(ctx, "fetch messages", http.MethodGet, "/fetch?id="+url.QueryEscape(id), http.Header{"Accept": {wireContentType}}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != wireContentType {
+		return nil, nil, fmt.Errorf("failed to fetch messages: relay does not support binary packets")
+	}
+
+	// Messages are deleted from the relay once fetched, so decode whatever
+	// arrived even if the stream was cut short.
+	frames, err := readFrames(resp.Body)
+	if err != nil {
+		log.Println("Error reading messages from relay:", err)
+	}
+	var msgs []EncryptedMessage
+	for _, f := range frames {
+		m, err := decodePacket(f)
+		if err != nil {
+			log.Println("Dropped undecodable packet:", err)
+			continue
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, resp.Header, nil
+}
+
+// fetchPreKeyBundle fetches and verifies id's prekey bundle, consuming one
+// of their one-time prekeys on the relay, so the request is not retried.
+func (r *Relay) fetchPreKeyBundle(ctx context.Context, id string) (*preKeyBundle, error) {
+	var b preKeyBundle
+	resp, err := r.doOnce(ctx, "fetch prekeys", http.MethodGet, "/prekeys?id="+url.QueryEscape(id), nil, nil)
+	found, err := decodeFound("fetch prekeys", resp, err, &b)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errNoBundle
+	}
+	if err := b.verify(id); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// uploadPreKeys publishes a signed prekey upload and returns the relay's
+// count of our one-time prekeys afterwards.
+func (r *Relay) uploadPreKeys(ctx context.Context, u *preKeyUpload) (PreKeyStatus, error) {
+	var status PreKeyStatus
+	if err := r.post(ctx, "upload prekeys", "/prekeys", u, &status); err != nil {
+		return PreKeyStatus{}, err
+	}
+	return status, nil
+}
+
+// fetchPreKeyStatus asks the relay how many of id's one-time prekeys are left.
+func (r *Relay) fetchPreKeyStatus(ctx context.Context, id string) (PreKeyStatus, error) {
+	var status PreKeyStatus
+	_, err := r.get(ctx, "fetch prekey status", "/prekeys/status?id="+url.QueryEscape(id), &status)
+	return status, err
+}
+
+// PublishRotation hands a rotation statement to the relay, which retires
+// the old identity's prekeys.
+func (r *Relay) PublishRotation(ctx context.Context, s *RotationStatement) error {
+	return r.post(ctx, "publish rotation", "/rotations", s, nil)
+}
+
+// fetchRotation returns the rotation statement published for the old
+// identity id, or nil if it has not rotated. The caller verifies it.
+func (r *Relay) fetchRotation(ctx context.Context, id string) (*RotationStatement, error) {
+	return r.getRotation(ctx, "id="+url.QueryEscape(id))
+}
+
+// fetchRotationTo returns the rotation statement that introduced the
+// identity id, or nil if there is none. The caller verifies it.
+func (r *Relay) fetchRotationTo(ctx context.Context, id string) (*RotationStatement, error) {
+	return r.getRotation(ctx, "new="+url.QueryEscape(id))
+}
+
+func (r *Relay) getRotation(ctx context.Context, query string) (*RotationStatement, error) {
+	var s RotationStatement
+	found, err := r.get(ctx, "fetch rotation", "/rotations?"+query, &s)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// uploadDeviceList publishes our signed device list.
+func (r *Relay) uploadDeviceList(ctx context.Context, l *DeviceList) error {
+	return r.post(ctx, "publish devices", "/devices", l, nil)
+}
+
+// FetchDeviceList returns the device list of the identity id, or nil if
+// it has linked no devices. The caller verifies it.
+func (r *Relay) FetchDeviceList(ctx context.Context, id string) (*DeviceList, error) {
+	var l DeviceList
+	found, err := r.get(ctx, "fetch devices", "/devices?id="+url.QueryEscape(id), &l)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// createBlob starts the upload of the blob req describes. The relay gives
+// a retry of the same request the same blob.
+func (r *Relay) createBlob(ctx context.Context, req *blobRequest) (*blobInfo, error) {
+	var info blobInfo
+	if err := r.post(ctx, "start upload", "/blobs", req, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// fetchBlobInfo returns the relay's description of the blob id, or nil if
+// it does not exist or has expired.
+func (r *Relay) fetchBlobInfo(ctx context.Context, id string) (*blobInfo, error) {
+	var info blobInfo
+	found, err := r.get(ctx, "fetch upload", "/blobs?id="+url.QueryEscape(id), &info)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// uploadChunk stores chunk n of the blob id, which must follow the last
+// one stored. The relay accepts a chunk again if it is unchanged, so a
+// retry after a lost response succeeds.
+func (r *Relay) uploadChunk(ctx context.Context, id string, n uint32, chunk []byte) error {
+	resp, err := r.do(ctx, "upload", http.MethodPut, fmt.Sprintf("/blobs/chunk?id=%s&n=%d", url.QueryEscape(id), n), http.Header{"Content-Type": {"application/octet-stream"}}, chunk)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// fetchChunk downloads chunk n of the complete blob id.
+func (r *Relay) fetchChunk(ctx context.Context, id string, n uint32) ([]byte, error) {
+	resp, err := r.do(ctx, "download", http.MethodGet, fmt.Sprintf("/blobs/chunk?id=%s&n=%d", url.QueryEscape(id), n), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	chunk, err := io.ReadAll(io.LimitReader(resp.Body, attachmentChunkSize+chacha20poly1305.Overhead+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to download: %w", err)
+	}
+	if len(chunk) > attachmentChunkSize+chacha20poly1305.Overhead {
+		return nil, errAttachmentCorrupt
+	}
+	return chunk, nil
+}
+
+// PreKeyStatusFromHeader reads the prekey pool warning the relay attaches
+// to /fetch responses. ok is false if the relay holds no prekeys for us.
+func PreKeyStatusFromHeader(h http.Header) (status PreKeyStatus, ok bool) {
+	n, err := strconv.Atoi(h.Get("X-Prekeys-Remaining"))
+	if err != nil {
+		return PreKeyStatus{}, false
+	}
+	return PreKeyStatus{Remaining: n, Low: h.Get("X-Prekeys-Low") == "true"}, true
+}
+
+// relayAt returns a client of the relay at url with the settings of
+// st.Relay, or st.Relay itself if url is empty or its own.
+func (st *Store) relayAt(url string) *Relay {
+	if url == "" || url == st.Relay.url {
+		return st.Relay
+	}
+	r := *st.Relay
+	r.url = url
+	return &r
+}
+
+// relayFor returns the relay the identity or device id is reached on: the
+// one its contact names, or ours.
+func (st *Store) relayFor(id string) *Relay {
+	for owner, c := range st.devices {
+		if slices.Contains(c.ids, id) {
+			id = owner
+			break
+		}
+	}
+	c, err := st.Contacts().Lookup(id)
+	if err != nil || c == nil || c.ID != id {
+		return st.Relay
+	}
+	return st.relayAt(c.Relay)
+}
+
+// PublishPreKeys tops up our prekeys on the relay. If the relay refuses
+// the upload as conflicting with the pool it holds, which means we lost
+// track of that pool, the pool is replaced.
+func (st *Store) PublishPreKeys() (PreKeyStatus, error) {
+	status, err := st.Relay.fetchPreKeyStatus(st.ctx, hex.EncodeToString(st.pub))
+	if err != nil {
+		return PreKeyStatus{}, err
+	}
+	u, err := st.prekeys.replenish(status.Remaining, false)
+	if err != nil {
+		return PreKeyStatus{}, err
+	}
+	status, err = st.Relay.uploadPreKeys(st.ctx, u)
+	if !errors.Is(err, ErrRelayConflict) || u.Replace {
+		return status, err
+	}
+	if u, err = st.prekeys.replenish(0, true); err != nil {
+		return PreKeyStatus{}, err
+	}
+	return st.Relay.uploadPreKeys(st.ctx, u)
+}
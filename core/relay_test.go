@@ -0,0 +1,265 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// roundTripFunc makes a function an http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// countingRelay answers every request with status, counting them, until
+// it has failed fails times; after that it answers 200 with an empty
+// JSON object.
+func countingRelay(t *testing.T, status, fails int) (*Relay, *atomic.Int32) {
+	t.Helper()
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(n.Add(1)) <= fails {
+			http.Error(w, "try again", status)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	return testRelay(srv.URL), &n
+}
+
+// testRelay returns a client of url that retries three times without
+// waiting long.
+func testRelay(url string) *Relay {
+	r := NewRelay(url)
+	r.Attempts = 3
+	r.MinBackoff = time.Millisecond
+	r.MaxBackoff = 2 * time.Millisecond
+	return r
+}
+
+func TestRelayRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		fails     int
+		wantCalls int32
+		wantErr   error
+	}{
+		{"success", http.StatusOK, 0, 1, nil},
+		{"recovers", http.StatusServiceUnavailable, 2, 3, nil},
+		{"server error", http.StatusInternalServerError, 10, 3, ErrRelayUnavailable},
+		{"unavailable", http.StatusServiceUnavailable, 10, 3, ErrRelayUnavailable},
+		{"rate limited", http.StatusTooManyRequests, 10, 3, ErrRelayUnavailable},
+		{"bad request", http.StatusBadRequest, 10, 1, ErrRelayRejected},
+		{"forbidden", http.StatusForbidden, 10, 1, ErrRelayRejected},
+		{"conflict", http.StatusConflict, 10, 1, ErrRelayConflict},
+		{"gone", http.StatusGone, 10, 1, ErrIdentityRotated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, calls := countingRelay(t, tt.status, tt.fails)
+			err := r.post(context.Background(), "test", "/test", struct{}{}, nil)
+			if tt.wantErr == nil && err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("post = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil && !strings.Contains(err.Error(), "try again") {
+				t.Errorf("error %q leaves out the relay's reason", err)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("relay got %d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRelayNotFound(t *testing.T) {
+	r, calls := countingRelay(t, http.StatusNotFound, 10)
+	var v struct{}
+	found, err := r.get(context.Background(), "test", "/test", &v)
+	if err != nil || found {
+		t.Errorf("get = %v, %v, want not found", found, err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("relay got %d requests, want 1", calls.Load())
+	}
+}
+
+// TestRelayUnreachable checks that requests that get no response at all
+// are retried, and fail with ErrRelayUnavailable and the cause.
+func TestRelayUnreachable(t *testing.T) {
+	cause := errors.New("connection refused")
+	var calls atomic.Int32
+	r := testRelay("http://relay.invalid")
+	r.Transport = roundTripFunc(func(*http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return nil, cause
+	})
+	err := r.post(context.Background(), "test", "/test", struct{}{}, nil)
+	if !errors.Is(err, ErrRelayUnavailable) || !errors.Is(err, cause) {
+		t.Errorf("post = %v, want ErrRelayUnavailable wrapping %v", err, cause)
+	}
+	var re *RelayError
+	if !errors.As(err, &re) || re.Status != 0 {
+		t.Errorf("post = %#v, want a RelayError without status", err)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("made %d requests, want 3", calls.Load())
+	}
+}
+
+func TestRelayTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	r := testRelay(srv.URL)
+	r.Attempts = 2
+	r.Timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err := r.post(context.Background(), "test", "/test", struct{}{}, nil)
+	if !errors.Is(err, ErrRelayUnavailable) {
+		t.Errorf("post = %v, want ErrRelayUnavailable", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("post took %v with a timeout of %v", elapsed, r.Timeout)
+	}
+}
+
+// TestRelayCanceled checks that a canceled context stops the retries
+// rather than being reported as an unavailable relay.
+func TestRelayCanceled(t *testing.T) {
+	r, calls := countingRelay(t, http.StatusServiceUnavailable, 10)
+	r.MinBackoff, r.MaxBackoff = time.Hour, time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	err := r.post(ctx, "test", "/test", struct{}{}, nil)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, ErrRelayUnavailable) {
+		t.Errorf("post = %v, want context.Canceled", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("relay got %d requests, want 1", calls.Load())
+	}
+}
+
+// TestRelayConsumingRequests checks that fetching the mailbox and prekey
+// bundles, which the relay deletes as it answers, is tried only once, while
+// sending a packet is retried.
+func TestRelayConsumingRequests(t *testing.T) {
+	ctx := context.Background()
+	id := strings.Repeat("11", 32)
+	tests := []struct {
+		name      string
+		call      func(r *Relay) error
+		wantCalls int32
+	}{
+		{"fetch", func(r *Relay) error {
+			_, _, err := r.FetchPackets(ctx, id)
+			return err
+		}, 1},
+		{"prekey bundle", func(r *Relay) error {
+			_, err := r.fetchPreKeyBundle(ctx, id)
+			return err
+		}, 1},
+		{"send", func(r *Relay) error {
+			return r.PostPacket(ctx, EncryptedMessage{Version: sessionVersion, ToID: id, FromID: id, Ciphertext: "AAAA"})
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" after a server error", func(t *testing.T) {
+			r, calls := countingRelay(t, http.StatusServiceUnavailable, 10)
+			if err := tt.call(r); !errors.Is(err, ErrRelayUnavailable) {
+				t.Errorf("got %v, want ErrRelayUnavailable", err)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("relay got %d requests, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+		t.Run(tt.name+" after a lost response", func(t *testing.T) {
+			r, calls := countingRelay(t, http.StatusOK, 0)
+			r.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				resp, err := http.DefaultTransport.RoundTrip(req)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return nil, errors.New("connection reset")
+			})
+			if err := tt.call(r); !errors.Is(err, ErrRelayUnavailable) {
+				t.Errorf("got %v, want ErrRelayUnavailable", err)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("relay got %d requests, want %d", calls.Load(), tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		n        int
+		want     time.Duration
+	}{
+		{"first retry", 500 * time.Millisecond, 10 * time.Second, 0, 500 * time.Millisecond},
+		{"doubles", 500 * time.Millisecond, 10 * time.Second, 3, 4 * time.Second},
+		{"capped", 500 * time.Millisecond, 10 * time.Second, 5, 10 * time.Second},
+		{"shift past the cap", 500 * time.Millisecond, 10 * time.Second, 40, 10 * time.Second},
+		{"shift overflows", time.Hour, 24 * time.Hour, 62, 24 * time.Hour},
+		{"no backoff", 0, 0, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Relay{MinBackoff: tt.min, MaxBackoff: tt.max}
+			for range 100 {
+				if d := r.backoff(tt.n); d < tt.want/2 || d > tt.want {
+					t.Fatalf("backoff(%d) = %v, want between %v and %v", tt.n, d, tt.want/2, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayErrorUnwrap(t *testing.T) {
+	tests := []struct {
+		status int
+		want   error
+	}{
+		{0, ErrRelayUnavailable},
+		{http.StatusTooManyRequests, ErrRelayUnavailable},
+		{http.StatusInternalServerError, ErrRelayUnavailable},
+		{http.StatusBadGateway, ErrRelayUnavailable},
+		{http.StatusServiceUnavailable, ErrRelayUnavailable},
+		{http.StatusNotFound, ErrRelayNotFound},
+		{http.StatusConflict, ErrRelayConflict},
+		{http.StatusGone, ErrIdentityRotated},
+		{http.StatusBadRequest, ErrRelayRejected},
+		{http.StatusUnauthorized, ErrRelayRejected},
+		{http.StatusForbidden, ErrRelayRejected},
+		{http.StatusRequestEntityTooLarge, ErrRelayRejected},
+	}
+	sentinels := []error{ErrRelayUnavailable, ErrRelayNotFound, ErrRelayConflict, ErrIdentityRotated, ErrRelayRejected}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			err := error(&RelayError{Op: "test", Status: tt.status})
+			for _, s := range sentinels {
+				if got := errors.Is(err, s); got != (s == tt.want) {
+					t.Errorf("errors.Is(%d, %v) = %v", tt.status, s, got)
+				}
+			}
+		})
+	}
+}
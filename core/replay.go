@@ -0,0 +1,144 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// replayWindow is how long message IDs are remembered. Messages sent
+	// longer ago are rejected as stale.
+	replayWindow = 30 * 24 * time.Hour
+	// maxClockSkew is how far in the future a send time may lie.
+	maxClockSkew = time.Hour
+	// maxSeenIDs bounds the IDs remembered per contact. When it is reached
+	// the oldest are dropped and everything sent before them is rejected.
+	maxSeenIDs = 2000
+)
+
+// ErrReplay is returned for messages that were already received or are too
+// old to tell.
+var ErrReplay = errors.New("replayed or stale message")
+
+type seenID struct {
+	ID []byte `json:"id"`
+	// TS is the send time in Unix milliseconds, or the time of receipt for
+	// messages from older clients that carry none.
+	TS int64 `json:"ts"`
+}
+
+// seenWindow is the set of message IDs recently received from one contact.
+type seenWindow struct {
+	// Floor rejects messages sent at or before it, in Unix milliseconds.
+	Floor int64    `json:"floor,omitempty"`
+	IDs   []seenID `json:"ids"`
+}
+
+// check returns ErrReplay if m was seen before or falls outside the window.
+func (w *seenWindow) check(m *Message, now time.Time) error {
+	if !m.Sent.IsZero() {
+		sent := m.Sent.UnixMilli()
+		if sent <= w.Floor || m.Sent.Before(now.Add(-replayWindow)) {
+			return fmt.Errorf("%w: sent %s", ErrReplay, m.Sent.Format(time.DateTime))
+		}
+		if m.Sent.After(now.Add(maxClockSkew)) {
+			return fmt.Errorf("%w: sent in the future", ErrReplay)
+		}
+	}
+	for _, s := range w.IDs {
+		if bytes.Equal(s.ID, m.ID) {
+			return fmt.Errorf("%w: duplicate %s", ErrReplay, m.IDString())
+		}
+	}
+	return nil
+}
+
+// add records m and forgets IDs that have left the window.
+func (w *seenWindow) add(m *Message, now time.Time) {
+	ts := now.UnixMilli()
+	if !m.Sent.IsZero() {
+		ts = m.Sent.UnixMilli()
+	}
+	w.IDs = append(w.IDs, seenID{ID: m.ID, TS: ts})
+
+	cutoff := now.Add(-replayWindow).UnixMilli()
+	kept := w.IDs[:0]
+	for _, s := range w.IDs {
+		if s.TS >= cutoff {
+			kept = append(kept, s)
+		}
+	}
+	w.IDs = kept
+	for len(w.IDs) > maxSeenIDs {
+		oldest := 0
+		for i, s := range w.IDs {
+			if s.TS < w.IDs[oldest].TS {
+				oldest = i
+			}
+		}
+		w.Floor = max(w.Floor, w.IDs[oldest].TS)
+		w.IDs = append(w.IDs[:oldest], w.IDs[oldest+1:]...)
+	}
+}
+
+func (st *Store) seenPath(peerID string) string {
+	return filepath.Join(filepath.Dir(st.dir), "seen", peerID+".bin")
+}
+
+// loadSeen returns the seen window for peerID. If it cannot be decrypted,
+// only messages sent from now on are accepted from them.
+func (st *Store) loadSeen(peerID string) (*seenWindow, error) {
+	var w seenWindow
+	err := readSealedFile(st.seenPath(peerID), st.key, "seen:"+peerID, &w)
+	if errors.Is(err, os.ErrNotExist) {
+		return &seenWindow{}, nil
+	}
+	if errors.Is(err, errCorrupt) {
+		log.Printf("Seen messages for %s are corrupt; older messages from them will be rejected.\n", ShortID(peerID))
+		return &seenWindow{Floor: time.Now().UnixMilli()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (st *Store) saveSeen(peerID string, w *seenWindow) error {
+	if err := writeSealedFile(st.seenPath(peerID), st.key, "seen:"+peerID, w); err != nil {
+		return fmt.Errorf("failed to save seen messages: %w", err)
+	}
+	return nil
+}
+
+// accept parses a plaintext from peerID and checks it against their seen
+// window. Only if it is new is it recorded and commit called to persist the
+// session state that decrypted it, so a replay leaves no trace.
+func (st *Store) accept(peerID string, plain, ct []byte, commit func() error) (*Message, error) {
+	m, err := decodePayload(plain, ct)
+	if err != nil {
+		return nil, err
+	}
+	w, err := st.loadSeen(peerID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := w.check(m, now); err != nil {
+		return nil, err
+	}
+	w.add(m, now)
+	if err := st.saveSeen(peerID, w); err != nil {
+		return nil, err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
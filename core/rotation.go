@@ -0,0 +1,307 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	rotationLabel = "HEMSAEUCC identity rotation"
+
+	// maxRotationHops bounds how many statements are followed from one
+	// contact's ID, in case they rotated several times while we were away.
+	maxRotationHops = 8
+)
+
+// RotationStatement announces that the identity Old has been replaced by
+// New. It is signed by both keys: by the old one to show the owner made the
+// change, and by the new one so nobody can claim a key that is not theirs.
+type RotationStatement struct {
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	TS     int64  `json:"ts"`
+	OldSig []byte `json:"old_sig"`
+	NewSig []byte `json:"new_sig"`
+}
+
+// signedMessage returns the bytes covered by both signatures.
+func (s *RotationStatement) signedMessage() []byte {
+	oldPub, _ := hex.DecodeString(s.Old)
+	newPub, _ := hex.DecodeString(s.New)
+	b := append([]byte(rotationLabel), 0)
+	b = append(b, oldPub...)
+	b = append(b, newPub...)
+	return binary.BigEndian.AppendUint64(b, uint64(s.TS))
+}
+
+// NewRotationStatement signs the move from the identity (oldPriv, oldPub)
+// to (newPriv, newPub).
+func NewRotationStatement(oldPriv, oldPub, newPriv, newPub []byte) (*RotationStatement, error) {
+	s := &RotationStatement{
+		Old: hex.EncodeToString(oldPub),
+		New: hex.EncodeToString(newPub),
+		TS:  time.Now().Unix(),
+	}
+	var err error
+	if s.OldSig, err = xeddsaSign(oldPriv, s.signedMessage()); err != nil {
+		return nil, err
+	}
+	if s.NewSig, err = xeddsaSign(newPriv, s.signedMessage()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// verify checks that s moves oldID to a different key and carries valid
+// signatures by both.
+func (s *RotationStatement) verify(oldID string) error {
+	oldPub, err := DecodeID(s.Old)
+	if err != nil || s.Old != oldID {
+		return fmt.Errorf("rotation statement is not for %s", ShortID(oldID))
+	}
+	newPub, err := DecodeID(s.New)
+	if err != nil || bytes.Equal(oldPub, newPub) {
+		return fmt.Errorf("rotation statement for %s names no new key", ShortID(oldID))
+	}
+	if !xeddsaVerify(oldPub, s.signedMessage(), s.OldSig) || !xeddsaVerify(newPub, s.signedMessage(), s.NewSig) {
+		return fmt.Errorf("rotation statement for %s has a bad signature", ShortID(oldID))
+	}
+	return nil
+}
+
+// FollowRotation returns the current ID of the identity id, following the
+// rotation statements published on the relay. If id belongs to a contact,
+// the contact is moved to the new ID and returned; a verified contact stays
+// verified, since the old key vouched for the new one. While the relay
+// cannot be reached, the last ID known is kept.
+func FollowRotation(sessions *Store, contacts *ContactStore, id string) (string, *Contact, error) {
+	current := id
+	relay := sessions.relayFor(id)
+	for range maxRotationHops {
+		s, err := relay.fetchRotation(sessions.ctx, current)
+		if errors.Is(err, ErrRelayUnavailable) {
+			break
+		}
+		if err != nil {
+			return id, nil, err
+		}
+		if s == nil {
+			break
+		}
+		if err := s.verify(current); err != nil {
+			return id, nil, err
+		}
+		current = s.New
+	}
+	if current == id {
+		return id, nil, nil
+	}
+
+	if err := sessions.migrate(id, current); err != nil {
+		return id, nil, err
+	}
+	c, err := contacts.migrate(id, current)
+	if err != nil {
+		return id, nil, err
+	}
+	return current, c, nil
+}
+
+// FollowRotationTo checks whether newID, an identity we do not know, is
+// the rotated key of one of our contacts, and if so moves the contact to
+// it.
+func FollowRotationTo(sessions *Store, contacts *ContactStore, newID string) (*Contact, error) {
+	s, err := sessions.Relay.fetchRotationTo(sessions.ctx, newID)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if c, err := contacts.Lookup(s.Old); err != nil || c == nil {
+		return nil, err
+	}
+	current, c, err := FollowRotation(sessions, contacts, s.Old)
+	if err != nil {
+		return nil, err
+	}
+	if current != newID && c != nil {
+		// They have rotated again since; the contact follows the latest
+		// key, which is not the one this message came from.
+		log.Printf("%s has rotated their key more than once.\n", c.Label())
+	}
+	return c, nil
+}
+
+// migrate carries what we know about oldID's sessions over to newID: the
+// sessions themselves are bound to the old key, but whether they used the
+// hybrid handshake still guards against a downgrade. The disappearing
+// message timer, the status of sent messages and the conversation history
+// move with them.
+func (st *Store) migrate(oldID, newID string) error {
+	rec, err := st.load(oldID)
+	if err != nil {
+		return err
+	}
+	if rec.Hybrid {
+		next, err := st.load(newID)
+		if err != nil {
+			return err
+		}
+		if !next.Hybrid {
+			next.Hybrid = true
+			if err := st.save(newID, next); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Remove(st.path(oldID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := st.moveSent(oldID, newID); err != nil {
+		return err
+	}
+	h, err := st.History()
+	if err != nil {
+		return err
+	}
+	if err := h.move(oldID, newID); err != nil {
+		return err
+	}
+	return st.moveTimer(oldID, newID)
+}
+
+// RotationDir returns the directory where a rotation of keysDir is
+// prepared.
+func RotationDir(keysDir string) string {
+	return keysDir + ".rotating"
+}
+
+// StageIdentity saves the new identity next, protected by passphrase,
+// where RotateKeysDir will pick it up. It is written before the rotation is
+// published, so the new key survives whatever happens next.
+func StageIdentity(keysDir string, next *Identity, passphrase []byte) error {
+	staging := RotationDir(keysDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+	return next.Save(staging, passphrase)
+}
+
+// RotateKeysDir replaces the identity in keysDir with the one staged by
+// StageIdentity. State sealed under the old storage key is re-sealed under
+// the new one; sessions and prekeys, which are bound to the old identity,
+// are dropped, keeping only which contacts used hybrid sessions. The
+// message history, which must not be open, has its key sealed again and
+// our messages in it filed under the new ID.
+// The old directory is swapped out at the end and deleted.
+func RotateKeysDir(keysDir string, oldPriv, newPriv []byte) error {
+	oldKey, err := deriveStorageKey(oldPriv)
+	if err != nil {
+		return fmt.Errorf("failed to derive storage key: %w", err)
+	}
+	newKey, err := deriveStorageKey(newPriv)
+	if err != nil {
+		return fmt.Errorf("failed to derive storage key: %w", err)
+	}
+
+	staging := RotationDir(keysDir)
+	reseal := func(rel, name string, v any) error {
+		err := readSealedFile(filepath.Join(keysDir, rel), oldKey, name, v)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return writeSealedFile(filepath.Join(staging, rel), newKey, name, v)
+	}
+
+	if err := reseal("contacts.bin", "contacts", &[]Contact{}); err != nil {
+		return fmt.Errorf("failed to move contacts: %w", err)
+	}
+	if err := reseal("timers.bin", "timers", &map[string]timerSetting{}); err != nil {
+		return fmt.Errorf("failed to move timers: %w", err)
+	}
+	if err := reseal("sent.bin", "sent", &[]*SentMessage{}); err != nil {
+		return fmt.Errorf("failed to move sent messages: %w", err)
+	}
+	if err := reseal("receipts.bin", "receipts", &ReceiptSettings{}); err != nil {
+		return fmt.Errorf("failed to move receipt settings: %w", err)
+	}
+	if err := moveHistory(keysDir, staging, oldPriv, newPriv, oldKey, newKey); err != nil {
+		return fmt.Errorf("failed to move message history: %w", err)
+	}
+	for _, dir := range []string{"seen", "sessions"} {
+		entries, err := os.ReadDir(filepath.Join(keysDir, dir))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, e := range entries {
+			peerID, ok := strings.CutSuffix(e.Name(), ".bin")
+			if !ok {
+				continue
+			}
+			rel := filepath.Join(dir, e.Name())
+			if dir == "seen" {
+				if err := reseal(rel, "seen:"+peerID, &seenWindow{}); err != nil {
+					log.Printf("Seen messages for %s were not kept: %v\n", ShortID(peerID), err)
+				}
+				continue
+			}
+			var rec sessionRecord
+			if err := readSealedFile(filepath.Join(keysDir, rel), oldKey, "session:"+peerID, &rec); err != nil || !rec.Hybrid {
+				continue
+			}
+			if err := writeSealedFile(filepath.Join(staging, rel), newKey, "session:"+peerID, &sessionRecord{Hybrid: true}); err != nil {
+				return fmt.Errorf("failed to move sessions: %w", err)
+			}
+		}
+	}
+
+	retired := fmt.Sprintf("%s.retired-%d", keysDir, time.Now().Unix())
+	if err := os.Rename(keysDir, retired); err != nil {
+		return fmt.Errorf("failed to retire old identity: %w", err)
+	}
+	if err := os.Rename(staging, keysDir); err != nil {
+		os.Rename(retired, keysDir)
+		return fmt.Errorf("failed to install new identity: %w", err)
+	}
+	if err := os.RemoveAll(retired); err != nil {
+		log.Println("WARNING: the old identity could not be deleted from", retired+":", err)
+	}
+	return nil
+}
+
+// moveHistory copies the message history of keysDir to staging for the
+// new identity.
+func moveHistory(keysDir, staging string, oldPriv, newPriv, oldKey, newKey []byte) error {
+	src := filepath.Join(keysDir, "history.db")
+	if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err := rewrapHistory(src, filepath.Join(staging, "history.db"), oldKey, newKey); err != nil {
+		return err
+	}
+	oldPub, err := curve25519.X25519(oldPriv, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	newPub, err := curve25519.X25519(newPriv, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	h, err := openHistory(staging, newKey)
+	if err != nil {
+		return err
+	}
+	defer h.close()
+	return h.renameSender(hex.EncodeToString(oldPub), hex.EncodeToString(newPub))
+}
@@ -0,0 +1,257 @@
+package core
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The search index is the bucket search of the history, with a key
+//
+//	tag("term:" term) | tag(conv) | seq
+//
+// and no value for every term of every message, where the terms of a
+// message are its lowercased words and their prefixes from minPrefixRunes
+// runes. Like the rest of the history it names no word, conversation or
+// message in the clear, though how often a tag occurs still shows. Hits
+// are checked against the decrypted message before they are returned.
+const (
+	bucketSearch = "search"
+
+	// searchIndexVersion is stored in the meta bucket once the index
+	// covers every message, so a history from before it, or from a
+	// client tokenizing differently, is indexed again.
+	searchIndexVersion = "1"
+
+	minTermRunes   = 2
+	minPrefixRunes = 3
+	maxTermRunes   = 32
+	// maxSearchResults bounds the results of a search without a limit.
+	maxSearchResults = 100
+)
+
+// SearchQuery is what to look for in the history. Conv, Since and Until
+// are optional.
+type SearchQuery struct {
+	Text  string
+	Conv  string
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// SearchResult is a message found in the conversation Conv.
+type SearchResult struct {
+	Conv    string
+	Message *HistoryMessage
+}
+
+// searchWords returns the distinct lowercased words of text that are long
+// enough to search for, cut to maxTermRunes.
+func searchWords(text string) []string {
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if utf8.RuneCountInString(w) < minTermRunes {
+			continue
+		}
+		if r := []rune(w); len(r) > maxTermRunes {
+			w = string(r[:maxTermRunes])
+		}
+		if !slices.Contains(words, w) {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// indexTerms returns the terms text is indexed under: its words and their
+// prefixes.
+func indexTerms(text string) []string {
+	var terms []string
+	for _, w := range searchWords(text) {
+		r := []rune(w)
+		for n := minPrefixRunes; n < len(r); n++ {
+			terms = append(terms, string(r[:n]))
+		}
+		terms = append(terms, w)
+	}
+	slices.Sort(terms)
+	return slices.Compact(terms)
+}
+
+// matches reports whether every word of the query starts a word of text.
+func matches(text string, query []string) bool {
+	words := searchWords(text)
+	for _, q := range query {
+		if !slices.ContainsFunc(words, func(w string) bool {
+			return w == q || (utf8.RuneCountInString(q) >= minPrefixRunes && strings.HasPrefix(w, q))
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *HistoryStore) termTag(term string) []byte {
+	return h.tag("term:" + term)
+}
+
+// indexMessage adds the message seq of the conversation with tag ct to the
+// index, or removes it. Notices and deleted messages are not indexed.
+func (h *HistoryStore) indexMessage(tx *bolt.Tx, ct []byte, seq uint64, m *HistoryMessage, add bool) error {
+	if m.ID == "" || m.Deleted {
+		return nil
+	}
+	b := tx.Bucket([]byte(bucketSearch))
+	for _, term := range indexTerms(m.Text) {
+		key := slices.Concat(h.termTag(term), ct, seqKey(seq))
+		var err error
+		if add {
+			err = b.Put(key, nil)
+		} else {
+			err = b.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex builds the search index again if it is missing or out of date.
+func (h *HistoryStore) reindex() error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket([]byte(bucketHistoryMeta))
+		if string(meta.Get([]byte("index"))) == searchIndexVersion {
+			return nil
+		}
+		if err := tx.DeleteBucket([]byte(bucketSearch)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte(bucketSearch)); err != nil {
+			return err
+		}
+		err := tx.Bucket([]byte(bucketMessages)).ForEachBucket(func(ct []byte) error {
+			return tx.Bucket([]byte(bucketMessages)).Bucket(ct).ForEach(func(k, v []byte) error {
+				var m HistoryMessage
+				if err := h.open(messageAD(ct), k, v, &m); err != nil {
+					return err
+				}
+				return h.indexMessage(tx, ct, binary.BigEndian.Uint64(k), &m, true)
+			})
+		})
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte("index"), []byte(searchIndexVersion))
+	})
+}
+
+// Search returns the messages matching q, newest first. Every word of
+// q.Text must start a word of the message.
+func (h *HistoryStore) Search(q SearchQuery) ([]SearchResult, error) {
+	words := searchWords(q.Text)
+	if words == nil {
+		return nil, fmt.Errorf("search for at least one word of %d letters", minTermRunes)
+	}
+	if q.Limit <= 0 {
+		q.Limit = maxSearchResults
+	}
+	var convTag []byte
+	if q.Conv != "" {
+		convTag = h.tag(q.Conv)
+	}
+	var results []SearchResult
+	now := time.Now()
+	err := h.db.View(func(tx *bolt.Tx) error {
+		// Hits are tag(conv) | seq, found under every word.
+		var hits map[string]bool
+		for _, w := range words {
+			found := make(map[string]bool)
+			prefix := append(h.termTag(w), convTag...)
+			c := tx.Bucket([]byte(bucketSearch)).Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if hit := string(k[historyTagSize:]); hits == nil || hits[hit] {
+					found[hit] = true
+				}
+			}
+			if hits = found; len(hits) == 0 {
+				return nil
+			}
+		}
+		convs := make(map[string]string)
+		for hit := range hits {
+			if len(hit) != historyTagSize+8 {
+				return errCorrupt
+			}
+			ct, key := []byte(hit[:historyTagSize]), []byte(hit[historyTagSize:])
+			b := tx.Bucket([]byte(bucketMessages)).Bucket(ct)
+			if b == nil {
+				continue
+			}
+			v := b.Get(key)
+			if v == nil {
+				continue
+			}
+			var m HistoryMessage
+			if err := h.open(messageAD(ct), key, v, &m); err != nil {
+				return err
+			}
+			m.seq = binary.BigEndian.Uint64(key)
+			sent := time.UnixMilli(m.Sent)
+			if m.expired(now) || m.Deleted || !matches(m.Text, words) ||
+				(!q.Since.IsZero() && sent.Before(q.Since)) || (!q.Until.IsZero() && !sent.Before(q.Until)) {
+				continue
+			}
+			conv, ok := convs[string(ct)]
+			if !ok {
+				sealed := tx.Bucket([]byte(bucketConversations)).Get(ct)
+				if sealed == nil {
+					continue
+				}
+				var c Conversation
+				if err := h.open(bucketConversations, ct, sealed, &c); err != nil {
+					return err
+				}
+				conv, convs[string(ct)] = c.ID, c.ID
+			}
+			results = append(results, SearchResult{Conv: conv, Message: &m})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search message history: %w", err)
+	}
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		return cmp.Compare(b.Message.Sent, a.Message.Sent)
+	})
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+// ParseSearchDate reads a day such as 2024-05-31 in local time. With end
+// set it returns the start of the next day, to search up to the end of
+// that one.
+func ParseSearchDate(s string, end bool) (time.Time, error) {
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,458 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/mlkem"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// sessionVersion is the packet version of Double Ratchet messages.
+const sessionVersion = 3
+
+// maxArchivedSessions is how many replaced sessions are kept per contact so
+// that messages still in flight on them, or a session both sides started at
+// the same time, can be decrypted.
+const maxArchivedSessions = 4
+
+// ErrNoSession is returned when a message arrives on a session we do not have.
+var ErrNoSession = errors.New("no session with this contact")
+
+// sessionRecord is the persisted session state for one contact.
+type sessionRecord struct {
+	Current  *ratchetState   `json:"current,omitempty"`
+	Archived []*ratchetState `json:"archived,omitempty"`
+	// Hybrid is set once the contact has used the hybrid handshake, after
+	// which a classic-only prekey bundle for them is treated as a downgrade.
+	Hybrid bool `json:"hybrid,omitempty"`
+}
+
+// promote makes s the current session, archiving the previous one.
+func (r *sessionRecord) promote(s *ratchetState) {
+	archived := make([]*ratchetState, 0, maxArchivedSessions)
+	if r.Current != nil {
+		archived = append(archived, r.Current)
+	}
+	for _, a := range r.Archived {
+		if a != s && len(archived) < maxArchivedSessions {
+			archived = append(archived, a)
+		}
+	}
+	r.Current = s
+	r.Archived = archived
+}
+
+// Store keeps one Double Ratchet session per contact device,
+// encrypted at rest under keys/sessions.
+type Store struct {
+	dir     string
+	key     []byte
+	priv    []byte
+	pub     []byte
+	prekeys *preKeyStore
+	// account is the identity this device belongs to: pub itself on the
+	// primary device, the identity that linked it otherwise.
+	account []byte
+	devices map[string]cachedDevices
+	// hist is the message history, opened on first use.
+	hist  *HistoryStore
+	Relay *Relay
+	// KnownRelays are the URLs of relays, besides ours and those of the
+	// contacts, that attachments are downloaded from without asking, such
+	// as the relay profiles of the config.
+	KnownRelays []string
+	// ctx is the context of the relay requests the store makes itself.
+	ctx context.Context
+}
+
+// openSessionStore returns the session store for the device (priv, pub)
+// kept in keysDir.
+func openSessionStore(keysDir string, priv, pub []byte) (*Store, error) {
+	key, err := deriveStorageKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive storage key: %w", err)
+	}
+	return &Store{
+		dir:     filepath.Join(keysDir, "sessions"),
+		key:     key,
+		priv:    priv,
+		pub:     pub,
+		prekeys: newPreKeyStore(keysDir, key, priv, pub),
+		account: LinkedIdentity(keysDir, pub),
+		devices: make(map[string]cachedDevices),
+		Relay:   NewRelay(DefaultRelayURL),
+		ctx:     context.Background(),
+	}, nil
+}
+
+// SetContext sets the context of the relay requests the store makes on its
+// own, such as fetching prekeys to seal a message, so that cancelling ctx
+// stops them.
+func (st *Store) SetContext(ctx context.Context) {
+	st.ctx = ctx
+}
+
+// Context returns the context set with SetContext.
+func (st *Store) Context() context.Context {
+	return st.ctx
+}
+
+func (st *Store) path(peerID string) string {
+	return filepath.Join(st.dir, peerID+".bin")
+}
+
+// load returns the session record for peerID. A record that cannot be
+// decrypted is discarded, so the next message starts a fresh session.
+func (st *Store) load(peerID string) (*sessionRecord, error) {
+	var rec sessionRecord
+	err := readSealedFile(st.path(peerID), st.key, "session:"+peerID, &rec)
+	if errors.Is(err, os.ErrNotExist) {
+		return &sessionRecord{}, nil
+	}
+	if errors.Is(err, errCorrupt) {
+		log.Printf("Session with %s is corrupt and has been reset.\n", ShortID(peerID))
+		if err := os.Remove(st.path(peerID)); err != nil {
+			return nil, err
+		}
+		return &sessionRecord{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (st *Store) save(peerID string, rec *sessionRecord) error {
+	if err := writeSealedFile(st.path(peerID), st.key, "session:"+peerID, rec); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	return nil
+}
+
+// Session is the end-to-end session with one device of a contact: a
+// Double Ratchet started with X3DH, hybrid with ML-KEM when both sides
+// support it. The Store keeps it under keys/sessions; the first Seal
+// starts it.
+type Session struct {
+	st     *Store
+	peerID string
+}
+
+// Session returns the session with the device peerID.
+func (st *Store) Session(peerID string) *Session {
+	if pub, err := DecodeID(peerID); err == nil {
+		peerID = hex.EncodeToString(pub)
+	}
+	return &Session{st: st, peerID: peerID}
+}
+
+// PeerID returns the device the session is with.
+func (s *Session) PeerID() string {
+	return s.peerID
+}
+
+// Reset deletes the session. The next message sent to the peer starts a
+// new one. Whether they have used the hybrid handshake is kept.
+func (s *Session) Reset() error {
+	st, peerID := s.st, s.peerID
+	if _, err := DecodeID(peerID); err != nil {
+		return err
+	}
+	rec, err := st.load(peerID)
+	if err != nil {
+		return err
+	}
+	if rec.Hybrid {
+		return st.save(peerID, &sessionRecord{Hybrid: true})
+	}
+	err = os.Remove(st.path(peerID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Seal encrypts msg to the peer on the current session, starting one with
+// X3DH if there is none. The updated session is saved before the packet is
+// returned, so a message key is never reused.
+func (s *Session) Seal(msg *Message) (EncryptedMessage, error) {
+	return s.st.seal(s.peerID, msg)
+}
+
+// Open decrypts a packet the peer sent, like Store.Open.
+func (s *Session) Open(m EncryptedMessage) (*Message, error) {
+	if fromPub, err := DecodeID(m.FromID); err != nil || hex.EncodeToString(fromPub) != s.peerID {
+		return nil, fmt.Errorf("packet is not from %s", ShortID(s.peerID))
+	}
+	return s.st.Open(m)
+}
+
+// seal is Session.Seal for the device toID.
+func (st *Store) seal(toID string, msg *Message) (EncryptedMessage, error) {
+	toPub, err := DecodeID(toID)
+	if err != nil {
+		return EncryptedMessage{}, fmt.Errorf("invalid recipient ID format")
+	}
+	toID = hex.EncodeToString(toPub)
+	rec, err := st.load(toID)
+	if err != nil {
+		return EncryptedMessage{}, err
+	}
+
+	if rec.Current == nil {
+		s, err := st.initiate(toID, toPub, rec.Hybrid)
+		if err != nil {
+			return EncryptedMessage{}, fmt.Errorf("failed to start session: %w", err)
+		}
+		rec.promote(s)
+	}
+
+	s := rec.Current
+	version := s.version()
+	h, ct, err := s.encrypt(encodePayload(msg), headerAD(version, st.pub, toPub, s.PendingEK))
+	if err != nil {
+		return EncryptedMessage{}, fmt.Errorf("failed to encrypt: %w", err)
+	}
+	if version == hybridVersion {
+		rec.Hybrid = true
+	}
+	if err := st.save(toID, rec); err != nil {
+		return EncryptedMessage{}, err
+	}
+
+	m := EncryptedMessage{
+		Version:    version,
+		FromID:     hex.EncodeToString(st.pub),
+		ToID:       toID,
+		RatchetPK:  base64.StdEncoding.EncodeToString(h.DH),
+		PN:         h.PN,
+		N:          h.N,
+		Ciphertext: base64.StdEncoding.EncodeToString(ct),
+	}
+	if s.PendingEK != nil {
+		m.EphemeralPK = base64.StdEncoding.EncodeToString(s.PendingEK)
+		m.SignedPreKeyID = s.PendingSPK
+		m.OneTimePreKeyID = s.PendingOPK
+		if s.PendingKEMCT != nil {
+			m.KEMCiphertext = base64.StdEncoding.EncodeToString(s.PendingKEMCT)
+		}
+	}
+	return m, nil
+}
+
+// initiate starts a session with toID from their published prekey bundle,
+// using the hybrid handshake if the bundle carries an ML-KEM key. Contacts
+// that have not published a bundle are reached through their identity key,
+// which then serves as the signed prekey. wasHybrid refuses to fall back to
+// a classic handshake with a contact known to support the hybrid one.
+func (st *Store) initiate(toID string, toPub []byte, wasHybrid bool) (*ratchetState, error) {
+	spkID, spk := uint32(0), toPub
+	var opkID uint32
+	var opk []byte
+	var kem *mlkem.EncapsulationKey768
+
+	bundle, err := st.relayFor(toID).fetchPreKeyBundle(st.ctx, toID)
+	switch {
+	case err == nil:
+		spkID, spk = bundle.SignedPreKey.ID, bundle.SignedPreKey.Pub
+		if bundle.OneTimePreKey != nil {
+			opkID, opk = bundle.OneTimePreKey.ID, bundle.OneTimePreKey.Pub
+		}
+		if bundle.KEMPreKey != nil && hybridEnabled() {
+			if kem, err = mlkem.NewEncapsulationKey768(bundle.KEMPreKey.Pub); err != nil {
+				return nil, fmt.Errorf("invalid ML-KEM key: %w", err)
+			}
+		}
+	case !errors.Is(err, errNoBundle):
+		return nil, err
+	}
+	if kem == nil && wasHybrid && hybridEnabled() {
+		return nil, fmt.Errorf("relay offered no ML-KEM key for %s, who has used one before", ShortID(toID))
+	}
+
+	sk, ephPub, kemCT, err := x3dhInitiate(st.priv, toPub, spk, opk, kem)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newInitiatorRatchet(sk, spk)
+	if err != nil {
+		return nil, err
+	}
+	s.PendingEK = ephPub
+	s.PendingSPK = spkID
+	s.PendingOPK = opkID
+	if kem != nil {
+		s.Version = hybridVersion
+		s.PendingKEMCT = kemCT
+	}
+	return s, nil
+}
+
+// Open decrypts a packet addressed to us. Version 2 packets are opened with
+// the sealed-box scheme; version 3 (classic) and 4 (hybrid) packets are tried
+// against the current and archived sessions with the sender, and a prekey
+// message that matches none of them starts a new session. Messages already
+// received from the sender are rejected with ErrReplay, leaving the
+// sessions untouched.
+func (st *Store) Open(m EncryptedMessage) (*Message, error) {
+	switch m.Version {
+	case sealedVersion:
+		plain, err := openMessage(st.priv, st.pub, m)
+		if errors.Is(err, ErrSenderUnverified) {
+			msg, perr := decodePayload(plain, []byte(m.Ciphertext))
+			if perr != nil {
+				return nil, perr
+			}
+			return msg, err
+		}
+		if err != nil {
+			return nil, err
+		}
+		fromPub, err := DecodeID(m.FromID)
+		if err != nil {
+			return nil, err
+		}
+		return st.accept(hex.EncodeToString(fromPub), plain, []byte(m.Ciphertext), nil)
+	case sessionVersion, hybridVersion:
+	default:
+		return nil, fmt.Errorf("%w %d", errUnsupportedVersion, m.Version)
+	}
+
+	fromPub, err := DecodeID(m.FromID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender ID format")
+	}
+	toPub, err := DecodeID(m.ToID)
+	if err != nil || !bytes.Equal(toPub, st.pub) {
+		return nil, fmt.Errorf("packet is not addressed to us")
+	}
+	var ephPub []byte
+	if m.EphemeralPK != "" {
+		ephPub, err = base64.StdEncoding.DecodeString(m.EphemeralPK)
+		if err != nil || len(ephPub) != curve25519.PointSize {
+			return nil, fmt.Errorf("invalid ephemeral key")
+		}
+	}
+	var kemCT []byte
+	if m.Version == hybridVersion && ephPub != nil {
+		kemCT, err = base64.StdEncoding.DecodeString(m.KEMCiphertext)
+		if err != nil || len(kemCT) != mlkem.CiphertextSize768 {
+			return nil, fmt.Errorf("invalid ML-KEM ciphertext")
+		}
+	}
+	ratchetPub, err := base64.StdEncoding.DecodeString(m.RatchetPK)
+	if err != nil || len(ratchetPub) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid ratchet key")
+	}
+	ct, err := base64.StdEncoding.DecodeString(m.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+	h := ratchetHeader{DH: ratchetPub, PN: m.PN, N: m.N}
+	ad := headerAD(m.Version, fromPub, toPub, ephPub)
+
+	fromID := hex.EncodeToString(fromPub)
+	rec, err := st.load(fromID)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := rec.Archived
+	if rec.Current != nil {
+		candidates = append([]*ratchetState{rec.Current}, candidates...)
+	}
+	for _, s := range candidates {
+		if s.version() != m.Version {
+			continue
+		}
+		trial := s.clone()
+		plain, err := trial.decrypt(h, ct, ad)
+		if err != nil {
+			continue
+		}
+		// Any reply means the contact has the session.
+		trial.PendingEK = nil
+		return st.accept(fromID, plain, []byte(m.Ciphertext), func() error {
+			rec.Archived = replaceSession(rec.Archived, s, trial)
+			if rec.Current == s {
+				rec.Current = trial
+			} else {
+				rec.promote(trial)
+			}
+			return st.save(fromID, rec)
+		})
+	}
+
+	if ephPub == nil {
+		if len(candidates) == 0 {
+			return nil, ErrNoSession
+		}
+		return nil, fmt.Errorf("failed to decrypt")
+	}
+
+	spkPriv, spkPub, err := st.prekeys.signedPreKey(m.SignedPreKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept session: %w", err)
+	}
+	var opkPriv []byte
+	if m.OneTimePreKeyID != 0 {
+		if opkPriv, err = st.prekeys.oneTimePreKey(m.OneTimePreKeyID); err != nil {
+			return nil, fmt.Errorf("failed to accept session: %w", err)
+		}
+	}
+	var kem *mlkem.DecapsulationKey768
+	if kemCT != nil {
+		if kem, err = st.prekeys.kemPreKey(m.SignedPreKeyID); err != nil {
+			return nil, fmt.Errorf("failed to accept session: %w", err)
+		}
+	}
+	sk, err := x3dhRespond(st.priv, spkPriv, opkPriv, kem, kemCT, fromPub, ephPub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to accept session: %w", err)
+	}
+	s := newResponderRatchet(sk, spkPriv, spkPub)
+	s.Version = m.Version
+	plain, err := s.decrypt(h, ct, ad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt")
+	}
+	return st.accept(fromID, plain, []byte(m.Ciphertext), func() error {
+		if m.OneTimePreKeyID != 0 {
+			if err := st.prekeys.consume(m.OneTimePreKeyID); err != nil {
+				return err
+			}
+		}
+		rec.promote(s)
+		if m.Version == hybridVersion {
+			rec.Hybrid = true
+		}
+		return st.save(fromID, rec)
+	})
+}
+
+// replaceSession returns list with old replaced by s.
+func replaceSession(list []*ratchetState, old, s *ratchetState) []*ratchetState {
+	for i := range list {
+		if list[i] == old {
+			list[i] = s
+		}
+	}
+	return list
+}
+
+// DecodeID parses a hex HEMSAEUCC ID into the public key it names.
+func DecodeID(id string) ([]byte, error) {
+	pub, err := hex.DecodeString(id)
+	if err != nil || len(pub) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid ID %q", ShortID(id))
+	}
+	return pub, nil
+}
@@ -0,0 +1,424 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRelay serves the prekey directory of the relay from memory, refusing
+// one-time prekey IDs it already holds unless the upload replaces them.
+// Every other request is answered 404, as for an identity that has
+// published nothing.
+type fakeRelay struct {
+	mu      sync.Mutex
+	uploads map[string]*preKeyUpload
+}
+
+func newFakeRelay(t *testing.T) *httptest.Server {
+	t.Helper()
+	f := &fakeRelay{uploads: make(map[string]*preKeyUpload)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (f *fakeRelay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := r.URL.Query().Get("id")
+	switch {
+	case r.URL.Path == "/prekeys" && r.Method == http.MethodPost:
+		var u preKeyUpload
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			http.Error(w, "bad json", http.StatusBadRequest)
+			return
+		}
+		if prev := f.uploads[u.ID]; prev != nil && !u.Replace {
+			for _, k := range prev.OneTimePreKeys {
+				if slices.ContainsFunc(u.OneTimePreKeys, func(n oneTimePreKey) bool { return n.ID == k.ID }) {
+					http.Error(w, "one-time prekey ID already uploaded", http.StatusConflict)
+					return
+				}
+			}
+			u.OneTimePreKeys = append(prev.OneTimePreKeys, u.OneTimePreKeys...)
+		}
+		f.uploads[u.ID] = &u
+		json.NewEncoder(w).Encode(PreKeyStatus{Remaining: len(u.OneTimePreKeys)})
+	case r.URL.Path == "/prekeys/status":
+		var status PreKeyStatus
+		if u := f.uploads[id]; u != nil {
+			status.Remaining = len(u.OneTimePreKeys)
+		}
+		json.NewEncoder(w).Encode(status)
+	case r.URL.Path == "/prekeys" && f.uploads[id] != nil:
+		u := f.uploads[id]
+		b := preKeyBundle{ID: id, SignedPreKey: u.SignedPreKey, KEMPreKey: u.KEMPreKey}
+		if len(u.OneTimePreKeys) > 0 {
+			b.OneTimePreKey = &u.OneTimePreKeys[0]
+			u.OneTimePreKeys = u.OneTimePreKeys[1:]
+		}
+		json.NewEncoder(w).Encode(b)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newTestStore creates an identity in a temporary directory and opens its
+// store on the relay at url.
+func newTestStore(t *testing.T, url string) *Store {
+	t.Helper()
+	me, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysDir := filepath.Join(t.TempDir(), "keys")
+	if err := me.Save(keysDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	st, err := me.OpenStore(keysDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	st.Relay = NewRelay(url)
+	st.Relay.Attempts = 1
+	return st
+}
+
+// setClassic sets HEMSAEUCC_CLASSIC for what a client does next.
+func setClassic(t *testing.T, classic bool) {
+	if classic {
+		t.Setenv(classicOnlyEnvVar, "1")
+	} else {
+		t.Setenv(classicOnlyEnvVar, "")
+	}
+}
+
+// exchange sends body from one store to the other and checks that it
+// arrives on a session of version want.
+func exchange(t *testing.T, from, to *Store, body string, want int) {
+	t.Helper()
+	msg, err := NewMessage([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := from.Session(to.DeviceID()).Seal(msg)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if m.Version != want {
+		t.Errorf("packet version = %d, want %d", m.Version, want)
+	}
+	got, err := to.Session(from.DeviceID()).Open(m)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if string(got.Body) != body {
+		t.Errorf("body = %q, want %q", got.Body, body)
+	}
+}
+
+// TestHybridInterop starts sessions between clients with and without
+// hybrid support, chosen with HEMSAEUCC_CLASSIC, and checks that they fall
+// back to classic X3DH unless both sides support ML-KEM.
+func TestHybridInterop(t *testing.T) {
+	tests := []struct {
+		name                     string
+		aliceClassic, bobClassic bool
+		want                     int
+	}{
+		{"hybrid to hybrid", false, false, hybridVersion},
+		{"hybrid to classic", false, true, sessionVersion},
+		{"classic to hybrid", true, false, sessionVersion},
+		{"classic to classic", true, true, sessionVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := newFakeRelay(t)
+			alice, bob := newTestStore(t, relay.URL), newTestStore(t, relay.URL)
+
+			setClassic(t, tt.bobClassic)
+			if _, err := bob.PublishPreKeys(); err != nil {
+				t.Fatal(err)
+			}
+			setClassic(t, tt.aliceClassic)
+			exchange(t, alice, bob, "hello bob", tt.want)
+			exchange(t, alice, bob, "still there?", tt.want)
+
+			setClassic(t, tt.bobClassic)
+			exchange(t, bob, alice, "hello alice", tt.want)
+			exchange(t, bob, alice, "yes", tt.want)
+			setClassic(t, tt.aliceClassic)
+			exchange(t, alice, bob, "good", tt.want)
+		})
+	}
+}
+
+// TestHybridKeyRotates checks that the ML-KEM key is not tied to the
+// identity: it differs between signed prekeys, and a session started on
+// the previous one is still accepted after a rotation.
+func TestHybridKeyRotates(t *testing.T) {
+	setClassic(t, false)
+	relay := newFakeRelay(t)
+	alice, bob := newTestStore(t, relay.URL), newTestStore(t, relay.URL)
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+	first, err := bob.Relay.fetchPreKeyBundle(bob.ctx, bob.DeviceID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewMessage([]byte("sent before the rotation"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := alice.Session(bob.DeviceID()).Seal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Age the signed prekey so that the next upload replaces it.
+	state, err := bob.prekeys.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.SignedPreKeys[0].Created = time.Now().Add(-2 * signedPreKeyMaxAge).Unix()
+	if err := bob.prekeys.save(state); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+	second, err := bob.Relay.fetchPreKeyBundle(bob.ctx, bob.DeviceID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.KEMPreKey.ID == second.KEMPreKey.ID || string(first.KEMPreKey.Pub) == string(second.KEMPreKey.Pub) {
+		t.Errorf("ML-KEM key did not rotate with the signed prekey")
+	}
+	if _, err := bob.Open(m); err != nil {
+		t.Errorf("session started before the rotation: %v", err)
+	}
+}
+
+// TestHybridDowngrade checks that a contact who has used the hybrid
+// handshake is not reached with classic X3DH, even after a reset.
+func TestHybridDowngrade(t *testing.T) {
+	relay := newFakeRelay(t)
+	alice, bob := newTestStore(t, relay.URL), newTestStore(t, relay.URL)
+	setClassic(t, false)
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, alice, bob, "hello", hybridVersion)
+
+	setClassic(t, true)
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+	setClassic(t, false)
+	if err := alice.Session(bob.DeviceID()).Reset(); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := NewMessage([]byte("downgraded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.Session(bob.DeviceID()).Seal(msg); err == nil {
+		t.Fatal("sealed to a contact whose ML-KEM key disappeared")
+	}
+}
+
+// TestPreKeyBundleKEMBinding checks that an ML-KEM key published for one
+// signed prekey cannot be presented with another.
+func TestPreKeyBundleKEMBinding(t *testing.T) {
+	setClassic(t, false)
+	relay := newFakeRelay(t)
+	bob := newTestStore(t, relay.URL)
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := bob.Relay.fetchPreKeyBundle(bob.ctx, bob.DeviceID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.KEMPreKey.ID++
+	if err := b.verify(bob.DeviceID()); err == nil {
+		t.Error("bundle with an ML-KEM key of another signed prekey verified")
+	}
+	if _, err := bob.prekeys.kemPreKey(b.KEMPreKey.ID); err == nil {
+		t.Error("found an ML-KEM key for a signed prekey that has none")
+	}
+}
+
+// TestSessionRoundTrip runs X3DH and the ratchet between two identities,
+// with and without published prekeys, delivering messages out of order and
+// replaying some.
+func TestSessionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		publish bool
+		classic bool
+		want    int
+	}{
+		{"no published bundle", false, false, sessionVersion},
+		{"classic bundle", true, true, sessionVersion},
+		{"hybrid bundle", true, false, hybridVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClassic(t, tt.classic)
+			relay := newFakeRelay(t)
+			alice, bob := newTestStore(t, relay.URL), newTestStore(t, relay.URL)
+			if tt.publish {
+				if _, err := bob.PublishPreKeys(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			toBob, toAlice := alice.Session(bob.DeviceID()), bob.Session(alice.DeviceID())
+			if toBob.PeerID() != bob.DeviceID() {
+				t.Fatalf("PeerID = %s, want %s", toBob.PeerID(), bob.DeviceID())
+			}
+
+			seal := func(s *Session, body string) EncryptedMessage {
+				t.Helper()
+				msg, err := NewMessage([]byte(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				m, err := s.Seal(msg)
+				if err != nil {
+					t.Fatalf("seal %q: %v", body, err)
+				}
+				if m.Version != tt.want {
+					t.Errorf("packet version = %d, want %d", m.Version, tt.want)
+				}
+				return m
+			}
+			open := func(s *Session, m EncryptedMessage, want string) {
+				t.Helper()
+				got, err := s.Open(m)
+				if err != nil {
+					t.Fatalf("open %q: %v", want, err)
+				}
+				if string(got.Body) != want {
+					t.Errorf("body = %q, want %q", got.Body, want)
+				}
+			}
+
+			// The first messages all carry the handshake; deliver them
+			// out of order.
+			m1, m2, m3 := seal(toBob, "one"), seal(toBob, "two"), seal(toBob, "three")
+			open(toAlice, m3, "three")
+			open(toAlice, m1, "one")
+			open(toAlice, m2, "two")
+
+			// The reply turns the ratchet; alice's next chain skips a key
+			// that arrives last.
+			open(toBob, seal(toAlice, "four"), "four")
+			m5, m6 := seal(toBob, "five"), seal(toBob, "six")
+			open(toAlice, m6, "six")
+			open(toAlice, m5, "five")
+			open(toBob, seal(toAlice, "seven"), "seven")
+
+			// The key of a message is deleted once it is read, so a replay
+			// is rejected whether or not it reaches the replay window.
+			if _, err := toAlice.Open(m5); err == nil {
+				t.Error("replayed message accepted")
+			}
+			if _, err := toAlice.Open(m1); err == nil {
+				t.Error("replayed prekey message accepted")
+			}
+			if _, err := toBob.Open(m1); err == nil {
+				t.Error("opened a message from another peer")
+			}
+			open(toAlice, seal(toBob, "eight"), "eight")
+		})
+	}
+}
+
+// restore opens the identity of st in a new keys directory, as `client
+// restore` does: the key comes back but the prekey secrets do not.
+func restore(t *testing.T, st *Store) *Store {
+	t.Helper()
+	me, err := IdentityFromKey(st.priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysDir := filepath.Join(t.TempDir(), "keys")
+	if err := me.Save(keysDir, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := me.OpenStore(keysDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { restored.Close() })
+	restored.Relay = st.Relay
+	return restored
+}
+
+// TestRestoreStartsSession checks that an identity restored without its
+// prekey secrets replaces the pool on the relay, so that contacts starting
+// a session get prekeys it can use.
+func TestRestoreStartsSession(t *testing.T) {
+	setClassic(t, false)
+	relay := newFakeRelay(t)
+	alice, bob := newTestStore(t, relay.URL), newTestStore(t, relay.URL)
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	bob = restore(t, bob)
+	status, err := bob.PublishPreKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Remaining != preKeyPoolSize {
+		t.Errorf("relay holds %d one-time prekeys after the restore, want %d", status.Remaining, preKeyPoolSize)
+	}
+	exchange(t, alice, bob, "hello again", hybridVersion)
+	exchange(t, bob, alice, "hi", hybridVersion)
+}
+
+// TestStalePreKeyStore checks that a prekey store put back from an old copy,
+// whose next IDs the relay already holds, gets the pool replaced rather than
+// silently losing the new keys.
+func TestStalePreKeyStore(t *testing.T) {
+	setClassic(t, false)
+	relay := newFakeRelay(t)
+	alice, bob := newTestStore(t, relay.URL), newTestStore(t, relay.URL)
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.ReadFile(bob.prekeys.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 3 {
+		if _, err := bob.Relay.fetchPreKeyBundle(bob.ctx, bob.DeviceID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(t, bob.prekeys.path, old)
+	for range 3 {
+		if _, err := bob.Relay.fetchPreKeyBundle(bob.ctx, bob.DeviceID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bob.PublishPreKeys(); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, alice, bob, "hello", hybridVersion)
+}
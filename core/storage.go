@@ -0,0 +1,84 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const storageKeyLabel = "HEMSAEUCC local storage key"
+
+// errCorrupt is returned when a sealed file exists but cannot be decrypted
+// or decoded.
+var errCorrupt = errors.New("stored state is corrupt")
+
+// deriveStorageKey derives the key protecting local state at rest from the
+// identity secret.
+func deriveStorageKey(priv []byte) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, priv, nil, []byte(storageKeyLabel)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// writeSealedFile encrypts the JSON encoding of v with key and atomically
+// replaces path with it. name is bound as associated data so that sealed
+// files cannot be swapped for one another.
+func writeSealedFile(path string, key []byte, name string, v any) error {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, chacha20poly1305.NonceSizeX+len(plain)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	data := aead.Seal(nonce, nonce, plain, []byte(name))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readSealedFile decrypts path with key into v. It returns an error
+// satisfying errors.Is(err, os.ErrNotExist) if the file does not exist and
+// errCorrupt if it cannot be opened.
+func readSealedFile(path string, key []byte, name string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+	if len(data) < chacha20poly1305.NonceSizeX {
+		return fmt.Errorf("%s: %w", filepath.Base(path), errCorrupt)
+	}
+	plain, err := aead.Open(nil, data[:chacha20poly1305.NonceSizeX], data[chacha20poly1305.NonceSizeX:], []byte(name))
+	if err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), errCorrupt)
+	}
+	if err := json.Unmarshal(plain, v); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Base(path), errCorrupt)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSealedFile(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	otherKey := bytes.Repeat([]byte{2}, 32)
+	type state struct {
+		N    int      `json:"n"`
+		Keys [][]byte `json:"keys"`
+	}
+	want := state{N: 7, Keys: [][]byte{{1, 2, 3}, nil}}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		file    string
+		tamper  func(data []byte) []byte
+		wantErr error
+	}{
+		{"round trip", key, "state", nil, nil},
+		{"wrong key", otherKey, "state", nil, errCorrupt},
+		{"wrong name", key, "other", nil, errCorrupt},
+		{"flipped bit", key, "state", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, errCorrupt},
+		{"truncated", key, "state", func(b []byte) []byte { return b[:10] }, errCorrupt},
+		{"empty", key, "state", func(b []byte) []byte { return nil }, errCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sub", "state.bin")
+			if err := writeSealedFile(path, key, "state", want); err != nil {
+				t.Fatal(err)
+			}
+			if tt.tamper != nil {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, path, tt.tamper(data))
+			}
+
+			var got state
+			err := readSealedFile(path, tt.key, tt.file, &got)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("readSealedFile = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("read %+v, wrote %+v", got, want)
+			}
+			if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("temporary file left behind: %v", err)
+			}
+		})
+	}
+
+	var got state
+	if err := readSealedFile(filepath.Join(t.TempDir(), "missing.bin"), key, "state", &got); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("readSealedFile of a missing file = %v, want os.ErrNotExist", err)
+	}
+}
+
+// TestStoreReopen checks that sessions, saved sealed under the storage key,
+// carry on once the store is closed and opened again from the keystore.
+func TestStoreReopen(t *testing.T) {
+	setClassic(t, false)
+	relay := newFakeRelay(t)
+	alice := newTestStore(t, relay.URL)
+
+	keysDir := filepath.Join(t.TempDir(), "keys")
+	bobID, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bobID.Save(keysDir, []byte("passphrase")); err != nil {
+		t.Fatal(err)
+	}
+	open := func() *Store {
+		id, _, err := LoadIdentity(keysDir, func() ([]byte, error) { return []byte("passphrase"), nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, err := id.OpenStore(keysDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st.Relay = NewRelay(relay.URL)
+		st.Relay.Attempts = 1
+		return st
+	}
+
+	bob := open()
+	if _, err := bob.PublishPreKeys(); err != nil {
+		bob.Close()
+		t.Fatal(err)
+	}
+	exchange(t, alice, bob, "before", hybridVersion)
+	exchange(t, bob, alice, "reply", hybridVersion)
+	bob.Close()
+
+	bob = open()
+	defer bob.Close()
+	exchange(t, alice, bob, "after", hybridVersion)
+	exchange(t, bob, alice, "reply again", hybridVersion)
+	if sessions, err := filepath.Glob(filepath.Join(keysDir, "sessions", "*")); err != nil || len(sessions) == 0 {
+		t.Errorf("no session files under %s: %v", keysDir, err)
+	}
+}
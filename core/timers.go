@@ -0,0 +1,212 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Disappearing messages. Every message carries the sender's timer for the
+// conversation, and a timer sent after the last change we know of replaces
+// ours, so both sides settle on the latest setting. A message disappears
+// its timer after it was sent: the relay drops copies still waiting at that
+// time, and clients purge what they kept of it.
+
+// MaxTimer is the longest disappearing message timer.
+const MaxTimer = 4 * 7 * 24 * time.Hour
+
+// timerSetting is the disappearing message timer of one conversation.
+type timerSetting struct {
+	Timer time.Duration `json:"timer"`
+	// Changed is when the setting was made, in Unix milliseconds.
+	Changed int64 `json:"changed"`
+}
+
+func (st *Store) timersPath() string {
+	return filepath.Join(filepath.Dir(st.dir), "timers.bin")
+}
+
+func (st *Store) loadTimers() (map[string]timerSetting, error) {
+	timers := make(map[string]timerSetting)
+	err := readSealedFile(st.timersPath(), st.key, "timers", &timers)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load timers: %w", err)
+	}
+	return timers, nil
+}
+
+func (st *Store) saveTimers(timers map[string]timerSetting) error {
+	if err := writeSealedFile(st.timersPath(), st.key, "timers", timers); err != nil {
+		return fmt.Errorf("failed to save timers: %w", err)
+	}
+	return nil
+}
+
+// Timer returns the disappearing message timer of the conversation conv:
+// an identity ID, or "group:" and a group ID. Zero means off.
+func (st *Store) Timer(conv string) (time.Duration, error) {
+	timers, err := st.loadTimers()
+	if err != nil {
+		return 0, err
+	}
+	return timers[conv].Timer, nil
+}
+
+// SetTimer changes the timer of conv. The next message sent there tells
+// the other side.
+func (st *Store) SetTimer(conv string, d time.Duration) error {
+	timers, err := st.loadTimers()
+	if err != nil {
+		return err
+	}
+	timers[conv] = timerSetting{Timer: d, Changed: time.Now().UnixMilli()}
+	return st.saveTimers(timers)
+}
+
+// ApplyTimer takes the timer carried by msg, received in conv, if it was
+// set after ours. It reports whether our timer changed.
+func (st *Store) ApplyTimer(conv string, msg *Message) (bool, error) {
+	if !msg.TimerSet {
+		return false, nil
+	}
+	timers, err := st.loadTimers()
+	if err != nil {
+		return false, err
+	}
+	cur := timers[conv]
+	if msg.Timer == cur.Timer || msg.Sent.UnixMilli() <= cur.Changed {
+		return false, nil
+	}
+	timers[conv] = timerSetting{Timer: msg.Timer, Changed: msg.Sent.UnixMilli()}
+	return true, st.saveTimers(timers)
+}
+
+// stampTimer sets the timer of msg, about to be sent to conv.
+func (st *Store) stampTimer(conv string, msg *Message) error {
+	d, err := st.Timer(conv)
+	if err != nil {
+		return err
+	}
+	msg.Timer, msg.TimerSet = d, true
+	return nil
+}
+
+// moveTimer carries the timer of oldID over to newID after a rotation.
+func (st *Store) moveTimer(oldID, newID string) error {
+	timers, err := st.loadTimers()
+	if err != nil {
+		return err
+	}
+	t, ok := timers[oldID]
+	if !ok {
+		return nil
+	}
+	delete(timers, oldID)
+	if _, ok := timers[newID]; !ok {
+		timers[newID] = t
+	}
+	return st.saveTimers(timers)
+}
+
+// Deadline returns when msg disappears, or the zero time if it does not.
+// Typing indicators are only good for a moment.
+func (m *Message) Deadline() time.Time {
+	if m.Kind == KindTyping {
+		return m.Sent.Add(typingTimeout)
+	}
+	if m.Timer == 0 {
+		return time.Time{}
+	}
+	return m.Sent.Add(m.Timer)
+}
+
+// Expired reports whether msg should already have disappeared.
+func (m *Message) Expired(now time.Time) bool {
+	d := m.Deadline()
+	return !d.IsZero() && !now.Before(d)
+}
+
+// PacketExpiry returns the Expires of the packets carrying msg.
+func PacketExpiry(msg *Message) int64 {
+	if d := msg.Deadline(); !d.IsZero() {
+		return d.Unix()
+	}
+	return 0
+}
+
+// PurgeExpired deletes the kept attachments whose Expires has passed.
+// Clients keep the attachment of a disappearing message with Expires no
+// later than the message's deadline, so it goes with the message.
+func (st *Store) PurgeExpired(now time.Time) error {
+	list, err := st.ListAttachments()
+	if err != nil {
+		return err
+	}
+	for _, a := range list {
+		if now.Unix() >= a.Expires {
+			if err := os.Remove(st.attachmentPath(a.Blob)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ParseTimer reads a timer such as "off", "30m", "12h", "1d" or "1w".
+func ParseTimer(s string) (time.Duration, error) {
+	if s == "off" || s == "0" {
+		return 0, nil
+	}
+	var d time.Duration
+	var err error
+	if n, ok := strings.CutSuffix(s, "d"); ok {
+		var days int
+		days, err = strconv.Atoi(n)
+		d = time.Duration(days) * 24 * time.Hour
+	} else if n, ok := strings.CutSuffix(s, "w"); ok {
+		var weeks int
+		weeks, err = strconv.Atoi(n)
+		d = time.Duration(weeks) * 7 * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid timer %q, use e.g. 30m, 12h, 1d, 1w or off", s)
+	}
+	if d > MaxTimer {
+		return 0, fmt.Errorf("the longest timer is %s", FormatTimer(MaxTimer))
+	}
+	return d.Truncate(time.Second), nil
+}
+
+// FormatTimer returns d in the largest unit that divides it.
+func FormatTimer(d time.Duration) string {
+	if d == 0 {
+		return "off"
+	}
+	for _, u := range []struct {
+		d    time.Duration
+		name string
+	}{
+		{7 * 24 * time.Hour, "week"},
+		{24 * time.Hour, "day"},
+		{time.Hour, "hour"},
+		{time.Minute, "minute"},
+	} {
+		if d%u.d == 0 {
+			return plural(int(d/u.d), u.name)
+		}
+	}
+	return plural(int(d/time.Second), "second")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
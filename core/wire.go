@@ -0,0 +1,265 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Packets travel to and from the relay in a binary envelope:
+//
+//	"HM" | wire version | packet version | to (32) | from (32) | field*
+//
+// where each field is uvarint(tag) | uvarint(len) | value. Decoders skip
+// fields with tags they do not know, so new fields can be added without a
+// new wire version.
+const (
+	wireMagic   = "HM"
+	wireVersion = 1
+
+	// envelopeHeaderSize is the size of the fixed envelope header.
+	envelopeHeaderSize = len(wireMagic) + 2 + 2*32
+
+	// maxEnvelopeSize bounds a single envelope, matching the relay's limit.
+	maxEnvelopeSize = 1 << 20
+
+	// wireContentType is the content type of envelopes and envelope streams.
+	wireContentType = "application/octet-stream"
+)
+
+// Envelope field tags.
+const (
+	tagEphemeralPK    = 1
+	tagNonce          = 2
+	tagCiphertext     = 3
+	tagRatchetPK      = 4
+	tagPN             = 5
+	tagN              = 6
+	tagSignedPreKeyID = 7
+	tagOneTimePreKey  = 8
+	tagKEMCiphertext  = 9
+	tagGroupID        = 10
+	tagEpoch          = 11
+	tagSignature      = 12
+	tagExpires        = 13
+)
+
+var (
+	// errMalformedEnvelope is returned for envelopes that cannot be decoded.
+	errMalformedEnvelope = errors.New("malformed envelope")
+	// errBadField is returned for field lists that are not well framed.
+	errBadField = errors.New("bad field framing")
+)
+
+// isEnvelope reports whether b starts like a binary envelope rather than a
+// legacy JSON packet.
+func isEnvelope(b []byte) bool {
+	return len(b) >= len(wireMagic) && string(b[:len(wireMagic)]) == wireMagic
+}
+
+// encodeEnvelope returns the binary envelope carrying m.
+func encodeEnvelope(m EncryptedMessage) ([]byte, error) {
+	if m.Version < 0 || m.Version > math.MaxUint8 {
+		return nil, fmt.Errorf("packet version %d out of range", m.Version)
+	}
+	to, err := DecodeID(m.ToID)
+	if err != nil {
+		return nil, fmt.Errorf("bad recipient: %w", err)
+	}
+	from, err := DecodeID(m.FromID)
+	if err != nil {
+		return nil, fmt.Errorf("bad sender: %w", err)
+	}
+
+	b := make([]byte, 0, envelopeHeaderSize+len(m.Ciphertext))
+	b = append(b, wireMagic...)
+	b = append(b, wireVersion, byte(m.Version))
+	b = append(b, to...)
+	b = append(b, from...)
+
+	for _, f := range []struct {
+		tag uint64
+		val string
+	}{
+		{tagEphemeralPK, m.EphemeralPK},
+		{tagNonce, m.Nonce},
+		{tagCiphertext, m.Ciphertext},
+		{tagRatchetPK, m.RatchetPK},
+		{tagKEMCiphertext, m.KEMCiphertext},
+		{tagSignature, m.Signature},
+	} {
+		if f.val == "" {
+			continue
+		}
+		v, err := base64.StdEncoding.DecodeString(f.val)
+		if err != nil {
+			return nil, fmt.Errorf("bad field %d: %w", f.tag, err)
+		}
+		b = appendField(b, f.tag, v)
+	}
+	for _, f := range []struct {
+		tag uint64
+		val uint32
+	}{
+		{tagPN, m.PN},
+		{tagN, m.N},
+		{tagSignedPreKeyID, m.SignedPreKeyID},
+		{tagOneTimePreKey, m.OneTimePreKeyID},
+		{tagEpoch, m.Epoch},
+	} {
+		if f.val != 0 {
+			b = appendField(b, f.tag, binary.AppendUvarint(nil, uint64(f.val)))
+		}
+	}
+	if m.GroupID != "" {
+		gid, err := hex.DecodeString(m.GroupID)
+		if err != nil {
+			return nil, fmt.Errorf("bad group ID: %w", err)
+		}
+		b = appendField(b, tagGroupID, gid)
+	}
+	if m.Expires > 0 {
+		b = appendField(b, tagExpires, binary.AppendUvarint(nil, uint64(m.Expires)))
+	}
+	return b, nil
+}
+
+func appendField(b []byte, tag uint64, v []byte) []byte {
+	b = binary.AppendUvarint(b, tag)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decodeEnvelope parses a binary envelope.
+func decodeEnvelope(b []byte) (EncryptedMessage, error) {
+	var m EncryptedMessage
+	if len(b) > maxEnvelopeSize {
+		return m, fmt.Errorf("%w: too large", errMalformedEnvelope)
+	}
+	if len(b) < envelopeHeaderSize || !isEnvelope(b) {
+		return m, fmt.Errorf("%w: bad header", errMalformedEnvelope)
+	}
+	if b[2] != wireVersion {
+		return m, fmt.Errorf("%w: unsupported wire version %d", errMalformedEnvelope, b[2])
+	}
+	m.Version = int(b[3])
+	m.ToID = hex.EncodeToString(b[4:36])
+	m.FromID = hex.EncodeToString(b[36:68])
+
+	fields, err := parseFields(b[envelopeHeaderSize:])
+	if err != nil {
+		return m, fmt.Errorf("%w: %v", errMalformedEnvelope, err)
+	}
+	for _, f := range fields {
+		tag, v := f.tag, f.val
+		switch tag {
+		case tagEphemeralPK:
+			m.EphemeralPK = base64.StdEncoding.EncodeToString(v)
+		case tagNonce:
+			m.Nonce = base64.StdEncoding.EncodeToString(v)
+		case tagCiphertext:
+			m.Ciphertext = base64.StdEncoding.EncodeToString(v)
+		case tagRatchetPK:
+			m.RatchetPK = base64.StdEncoding.EncodeToString(v)
+		case tagKEMCiphertext:
+			m.KEMCiphertext = base64.StdEncoding.EncodeToString(v)
+		case tagSignature:
+			m.Signature = base64.StdEncoding.EncodeToString(v)
+		case tagGroupID:
+			m.GroupID = hex.EncodeToString(v)
+		case tagExpires:
+			x, n := binary.Uvarint(v)
+			if n != len(v) || x > math.MaxInt64 {
+				return m, fmt.Errorf("%w: bad integer in field %d", errMalformedEnvelope, tag)
+			}
+			m.Expires = int64(x)
+		case tagPN, tagN, tagSignedPreKeyID, tagOneTimePreKey, tagEpoch:
+			x, n := binary.Uvarint(v)
+			if n != len(v) || x > math.MaxUint32 {
+				return m, fmt.Errorf("%w: bad integer in field %d", errMalformedEnvelope, tag)
+			}
+			switch tag {
+			case tagPN:
+				m.PN = uint32(x)
+			case tagN:
+				m.N = uint32(x)
+			case tagSignedPreKeyID:
+				m.SignedPreKeyID = uint32(x)
+			case tagOneTimePreKey:
+				m.OneTimePreKeyID = uint32(x)
+			case tagEpoch:
+				m.Epoch = uint32(x)
+			}
+		}
+	}
+	return m, nil
+}
+
+// decodePacket parses a packet from the relay, which is either a binary
+// envelope or a JSON packet from a client that predates them.
+func decodePacket(b []byte) (EncryptedMessage, error) {
+	if isEnvelope(b) {
+		return decodeEnvelope(b)
+	}
+	var m EncryptedMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("%w: %v", errMalformedEnvelope, err)
+	}
+	return m, nil
+}
+
+// readFrames splits a stream of uvarint length-prefixed packets, as
+// returned by the relay's binary /fetch.
+func readFrames(r io.Reader) ([][]byte, error) {
+	br := bufio.NewReader(r)
+	var frames [][]byte
+	for {
+		size, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, fmt.Errorf("%w: bad frame length", errMalformedEnvelope)
+		}
+		if size > maxEnvelopeSize {
+			return frames, fmt.Errorf("%w: frame too large", errMalformedEnvelope)
+		}
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, br, int64(size)); err != nil {
+			return frames, fmt.Errorf("%w: truncated frame", errMalformedEnvelope)
+		}
+		frames = append(frames, buf.Bytes())
+	}
+}
+
+// wireField is one tagged field of an envelope or payload.
+type wireField struct {
+	tag uint64
+	val []byte
+}
+
+// parseFields splits b into tagged fields.
+func parseFields(b []byte) ([]wireField, error) {
+	var fields []wireField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errBadField
+		}
+		b = b[n:]
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > uint64(len(b)-n) {
+			return nil, errBadField
+		}
+		fields = append(fields, wireField{tag, b[n : n+int(size)]})
+		b = b[n+int(size):]
+	}
+	return fields, nil
+}
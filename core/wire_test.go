@@ -0,0 +1,184 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testEnvelopes are valid packets of each kind, used as fuzz seeds.
+func testEnvelopes(t testing.TB) [][]byte {
+	b64 := func(n int, c byte) string {
+		return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{c}, n))
+	}
+	to, from := strings.Repeat("11", 32), strings.Repeat("22", 32)
+	msgs := []EncryptedMessage{
+		{Version: sealedVersion, ToID: to, FromID: from, EphemeralPK: b64(32, 3), Nonce: b64(24, 4), Ciphertext: b64(48, 5)},
+		{Version: sessionVersion, ToID: to, FromID: from, RatchetPK: b64(32, 6), PN: 3, N: 300, Ciphertext: b64(64, 7)},
+		{Version: hybridVersion, ToID: to, FromID: from, EphemeralPK: b64(32, 8), RatchetPK: b64(32, 9), SignedPreKeyID: 7, OneTimePreKeyID: 1 << 20, KEMCiphertext: b64(1088, 10), Ciphertext: b64(80, 11), Expires: 1 << 40},
+		{Version: GroupVersion, ToID: to, FromID: from, GroupID: strings.Repeat("ab", 16), Epoch: 2, N: 5, Signature: b64(64, 12), Ciphertext: b64(16, 13)},
+	}
+	var out [][]byte
+	for _, m := range msgs {
+		b, err := encodeEnvelope(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// FuzzDecodeEnvelope checks that decoding never panics, and that an
+// envelope that decodes encodes again to one that decodes the same.
+func FuzzDecodeEnvelope(f *testing.F) {
+	for _, b := range testEnvelopes(f) {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := decodeEnvelope(b)
+		if err != nil {
+			if !errors.Is(err, errMalformedEnvelope) {
+				t.Fatalf("error %v is not errMalformedEnvelope", err)
+			}
+			return
+		}
+		enc, err := encodeEnvelope(m)
+		if err != nil {
+			t.Fatalf("decoded envelope does not encode: %v", err)
+		}
+		again, err := decodeEnvelope(enc)
+		if err != nil {
+			t.Fatalf("encoded envelope does not decode: %v", err)
+		}
+		if !reflect.DeepEqual(m, again) {
+			t.Fatalf("round trip changed the packet:\n%+v\n%+v", m, again)
+		}
+	})
+}
+
+// FuzzReadFrames checks that a frame stream never panics the reader, and
+// that the frames read are found again once framed anew.
+func FuzzReadFrames(f *testing.F) {
+	var stream []byte
+	for _, b := range testEnvelopes(f) {
+		stream = binary.AppendUvarint(stream, uint64(len(b)))
+		stream = append(stream, b...)
+		f.Add(stream)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		frames, err := readFrames(bytes.NewReader(b))
+		if err != nil && !errors.Is(err, errMalformedEnvelope) {
+			t.Fatalf("error %v is not errMalformedEnvelope", err)
+		}
+		var enc []byte
+		for _, fr := range frames {
+			enc = binary.AppendUvarint(enc, uint64(len(fr)))
+			enc = append(enc, fr...)
+		}
+		again, err := readFrames(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatalf("framed again: %v", err)
+		}
+		if len(again) != len(frames) {
+			t.Fatalf("framed again: %d frames, want %d", len(again), len(frames))
+		}
+		for i := range frames {
+			if !bytes.Equal(again[i], frames[i]) {
+				t.Fatalf("frame %d changed", i)
+			}
+		}
+	})
+}
+
+func TestDecodeEnvelopeMalformed(t *testing.T) {
+	valid := testEnvelopes(t)[1]
+	header := valid[:envelopeHeaderSize]
+	with := func(fields ...byte) []byte {
+		return append(append([]byte{}, header...), fields...)
+	}
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", nil},
+		{"short header", valid[:envelopeHeaderSize-1]},
+		{"bad magic", append([]byte("XX"), valid[2:]...)},
+		{"unknown wire version", append([]byte{'H', 'M', wireVersion + 1}, valid[3:]...)},
+		{"too large", append(with(), make([]byte, maxEnvelopeSize)...)},
+		{"truncated tag", with(0x80)},
+		{"truncated length", with(tagCiphertext, 0x80)},
+		{"tag overflows uvarint", with(0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0)},
+		{"length past end", with(tagCiphertext, 5, 1, 2, 3)},
+		{"huge length", with(tagCiphertext, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1)},
+		{"integer with trailing byte", with(tagN, 2, 1, 0)},
+		{"truncated integer", with(tagN, 1, 0x80)},
+		{"integer over uint32", with(append([]byte{tagN, 5}, binary.AppendUvarint(nil, math.MaxUint32+1)...)...)},
+		{"expiry over int64", with(append([]byte{tagExpires, 10}, binary.AppendUvarint(nil, math.MaxUint64)...)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeEnvelope(tt.b); !errors.Is(err, errMalformedEnvelope) {
+				t.Errorf("decodeEnvelope = %v, want errMalformedEnvelope", err)
+			}
+		})
+	}
+}
+
+func TestDecodeEnvelopeUnknownTags(t *testing.T) {
+	valid := testEnvelopes(t)[2]
+	want, err := decodeEnvelope(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		extra []byte
+	}{
+		{"small tag", appendField(nil, 14, []byte("new field"))},
+		{"large tag", appendField(nil, math.MaxUint64, []byte{1, 2, 3})},
+		{"empty value", appendField(nil, 99, nil)},
+		{"several", appendField(appendField(nil, 20, []byte{1}), 21, make([]byte, 300))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeEnvelope(append(append([]byte{}, valid...), tt.extra...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("unknown field changed the packet:\n%+v\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadFramesMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		b      []byte
+		frames int
+	}{
+		{"truncated length", []byte{0x80}, 0},
+		{"length overflows uvarint", bytes.Repeat([]byte{0xff}, 11), 0},
+		{"oversized frame", binary.AppendUvarint(nil, maxEnvelopeSize+1), 0},
+		{"truncated frame", []byte{4, 'H', 'M'}, 0},
+		{"truncated after a frame", []byte{2, 'H', 'M', 3, 'x'}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, err := readFrames(bytes.NewReader(tt.b))
+			if !errors.Is(err, errMalformedEnvelope) {
+				t.Errorf("readFrames = %v, want errMalformedEnvelope", err)
+			}
+			if len(frames) != tt.frames {
+				t.Errorf("read %d frames, want %d", len(frames), tt.frames)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const x3dhLabel = "HEMSAEUCC v3 X3DH"
+
+// kdfX3DH derives the initial session key from the X3DH DH outputs, and for
+// hybrid sessions the ML-KEM shared secret, as in section 2.2 of the X3DH
+// specification.
+func kdfX3DH(label string, secrets ...[]byte) ([]byte, error) {
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, s := range secrets {
+		ikm = append(ikm, s...)
+	}
+	sk := make([]byte, 32)
+	salt := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte(label)), sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+// x3dhInitiate runs the initiator side of X3DH against the contact's
+// identity key, signed prekey and, if one was available, one-time prekey.
+// If remoteKEM is not nil the handshake is hybrid: a secret encapsulated to
+// it is mixed into the session key and its ciphertext returned as kemCT.
+// ephPub and kemCT must be sent to the contact.
+func x3dhInitiate(identityPriv, remoteIdentity, remotePreKey, remoteOneTime []byte, remoteKEM *mlkem.EncapsulationKey768) (sk, ephPub, kemCT []byte, err error) {
+	ephPriv, ephPub, err := newKeyPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dh1, err := curve25519.X25519(identityPriv, remotePreKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dh2, err := curve25519.X25519(ephPriv, remoteIdentity)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	dh3, err := curve25519.X25519(ephPriv, remotePreKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	secrets := [][]byte{dh1, dh2, dh3}
+	if remoteOneTime != nil {
+		dh4, err := curve25519.X25519(ephPriv, remoteOneTime)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		secrets = append(secrets, dh4)
+	}
+
+	label := x3dhLabel
+	if remoteKEM != nil {
+		var ss []byte
+		ss, kemCT = remoteKEM.Encapsulate()
+		secrets = append(secrets, ss)
+		label = hybridX3DHLabel
+	}
+	sk, err = kdfX3DH(label, secrets...)
+	return sk, ephPub, kemCT, err
+}
+
+// x3dhRespond runs the responder side of X3DH for a session the contact
+// started with our signed prekey preKeyPriv, optionally our one-time prekey
+// oneTimePriv, and their ephemeral key. For hybrid sessions kemCT is the
+// ciphertext they encapsulated to kemKey.
+func x3dhRespond(identityPriv, preKeyPriv, oneTimePriv []byte, kemKey *mlkem.DecapsulationKey768, kemCT, remoteIdentity, remoteEph []byte) ([]byte, error) {
+	dh1, err := curve25519.X25519(preKeyPriv, remoteIdentity)
+	if err != nil {
+		return nil, err
+	}
+	dh2, err := curve25519.X25519(identityPriv, remoteEph)
+	if err != nil {
+		return nil, err
+	}
+	dh3, err := curve25519.X25519(preKeyPriv, remoteEph)
+	if err != nil {
+		return nil, err
+	}
+	secrets := [][]byte{dh1, dh2, dh3}
+	if oneTimePriv != nil {
+		dh4, err := curve25519.X25519(oneTimePriv, remoteEph)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, dh4)
+	}
+
+	label := x3dhLabel
+	if kemCT != nil {
+		ss, err := kemKey.Decapsulate(kemCT)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, ss)
+		label = hybridX3DHLabel
+	}
+	return kdfX3DH(label, secrets...)
+}
@@ -0,0 +1,77 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+// XEdDSA lets an X25519 identity key also sign, as specified in
+// https://signal.org/docs/specifications/xeddsa/. Signatures verify as
+// Ed25519 signatures under the Edwards form of the Montgomery public key.
+
+// xeddsaSign signs msg with the X25519 private key priv.
+func xeddsaSign(priv, msg []byte) ([]byte, error) {
+	k, err := edwards25519.NewScalar().SetBytesWithClamping(priv)
+	if err != nil {
+		return nil, err
+	}
+	A := new(edwards25519.Point).ScalarBaseMult(k).Bytes()
+	a := k
+	if A[31]&0x80 != 0 {
+		// Use the key whose Edwards form has a zero sign bit, which is the
+		// one a verifier recovers from the Montgomery u-coordinate.
+		a = edwards25519.NewScalar().Negate(k)
+		A[31] &= 0x7f
+	}
+
+	Z := make([]byte, 64)
+	if _, err := rand.Read(Z); err != nil {
+		return nil, err
+	}
+	h := sha512.New()
+	h.Write(append([]byte{0xfe}, bytes.Repeat([]byte{0xff}, 31)...))
+	h.Write(a.Bytes())
+	h.Write(msg)
+	h.Write(Z)
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(A)
+	h.Write(msg)
+	c, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	s := edwards25519.NewScalar().MultiplyAdd(c, a, r)
+
+	return append(R, s.Bytes()...), nil
+}
+
+// xeddsaVerify reports whether sig is a valid XEdDSA signature of msg by
+// the X25519 public key pub.
+func xeddsaVerify(pub, msg, sig []byte) bool {
+	if len(pub) != 32 || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	u, err := new(field.Element).SetBytes(pub)
+	if err != nil || !bytes.Equal(u.Bytes(), pub) {
+		return false
+	}
+	// Convert the Montgomery u-coordinate to the Edwards y-coordinate
+	// y = (u - 1) / (u + 1), with the sign bit cleared.
+	one := new(field.Element).One()
+	num := new(field.Element).Subtract(u, one)
+	den := new(field.Element).Add(u, one)
+	y := new(field.Element).Multiply(num, new(field.Element).Invert(den))
+	return ed25519.Verify(ed25519.PublicKey(y.Bytes()), msg, sig)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BatchPolicy controls when the mixnet batcher releases pending packets.
+// A batch is released as soon as Threshold packets are pending or Interval
+// has elapsed since the first packet of the batch arrived, whichever comes
+// first.
+type BatchPolicy struct {
+	Threshold int
+	Interval  time.Duration
+}
+
+// batchMetrics is published under "mixnet" in the metrics.
+var batchMetrics = expvar.NewMap("mixnet")
+
+// Batcher collects forwarded packets and stores them in shuffled order so
+// that the order and timing of deliveries does not reveal the order and
+// timing of submissions.
+type Batcher struct {
+	db      *bolt.DB
+	policy  BatchPolicy
+	mu      sync.Mutex
+	pending []StoredMessage
+	timer   *time.Timer
+}
+
+// NewBatcher returns a Batcher that flushes into db according to policy.
+func NewBatcher(db *bolt.DB, policy BatchPolicy) *Batcher {
+	batchMetrics.Set("threshold", expvarInt(int64(policy.Threshold)))
+	batchMetrics.Set("interval_seconds", expvarFloat(policy.Interval.Seconds()))
+	batchMetrics.Set("pending", expvarInt(0))
+	return &Batcher{db: db, policy: policy}
+}
+
+// Add queues a packet for the next batch.
+func (b *Batcher) Add(m StoredMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pending = append(b.pending, m)
+	batchMetrics.Add("received", 1)
+	batchMetrics.Set("pending", expvarInt(int64(len(b.pending))))
+
+	if len(b.pending) >= b.policy.Threshold {
+		b.flushLocked("threshold")
+		return
+	}
+	b.armLocked()
+}
+
+// Flush releases whatever is pending, e.g. on shutdown.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked("shutdown")
+}
+
+// armLocked starts the release timer for the current batch if it is not
+// already running. b.mu must be held.
+func (b *Batcher) armLocked() {
+	if b.timer != nil {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(b.policy.Interval, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		// A threshold flush may have released this batch already.
+		if b.timer == t {
+			b.flushLocked("timer")
+		}
+	})
+	b.timer = t
+}
+
+// flushLocked shuffles and stores the pending batch. b.mu must be held.
+func (b *Batcher) flushLocked(reason string) {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+
+	batch := b.pending
+	b.pending = nil
+	rand.Shuffle(len(batch), func(i, j int) {
+		batch[i], batch[j] = batch[j], batch[i]
+	})
+
+	if err := storeMessages(b.db, batch); err != nil {
+		// Keep the batch so it is retried with the next one.
+		log.Println("batch flush failed:", err)
+		b.pending = append(batch, b.pending...)
+		batchMetrics.Add("flush_errors", 1)
+		b.armLocked()
+		return
+	}
+
+	batchMetrics.Add("flushes_"+reason, 1)
+	batchMetrics.Add("batches_released", 1)
+	batchMetrics.Add("messages_released", int64(len(batch)))
+	batchMetrics.Set("last_batch_size", expvarInt(int64(len(batch))))
+	batchMetrics.Set("pending", expvarInt(int64(len(b.pending))))
+}
+
+func expvarInt(v int64) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(v)
+	return i
+}
+
+func expvarFloat(v float64) *expvar.Float {
+	f := new(expvar.Float)
+	f.Set(v)
+	return f
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// bucketBlobs maps a blob ID to its blobInfo; bucketBlobChunks maps
+	// the ID followed by a uint32 chunk number to the chunk.
+	// bucketBlobOwners maps an uploader's ID to the TS of its last upload.
+	bucketBlobs      = "blobs"
+	bucketBlobChunks = "blob_chunks"
+	bucketBlobOwners = "blob_owners"
+
+	blobUploadLabel = "HEMSAEUCC blob upload"
+
+	blobIDSize = 16
+	// maxBlobSize caps the size of a blob, and maxBlobChunk that of each
+	// chunk of it.
+	maxBlobSize  = 100 << 20
+	maxBlobChunk = 1 << 20
+	// blobUploadTimeout is how long an incomplete upload is kept after its
+	// last chunk before it is taken as abandoned.
+	blobUploadTimeout = 24 * time.Hour
+)
+
+var (
+	errNoBlob       = errors.New("no such blob")
+	errChunkOrder   = errors.New("chunks must be uploaded in order")
+	errChunkChanged = errors.New("chunk differs from the one already uploaded")
+	errBlobTooLarge = errors.New("blob larger than announced")
+	errBlobQuota    = errors.New("attachment quota used up until older attachments expire")
+)
+
+// BlobRequest is the body of POST /blobs: the size of a blob to upload,
+// signed by the key of the uploader it is counted against.
+type BlobRequest struct {
+	Owner string `json:"owner"`
+	Size  int64  `json:"size"`
+	TS    int64  `json:"ts"`
+	Sig   []byte `json:"sig"`
+}
+
+func (r *BlobRequest) signedMessage() []byte {
+	owner, _ := hex.DecodeString(r.Owner)
+	b := append([]byte(blobUploadLabel), 0)
+	b = append(b, owner...)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.TS))
+	return binary.BigEndian.AppendUint64(b, uint64(r.Size))
+}
+
+// blobID returns the ID of the blob created by r. It is derived from the
+// signature, so a retry of a request whose response was lost gets the same
+// blob rather than a second one.
+func (r *BlobRequest) blobID() string {
+	sum := sha256.Sum256(r.Sig)
+	return hex.EncodeToString(sum[:blobIDSize])
+}
+
+// blobInfo describes an uploaded, or partly uploaded, blob. Blobs are
+// opaque to the relay: clients encrypt them before upload.
+type blobInfo struct {
+	ID      string `json:"id"`
+	Size    int64  `json:"size"`
+	Chunks  uint32 `json:"chunks"`
+	Stored  int64  `json:"stored"`
+	Expires int64  `json:"expires"`
+	// Owner and Updated, the time of the last chunk, are only kept by
+	// the relay.
+	Owner   string `json:"owner,omitempty"`
+	Updated int64  `json:"updated,omitempty"`
+}
+
+func (b *blobInfo) complete() bool {
+	return b.Stored == b.Size
+}
+
+// expired reports whether b has expired, or was left incomplete for
+// longer than blobUploadTimeout.
+func (b *blobInfo) expired(now time.Time) bool {
+	return now.Unix() >= b.Expires || (!b.complete() && now.Unix() >= b.Updated+int64(blobUploadTimeout/time.Second))
+}
+
+// writeBlobInfo sends b to the client without the fields only the relay
+// keeps.
+func writeBlobInfo(w http.ResponseWriter, b *blobInfo) {
+	public := *b
+	public.Owner, public.Updated = "", 0
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(public)
+}
+
+func chunkKey(id string, n uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte(id), n)
+}
+
+// handleBlobs serves the blob store: POST of a signed BlobRequest starts an
+// upload and returns its blobInfo, GET ?id= returns the blobInfo of an
+// upload, so an interrupted one can resume after its last stored chunk.
+// Each uploader may keep quota bytes of blobs that have not expired.
+func handleBlobs(db *bolt.DB, ttl time.Duration, quota int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			createBlob(db, ttl, quota, w, r)
+		case http.MethodGet:
+			fetchBlobInfo(db, w, r)
+		default:
+			http.Error(w, "GET or POST only", 405)
+		}
+	}
+}
+
+// handleBlobChunks serves the chunks of a blob: PUT ?id=&n= stores chunk
+// n, which must follow the last one stored, and GET ?id=&n= returns it
+// once the blob is complete.
+func handleBlobChunks(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPut:
+			uploadChunk(db, w, r)
+		case http.MethodGet:
+			fetchChunk(db, w, r)
+		default:
+			http.Error(w, "GET or PUT only", 405)
+		}
+	}
+}
+
+func createBlob(db *bolt.DB, ttl time.Duration, quota int64, w http.ResponseWriter, r *http.Request) {
+	var req BlobRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	owner, err := hex.DecodeString(req.Owner)
+	if err != nil || len(owner) != 32 || hex.EncodeToString(owner) != req.Owner {
+		http.Error(w, "bad owner", 400)
+		return
+	}
+	if req.Size <= 0 {
+		http.Error(w, "bad size", 400)
+		return
+	}
+	if req.Size > maxBlobSize {
+		http.Error(w, "blob too large", 413)
+		return
+	}
+	if !xeddsaVerify(owner, req.signedMessage(), req.Sig) {
+		http.Error(w, "bad signature", 403)
+		return
+	}
+
+	now := time.Now()
+	var info *blobInfo
+	err = db.Update(func(tx *bolt.Tx) error {
+		id := req.blobID()
+		if existing, err := loadBlob(tx, id, now); err == nil && existing.Owner == req.Owner {
+			info = existing
+			return nil
+		}
+		if isRotated(tx, req.Owner) {
+			return errRotated
+		}
+		owners := tx.Bucket([]byte(bucketBlobOwners))
+		if v := owners.Get([]byte(req.Owner)); len(v) == 8 && req.TS <= int64(binary.BigEndian.Uint64(v)) {
+			return errStaleUpload
+		}
+		if blobUsage(tx, req.Owner, now)+req.Size > quota {
+			return errBlobQuota
+		}
+		info = &blobInfo{
+			ID:      id,
+			Size:    req.Size,
+			Expires: now.Add(ttl).Unix(),
+			Owner:   req.Owner,
+			Updated: now.Unix(),
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket([]byte(bucketBlobs)).Put([]byte(id), data); err != nil {
+			return err
+		}
+		return owners.Put([]byte(req.Owner), binary.BigEndian.AppendUint64(nil, uint64(req.TS)))
+	})
+	switch {
+	case errors.Is(err, errStaleUpload):
+		http.Error(w, "stale upload", 409)
+		return
+	case errors.Is(err, errRotated):
+		http.Error(w, "identity rotated", 410)
+		return
+	case errors.Is(err, errBlobQuota):
+		http.Error(w, err.Error(), 413)
+		return
+	case err != nil:
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeBlobInfo(w, info)
+}
+
+// blobUsage returns the bytes of blobs owner has started uploading that
+// have not expired.
+func blobUsage(tx *bolt.Tx, owner string, now time.Time) int64 {
+	var used int64
+	tx.Bucket([]byte(bucketBlobs)).ForEach(func(k, v []byte) error {
+		var info blobInfo
+		if json.Unmarshal(v, &info) == nil && info.Owner == owner && !info.expired(now) {
+			used += info.Size
+		}
+		return nil
+	})
+	return used
+}
+
+// loadBlob returns the blobInfo of id, or errNoBlob if it does not exist,
+// has expired or was abandoned.
+func loadBlob(tx *bolt.Tx, id string, now time.Time) (*blobInfo, error) {
+	v := tx.Bucket([]byte(bucketBlobs)).Get([]byte(id))
+	if v == nil {
+		return nil, errNoBlob
+	}
+	var info blobInfo
+	if err := json.Unmarshal(v, &info); err != nil {
+		return nil, err
+	}
+	if info.expired(now) {
+		return nil, errNoBlob
+	}
+	return &info, nil
+}
+
+func fetchBlobInfo(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", 400)
+		return
+	}
+	var info *blobInfo
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = loadBlob(tx, id, time.Now())
+		return err
+	})
+	if errors.Is(err, errNoBlob) {
+		http.Error(w, "no blob", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeBlobInfo(w, info)
+}
+
+// chunkParams reads the id and n query parameters of a chunk request.
+func chunkParams(r *http.Request) (string, uint32, bool) {
+	q := r.URL.Query()
+	n, err := strconv.ParseUint(q.Get("n"), 10, 32)
+	if q.Get("id") == "" || err != nil {
+		return "", 0, false
+	}
+	return q.Get("id"), uint32(n), true
+}
+
+func uploadChunk(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	id, n, ok := chunkParams(r)
+	if !ok {
+		http.Error(w, "missing id or n", 400)
+		return
+	}
+	chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBlobChunk))
+	if err != nil {
+		http.Error(w, "chunk too large", 413)
+		return
+	}
+	if len(chunk) == 0 {
+		http.Error(w, "empty chunk", 400)
+		return
+	}
+
+	var info *blobInfo
+	now := time.Now()
+	err = db.Update(func(tx *bolt.Tx) error {
+		info, err = loadBlob(tx, id, now)
+		if err != nil {
+			return err
+		}
+		chunks := tx.Bucket([]byte(bucketBlobChunks))
+		if n < info.Chunks {
+			// A retry of a chunk whose response was lost.
+			if !bytes.Equal(chunks.Get(chunkKey(id, n)), chunk) {
+				return errChunkChanged
+			}
+			return nil
+		}
+		if n != info.Chunks {
+			return errChunkOrder
+		}
+		if info.Stored+int64(len(chunk)) > info.Size {
+			return errBlobTooLarge
+		}
+		if err := chunks.Put(chunkKey(id, n), chunk); err != nil {
+			return err
+		}
+		info.Chunks++
+		info.Stored += int64(len(chunk))
+		info.Updated = now.Unix()
+		data, _ := json.Marshal(info)
+		return tx.Bucket([]byte(bucketBlobs)).Put([]byte(id), data)
+	})
+	switch {
+	case errors.Is(err, errNoBlob):
+		http.Error(w, "no blob", 404)
+		return
+	case errors.Is(err, errChunkOrder), errors.Is(err, errChunkChanged):
+		http.Error(w, err.Error(), 409)
+		return
+	case errors.Is(err, errBlobTooLarge):
+		http.Error(w, err.Error(), 413)
+		return
+	case err != nil:
+		http.Error(w, "db error", 500)
+		return
+	}
+	writeBlobInfo(w, info)
+}
+
+func fetchChunk(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	id, n, ok := chunkParams(r)
+	if !ok {
+		http.Error(w, "missing id or n", 400)
+		return
+	}
+	var chunk []byte
+	err := db.View(func(tx *bolt.Tx) error {
+		info, err := loadBlob(tx, id, time.Now())
+		if err != nil {
+			return err
+		}
+		if !info.complete() || n >= info.Chunks {
+			return errNoBlob
+		}
+		chunk = append([]byte(nil), tx.Bucket([]byte(bucketBlobChunks)).Get(chunkKey(id, n))...)
+		return nil
+	})
+	if errors.Is(err, errNoBlob) {
+		http.Error(w, "no chunk", 404)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(chunk)
+}
+
+// pruneBlobs deletes expired and abandoned blobs and their chunks.
+func pruneBlobs(db *bolt.DB, now time.Time) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketBlobs))
+		var expired []blobInfo
+		b.ForEach(func(k, v []byte) error {
+			var info blobInfo
+			if json.Unmarshal(v, &info) != nil || info.expired(now) {
+				info.ID = string(k)
+				expired = append(expired, info)
+			}
+			return nil
+		})
+		chunks := tx.Bucket([]byte(bucketBlobChunks))
+		for _, info := range expired {
+			for n := range info.Chunks {
+				if err := chunks.Delete(chunkKey(info.ID, n)); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete([]byte(info.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("pruning blobs:", err)
+	}
+}
+
+// pruneBlobsEvery prunes expired blobs periodically.
+func pruneBlobsEvery(db *bolt.DB, d time.Duration) {
+	for now := range time.Tick(d) {
+		pruneBlobs(db, now)
+	}
+}
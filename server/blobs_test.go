@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// blobRequest returns a signed request to upload size bytes.
+func (me *testIdentity) blobRequest(t *testing.T, ts, size int64) *BlobRequest {
+	t.Helper()
+	req := &BlobRequest{Owner: me.id, Size: size, TS: ts}
+	req.Sig = xeddsaSign(t, me.priv, req.signedMessage())
+	return req
+}
+
+func postBlob(t *testing.T, db *bolt.DB, quota int64, req *BlobRequest) (int, blobInfo) {
+	t.Helper()
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleBlobs(db, 7*24*time.Hour, quota)(w, httptest.NewRequest(http.MethodPost, "/blobs", bytes.NewReader(body)))
+	var info blobInfo
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, info
+}
+
+func putChunk(t *testing.T, db *bolt.DB, id string, n int, chunk []byte) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	target := "/blobs/chunk?id=" + id + "&n=" + strconv.Itoa(n)
+	handleBlobChunks(db)(w, httptest.NewRequest(http.MethodPut, target, bytes.NewReader(chunk)))
+	return w.Code
+}
+
+// TestCreateBlob checks that only signed requests start uploads, that each
+// key is held to its quota, and that a retried request gets its blob back.
+func TestCreateBlob(t *testing.T) {
+	db := newTestDB(t)
+	me := newTestIdentity(t)
+	other := newTestIdentity(t)
+	const quota = 1000
+
+	first := me.blobRequest(t, 1, 600)
+	unsigned := me.blobRequest(t, 5, 10)
+	unsigned.Size = 20
+	tests := []struct {
+		name string
+		req  *BlobRequest
+		code int
+	}{
+		{"first upload", first, http.StatusOK},
+		{"retry", first, http.StatusOK},
+		{"stale", me.blobRequest(t, 1, 10), http.StatusConflict},
+		{"over quota", me.blobRequest(t, 2, 500), http.StatusRequestEntityTooLarge},
+		{"within quota", me.blobRequest(t, 3, 400), http.StatusOK},
+		{"quota used up", me.blobRequest(t, 4, 1), http.StatusRequestEntityTooLarge},
+		{"other key", other.blobRequest(t, 1, 600), http.StatusOK},
+		{"size not signed", unsigned, http.StatusForbidden},
+		{"too large", other.blobRequest(t, 2, maxBlobSize+1), http.StatusRequestEntityTooLarge},
+		{"bad owner", &BlobRequest{Owner: "00", Size: 10, TS: 6}, http.StatusBadRequest},
+	}
+	var firstID string
+	for _, tt := range tests {
+		code, info := postBlob(t, db, quota, tt.req)
+		if code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.code)
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		if info.Owner != "" || info.Updated != 0 {
+			t.Errorf("%s: relay-only fields sent to the client: %+v", tt.name, info)
+		}
+		if tt.req == first {
+			if firstID != "" && info.ID != firstID {
+				t.Errorf("retry got blob %s, want %s", info.ID, firstID)
+			}
+			firstID = info.ID
+		}
+	}
+}
+
+// TestAbandonedBlob checks that an incomplete upload is dropped once no
+// chunk has arrived for blobUploadTimeout, freeing its quota, and that a
+// complete one is kept until it expires.
+func TestAbandonedBlob(t *testing.T) {
+	db := newTestDB(t)
+	me := newTestIdentity(t)
+
+	_, partial := postBlob(t, db, 100, me.blobRequest(t, 1, 100))
+	if code := putChunk(t, db, partial.ID, 0, make([]byte, 50)); code != http.StatusOK {
+		t.Fatalf("chunk upload: status %d", code)
+	}
+	if code, _ := postBlob(t, db, 100, me.blobRequest(t, 2, 10)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload beyond a partial one: status %d, want 413", code)
+	}
+
+	_, complete := postBlob(t, db, 200, me.blobRequest(t, 3, 10))
+	if code := putChunk(t, db, complete.ID, 0, make([]byte, 10)); code != http.StatusOK {
+		t.Fatalf("chunk upload: status %d", code)
+	}
+
+	pruneBlobs(db, time.Now().Add(blobUploadTimeout+time.Minute))
+	db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketBlobs)).Get([]byte(partial.ID)) != nil {
+			t.Error("abandoned upload kept")
+		}
+		if tx.Bucket([]byte(bucketBlobChunks)).Get(chunkKey(partial.ID, 0)) != nil {
+			t.Error("chunk of abandoned upload kept")
+		}
+		if tx.Bucket([]byte(bucketBlobs)).Get([]byte(complete.ID)) == nil {
+			t.Error("complete blob pruned before it expired")
+		}
+		return nil
+	})
+	if code, _ := postBlob(t, db, 100, me.blobRequest(t, 4, 90)); code != http.StatusOK {
+		t.Errorf("upload after the partial one was dropped: status %d, want 200", code)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"expvar"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bucketSeen = "seen"
+
+	// dedupeWindow is how long the relay remembers packets it has stored.
+	dedupeWindow = 30 * 24 * time.Hour
+)
+
+// duplicatesDropped counts packets refused because the mailbox already
+// received them.
+var duplicatesDropped = expvar.NewInt("duplicates_dropped")
+
+// seenKey identifies m within its mailbox by the hash of its packet.
+func seenKey(m StoredMessage) []byte {
+	h := sha256.New()
+	if m.Envelope != nil {
+		h.Write(m.Envelope)
+	} else {
+		h.Write([]byte(m.Packet))
+	}
+	return h.Sum([]byte(m.ToID + "-"))
+}
+
+// isDuplicate reports whether m was already stored within the window.
+func isDuplicate(db *bolt.DB, m StoredMessage) bool {
+	dup := false
+	db.View(func(tx *bolt.Tx) error {
+		dup = tx.Bucket([]byte(bucketSeen)).Get(seenKey(m)) != nil
+		return nil
+	})
+	return dup
+}
+
+// markSeen records m in the seen bucket of tx. It returns false if m was
+// already there.
+func markSeen(tx *bolt.Tx, m StoredMessage, now time.Time) (bool, error) {
+	b := tx.Bucket([]byte(bucketSeen))
+	key := seenKey(m)
+	if b.Get(key) != nil {
+		return false, nil
+	}
+	return true, b.Put(key, binary.BigEndian.AppendUint64(nil, uint64(now.Unix())))
+}
+
+// pruneSeen forgets packets stored before the dedupe window.
+func pruneSeen(db *bolt.DB, now time.Time) {
+	cutoff := uint64(now.Add(-dedupeWindow).Unix())
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketSeen))
+		var stale [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || binary.BigEndian.Uint64(v) < cutoff {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("pruning seen packets:", err)
+	}
+}
+
+// pruneSeenEvery prunes the seen bucket periodically.
+func pruneSeenEvery(db *bolt.DB, d time.Duration) {
+	for now := range time.Tick(d) {
+		pruneSeen(db, now)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bucketDevices = "devices"
+
+	deviceListLabel = "HEMSAEUCC device list"
+	// maxDevices caps the number of linked devices per identity.
+	maxDevices = 16
+)
+
+type device struct {
+	Pub   []byte `json:"pub"`
+	Name  string `json:"name,omitempty"`
+	Added int64  `json:"added"`
+}
+
+// DeviceList is the body of POST /devices: the linked devices of an
+// identity, signed by its key. Each device has its own mailbox and prekeys.
+type DeviceList struct {
+	ID      string   `json:"id"`
+	Devices []device `json:"devices"`
+	TS      int64    `json:"ts"`
+	Sig     []byte   `json:"sig"`
+}
+
+func (l *DeviceList) signedMessage() []byte {
+	id, _ := hex.DecodeString(l.ID)
+	b := append([]byte(deviceListLabel), 0)
+	b = append(b, id...)
+	b = binary.BigEndian.AppendUint64(b, uint64(l.TS))
+	for _, d := range l.Devices {
+		b = append(b, d.Pub...)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(d.Name)))
+		b = append(b, d.Name...)
+		b = binary.BigEndian.AppendUint64(b, uint64(d.Added))
+	}
+	return b
+}
+
+// handleDevices serves device lists: POST replaces the caller's signed
+// list, GET returns the list of ?id=.
+func handleDevices(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			uploadDevices(db, w, r)
+		case http.MethodGet:
+			fetchDevices(db, w, r)
+		default:
+			http.Error(w, "GET or POST only", 405)
+		}
+	}
+}
+
+func uploadDevices(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	var l DeviceList
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&l); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	pub, err := hex.DecodeString(l.ID)
+	if err != nil || len(pub) != 32 || hex.EncodeToString(pub) != l.ID {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	if len(l.Devices) > maxDevices {
+		http.Error(w, "too many devices", 400)
+		return
+	}
+	listed := make(map[string]bool, len(l.Devices))
+	for _, d := range l.Devices {
+		id := hex.EncodeToString(d.Pub)
+		if len(d.Pub) != 32 || len(d.Name) > 64 || bytes.Equal(d.Pub, pub) || listed[id] {
+			http.Error(w, "bad device", 400)
+			return
+		}
+		listed[id] = true
+	}
+	if !xeddsaVerify(pub, l.signedMessage(), l.Sig) {
+		http.Error(w, "bad signature", 403)
+		return
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if isRotated(tx, l.ID) {
+			return errRotated
+		}
+		b := tx.Bucket([]byte(bucketDevices))
+		var old DeviceList
+		if v := b.Get([]byte(l.ID)); v != nil {
+			if err := json.Unmarshal(v, &old); err != nil {
+				return err
+			}
+		}
+		if l.TS <= old.TS {
+			return errStaleUpload
+		}
+		// An unlinked device should not be offered to new sessions.
+		for _, d := range old.Devices {
+			if id := hex.EncodeToString(d.Pub); !listed[id] {
+				if err := tx.Bucket([]byte(bucketPreKeys)).Delete([]byte(id)); err != nil {
+					return err
+				}
+			}
+		}
+		data, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(l.ID), data)
+	})
+	switch {
+	case errors.Is(err, errStaleUpload):
+		http.Error(w, "stale upload", 409)
+		return
+	case errors.Is(err, errRotated):
+		http.Error(w, "identity rotated", 410)
+		return
+	case err != nil:
+		http.Error(w, "db error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func fetchDevices(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", 400)
+		return
+	}
+	var data []byte
+	db.View(func(tx *bolt.Tx) error {
+		data = append([]byte(nil), tx.Bucket([]byte(bucketDevices)).Get([]byte(id))...)
+		return nil
+	})
+	if len(data) == 0 {
+		http.Error(w, "no devices", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// expired reports whether m is a disappearing message past its deadline.
+func (m *StoredMessage) expired(now time.Time) bool {
+	return m.Expires != 0 && now.Unix() >= m.Expires
+}
+
+// pruneExpired deletes disappearing messages that were not fetched before
+// their deadline.
+func pruneExpired(db *bolt.DB, now time.Time) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMsgs))
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var m StoredMessage
+			if json.Unmarshal(v, &m) == nil && m.expired(now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("pruning expired messages:", err)
+	}
+}
+
+// pruneExpiredEvery prunes expired messages periodically.
+func pruneExpiredEvery(db *bolt.DB, d time.Duration) {
+	for now := range time.Tick(d) {
+		pruneExpired(db, now)
+	}
+}
@@ -2,6 +2,9 @@ module HEMSAEUCC-server
 
 go 1.25.0
 
-require go.etcd.io/bbolt v1.4.3
+require (
+	filippo.io/edwards25519 v1.1.0
+	go.etcd.io/bbolt v1.4.3
+)
 
 require golang.org/x/sys v0.29.0 // indirect
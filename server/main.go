@@ -1,10 +1,17 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"expvar"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
@@ -15,50 +22,165 @@ const (
 	bucketMsgs = "msgs"
 )
 
+// StoredMessage is a packet waiting in a mailbox. Packets sent in the
+// binary format are kept as Envelope; Packet holds the base64 JSON packet
+// of legacy clients.
 type StoredMessage struct {
-	ToID   string `json:"to_id"`
-	FromID string `json:"from_id"`
-	Packet string `json:"packet"`
-	TS     int64  `json:"ts"`
+	ToID     string `json:"to_id"`
+	FromID   string `json:"from_id"`
+	Packet   string `json:"packet,omitempty"`
+	Envelope []byte `json:"envelope,omitempty"`
+	TS       int64  `json:"ts"`
+	// Expires is the Unix time after which a disappearing message is
+	// dropped, or zero.
+	Expires int64 `json:"expires,omitempty"`
 }
 
-func main() {
-	db, err := bolt.Open(dbFile, 0600, nil)
+// openDB opens the database at path and creates its buckets.
+func openDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer db.Close()
-
 	db.Update(func(tx *bolt.Tx) error {
 		_, _ = tx.CreateBucketIfNotExists([]byte(bucketMsgs))
+		_, _ = tx.CreateBucketIfNotExists([]byte(bucketPreKeys))
+		_, _ = tx.CreateBucketIfNotExists([]byte(bucketSeen))
+		_, _ = tx.CreateBucketIfNotExists([]byte(bucketRotations))
+		_, _ = tx.CreateBucketIfNotExists([]byte(bucketDevices))
+		_, _ = tx.CreateBucketIfNotExists([]byte(bucketBlobs))
+		_, _ = tx.CreateBucketIfNotExists([]byte(bucketBlobChunks))
+		_, _ = tx.CreateBucketIfNotExists([]byte(bucketBlobOwners))
 		return nil
 	})
+	return db, nil
+}
 
-	http.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
+// storeMessages writes msgs to their recipients' mailboxes in one
+// transaction, dropping packets a mailbox has already received.
+func storeMessages(db *bolt.DB, msgs []StoredMessage) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMsgs))
+		for _, m := range msgs {
+			fresh, err := markSeen(tx, m, time.Now())
+			if err != nil {
+				return err
+			}
+			if !fresh {
+				duplicatesDropped.Add(1)
+				continue
+			}
+			m.TS = time.Now().Unix()
+			seq, _ := b.NextSequence()
+			id := fmt.Sprintf("%s-%d-%d", m.ToID, time.Now().UnixNano(), seq)
+			data, _ := json.Marshal(m)
+			if err := b.Put([]byte(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func main() {
+	batchSize := flag.Int("batch-size", 0, "mixnet mode: release stored packets in shuffled batches of this size (0 disables batching)")
+	batchInterval := flag.Duration("batch-interval", 30*time.Second, "mixnet mode: release a partial batch after this long")
+	acceptJSON := flag.Bool("accept-json", true, "accept packets from clients that still send the legacy JSON format")
+	blobTTL := flag.Duration("blob-ttl", 7*24*time.Hour, "delete uploaded attachments after this long")
+	blobQuota := flag.Int64("blob-quota", 1<<30, "bytes of attachments each key may keep on the relay until they expire")
+	metricsAddr := flag.String("metrics-addr", "", "serve counters on /debug/vars at this address, such as localhost:9090; off if empty")
+	flag.Parse()
+	if *batchSize > 0 && *batchInterval <= 0 {
+		log.Fatal("-batch-interval must be positive when batching is enabled")
+	}
+	if *blobTTL <= 0 {
+		log.Fatal("-blob-ttl must be positive")
+	}
+	if *blobQuota < maxBlobSize {
+		log.Fatal("-blob-quota must be at least the largest blob, 100 MiB")
+	}
+
+	db, err := openDB(dbFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	go pruneSeenEvery(db, time.Hour)
+	go pruneBlobsEvery(db, time.Hour)
+	go pruneExpiredEvery(db, time.Minute)
+
+	var batcher *Batcher
+	if *batchSize > 0 {
+		batcher = NewBatcher(db, BatchPolicy{Threshold: *batchSize, Interval: *batchInterval})
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt)
+			<-sig
+			batcher.Flush()
+			db.Close()
+			os.Exit(0)
+		}()
+	}
+
+	// The relay's own mux leaves out /debug/vars, which expvar adds to the
+	// default one: batch sizes and pending counts would tell anyone polling
+	// them when packets arrive.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "POST only", 405)
 			return
 		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxEnvelopeSize))
+		if err != nil {
+			http.Error(w, "packet too large", 413)
+			return
+		}
 		var m StoredMessage
-		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-			http.Error(w, "bad json", 400)
+		if r.Header.Get("Content-Type") == wireContentType {
+			m.ToID, m.FromID, m.Expires, err = parseEnvelope(body)
+			if err != nil {
+				http.Error(w, "bad envelope", 400)
+				return
+			}
+			m.Envelope = body
+			wireStats.Add("binary_sends", 1)
+		} else {
+			if !*acceptJSON {
+				http.Error(w, "JSON packets are no longer accepted, please update your client", 415)
+				return
+			}
+			if err := json.Unmarshal(body, &m); err != nil || m.ToID == "" {
+				http.Error(w, "bad json", 400)
+				return
+			}
+			m.Envelope = nil
+			wireStats.Add("json_sends", 1)
+		}
+		if m.expired(time.Now()) {
+			// It would be dropped before anyone could fetch it.
+			w.Write([]byte(`{"ok":true}`))
 			return
 		}
-		m.TS = time.Now().Unix()
-		err := db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(bucketMsgs))
-			id := fmt.Sprintf("%s-%d", m.ToID, time.Now().UnixNano())
-			data, _ := json.Marshal(m)
-			return b.Put([]byte(id), data)
-		})
-		if err != nil {
+		if isDuplicate(db, m) {
+			duplicatesDropped.Add(1)
+			w.Write([]byte(`{"ok":true,"duplicate":true}`))
+			return
+		}
+		if batcher != nil {
+			batcher.Add(m)
+			w.Write([]byte(`{"ok":true}`))
+			return
+		}
+		if err := storeMessages(db, []StoredMessage{m}); err != nil {
 			http.Error(w, "db error", 500)
 			return
 		}
 		w.Write([]byte(`{"ok":true}`))
 	})
 
-	http.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/fetch", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "GET only", 405)
 			return
@@ -77,16 +199,75 @@ func main() {
 				if len(k) >= len(toID) && string(k[:len(toID)]) == toID {
 					var m StoredMessage
 					_ = json.Unmarshal(v, &m)
-					results = append(results, m)
+					if !m.expired(time.Now()) {
+						results = append(results, m)
+					}
 					c.Delete()
 				}
 			}
 			return nil
 		})
+		setPreKeyHeaders(db, w, toID)
+
+		if r.Header.Get("Accept") == wireContentType {
+			wireStats.Add("binary_fetches", 1)
+			var out []byte
+			for _, m := range results {
+				if m.Envelope != nil {
+					out = appendFrame(out, m.Envelope)
+					continue
+				}
+				// Legacy packets are passed on as their JSON encoding,
+				// which clients tell apart from envelopes by the magic.
+				p, err := base64.StdEncoding.DecodeString(m.Packet)
+				if err != nil {
+					continue
+				}
+				out = appendFrame(out, p)
+			}
+			w.Header().Set("Content-Type", wireContentType)
+			w.Write(out)
+			return
+		}
+
+		wireStats.Add("json_fetches", 1)
+		for i, m := range results {
+			if m.Envelope != nil {
+				results[i].Packet = base64.StdEncoding.EncodeToString(m.Envelope)
+				results[i].Envelope = nil
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(results)
 	})
 
+	mux.HandleFunc("/prekeys", handlePreKeys(db))
+	mux.HandleFunc("/prekeys/status", handlePreKeyStatus(db))
+	mux.HandleFunc("/rotations", handleRotations(db))
+	mux.HandleFunc("/devices", handleDevices(db))
+	mux.HandleFunc("/blobs", handleBlobs(db, *blobTTL, *blobQuota))
+	mux.HandleFunc("/blobs/chunk", handleBlobChunks(db))
+
+	if batcher != nil {
+		fmt.Printf("Mixnet batching enabled: %d packets or %s per batch\n", *batchSize, *batchInterval)
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
 	fmt.Println("HEMSAEUCC relay running on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", mux))
+}
+
+// serveMetrics serves the expvar counters on addr, which should only be
+// reachable by the operator.
+func serveMetrics(addr string) {
+	if host, _, err := net.SplitHostPort(addr); err == nil && host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			log.Printf("WARNING: metrics on %s can be read from other hosts", addr)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	fmt.Println("Metrics on", addr+"/debug/vars")
+	log.Fatal(http.ListenAndServe(addr, mux))
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bucketPreKeys = "prekeys"
+
+	// maxOneTimePreKeys caps the pool stored per identity.
+	maxOneTimePreKeys = 200
+	// lowPreKeys is the pool size below which the owner is warned.
+	lowPreKeys = 10
+)
+
+const (
+	signedPreKeyLabel = "HEMSAEUCC signed prekey"
+	preKeyUploadLabel = "HEMSAEUCC prekey upload"
+	// preKeyReplaceLabel signs an upload that replaces the whole pool.
+	preKeyReplaceLabel = "HEMSAEUCC prekey replace"
+	kemPreKeyLabel     = "HEMSAEUCC ML-KEM-768 signed prekey"
+
+	// kemPreKeySize is the size of an ML-KEM-768 encapsulation key.
+	kemPreKeySize = 1184
+)
+
+type signedPreKey struct {
+	ID  uint32 `json:"id"`
+	Pub []byte `json:"pub"`
+	Sig []byte `json:"sig"`
+}
+
+func (k signedPreKey) signedMessage() []byte {
+	b := append([]byte(signedPreKeyLabel), 0)
+	b = binary.BigEndian.AppendUint32(b, k.ID)
+	return append(b, k.Pub...)
+}
+
+type oneTimePreKey struct {
+	ID  uint32 `json:"id"`
+	Pub []byte `json:"pub"`
+}
+
+// kemPreKey is the ML-KEM-768 key of clients that support hybrid sessions.
+// It rotates with the signed prekey and carries its ID.
+type kemPreKey struct {
+	ID  uint32 `json:"id"`
+	Pub []byte `json:"pub"`
+	Sig []byte `json:"sig"`
+}
+
+func (k kemPreKey) signedMessage() []byte {
+	b := append([]byte(kemPreKeyLabel), 0)
+	b = binary.BigEndian.AppendUint32(b, k.ID)
+	return append(b, k.Pub...)
+}
+
+// PreKeyUpload is the body of POST /prekeys, signed by the identity key.
+// An upload with Replace set drops the one-time prekeys already stored,
+// for an owner who lost their secrets.
+type PreKeyUpload struct {
+	ID             string          `json:"id"`
+	SignedPreKey   signedPreKey    `json:"signed_prekey"`
+	OneTimePreKeys []oneTimePreKey `json:"one_time_prekeys"`
+	KEMPreKey      *kemPreKey      `json:"kem_prekey,omitempty"`
+	Replace        bool            `json:"replace,omitempty"`
+	TS             int64           `json:"ts"`
+	Sig            []byte          `json:"sig"`
+}
+
+func (u *PreKeyUpload) signedMessage() []byte {
+	label := preKeyUploadLabel
+	if u.Replace {
+		label = preKeyReplaceLabel
+	}
+	b := append([]byte(label), 0)
+	b = append(b, u.ID...)
+	b = binary.BigEndian.AppendUint64(b, uint64(u.TS))
+	b = append(b, u.SignedPreKey.signedMessage()...)
+	b = append(b, u.SignedPreKey.Sig...)
+	for _, k := range u.OneTimePreKeys {
+		b = binary.BigEndian.AppendUint32(b, k.ID)
+		b = append(b, k.Pub...)
+	}
+	if u.KEMPreKey != nil {
+		b = append(b, u.KEMPreKey.signedMessage()...)
+		b = append(b, u.KEMPreKey.Sig...)
+	}
+	return b
+}
+
+// PreKeyRecord is the stored prekey directory entry for one identity.
+type PreKeyRecord struct {
+	SignedPreKey   signedPreKey    `json:"signed_prekey"`
+	OneTimePreKeys []oneTimePreKey `json:"one_time_prekeys"`
+	KEMPreKey      *kemPreKey      `json:"kem_prekey,omitempty"`
+	TS             int64           `json:"ts"`
+}
+
+// PreKeyBundle is returned by GET /prekeys.
+type PreKeyBundle struct {
+	ID            string         `json:"id"`
+	SignedPreKey  signedPreKey   `json:"signed_prekey"`
+	OneTimePreKey *oneTimePreKey `json:"one_time_prekey,omitempty"`
+	KEMPreKey     *kemPreKey     `json:"kem_prekey,omitempty"`
+}
+
+type preKeyStatus struct {
+	Remaining int  `json:"remaining"`
+	Low       bool `json:"low"`
+}
+
+var (
+	errStaleUpload = errors.New("stale upload")
+	errRotated     = errors.New("identity rotated")
+	// errDuplicatePreKey is an upload of a one-time prekey ID the relay
+	// already holds. The owner has lost track of its pool and should
+	// replace it.
+	errDuplicatePreKey = errors.New("one-time prekey ID already uploaded")
+)
+
+// handlePreKeys serves the prekey directory: POST uploads a signed bundle,
+// GET hands out a bundle and consumes one of its one-time prekeys.
+func handlePreKeys(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			uploadPreKeys(db, w, r)
+		case http.MethodGet:
+			fetchPreKeys(db, w, r)
+		default:
+			http.Error(w, "GET or POST only", 405)
+		}
+	}
+}
+
+func uploadPreKeys(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	var u PreKeyUpload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&u); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	pub, err := hex.DecodeString(u.ID)
+	if err != nil || len(pub) != 32 || hex.EncodeToString(pub) != u.ID {
+		http.Error(w, "bad id", 400)
+		return
+	}
+	if !xeddsaVerify(pub, u.signedMessage(), u.Sig) || !xeddsaVerify(pub, u.SignedPreKey.signedMessage(), u.SignedPreKey.Sig) {
+		http.Error(w, "bad signature", 403)
+		return
+	}
+	if k := u.KEMPreKey; k != nil && (k.ID != u.SignedPreKey.ID || len(k.Pub) != kemPreKeySize || !xeddsaVerify(pub, k.signedMessage(), k.Sig)) {
+		http.Error(w, "bad ML-KEM key", 403)
+		return
+	}
+	uploaded := make(map[uint32]bool, len(u.OneTimePreKeys))
+	for _, k := range u.OneTimePreKeys {
+		if uploaded[k.ID] || len(k.Pub) != 32 {
+			http.Error(w, "bad one-time prekey", 400)
+			return
+		}
+		uploaded[k.ID] = true
+	}
+
+	var status preKeyStatus
+	err = db.Update(func(tx *bolt.Tx) error {
+		if isRotated(tx, u.ID) {
+			return errRotated
+		}
+		b := tx.Bucket([]byte(bucketPreKeys))
+		var rec PreKeyRecord
+		if v := b.Get([]byte(u.ID)); v != nil {
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+		}
+		if u.TS <= rec.TS {
+			return errStaleUpload
+		}
+
+		rec.TS = u.TS
+		rec.SignedPreKey = u.SignedPreKey
+		// A client that stops offering hybrid sessions drops its ML-KEM key.
+		rec.KEMPreKey = u.KEMPreKey
+		if u.Replace {
+			rec.OneTimePreKeys = nil
+		}
+		for _, k := range rec.OneTimePreKeys {
+			if uploaded[k.ID] {
+				return errDuplicatePreKey
+			}
+		}
+		rec.OneTimePreKeys = append(rec.OneTimePreKeys, u.OneTimePreKeys...)
+		if over := len(rec.OneTimePreKeys) - maxOneTimePreKeys; over > 0 {
+			rec.OneTimePreKeys = rec.OneTimePreKeys[over:]
+		}
+		status = statusOf(&rec)
+
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(u.ID), data)
+	})
+	if errors.Is(err, errStaleUpload) || errors.Is(err, errDuplicatePreKey) {
+		http.Error(w, err.Error(), 409)
+		return
+	}
+	if errors.Is(err, errRotated) {
+		http.Error(w, "identity rotated", 410)
+		return
+	}
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func fetchPreKeys(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "missing id", 400)
+		return
+	}
+
+	var bundle *PreKeyBundle
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketPreKeys))
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		var rec PreKeyRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		bundle = &PreKeyBundle{ID: id, SignedPreKey: rec.SignedPreKey, KEMPreKey: rec.KEMPreKey}
+		if len(rec.OneTimePreKeys) == 0 {
+			return nil
+		}
+		bundle.OneTimePreKey = &rec.OneTimePreKeys[0]
+		rec.OneTimePreKeys = rec.OneTimePreKeys[1:]
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+	if err != nil {
+		http.Error(w, "db error", 500)
+		return
+	}
+	if bundle == nil {
+		http.Error(w, "no prekeys", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bundle)
+}
+
+// handlePreKeyStatus reports how many one-time prekeys an identity has left.
+func handlePreKeyStatus(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "GET only", 405)
+			return
+		}
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "missing id", 400)
+			return
+		}
+		rec, err := loadPreKeys(db, id)
+		if err != nil {
+			http.Error(w, "db error", 500)
+			return
+		}
+		status := preKeyStatus{Low: true}
+		if rec != nil {
+			status = statusOf(rec)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// loadPreKeys returns the directory entry for id, or nil if there is none.
+func loadPreKeys(db *bolt.DB, id string) (*PreKeyRecord, error) {
+	var rec *PreKeyRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(bucketPreKeys)).Get([]byte(id)); v != nil {
+			rec = new(PreKeyRecord)
+			return json.Unmarshal(v, rec)
+		}
+		return nil
+	})
+	return rec, err
+}
+
+func statusOf(rec *PreKeyRecord) preKeyStatus {
+	n := len(rec.OneTimePreKeys)
+	return preKeyStatus{Remaining: n, Low: n < lowPreKeys}
+}
+
+// setPreKeyHeaders tells the owner of a mailbox how many one-time prekeys
+// they have left, so clients can replenish before the pool runs out.
+func setPreKeyHeaders(db *bolt.DB, w http.ResponseWriter, id string) {
+	rec, err := loadPreKeys(db, id)
+	if err != nil || rec == nil {
+		return
+	}
+	status := statusOf(rec)
+	w.Header().Set("X-Prekeys-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("X-Prekeys-Low", strconv.FormatBool(status.Low))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/edwards25519"
+	bolt "go.etcd.io/bbolt"
+)
+
+// xeddsaSign signs msg with the X25519 private key priv, as clients do.
+func xeddsaSign(t *testing.T, priv, msg []byte) []byte {
+	t.Helper()
+	k, err := edwards25519.NewScalar().SetBytesWithClamping(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	A := new(edwards25519.Point).ScalarBaseMult(k).Bytes()
+	a := k
+	if A[31]&0x80 != 0 {
+		a = edwards25519.NewScalar().Negate(k)
+		A[31] &= 0x7f
+	}
+	Z := make([]byte, 64)
+	rand.Read(Z)
+	h := sha512.New()
+	h.Write(append([]byte{0xfe}, bytes.Repeat([]byte{0xff}, 31)...))
+	h.Write(a.Bytes())
+	h.Write(msg)
+	h.Write(Z)
+	r, _ := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+	h.Reset()
+	h.Write(R)
+	h.Write(A)
+	h.Write(msg)
+	c, _ := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	return append(R, edwards25519.NewScalar().MultiplyAdd(c, a, r).Bytes()...)
+}
+
+// testIdentity is an identity key pair that signs prekey uploads.
+type testIdentity struct {
+	priv []byte
+	id   string
+}
+
+func newTestIdentity(t *testing.T) *testIdentity {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIdentity{priv: key.Bytes(), id: hex.EncodeToString(key.PublicKey().Bytes())}
+}
+
+// upload returns a signed upload of the one-time prekeys ids.
+func (me *testIdentity) upload(t *testing.T, ts int64, replace bool, ids ...uint32) *PreKeyUpload {
+	t.Helper()
+	u := &PreKeyUpload{ID: me.id, SignedPreKey: signedPreKey{ID: 1, Pub: make([]byte, 32)}, Replace: replace, TS: ts}
+	u.SignedPreKey.Sig = xeddsaSign(t, me.priv, u.SignedPreKey.signedMessage())
+	for _, id := range ids {
+		u.OneTimePreKeys = append(u.OneTimePreKeys, oneTimePreKey{ID: id, Pub: bytes.Repeat([]byte{byte(id)}, 32)})
+	}
+	u.Sig = xeddsaSign(t, me.priv, u.signedMessage())
+	return u
+}
+
+func newTestDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func postPreKeys(t *testing.T, db *bolt.DB, u *PreKeyUpload) (int, preKeyStatus) {
+	t.Helper()
+	body, err := json.Marshal(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handlePreKeys(db)(w, httptest.NewRequest(http.MethodPost, "/prekeys", bytes.NewReader(body)))
+	var status preKeyStatus
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, status
+}
+
+// TestUploadPreKeys checks that the relay refuses one-time prekey IDs it
+// already holds rather than dropping them, and that a signed replacing
+// upload starts the pool over.
+func TestUploadPreKeys(t *testing.T) {
+	db := newTestDB(t)
+	me := newTestIdentity(t)
+
+	tamperedReplace := me.upload(t, 7, false, 9)
+	tamperedReplace.Replace = true
+	tests := []struct {
+		name      string
+		u         *PreKeyUpload
+		code      int
+		remaining int
+	}{
+		{"first upload", me.upload(t, 1, false, 1, 2, 3), http.StatusOK, 3},
+		{"top up", me.upload(t, 2, false, 4, 5), http.StatusOK, 5},
+		{"stale", me.upload(t, 2, false, 6), http.StatusConflict, 5},
+		{"duplicate ID", me.upload(t, 3, false, 5, 6), http.StatusConflict, 5},
+		{"duplicate within the upload", me.upload(t, 4, false, 7, 7), http.StatusBadRequest, 5},
+		{"replace", me.upload(t, 5, true, 1, 2), http.StatusOK, 2},
+		{"top up after replace", me.upload(t, 6, false, 3), http.StatusOK, 3},
+		{"replace flag not signed", tamperedReplace, http.StatusForbidden, 3},
+	}
+	for _, tt := range tests {
+		code, status := postPreKeys(t, db, tt.u)
+		if code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, code, tt.code)
+		}
+		rec, err := loadPreKeys(db, me.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.OneTimePreKeys) != tt.remaining {
+			t.Errorf("%s: relay holds %d one-time prekeys, want %d", tt.name, len(rec.OneTimePreKeys), tt.remaining)
+		}
+		if code == http.StatusOK && status.Remaining != tt.remaining {
+			t.Errorf("%s: reported %d remaining, want %d", tt.name, status.Remaining, tt.remaining)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// bucketRotations maps "old:<id>" to the rotation statement retiring
+	// that identity and "new:<id>" to the old ID of the one introducing it.
+	bucketRotations = "rotations"
+
+	rotationLabel = "HEMSAEUCC identity rotation"
+)
+
+var (
+	errAlreadyRotated = errors.New("identity already rotated")
+	errKeyTaken       = errors.New("new key already in use")
+)
+
+// RotationStatement is the body of POST /rotations: the identity Old moves
+// to New, signed by both keys.
+type RotationStatement struct {
+	Old    string `json:"old"`
+	New    string `json:"new"`
+	TS     int64  `json:"ts"`
+	OldSig []byte `json:"old_sig"`
+	NewSig []byte `json:"new_sig"`
+}
+
+func (s *RotationStatement) signedMessage() []byte {
+	oldPub, _ := hex.DecodeString(s.Old)
+	newPub, _ := hex.DecodeString(s.New)
+	b := append([]byte(rotationLabel), 0)
+	b = append(b, oldPub...)
+	b = append(b, newPub...)
+	return binary.BigEndian.AppendUint64(b, uint64(s.TS))
+}
+
+// handleRotations serves identity rotations: POST publishes a statement,
+// GET ?id= returns the one retiring an identity and GET ?new= the one
+// introducing it.
+func handleRotations(db *bolt.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			publishRotation(db, w, r)
+		case http.MethodGet:
+			fetchRotation(db, w, r)
+		default:
+			http.Error(w, "GET or POST only", 405)
+		}
+	}
+}
+
+func publishRotation(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	var s RotationStatement
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&s); err != nil {
+		http.Error(w, "bad json", 400)
+		return
+	}
+	oldPub, err := hex.DecodeString(s.Old)
+	if err != nil || len(oldPub) != 32 || hex.EncodeToString(oldPub) != s.Old {
+		http.Error(w, "bad old id", 400)
+		return
+	}
+	newPub, err := hex.DecodeString(s.New)
+	if err != nil || len(newPub) != 32 || hex.EncodeToString(newPub) != s.New || s.New == s.Old {
+		http.Error(w, "bad new id", 400)
+		return
+	}
+	if !xeddsaVerify(oldPub, s.signedMessage(), s.OldSig) || !xeddsaVerify(newPub, s.signedMessage(), s.NewSig) {
+		http.Error(w, "bad signature", 403)
+		return
+	}
+
+	data, _ := json.Marshal(s)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketRotations))
+		if v := b.Get([]byte("old:" + s.Old)); v != nil {
+			if bytes.Equal(v, data) {
+				return nil
+			}
+			return errAlreadyRotated
+		}
+		// A key can only be introduced once, and never by moving back to
+		// an identity that was already retired.
+		if b.Get([]byte("new:"+s.New)) != nil || b.Get([]byte("old:"+s.New)) != nil {
+			return errKeyTaken
+		}
+		if err := b.Put([]byte("old:"+s.Old), data); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("new:"+s.New), []byte(s.Old)); err != nil {
+			return err
+		}
+		// Nobody should start a session with the retired identity, and the
+		// devices it linked must be linked again to the new one.
+		if err := tx.Bucket([]byte(bucketDevices)).Delete([]byte(s.Old)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(bucketPreKeys)).Delete([]byte(s.Old))
+	})
+	switch {
+	case errors.Is(err, errAlreadyRotated), errors.Is(err, errKeyTaken):
+		http.Error(w, err.Error(), 409)
+		return
+	case err != nil:
+		http.Error(w, "db error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func fetchRotation(db *bolt.DB, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("id") == "" && q.Get("new") == "" {
+		http.Error(w, "missing id", 400)
+		return
+	}
+	var data []byte
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketRotations))
+		old := q.Get("id")
+		if id := q.Get("new"); id != "" {
+			old = string(b.Get([]byte("new:" + id)))
+		}
+		if old != "" {
+			data = append([]byte(nil), b.Get([]byte("old:"+old))...)
+		}
+		return nil
+	})
+	if len(data) == 0 {
+		http.Error(w, "no rotation", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// isRotated reports whether the identity id has been retired.
+func isRotated(tx *bolt.Tx, id string) bool {
+	return tx.Bucket([]byte(bucketRotations)).Get([]byte("old:"+id)) != nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"math"
+)
+
+// Binary envelope, see docs/protocol.md:
+//
+//	"HM" | wire version | packet version | to (32) | from (32) | field*
+//
+// with each field uvarint(tag) | uvarint(len) | value. The relay only reads
+// the addresses and the expiry, and checks that the fields are well framed.
+const (
+	wireMagic          = "HM"
+	wireVersion        = 1
+	envelopeHeaderSize = len(wireMagic) + 2 + 2*32
+	maxEnvelopeSize    = 1 << 20
+	wireContentType    = "application/octet-stream"
+
+	// tagExpires is the envelope field holding the Unix time after which
+	// a disappearing message is dropped.
+	tagExpires = 13
+)
+
+var errMalformedEnvelope = errors.New("malformed envelope")
+
+// wireStats counts traffic in each format, to tell when legacy JSON
+// clients are gone.
+var wireStats = expvar.NewMap("wire")
+
+// parseEnvelope checks the framing of a binary envelope and returns its
+// hex-encoded recipient and sender, and its expiry or zero.
+func parseEnvelope(b []byte) (toID, fromID string, expires int64, err error) {
+	if len(b) < envelopeHeaderSize || len(b) > maxEnvelopeSize || string(b[:len(wireMagic)]) != wireMagic {
+		return "", "", 0, errMalformedEnvelope
+	}
+	if b[2] != wireVersion {
+		return "", "", 0, errMalformedEnvelope
+	}
+	rest := b[envelopeHeaderSize:]
+	for len(rest) > 0 {
+		tag, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return "", "", 0, errMalformedEnvelope
+		}
+		rest = rest[n:]
+		size, n := binary.Uvarint(rest)
+		if n <= 0 || size > uint64(len(rest)-n) {
+			return "", "", 0, errMalformedEnvelope
+		}
+		if tag == tagExpires {
+			v := rest[n : n+int(size)]
+			x, m := binary.Uvarint(v)
+			if m != len(v) || x > math.MaxInt64 {
+				return "", "", 0, errMalformedEnvelope
+			}
+			expires = int64(x)
+		}
+		rest = rest[n+int(size):]
+	}
+	return hex.EncodeToString(b[4:36]), hex.EncodeToString(b[36:68]), expires, nil
+}
+
+// appendFrame appends p to b as one frame of a binary /fetch response.
+func appendFrame(b, p []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
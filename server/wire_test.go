@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"testing"
+)
+
+// testEnvelope builds an envelope from to, from and expires, with fields
+// appended as they are.
+func testEnvelope(to, from []byte, expires int64, fields ...byte) []byte {
+	b := append([]byte(wireMagic), wireVersion, 3)
+	b = append(b, to...)
+	b = append(b, from...)
+	if expires != 0 {
+		v := binary.AppendUvarint(nil, uint64(expires))
+		b = binary.AppendUvarint(b, tagExpires)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+	return append(b, fields...)
+}
+
+var (
+	testTo   = bytes.Repeat([]byte{0x11}, 32)
+	testFrom = bytes.Repeat([]byte{0x22}, 32)
+)
+
+// FuzzParseEnvelope checks that parsing never panics, and that what a
+// valid envelope yields survives being put into an envelope again.
+func FuzzParseEnvelope(f *testing.F) {
+	f.Add(testEnvelope(testTo, testFrom, 0))
+	f.Add(testEnvelope(testTo, testFrom, 1<<40, 3, 4, 'a', 'b', 'c', 'd'))
+	f.Add(testEnvelope(testTo, testFrom, 0, 1, 32, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 99, 0))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		to, from, expires, err := parseEnvelope(b)
+		if err != nil {
+			if !errors.Is(err, errMalformedEnvelope) {
+				t.Fatalf("error %v is not errMalformedEnvelope", err)
+			}
+			return
+		}
+		toPub, err := hex.DecodeString(to)
+		if err != nil || len(toPub) != 32 {
+			t.Fatalf("bad recipient %q", to)
+		}
+		fromPub, err := hex.DecodeString(from)
+		if err != nil || len(fromPub) != 32 {
+			t.Fatalf("bad sender %q", from)
+		}
+		if expires < 0 {
+			t.Fatalf("negative expiry %d", expires)
+		}
+		to2, from2, expires2, err := parseEnvelope(testEnvelope(toPub, fromPub, expires))
+		if err != nil || to2 != to || from2 != from || expires2 != expires {
+			t.Fatalf("round trip gave %s %s %d %v, want %s %s %d", to2, from2, expires2, err, to, from, expires)
+		}
+	})
+}
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		expires int64
+		ok      bool
+	}{
+		{"no fields", testEnvelope(testTo, testFrom, 0), 0, true},
+		{"expiry", testEnvelope(testTo, testFrom, 1700000000), 1700000000, true},
+		{"unknown tag", testEnvelope(testTo, testFrom, 5, 99, 3, 1, 2, 3), 5, true},
+		{"huge unknown tag", testEnvelope(testTo, testFrom, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 1, 0), 0, true},
+		{"short header", testEnvelope(testTo, testFrom, 0)[:envelopeHeaderSize-1], 0, false},
+		{"bad magic", append([]byte("XX"), testEnvelope(testTo, testFrom, 0)[2:]...), 0, false},
+		{"unknown wire version", append([]byte{'H', 'M', wireVersion + 1}, testEnvelope(testTo, testFrom, 0)[3:]...), 0, false},
+		{"too large", testEnvelope(testTo, testFrom, 0, make([]byte, maxEnvelopeSize)...), 0, false},
+		{"truncated tag", testEnvelope(testTo, testFrom, 0, 0x80), 0, false},
+		{"truncated length", testEnvelope(testTo, testFrom, 0, 3, 0x80), 0, false},
+		{"tag overflows uvarint", testEnvelope(testTo, testFrom, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0), 0, false},
+		{"length past end", testEnvelope(testTo, testFrom, 0, 3, 5, 1, 2), 0, false},
+		{"huge length", testEnvelope(testTo, testFrom, 0, 3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 1), 0, false},
+		{"expiry with trailing byte", testEnvelope(testTo, testFrom, 0, tagExpires, 2, 1, 0), 0, false},
+		{"expiry over int64", testEnvelope(testTo, testFrom, 0, append([]byte{tagExpires, 10}, binary.AppendUvarint(nil, math.MaxUint64)...)...), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			to, from, expires, err := parseEnvelope(tt.b)
+			if !tt.ok {
+				if !errors.Is(err, errMalformedEnvelope) {
+					t.Errorf("parseEnvelope = %v, want errMalformedEnvelope", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if to != hex.EncodeToString(testTo) || from != hex.EncodeToString(testFrom) || expires != tt.expires {
+				t.Errorf("parseEnvelope = %s %s %d, want %x %x %d", to, from, expires, testTo, testFrom, tt.expires)
+			}
+		})
+	}
+}
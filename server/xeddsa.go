@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+
+	"filippo.io/edwards25519/field"
+)
+
+// xeddsaVerify reports whether sig is a valid XEdDSA signature of msg by
+// the X25519 public key pub, as specified in
+// https://signal.org/docs/specifications/xeddsa/.
+func xeddsaVerify(pub, msg, sig []byte) bool {
+	if len(pub) != 32 || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	u, err := new(field.Element).SetBytes(pub)
+	if err != nil || !bytes.Equal(u.Bytes(), pub) {
+		return false
+	}
+	// Convert the Montgomery u-coordinate to the Edwards y-coordinate
+	// y = (u - 1) / (u + 1), with the sign bit cleared.
+	one := new(field.Element).One()
+	num := new(field.Element).Subtract(u, one)
+	den := new(field.Element).Add(u, one)
+	y := new(field.Element).Multiply(num, new(field.Element).Invert(den))
+	return ed25519.Verify(ed25519.PublicKey(y.Bytes()), msg, sig)
+}